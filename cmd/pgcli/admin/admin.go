@@ -23,6 +23,10 @@ func Run() error {
 		return listPeers(admin)
 	case "secret":
 		return generateSecret(admin)
+	case "revoke":
+		return revoke(admin)
+	case "kick":
+		return kick(admin)
 	}
 	usageAdmin(admin)
 	return nil
@@ -55,4 +59,6 @@ func usageAdmin(flagSet *flag.FlagSet) {
 	fmt.Printf("  networks\tshow all networks\n")
 	fmt.Printf("  peers\t\tshow all peers\n")
 	fmt.Printf("  secret\tgenerate a network secret file\n")
+	fmt.Printf("  revoke\trevoke a network, secret or peer and disconnect the affected peers\n")
+	fmt.Printf("  kick\t\tdisconnect the peers\n")
 }
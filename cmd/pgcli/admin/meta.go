@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 
 	"github.com/sigcn/pg/peermap/exporter"
 )
@@ -32,7 +33,7 @@ func setMeta(admin *flag.FlagSet) error {
 	flagSet := flag.NewFlagSet("get-meta", flag.ExitOnError)
 	var key, value string
 	flagSet.StringVar(&key, "key", "", "")
-	flagSet.StringVar(&value, "value", "", "")
+	flagSet.StringVar(&value, "value", "", "list values (e.g. ACL) are separated by ';'")
 	secretKey, server, err := parseSecretKeyAndServer(flagSet, admin.Args()[1:])
 	if err != nil {
 		return err
@@ -50,7 +51,18 @@ func setMeta(admin *flag.FlagSet) error {
 	if !v.IsValid() {
 		return fmt.Errorf("meta %s not found", key)
 	}
-	v.SetString(value)
+	switch v.Kind() {
+	case reflect.Slice:
+		values := []string{}
+		for _, item := range strings.Split(value, ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		v.Set(reflect.ValueOf(values))
+	default:
+		v.SetString(value)
+	}
 	json.NewEncoder(os.Stdout).Encode(networkMeta)
 	return c.PutNetworkMeta(flagSet.Arg(0), *networkMeta)
 }
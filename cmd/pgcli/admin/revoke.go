@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/sigcn/pg/peermap/exporter"
+)
+
+func revoke(admin *flag.FlagSet) error {
+	flagSet := flag.NewFlagSet("revoke", flag.ExitOnError)
+	var network, secretID, peerID string
+	var undo, list bool
+	flagSet.StringVar(&network, "network", "", "revoke all secrets of the network")
+	flagSet.StringVar(&secretID, "secret-id", "", "revoke the secret by id (the sid of peers)")
+	flagSet.StringVar(&peerID, "peer", "", "revoke the peer by id")
+	flagSet.BoolVar(&undo, "undo", false, "remove from the revocation list")
+	flagSet.BoolVar(&list, "list", false, "show the revocation list")
+	secretKey, server, err := parseSecretKeyAndServer(flagSet, admin.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	c, err := exporter.NewClient(server, secretKey)
+	if err != nil {
+		return err
+	}
+	if list {
+		revocations, err := c.Revocations()
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(revocations)
+	}
+	var revoked bool
+	for kind, id := range map[string]string{"network": network, "secret": secretID, "peer": peerID} {
+		if id == "" {
+			continue
+		}
+		revoked = true
+		if undo {
+			err = c.Unrevoke(kind, id)
+		} else {
+			err = c.Revoke(kind, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !revoked {
+		return errors.New("one of the flags \"network\", \"secret-id\" and \"peer\" is required")
+	}
+	return nil
+}
+
+func kick(admin *flag.FlagSet) error {
+	flagSet := flag.NewFlagSet("kick", flag.ExitOnError)
+	secretKey, server, err := parseSecretKeyAndServer(flagSet, admin.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if flagSet.NArg() == 0 {
+		return errors.New("peer id is required")
+	}
+
+	c, err := exporter.NewClient(server, secretKey)
+	if err != nil {
+		return err
+	}
+	for _, peerID := range flagSet.Args() {
+		if err := c.Kick(peerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
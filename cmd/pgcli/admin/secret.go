@@ -40,6 +40,9 @@ func generateSecret(admin *flag.FlagSet) error {
 	if err != nil {
 		return err
 	}
+	if jsonSecret, err := auth.NewAuthenticator(secretKey).ParseSecret(secret); err == nil {
+		fmt.Fprintf(os.Stderr, "secret id: %s\n", jsonSecret.ID)
+	}
 	return json.NewEncoder(os.Stdout).Encode(disco.NetworkSecret{
 		Secret:  secret,
 		Network: network,
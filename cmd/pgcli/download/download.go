@@ -11,7 +11,10 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/sigcn/pg/cmd/pgcli/share"
 	"github.com/sigcn/pg/fileshare"
@@ -29,6 +32,9 @@ func Run() error {
 	flagSet.StringVar(&downloader.Server, "s", "", "peermap server")
 	flagSet.StringVar(&downloader.Network, "pubnet", "public", "peermap public network")
 
+	var parallel int
+	flagSet.IntVar(&parallel, "parallel", 4, "files downloaded concurrently from a shared directory")
+
 	var logLevel int
 	flagSet.IntVar(&logLevel, "loglevel", 1, "log level")
 	flagSet.Parse(flag.Args()[1:])
@@ -43,52 +49,119 @@ func Run() error {
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	if strings.HasSuffix(flagSet.Arg(0), "/") {
+		return downloader.RequestDir(ctx, flagSet.Arg(0), func(dh *fileshare.DirHandle) error {
+			return readDir(dh, parallel)
+		})
+	}
 	return downloader.Request(ctx, flagSet.Arg(0), readFile)
 }
 
+// readDir recreates the tree of the manifest, the files already matched are skipped
+func readDir(dh *fileshare.DirHandle, parallel int) error {
+	var (
+		entries []fileshare.ManifestEntry
+		total   int64
+		matched int
+	)
+	for _, e := range dh.Manifest.Entries {
+		localPath, _ := e.LocalPath(dh.Manifest.Name)
+		if e.Mode.IsDir() {
+			if err := os.MkdirAll(localPath, e.Mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+		if e.Matches(localPath) {
+			matched++
+			continue
+		}
+		if stat, err := os.Stat(localPath); err == nil && stat.Size() >= e.Size {
+			os.Remove(localPath) // changed, download from the beginning
+		}
+		entries = append(entries, e)
+		total += e.Size
+	}
+	fmt.Printf("%d files to download, %d files matched\n", len(entries), matched)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	trackerManager := share.TrackerManager{AutoStop: true}
+	bar := trackerManager.CreateBar(total, dh.Manifest.Name)
+	return dh.Download(dh.Manifest.Name, entries, parallel, func(fh *fileshare.FileHandle) error {
+		_, err := download(fh, func(int64) fileshare.ProgressBar { return bar })
+		return err
+	})
+}
+
 func readFile(fh *fileshare.FileHandle) error {
+	trackerManager := share.TrackerManager{AutoStop: true}
+	checksum, err := download(fh, func(fileSize int64) fileshare.ProgressBar {
+		return trackerManager.CreateBar(fileSize, fh.Filename)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("sha256: %x\n", checksum)
+	return nil
+}
+
+// download resumes the partial file, the checksum of the whole file is returned
+func download(fh *fileshare.FileHandle, createBar func(fileSize int64) fileshare.ProgressBar) ([]byte, error) {
 	f, err := os.OpenFile(fh.Filename, os.O_RDWR, 0666)
 	if err != nil {
 		f, err = os.Create(fh.Filename)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	defer f.Close()
 	stat, err := f.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	partSize := stat.Size()
 
 	sha256Checksum := sha256.New()
 	if partSize > 0 {
-		fmt.Println("download resuming")
+		slog.Info("Download resuming", "file", fh.Filename, "offset", partSize)
 	}
 	if _, err = io.CopyN(sha256Checksum, f, partSize); err != nil {
-		return err
+		return nil, err
 	}
-	if err := fh.Handshake(uint32(partSize), sha256Checksum.Sum(nil)); err != nil {
-		return err
+	if err := fh.Handshake(partSize, sha256Checksum.Sum(nil)); err != nil {
+		return nil, err
 	}
 	r, fileSize, _ := fh.File()
 
-	trackerManager := share.TrackerManager{AutoStop: true}
-	bar := trackerManager.CreateBar(int64(fileSize), fh.Filename)
+	bar := createBar(fileSize)
 	bar.Add(int(partSize))
 
 	if _, err = io.Copy(io.MultiWriter(f, bar, sha256Checksum), r); err != nil {
-		return fmt.Errorf("download file falied: %w", err)
+		return nil, fmt.Errorf("download file falied: %w", err)
 	}
 	checksum, err := fh.Sha256()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	recvSum := sha256Checksum.Sum(nil)
 	slog.Debug("Checksum", "recv", recvSum, "send", checksum)
 	if !bytes.Equal(checksum, recvSum) {
-		return fmt.Errorf("download file failed: checksum mismatched")
+		return nil, fmt.Errorf("download file failed: checksum mismatched")
 	}
-	fmt.Printf("sha256: %x\n", checksum)
-	return nil
+	if fh.Mode != 0 {
+		if err := f.Chmod(fh.Mode.Perm()); err != nil {
+			return nil, err
+		}
+	}
+	if !fh.ModTime.IsZero() {
+		if err := os.Chtimes(fh.Filename, time.Time{}, fh.ModTime); err != nil {
+			return nil, err
+		}
+	}
+	return checksum, nil
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/jedib0t/go-pretty/v6/progress"
 	"github.com/sigcn/pg/fileshare"
+	"github.com/sigcn/pg/rdt"
 )
 
 func Run() error {
@@ -29,11 +30,20 @@ func Run() error {
 	flagSet.StringVar(&fileManager.Network, "pubnet", "public", "peermap public network")
 	flagSet.StringVar(&fileManager.PrivateKey, "key", "", "curve25519 private key in base58 format (default generate a new one)")
 
+	flagSet.BoolVar(&fileManager.ShareDirs, "dir", false, "share a directory by one url with the manifest, instead of a url per file")
+
+	var fec bool
+	flagSet.BoolVar(&fec, "fec", false, "send forward error correction frames, for the lossy relay or mobile links")
+
 	var logLevel int
 	flagSet.IntVar(&logLevel, "loglevel", 1, "log level")
 	flagSet.Parse(flag.Args()[1:])
 	slog.SetLogLoggerLevel(slog.Level(logLevel))
 
+	if fec {
+		fileManager.RDTOptions = append(fileManager.RDTOptions, rdt.EnableFEC())
+	}
+
 	if len(fileManager.Server) == 0 {
 		fileManager.Server = os.Getenv("PG_SERVER")
 		if len(fileManager.Server) == 0 {
@@ -0,0 +1,98 @@
+package vpn
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/sigcn/pg/vpn/dns"
+	"github.com/sigcn/pg/vpn/nic"
+	"github.com/sigcn/pg/vpn/nic/gvisor"
+)
+
+// startDNS runs the dns responder on the vpn addresses, it's inside the gvisor stack in rootless mode
+func (v *P2PVPN) startDNS(ctx context.Context, wg *sync.WaitGroup, card nic.NIC) {
+	var vpnIPs []string
+	for _, cidr := range []string{v.Config.NICConfig.IPv4, v.Config.NICConfig.IPv6} {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil {
+			vpnIPs = append(vpnIPs, prefix.Addr().String())
+		}
+	}
+	server := &dns.Server{
+		Domain:   v.dnsDomain(),
+		Upstream: v.Config.DNSUpstream,
+		Lookup:   v.lookupHost,
+	}
+	if len(server.Upstream) == 0 {
+		server.Upstream = dns.SystemUpstream(vpnIPs...)
+	}
+	gvisorCard, rootlessMode := card.(*gvisor.GvisorCard)
+	if rootlessMode {
+		gvisorCard.Resolver = server
+	}
+	for _, ip := range vpnIPs {
+		var pc net.PacketConn
+		var err error
+		if rootlessMode {
+			pc, err = gvisorCard.ListenPacket(map[bool]string{true: "udp4", false: "udp6"}[net.ParseIP(ip).To4() != nil], 53)
+		} else {
+			pc, err = net.ListenPacket("udp", net.JoinHostPort(ip, "53"))
+		}
+		if err != nil {
+			slog.Warn("[DNS] Listen", "ip", ip, "err", err)
+			continue
+		}
+		slog.Info("[DNS] Serving", "listen", pc.LocalAddr(), "domain", server.Domain, "upstream", server.Upstream)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Serve(ctx, pc); err != nil {
+				slog.Error("[DNS] Serve", "err", err)
+			}
+		}()
+	}
+}
+
+// dnsDomain returns the domain of the peer names, default `<network>.pg`
+func (v *P2PVPN) dnsDomain() string {
+	if v.Config.DNSDomain != "" {
+		return v.Config.DNSDomain
+	}
+	if network := dns.Label(v.network); network != "" {
+		return network + ".pg"
+	}
+	return "pg"
+}
+
+// lookupHost finds the ips of the peer (this node included) which hostname is matched
+func (v *P2PVPN) lookupHost(hostname string) (ips []net.IP) {
+	appendIPs := func(ipv4, ipv6 string) {
+		for _, s := range []string{ipv4, ipv6} {
+			if ip := net.ParseIP(s); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if self, _ := os.Hostname(); dns.Label(self) == hostname {
+		var ipv4, ipv6 string
+		if prefix, err := netip.ParsePrefix(v.Config.NICConfig.IPv4); err == nil {
+			ipv4 = prefix.Addr().String()
+		}
+		if prefix, err := netip.ParsePrefix(v.Config.NICConfig.IPv6); err == nil {
+			ipv6 = prefix.Addr().String()
+		}
+		appendIPs(ipv4, ipv6)
+		return
+	}
+	for _, peer := range v.nic.Peers() {
+		if dns.Label(peer.Meta.Get("name")) != hostname {
+			continue
+		}
+		appendIPs(cmp.Or(peer.IPv4, peer.Meta.Get("alias1")), cmp.Or(peer.IPv6, peer.Meta.Get("alias2")))
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package vpn
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/sigcn/pg/disco"
+	"storj.io/common/base58"
+)
+
+// leaseRequired reports whether the nic addresses are leased from the peermap server
+func (v *P2PVPN) leaseRequired() bool {
+	return v.Config.NICConfig.IPv4 == "" && v.Config.NICConfig.IPv6 == ""
+}
+
+// applyIPLease configures the nic with the addresses leased by the peermap server
+func (v *P2PVPN) applyIPLease(lease disco.IPLease) error {
+	if !v.leaseRequired() {
+		return nil
+	}
+	if lease.IPv4 == "" && lease.IPv6 == "" {
+		return errors.New("no address is leased by the peermap server, at least one of the flags in the group [ipv4 ipv6] is required")
+	}
+	v.Config.NICConfig.IPv4 = lease.IPv4
+	v.Config.NICConfig.IPv6 = lease.IPv6
+	v.leased = lease
+	for _, cidr := range []string{lease.IPv4, lease.IPv6} {
+		if cidr != "" {
+			disco.AddIgnoredLocalCIDRs(cidr)
+		}
+	}
+	slog.Info("[IPAM] Leased", "ipv4", lease.IPv4, "ipv6", lease.IPv6)
+	return nil
+}
+
+// onIPLeaseChange stops the vpn when the peermap server leases other addresses after reconnecting,
+// e.g. failover to a cluster node which leased them to another peer. The nic addresses can not be
+// changed while running, keeping them would conflict with other peers
+func (v *P2PVPN) onIPLeaseChange(lease disco.IPLease) {
+	if v.leased == (disco.IPLease{}) || v.leased == lease {
+		return
+	}
+	v.stop(fmt.Errorf("ip lease changed from %v to %v, restart is required", v.leased, lease))
+}
+
+// leaseKey returns the private key saved in ~/.peerguard_private_key, a new one is generated if absent.
+// The lease is bound to the peer id, a persistent key keeps the leased addresses stable
+func leaseKey() (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	keyFile := filepath.Join(currentUser.HomeDir, ".peerguard_private_key")
+	b, err := os.ReadFile(keyFile)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	key := base58.Encode(priv.Bytes())
+	return key, os.WriteFile(keyFile, []byte(key), 0600)
+}
@@ -3,12 +3,14 @@ package client
 import (
 	"cmp"
 	"fmt"
+	"maps"
 	"slices"
 	"strings"
 
 	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/sigcn/pg/cmd/pgcli/vpn/ipc/sdk"
 	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/p2p"
 )
 
 func PrintNodeInfo() error {
@@ -37,6 +39,12 @@ func PrintNodeInfo() error {
 		{"Endpoints", cmp.Or(strings.Join(addrs[:min(len(addrs), 3)], ","), "-")},
 		{"Version", nodeInfo.Version},
 	})
+	if nodeInfo.ServerError != "" {
+		tw.AppendRow(table.Row{"Error", nodeInfo.ServerError})
+	}
+	for _, ip := range slices.Sorted(maps.Keys(nodeInfo.Conflicts)) {
+		tw.AppendRow(table.Row{"Conflict", fmt.Sprintf("%s claimed by %s", ip, strings.Join(nodeInfo.Conflicts[ip], ","))})
+	}
 	tw.SetStyle(table.Style{Box: table.StyleBoxLight})
 	fmt.Println(tw.Render())
 	return nil
@@ -63,13 +71,17 @@ func PrintPeers() error {
 		if _, ok := peer.Labels.Get("node.off"); ok {
 			peer.Mode = ""
 		}
+		flags := parseFlags(peer.Labels)
+		if peer.Conflict {
+			flags = append(flags, "CONFLICT")
+		}
 		tw.AppendRow(table.Row{
 			cmp.Or(peer.Hostname, "-"),
 			cmp.Or(peer.IPv4, "-"),
 			cmp.Or(peer.IPv6, "-"),
 			cmp.Or(peer.Mode, "-"),
 			cmp.Or(peer.NAT, "-"),
-			cmp.Or(strings.Join(parseFlags(peer.Labels), ","), "-"),
+			cmp.Or(strings.Join(flags, ","), "-"),
 			cmp.Or(strings.Join(peer.Addrs[:min(len(peer.Addrs), 3)], ","), "-"),
 			peer.Version,
 		})
@@ -80,6 +92,114 @@ func PrintPeers() error {
 	return nil
 }
 
+func PrintMetrics() error {
+	metrics, err := (&sdk.ApiClient{}).QueryMetrics()
+	if err != nil {
+		return err
+	}
+	traffic := func(s p2p.TrafficStat) string {
+		return fmt.Sprintf("%d/%d %s/%s", s.RxPackets, s.TxPackets, humanBytes(s.RxBytes), humanBytes(s.TxBytes))
+	}
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{
+		"Node",
+		"IPv4",
+		"Direct(rx/tx)",
+		"PeerRelay(rx/tx)",
+		"ServerRelay(rx/tx)",
+	})
+	for _, peer := range metrics.Peers {
+		tw.AppendRow(table.Row{
+			cmp.Or(peer.Hostname, peer.ID.String()),
+			cmp.Or(peer.IPv4, "-"),
+			traffic(peer.Direct),
+			traffic(peer.PeerRelay),
+			traffic(peer.ServerRelay),
+		})
+	}
+	tw.SetStyle(table.Style{Box: table.StyleBoxLight})
+	fmt.Println(tw.Render())
+
+	tw = table.NewWriter()
+	tw.AppendRows([]table.Row{
+		{"DiscoAttempts", metrics.Disco.DiscoAttempts},
+		{"EasyChallengePackets", metrics.Disco.EasyChallengePackets},
+		{"HardChallengePackets", metrics.Disco.HardChallengePackets},
+		{"HardChallengeHits", metrics.Disco.HardChallengeHits},
+		{"PortScanPackets", metrics.Disco.PortScanPackets},
+		{"PortScanHits", metrics.Disco.PortScanHits},
+		{"RelayedPackets", metrics.Disco.RelayedPackets},
+		{"UnknownPeerPackets", metrics.Disco.UnknownPeerPackets},
+		{"UnauthorizedPackets", metrics.Disco.UnauthorizedPackets},
+		{"EncryptFailures", metrics.Crypto.EncryptFailures},
+		{"DecryptFailures", metrics.Crypto.DecryptFailures},
+		{"ReplayDrops", metrics.Crypto.ReplayDrops},
+		{"InboundPackets", metrics.VPN.InboundPackets},
+		{"OutboundPackets", metrics.VPN.OutboundPackets},
+		{"InboundDrops", metrics.VPN.InboundDrops},
+		{"OutboundDrops", metrics.VPN.OutboundDrops},
+		{"MulticastDrops", metrics.VPN.MulticastDrops},
+		{"UnreachableDrops", metrics.VPN.UnreachableDrops},
+		{"InvalidPackets", metrics.VPN.InvalidPackets},
+		{"InboundQueueFull", metrics.VPN.InboundQueueFull},
+		{"OutboundQueueFull", metrics.VPN.OutboundQueueFull},
+		{"NICWriteErrors", metrics.VPN.NICWriteErrors},
+		{"PeerWriteErrors", metrics.VPN.PeerWriteErrors},
+	})
+	tw.SetStyle(table.Style{Box: table.StyleBoxLight})
+	fmt.Println(tw.Render())
+	return nil
+}
+
+func PrintAuthorizedPeers() error {
+	peers, err := (&sdk.ApiClient{}).QueryAuthorizedPeers()
+	if err != nil {
+		return err
+	}
+	tw := table.NewWriter()
+	tw.AppendHeader(table.Row{"ID", "PinnedIP"})
+	for _, peer := range peers {
+		tw.AppendRow(table.Row{peer.ID, cmp.Or(peer.IP, "-")})
+	}
+	tw.SetStyle(table.Style{Box: table.StyleBoxLight})
+	fmt.Println(tw.Render())
+	return nil
+}
+
+// EditAuthorizedPeers authorizes the `<base58 public key>[=<ip>]` peers and deauthorizes the public keys
+func EditAuthorizedPeers(authorize, deauthorize []string) error {
+	client := &sdk.ApiClient{}
+	for _, s := range authorize {
+		peerID, ip, err := p2p.ParseAuthorizedPeer(s)
+		if err != nil {
+			return err
+		}
+		if err := client.AuthorizePeer(sdk.AuthorizedPeer{ID: peerID, IP: ip}); err != nil {
+			return err
+		}
+	}
+	for _, peerID := range deauthorize {
+		if err := client.DeauthorizePeer(disco.PeerID(peerID)); err != nil {
+			return err
+		}
+	}
+	return PrintAuthorizedPeers()
+}
+
+func humanBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", v, units[i])
+}
+
 func parseFlags(labels disco.Labels) []string {
 	var flags []string
 	if _, ok := labels.Get("node.nr"); ok {
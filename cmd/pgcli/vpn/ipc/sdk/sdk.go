@@ -1,6 +1,7 @@
 package sdk
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -15,12 +16,17 @@ import (
 	"time"
 
 	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/disco/udp"
+	"github.com/sigcn/pg/langs"
 	"github.com/sigcn/pg/p2p"
+	"github.com/sigcn/pg/vpn"
 )
 
 var (
 	ErrPermissionDenied error = errors.New("ipc: permission denied")
 	ErrNoDaemon         error = errors.New("ipc: no daemon")
+
+	ErrAuthorizedPeersDisabled = langs.Error{Code: 1001, Msg: "authorized peers is not enabled"}
 )
 
 type Response[T any] struct {
@@ -40,11 +46,33 @@ type PeerState struct {
 	NAT            string       `json:"nat"`
 	Version        string       `json:"version"`
 	Labels         disco.Labels `json:"labels"`
+	Conflict       bool         `json:"conflict"`
 }
 
 type NodeInfo struct {
 	p2p.NodeInfo
-	Version string `json:"version"`
+	Version   string              `json:"version"`
+	Conflicts map[string][]string `json:"conflicts"` // ip as key, ids of the peers claim the ip as value
+}
+
+type AuthorizedPeer struct {
+	ID disco.PeerID `json:"id"`
+	IP string       `json:"ip,omitempty"` // pinned ip
+}
+
+type PeerMetrics struct {
+	ID       disco.PeerID `json:"id"`
+	Hostname string       `json:"hostname"`
+	IPv4     string       `json:"ipv4"`
+	IPv6     string       `json:"ipv6"`
+	p2p.PeerStat
+}
+
+type Metrics struct {
+	Peers  []PeerMetrics  `json:"peers"`
+	Disco  udp.DiscoStats `json:"disco"`
+	Crypto p2p.CryptoStat `json:"crypto"`
+	VPN    vpn.Stats      `json:"vpn"`
 }
 
 func GetDefaultUnixSocketPath() string {
@@ -114,3 +142,58 @@ func (c *ApiClient) QueryNodeInfo() (*NodeInfo, error) {
 	}
 	return resp.Data, nil
 }
+
+func (c *ApiClient) QueryMetrics() (*Metrics, error) {
+	c.init()
+	r, err := c.httpClient.Get("http://_/apis/p2p/v1alpha1/metrics")
+	if err != nil {
+		return nil, errors.Unwrap(err)
+	}
+	var resp Response[*Metrics]
+	json.NewDecoder(r.Body).Decode(&resp)
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("ENO%d: %s", resp.Code, resp.Msg)
+	}
+	return resp.Data, nil
+}
+
+func (c *ApiClient) QueryAuthorizedPeers() ([]AuthorizedPeer, error) {
+	c.init()
+	r, err := c.httpClient.Get("http://_/apis/p2p/v1alpha1/authorized_peers")
+	if err != nil {
+		return nil, errors.Unwrap(err)
+	}
+	var resp Response[[]AuthorizedPeer]
+	json.NewDecoder(r.Body).Decode(&resp)
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("ENO%d: %s", resp.Code, resp.Msg)
+	}
+	return resp.Data, nil
+}
+
+// AuthorizePeer adds the peer to the authorized peers or updates its pinned ip
+func (c *ApiClient) AuthorizePeer(peer AuthorizedPeer) error {
+	b, _ := json.Marshal(peer)
+	req, _ := http.NewRequest(http.MethodPut, "http://_/apis/p2p/v1alpha1/authorized_peers/"+peer.ID.String(), bytes.NewReader(b))
+	return c.do(req)
+}
+
+// DeauthorizePeer removes the peer from the authorized peers
+func (c *ApiClient) DeauthorizePeer(peerID disco.PeerID) error {
+	req, _ := http.NewRequest(http.MethodDelete, "http://_/apis/p2p/v1alpha1/authorized_peers/"+peerID.String(), nil)
+	return c.do(req)
+}
+
+func (c *ApiClient) do(req *http.Request) error {
+	c.init()
+	r, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Unwrap(err)
+	}
+	var resp Response[any]
+	json.NewDecoder(r.Body).Decode(&resp)
+	if resp.Code != 0 {
+		return fmt.Errorf("ENO%d: %s", resp.Code, resp.Msg)
+	}
+	return nil
+}
@@ -8,17 +8,22 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/sigcn/pg/cmd/pgcli/vpn/ipc/sdk"
 	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/langs"
 	"github.com/sigcn/pg/p2p"
+	"github.com/sigcn/pg/vpn"
 	"github.com/sigcn/pg/vpn/nic"
 )
 
 type Server struct {
 	Vnic       *nic.VirtualNIC
 	PacketConn *p2p.PacketConn
+	VPN        *vpn.VPN
 	Version    string
 }
 
@@ -40,6 +45,10 @@ func (s *Server) Start(ctx context.Context, stopWG *sync.WaitGroup) error {
 
 	http.HandleFunc("GET /apis/p2p/v1alpha1/peers", s.handleQueryPeers)
 	http.HandleFunc("GET /apis/p2p/v1alpha1/node_info", s.handleQueryNodeInfo)
+	http.HandleFunc("GET /apis/p2p/v1alpha1/metrics", s.handleQueryMetrics)
+	http.HandleFunc("GET /apis/p2p/v1alpha1/authorized_peers", s.handleQueryAuthorizedPeers)
+	http.HandleFunc("PUT /apis/p2p/v1alpha1/authorized_peers/{id}", s.handleAuthorizePeer)
+	http.HandleFunc("DELETE /apis/p2p/v1alpha1/authorized_peers/{id}", s.handleDeauthorizePeer)
 
 	server := http.Server{}
 	stopWG.Add(1)
@@ -88,6 +97,7 @@ func (s *Server) handleQueryPeers(w http.ResponseWriter, r *http.Request) {
 		last.Addrs = append(last.Addrs, p.Addr.String())
 	}
 	var peers []sdk.PeerState
+	conflicts := s.Vnic.Conflicts()
 	for _, p := range s.Vnic.Peers() {
 		state := sdk.PeerState{
 			ID:       disco.PeerID(p.Addr.String()),
@@ -99,6 +109,9 @@ func (s *Server) handleQueryPeers(w http.ResponseWriter, r *http.Request) {
 			Version:  p.Meta.Get("version"),
 			Labels:   p.Meta["label"],
 		}
+		_, conflict4 := conflicts[p.IPv4]
+		_, conflict6 := conflicts[p.IPv6]
+		state.Conflict = conflict4 || conflict6
 		if p2pPeer, ok := p2pPeers[disco.PeerID(p.Addr.String())]; ok {
 			state.Mode = "P2P"
 			state.LastActiveTime = p2pPeer.LastActiveTime
@@ -113,8 +126,82 @@ func (s *Server) handleQueryPeers(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleQueryNodeInfo(w http.ResponseWriter, r *http.Request) {
 	ni := sdk.NodeInfo{
-		NodeInfo: s.PacketConn.NodeInfo(),
-		Version:  s.Version,
+		NodeInfo:  s.PacketConn.NodeInfo(),
+		Version:   s.Version,
+		Conflicts: s.Vnic.Conflicts(),
 	}
 	json.NewEncoder(w).Encode(sdk.Response[any]{Data: ni})
 }
+
+func (s *Server) handleQueryMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := sdk.Metrics{
+		Disco:  s.PacketConn.DiscoStats(),
+		Crypto: s.PacketConn.CryptoStat(),
+	}
+	if s.VPN != nil {
+		metrics.VPN = s.VPN.Stats()
+	}
+	peerStats := s.PacketConn.PeerStats()
+	for _, p := range s.Vnic.Peers() {
+		peerID := disco.PeerID(p.Addr.String())
+		metrics.Peers = append(metrics.Peers, sdk.PeerMetrics{
+			ID:       peerID,
+			Hostname: p.Meta.Get("name"),
+			IPv4:     p.IPv4,
+			IPv6:     p.IPv6,
+			PeerStat: peerStats[peerID],
+		})
+		delete(peerStats, peerID)
+	}
+	for peerID, stat := range peerStats {
+		metrics.Peers = append(metrics.Peers, sdk.PeerMetrics{ID: peerID, PeerStat: stat})
+	}
+	slices.SortStableFunc(metrics.Peers, func(a, b sdk.PeerMetrics) int {
+		return strings.Compare(a.ID.String(), b.ID.String())
+	})
+	json.NewEncoder(w).Encode(sdk.Response[any]{Data: metrics})
+}
+
+func (s *Server) handleQueryAuthorizedPeers(w http.ResponseWriter, r *http.Request) {
+	authorizedPeers := s.PacketConn.AuthorizedPeers()
+	if authorizedPeers == nil {
+		json.NewEncoder(w).Encode(sdk.Response[any]{Code: sdk.ErrAuthorizedPeersDisabled.Code, Msg: sdk.ErrAuthorizedPeersDisabled.Msg})
+		return
+	}
+	peers := []sdk.AuthorizedPeer{}
+	for peerID, ip := range authorizedPeers.List() {
+		peers = append(peers, sdk.AuthorizedPeer{ID: peerID, IP: ip})
+	}
+	slices.SortFunc(peers, func(a, b sdk.AuthorizedPeer) int {
+		return strings.Compare(a.ID.String(), b.ID.String())
+	})
+	json.NewEncoder(w).Encode(sdk.Response[any]{Data: peers})
+}
+
+func (s *Server) handleAuthorizePeer(w http.ResponseWriter, r *http.Request) {
+	var peer sdk.AuthorizedPeer
+	json.NewDecoder(r.Body).Decode(&peer)
+	s.editAuthorizedPeers(w, func(peers *p2p.AuthorizedPeers) error {
+		return peers.Set(disco.PeerID(r.PathValue("id")), peer.IP)
+	})
+}
+
+func (s *Server) handleDeauthorizePeer(w http.ResponseWriter, r *http.Request) {
+	s.editAuthorizedPeers(w, func(peers *p2p.AuthorizedPeers) error {
+		return peers.Del(disco.PeerID(r.PathValue("id")))
+	})
+}
+
+func (s *Server) editAuthorizedPeers(w http.ResponseWriter, edit func(*p2p.AuthorizedPeers) error) {
+	authorizedPeers := s.PacketConn.AuthorizedPeers()
+	if authorizedPeers == nil {
+		json.NewEncoder(w).Encode(sdk.Response[any]{Code: sdk.ErrAuthorizedPeersDisabled.Code, Msg: sdk.ErrAuthorizedPeersDisabled.Msg})
+		return
+	}
+	if err := edit(authorizedPeers); err != nil {
+		e := langs.Err(err)
+		json.NewEncoder(w).Encode(sdk.Response[any]{Code: e.Code, Msg: e.Msg})
+		return
+	}
+	json.NewEncoder(w).Encode(sdk.Response[any]{})
+}
@@ -0,0 +1,253 @@
+package vpn
+
+import (
+	"log/slog"
+	"net"
+	"net/url"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/netlink"
+	"github.com/sigcn/pg/vpn/nic"
+	"github.com/sigcn/pg/vpn/nic/gvisor"
+)
+
+// peerRoute is a route advertised by a peer with the label route=<cidr>
+type peerRoute struct {
+	dst *net.IPNet
+	via net.IP
+}
+
+func (r peerRoute) exit() bool {
+	ones, _ := r.dst.Mask.Size()
+	return ones == 0
+}
+
+func (r peerRoute) equal(r1 peerRoute) bool {
+	return r.dst.String() == r1.dst.String() && r.via.Equal(r1.via)
+}
+
+// routeManager installs the routes advertised by peers to the VirtualNIC and the OS.
+// The routes are installed only if AcceptRoutes, and within AcceptWithin if it is not empty.
+// The exit node routes (0.0.0.0/0, ::/0) are installed only if the peer is chosen by
+// ExitNode, the OS default route is split into two halves to keep the original one
+type routeManager struct {
+	IfName       string
+	ExitNode     string // ip of the peer which is used as the exit node
+	AcceptRoutes bool
+	AcceptWithin []*net.IPNet
+	VNIC         *nic.VirtualNIC
+	Gvisor       *gvisor.GvisorCard // not nil in rootless mode
+	Servers      []string           // peermap servers, bypass the exit node
+
+	mut    sync.Mutex
+	routes map[disco.PeerID][]peerRoute
+	addrs  map[disco.PeerID][]string // udp addrs of peers, bypass the exit node
+	bypass map[string]struct{}
+}
+
+// advertisedRoutes parses the routes from the peer labels
+func advertisedRoutes(meta url.Values) (routes []peerRoute) {
+	for _, l := range meta["label"] {
+		cidr, ok := strings.CutPrefix(l, "route=")
+		if !ok {
+			continue
+		}
+		_, dst, err := net.ParseCIDR(cidr)
+		if err != nil {
+			slog.Debug("[Route] Invalid advertised route", "route", cidr, "err", err)
+			continue
+		}
+		via := net.ParseIP(meta.Get("alias1"))
+		if dst.IP.To4() == nil {
+			via = net.ParseIP(meta.Get("alias2"))
+		}
+		if via == nil {
+			continue
+		}
+		routes = append(routes, peerRoute{dst: dst, via: via})
+	}
+	return
+}
+
+// Sync installs the routes advertised by the peer and removes the stale ones
+func (m *routeManager) Sync(peerID disco.PeerID, meta url.Values) {
+	var routes []peerRoute
+	for _, r := range advertisedRoutes(meta) {
+		if !m.accept(r) {
+			slog.Debug("[Route] Ignore", "peer", peerID, "dst", r.dst, "via", r.via)
+			continue
+		}
+		routes = append(routes, r)
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.routes == nil {
+		m.routes = make(map[disco.PeerID][]peerRoute)
+		m.addrs = make(map[disco.PeerID][]string)
+		m.bypass = make(map[string]struct{})
+	}
+	installed := m.routes[peerID]
+	for _, r := range installed {
+		if !slices.ContainsFunc(routes, r.equal) {
+			m.delRoute(r)
+		}
+	}
+	for _, r := range routes {
+		if !slices.ContainsFunc(installed, r.equal) {
+			m.addRoute(r)
+		}
+	}
+	if len(routes) == 0 {
+		delete(m.routes, peerID)
+	} else {
+		m.routes[peerID] = routes
+	}
+	if addrs := meta["addr"]; len(addrs) > 0 {
+		m.addrs[peerID] = addrs
+	} else {
+		delete(m.addrs, peerID)
+	}
+	if m.Gvisor == nil && m.exitActive() {
+		m.addBypass(m.Servers...)
+		for _, addrs := range m.addrs {
+			m.addBypass(addrs...)
+		}
+	}
+}
+
+// Remove removes all routes advertised by the peer
+func (m *routeManager) Remove(peerID disco.PeerID) {
+	m.Sync(peerID, nil)
+}
+
+// Close removes all routes installed
+func (m *routeManager) Close() {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for peerID, routes := range m.routes {
+		for _, r := range routes {
+			m.delRoute(r)
+		}
+		delete(m.routes, peerID)
+	}
+	for ip := range m.bypass {
+		netlink.DelBypassRoute(net.ParseIP(ip))
+		delete(m.bypass, ip)
+	}
+}
+
+// accept reports whether the advertised route can be installed
+func (m *routeManager) accept(r peerRoute) bool {
+	if r.exit() {
+		return m.ExitNode != "" && net.ParseIP(m.ExitNode).Equal(r.via)
+	}
+	if !m.AcceptRoutes {
+		return false
+	}
+	if len(m.AcceptWithin) == 0 {
+		return true
+	}
+	ones, _ := r.dst.Mask.Size()
+	return slices.ContainsFunc(m.AcceptWithin, func(within *net.IPNet) bool {
+		withinOnes, _ := within.Mask.Size()
+		return within.Contains(r.dst.IP) && ones >= withinOnes
+	})
+}
+
+func (m *routeManager) exitActive() bool {
+	for _, routes := range m.routes {
+		if slices.ContainsFunc(routes, peerRoute.exit) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *routeManager) addRoute(r peerRoute) {
+	slog.Info("[Route] Add", "dst", r.dst, "via", r.via)
+	m.VNIC.AddRoute(r.dst, r.via)
+	if m.Gvisor != nil {
+		m.Gvisor.AddRoute(r.dst)
+		return
+	}
+	if r.exit() {
+		if runtime.GOOS != "linux" {
+			slog.Warn("[Route] Exit node is only supported on linux or in rootless mode")
+			return
+		}
+		// must be done before the default route is taken over
+		m.addBypass(m.Servers...)
+		for _, addrs := range m.addrs {
+			m.addBypass(addrs...)
+		}
+	}
+	for _, dst := range splitDefaultRoute(r.dst) {
+		if err := netlink.AddRoute(m.IfName, dst, r.via); err != nil {
+			slog.Error("[Route] Add", "dst", dst, "via", r.via, "err", err)
+		}
+	}
+}
+
+func (m *routeManager) delRoute(r peerRoute) {
+	slog.Info("[Route] Remove", "dst", r.dst, "via", r.via)
+	m.VNIC.DelRoute(r.dst, r.via)
+	if m.Gvisor != nil {
+		m.Gvisor.DelRoute(r.dst)
+		return
+	}
+	if r.exit() && runtime.GOOS != "linux" {
+		return
+	}
+	for _, dst := range splitDefaultRoute(r.dst) {
+		if err := netlink.DelRoute(m.IfName, dst, r.via); err != nil {
+			slog.Debug("[Route] Remove", "dst", dst, "via", r.via, "err", err)
+		}
+	}
+}
+
+// addBypass routes the hosts through the system default gateway
+func (m *routeManager) addBypass(hosts ...string) {
+	for _, host := range hosts {
+		if u, err := url.Parse(host); err == nil && u.Scheme != "" && u.Hostname() != "" {
+			host = u.Hostname()
+		} else if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			slog.Debug("[Route] Bypass", "host", host, "err", err)
+			continue
+		}
+		for _, ip := range ips {
+			if _, ok := m.bypass[ip.String()]; ok || ip.IsPrivate() || ip.IsLoopback() {
+				continue
+			}
+			if err := netlink.AddBypassRoute(ip); err != nil {
+				slog.Debug("[Route] Bypass", "ip", ip, "err", err)
+				continue
+			}
+			m.bypass[ip.String()] = struct{}{}
+		}
+	}
+}
+
+// splitDefaultRoute splits the default route into two halves
+func splitDefaultRoute(dst *net.IPNet) []*net.IPNet {
+	if ones, bits := dst.Mask.Size(); ones > 0 {
+		return []*net.IPNet{dst}
+	} else if bits == 32 {
+		return []*net.IPNet{
+			{IP: net.IPv4(0, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+			{IP: net.IPv4(128, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+		}
+	}
+	return []*net.IPNet{
+		{IP: net.ParseIP("::"), Mask: net.CIDRMask(1, 128)},
+		{IP: net.ParseIP("8000::"), Mask: net.CIDRMask(1, 128)},
+	}
+}
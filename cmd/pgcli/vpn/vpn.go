@@ -1,6 +1,7 @@
 package vpn
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"flag"
@@ -13,6 +14,7 @@ import (
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -24,11 +26,15 @@ import (
 	"github.com/sigcn/pg/cmd/pgcli/vpn/rootless"
 	"github.com/sigcn/pg/disco"
 	"github.com/sigcn/pg/disco/udp"
+	"github.com/sigcn/pg/netlink"
 	"github.com/sigcn/pg/p2p"
 	"github.com/sigcn/pg/peermap/network"
 	"github.com/sigcn/pg/secure/aescbc"
+	"github.com/sigcn/pg/secure/aesgcm"
 	"github.com/sigcn/pg/secure/chacha20poly1305"
+	"github.com/sigcn/pg/secure/noise"
 	"github.com/sigcn/pg/vpn"
+	"github.com/sigcn/pg/vpn/acl"
 	"github.com/sigcn/pg/vpn/nic"
 	"github.com/sigcn/pg/vpn/nic/gvisor"
 	"github.com/sigcn/pg/vpn/nic/tun"
@@ -71,6 +77,18 @@ func Run(args []string) error {
 		return client.PrintNodeInfo()
 	}
 
+	if cfg.QueryMetrics {
+		return client.PrintMetrics()
+	}
+
+	if len(cfg.Authorize) > 0 || len(cfg.Deauthorize) > 0 {
+		return client.EditAuthorizedPeers(cfg.Authorize, cfg.Deauthorize)
+	}
+
+	if cfg.QueryAuthorizedPeers {
+		return client.PrintAuthorizedPeers()
+	}
+
 	slog.SetLogLoggerLevel(slog.Level(logLevel))
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -81,6 +99,10 @@ func Run(args []string) error {
 func usage(flagSet *flag.FlagSet) {
 	ipv4 := flagSet.Lookup("4")
 	ipv6 := flagSet.Lookup("6")
+	acceptRoutes := flagSet.Lookup("accept-routes")
+	acceptRoutesWithin := flagSet.Lookup("accept-routes-within")
+	advertiseExitNode := flagSet.Lookup("advertise-exit-node")
+	advertiseRoute := flagSet.Lookup("advertise-route")
 	authQR := flagSet.Lookup("auth-qr")
 	discoChallengesBackoffRate := flagSet.Lookup("disco-challenges-backoff-rate")
 	discoChallengesInitialInterval := flagSet.Lookup("disco-challenges-initial-interval")
@@ -89,6 +111,10 @@ func usage(flagSet *flag.FlagSet) {
 	discoPortScanCount := flagSet.Lookup("disco-port-scan-count")
 	discoPortScanDuration := flagSet.Lookup("disco-port-scan-duration")
 	discoPortScanOffset := flagSet.Lookup("disco-port-scan-offset")
+	dns := flagSet.Lookup("dns")
+	dnsDomain := flagSet.Lookup("dns-domain")
+	dnsUpstream := flagSet.Lookup("dns-upstream")
+	exitNode := flagSet.Lookup("exit-node")
 	cryptoAlgo := flagSet.Lookup("udp-crypto")
 	secret := flagSet.Lookup("secret")
 	secretFile := flagSet.Lookup("f")
@@ -96,13 +122,22 @@ func usage(flagSet *flag.FlagSet) {
 	forceServerRelay := flagSet.Lookup("force-server-relay")
 	forward := flagSet.Lookup("forward")
 	key := flagSet.Lookup("key")
+	psk := flagSet.Lookup("psk")
+	pskFile := flagSet.Lookup("psk-file")
 	labels := flagSet.Lookup("l")
 	logLevel := flagSet.Lookup("loglevel")
 	mtu := flagSet.Lookup("mtu")
 	peers := flagSet.Lookup("peers")
+	metrics := flagSet.Lookup("metrics")
+	authorizedPeer := flagSet.Lookup("authorized-peer")
+	authorizedPeersFile := flagSet.Lookup("authorized-peers-file")
+	authorizedPeers := flagSet.Lookup("authorized-peers")
+	authorize := flagSet.Lookup("authorize")
+	deauthorize := flagSet.Lookup("deauthorize")
 	nodeInfo := flagSet.Lookup("nodeinfo")
 	proxyListen := flagSet.Lookup("proxy-listen")
 	proxyUsers := flagSet.Lookup("proxy-user")
+	requireSignedMeta := flagSet.Lookup("require-signed-meta")
 	server := flagSet.Lookup("s")
 	tun := flagSet.Lookup("tun")
 	udpPort := flagSet.Lookup("udp-port")
@@ -113,7 +148,13 @@ func usage(flagSet *flag.FlagSet) {
 	fmt.Printf("Daemon Flags:\n")
 	fmt.Printf("  -4, --ipv4 string\n\t%s\n", ipv4.Usage)
 	fmt.Printf("  -6, --ipv6 string\n\t%s\n", ipv6.Usage)
+	fmt.Printf("  --accept-routes\n\t%s\n", acceptRoutes.Usage)
+	fmt.Printf("  --accept-routes-within strings\n\t%s\n", acceptRoutesWithin.Usage)
+	fmt.Printf("  --advertise-exit-node\n\t%s\n", advertiseExitNode.Usage)
+	fmt.Printf("  --advertise-route strings\n\t%s\n", advertiseRoute.Usage)
 	fmt.Printf("  --auth-qr\n\t%s\n", authQR.Usage)
+	fmt.Printf("  --authorized-peer strings\n\t%s\n", authorizedPeer.Usage)
+	fmt.Printf("  --authorized-peers-file string\n\t%s\n", authorizedPeersFile.Usage)
 	fmt.Printf("  --disco-challenges-backoff-rate float\n\t%s (default %s)\n", discoChallengesBackoffRate.Usage, discoChallengesBackoffRate.DefValue)
 	fmt.Printf("  --disco-challenges-initial-interval duration\n\t%s (default %s)\n", discoChallengesInitialInterval.Usage, discoChallengesInitialInterval.DefValue)
 	fmt.Printf("  --disco-challenges-retry int\n\t%s (default %s)\n", discoChallengesRetry.Usage, discoChallengesRetry.DefValue)
@@ -121,6 +162,10 @@ func usage(flagSet *flag.FlagSet) {
 	fmt.Printf("  --disco-port-scan-count int\n\t%s (default %s)\n", discoPortScanCount.Usage, discoPortScanCount.DefValue)
 	fmt.Printf("  --disco-port-scan-duration duration\n\t%s (default %s)\n", discoPortScanDuration.Usage, discoPortScanDuration.DefValue)
 	fmt.Printf("  --disco-port-scan-offset int\n\t%s (default %s)\n", discoPortScanOffset.Usage, discoPortScanOffset.DefValue)
+	fmt.Printf("  --dns\n\t%s\n", dns.Usage)
+	fmt.Printf("  --dns-domain string\n\t%s\n", dnsDomain.Usage)
+	fmt.Printf("  --dns-upstream strings\n\t%s\n", dnsUpstream.Usage)
+	fmt.Printf("  --exit-node string\n\t%s\n", exitNode.Usage)
 	fmt.Printf("  --force-peer-relay \n\t%s\n", forcePeerRelay.Usage)
 	fmt.Printf("  --force-server-relay \n\t%s\n", forceServerRelay.Usage)
 	fmt.Printf("  --forward strings\n\t%s\n", forward.Usage)
@@ -128,8 +173,11 @@ func usage(flagSet *flag.FlagSet) {
 	fmt.Printf("  -l, --label strings\n\t%s\n", labels.Usage)
 	fmt.Printf("  --loglevel int\n\t%s (default %s)\n", logLevel.Usage, logLevel.DefValue)
 	fmt.Printf("  --mtu int\n\t%s (default %s)\n", mtu.Usage, mtu.DefValue)
+	fmt.Printf("  --psk string\n\t%s\n", psk.Usage)
+	fmt.Printf("  --psk-file string\n\t%s\n", pskFile.Usage)
 	fmt.Printf("  --proxy-listen string\n\t%s\n", proxyListen.Usage)
 	fmt.Printf("  --proxy-user strings\n\t%s\n", proxyUsers.Usage)
+	fmt.Printf("  --require-signed-meta\n\t%s\n", requireSignedMeta.Usage)
 	fmt.Printf("  --secret string\n\t%s\n", secret.Usage)
 	fmt.Printf("  -f, --secret-file string\n\t%s\n", secretFile.Usage)
 	fmt.Printf("  -s, --server string\n\t%s\n", server.Usage)
@@ -137,6 +185,10 @@ func usage(flagSet *flag.FlagSet) {
 	fmt.Printf("  --udp-crypto string\n\t%s (default %s)\n", cryptoAlgo.Usage, cryptoAlgo.DefValue)
 	fmt.Printf("  --udp-port int\n\t%s (default %s)\n\n", udpPort.Usage, udpPort.DefValue)
 	fmt.Printf("IPC Flags:\n")
+	fmt.Printf("  --authorize strings\n\t%s\n", authorize.Usage)
+	fmt.Printf("  --authorized-peers \n\t%s\n", authorizedPeers.Usage)
+	fmt.Printf("  --deauthorize strings\n\t%s\n", deauthorize.Usage)
+	fmt.Printf("  --metrics \n\t%s\n", metrics.Usage)
 	fmt.Printf("  --nodeinfo \n\t%s\n", nodeInfo.Usage)
 	fmt.Printf("  --peers \n\t%s\n\n", peers.Usage)
 	fmt.Printf("Global Flags:\n")
@@ -147,7 +199,8 @@ func usage(flagSet *flag.FlagSet) {
 func createConfig(flagSet *flag.FlagSet, args []string) (cfg Config, err error) {
 	// daemon flags
 	var forcePeerRelay, forceServerRelay bool
-	var ignoredInterfaces, forwards, proxyUsers, nodeLabels stringSlice
+	var ignoredInterfaces, forwards, proxyUsers, nodeLabels, advertiseRoutes, acceptRoutesWithin, dnsUpstreams stringSlice
+	var authorizedPeers, authorize, deauthorize stringSlice
 	var cryptoAlgo string
 
 	flagSet.IntVar(&cfg.DiscoConfig.PortScanOffset, "disco-port-scan-offset", -1000, "scan ports offset when disco")
@@ -159,30 +212,47 @@ func createConfig(flagSet *flag.FlagSet, args []string) (cfg Config, err error)
 	flagSet.Var(&ignoredInterfaces, "disco-ignored-interface", "ignore interfaces prefix when disco")
 
 	flagSet.StringVar(&cfg.NICConfig.IPv4, "ipv4", "", "")
-	flagSet.StringVar(&cfg.NICConfig.IPv4, "4", "", "ipv4 address prefix (e.g. 100.99.0.1/24)")
+	flagSet.StringVar(&cfg.NICConfig.IPv4, "4", "", "ipv4 address prefix (e.g. 100.99.0.1/24, default leased from the peermap server)")
 	flagSet.StringVar(&cfg.NICConfig.IPv6, "ipv6", "", "")
-	flagSet.StringVar(&cfg.NICConfig.IPv6, "6", "", "ipv6 address prefix (e.g. fd00::1/64)")
+	flagSet.StringVar(&cfg.NICConfig.IPv6, "6", "", "ipv6 address prefix (e.g. fd00::1/64, default leased from the peermap server)")
 	flagSet.IntVar(&cfg.NICConfig.MTU, "mtu", 1371, "nic mtu")
 	flagSet.StringVar(&cfg.NICConfig.Name, "tun", defaultTunName, "nic name")
 	flagSet.Var(&forwards, "forward", "start in rootless mode and create a port forward (e.g. tcp://127.0.0.1:80)")
 	flagSet.StringVar(&cfg.ProxyConfig.Listen, "proxy-listen", "", "start a proxy server to access the PG network (e.g. 127.0.0.1:4090)")
 	flagSet.Var(&proxyUsers, "proxy-user", "user:pass pair for proxy server authenticate (can be specified multiple times)")
 	flagSet.StringVar(&cfg.PrivateKey, "key", "", "curve25519 private key in base58 format (default generate a new one)")
+	flagSet.StringVar(&cfg.PSK, "psk", "", "pre-shared key of the network mixed into the peer encryption (all peers must use the same one)")
+	flagSet.StringVar(&cfg.PSKFile, "psk-file", "", "file contains the pre-shared key of the network")
+	flagSet.Var(&authorizedPeers, "authorized-peer", "<base58 public key>[=<pinned ip>] of the peer allowed to connect (can be specified multiple times)")
+	flagSet.StringVar(&cfg.AuthorizedPeersFile, "authorized-peers-file", "", "file contains the authorized peers, one per line (edits over ipc are saved to it)")
+	flagSet.BoolVar(&cfg.RequireSignedMeta, "require-signed-meta", false, "ignore the peers whose addresses and labels are not signed by their keys (leased addresses are not signed)")
 	flagSet.StringVar(&cfg.Secret, "secret", "", "p2p network secret string (enable this will disable secret rotation)")
 	flagSet.StringVar(&cfg.SecretFile, "secret-file", "", "")
 	flagSet.StringVar(&cfg.SecretFile, "f", "", "p2p network secret file (default ~/.peerguard_network_secret.json)")
 	flagSet.BoolVar(&cfg.AuthQR, "auth-qr", false, "display the QR code when authentication is required")
 	flagSet.StringVar(&cfg.Server, "server", os.Getenv("PG_SERVER"), "")
-	flagSet.StringVar(&cfg.Server, "s", os.Getenv("PG_SERVER"), "peermap server")
+	flagSet.StringVar(&cfg.Server, "s", os.Getenv("PG_SERVER"), "peermap server (comma separated list for failover, append #weight=N to spread peers by weight)")
 	flagSet.BoolVar(&cfg.QueryPeers, "peers", false, "query found peers")
 	flagSet.BoolVar(&cfg.QueryNodeInfo, "nodeinfo", false, "get information about this node")
+	flagSet.BoolVar(&cfg.QueryMetrics, "metrics", false, "query data path metrics")
+	flagSet.BoolVar(&cfg.QueryAuthorizedPeers, "authorized-peers", false, "query authorized peers")
+	flagSet.Var(&authorize, "authorize", "authorize the <base58 public key>[=<pinned ip>] peer (can be specified multiple times)")
+	flagSet.Var(&deauthorize, "deauthorize", "deauthorize the peer by the base58 public key (can be specified multiple times)")
 
-	flagSet.StringVar(&cryptoAlgo, "udp-crypto", "chacha20poly1305", "udp packet crypto algorithm from the list [chacha20poly1305, aescbc]")
+	flagSet.StringVar(&cryptoAlgo, "udp-crypto", "chacha20poly1305", "udp packet crypto algorithm from the list [chacha20poly1305, chacha20poly1305-counter, noise, aesgcm, aescbc(deprecated)]")
 	flagSet.IntVar(&cfg.UDPPort, "udp-port", 29877, "p2p udp listen port")
 	flagSet.BoolVar(&forcePeerRelay, "force-peer-relay", false, "force to peer relay transport mode")
 	flagSet.BoolVar(&forceServerRelay, "force-server-relay", false, "force to server relay transport mode")
 	flagSet.Var(&nodeLabels, "label", "")
 	flagSet.Var(&nodeLabels, "l", "key=value pair to describe peer node")
+	flagSet.Var(&advertiseRoutes, "advertise-route", "advertise a cidr which is reachable through this node (e.g. 10.0.0.0/8)")
+	flagSet.BoolVar(&cfg.AdvertiseExitNode, "advertise-exit-node", false, "advertise this node as an exit node (linux only)")
+	flagSet.BoolVar(&cfg.AcceptRoutes, "accept-routes", false, "install the routes advertised by peers (the exit node routes are installed by --exit-node only)")
+	flagSet.Var(&acceptRoutesWithin, "accept-routes-within", "only accept the advertised routes within the cidr, implies --accept-routes (can be specified multiple times)")
+	flagSet.StringVar(&cfg.ExitNode, "exit-node", "", "ip of the peer used as the exit node")
+	flagSet.BoolVar(&cfg.DNS, "dns", false, "run a dns server on the vpn addresses to resolve peer names")
+	flagSet.StringVar(&cfg.DNSDomain, "dns-domain", "", "domain of the peer names (default <network>.pg)")
+	flagSet.Var(&dnsUpstreams, "dns-upstream", "upstream dns server for other names (default nameservers in /etc/resolv.conf)")
 
 	flagSet.Parse(args)
 
@@ -190,15 +260,32 @@ func createConfig(flagSet *flag.FlagSet, args []string) (cfg Config, err error)
 	cfg.Forwards = forwards
 	cfg.ProxyConfig.Users = proxyUsers
 	cfg.Labels = nodeLabels
+	cfg.AdvertiseRoutes = advertiseRoutes
+	if len(acceptRoutesWithin) > 0 {
+		cfg.AcceptRoutes = true
+		cfg.AcceptRoutesWithin = acceptRoutesWithin
+	}
+	cfg.DNSUpstream = dnsUpstreams
+	cfg.AuthorizedPeers = authorizedPeers
+	cfg.Authorize = authorize
+	cfg.Deauthorize = deauthorize
 
-	if cfg.QueryPeers || cfg.QueryNodeInfo {
+	if cfg.QueryPeers || cfg.QueryNodeInfo || cfg.QueryMetrics || cfg.QueryAuthorizedPeers ||
+		len(cfg.Authorize) > 0 || len(cfg.Deauthorize) > 0 {
 		return
 	}
 
 	switch cryptoAlgo {
 	case "chacha20poly1305":
 		p2p.SetDefaultSymmAlgo(chacha20poly1305.New)
+	case "chacha20poly1305-counter":
+		p2p.SetDefaultSymmAlgo(chacha20poly1305.NewCounter)
+	case "noise":
+		p2p.SetDefaultSymmAlgo(noise.New)
+	case "aesgcm":
+		p2p.SetDefaultSymmAlgo(aesgcm.New)
 	case "aescbc":
+		slog.Warn("The aescbc is unauthenticated and deprecated, use aesgcm instead")
 		p2p.SetDefaultSymmAlgo(aescbc.New)
 	default:
 		slog.Warn("Fallback to default chacha20poly1305")
@@ -208,10 +295,27 @@ func createConfig(flagSet *flag.FlagSet, args []string) (cfg Config, err error)
 		err = errors.New("flag \"server\" not set")
 		return
 	}
-	if cfg.NICConfig.IPv4 == "" && cfg.NICConfig.IPv6 == "" {
-		err = errors.New("at least one of the flags in the group [ipv4 ipv6] is required")
+	for _, route := range cfg.AdvertiseRoutes {
+		if _, _, err = net.ParseCIDR(route); err != nil {
+			err = fmt.Errorf("invalid advertised route: %w", err)
+			return
+		}
+	}
+	for _, cidr := range cfg.AcceptRoutesWithin {
+		if _, _, err = net.ParseCIDR(cidr); err != nil {
+			err = fmt.Errorf("invalid accepted routes cidr: %w", err)
+			return
+		}
+	}
+	if cfg.ExitNode != "" && net.ParseIP(cfg.ExitNode) == nil {
+		err = fmt.Errorf("invalid exit node ip %q", cfg.ExitNode)
 		return
 	}
+	for i, upstream := range cfg.DNSUpstream {
+		if _, _, err1 := net.SplitHostPort(upstream); err1 != nil {
+			cfg.DNSUpstream[i] = net.JoinHostPort(upstream, "53")
+		}
+	}
 	if forcePeerRelay {
 		cfg.P2pTransportMode = p2p.MODE_FORCE_PEER_RELAY
 	}
@@ -222,51 +326,110 @@ func createConfig(flagSet *flag.FlagSet, args []string) (cfg Config, err error)
 }
 
 type Config struct {
-	NICConfig        nic.Config           `yaml:"nic"`
-	ProxyConfig      rootless.ProxyConfig `yaml:"proxy"`
-	DiscoConfig      udp.DiscoConfig      `yaml:"disco"`
-	UDPPort          int                  `yaml:"udp_port"`
-	PrivateKey       string               `yaml:"private_key"`
-	Secret           string               `yaml:"secret"`
-	SecretFile       string               `yaml:"secret_file"`
-	Server           string               `yaml:"server"`
-	AuthQR           bool                 `yaml:"auth_qr"`
-	P2pTransportMode p2p.TransportMode    `yaml:"transport_mode"`
-	Forwards         []string             `yaml:"forwards"`
-	Labels           []string             `yaml:"labels"`
+	NICConfig           nic.Config           `yaml:"nic"`
+	ProxyConfig         rootless.ProxyConfig `yaml:"proxy"`
+	DiscoConfig         udp.DiscoConfig      `yaml:"disco"`
+	UDPPort             int                  `yaml:"udp_port"`
+	PrivateKey          string               `yaml:"private_key"`
+	PSK                 string               `yaml:"psk"`
+	PSKFile             string               `yaml:"psk_file"`
+	AuthorizedPeers     []string             `yaml:"authorized_peers"`
+	AuthorizedPeersFile string               `yaml:"authorized_peers_file"`
+	RequireSignedMeta   bool                 `yaml:"require_signed_meta"`
+	Secret              string               `yaml:"secret"`
+	SecretFile          string               `yaml:"secret_file"`
+	Server              string               `yaml:"server"`
+	AuthQR              bool                 `yaml:"auth_qr"`
+	P2pTransportMode    p2p.TransportMode    `yaml:"transport_mode"`
+	Forwards            []string             `yaml:"forwards"`
+	Labels              []string             `yaml:"labels"`
+	AdvertiseRoutes     []string             `yaml:"advertise_routes"`
+	AdvertiseExitNode   bool                 `yaml:"advertise_exit_node"`
+	AcceptRoutes        bool                 `yaml:"accept_routes"`
+	AcceptRoutesWithin  []string             `yaml:"accept_routes_within"`
+	ExitNode            string               `yaml:"exit_node"`
+	DNS                 bool                 `yaml:"dns"`
+	DNSDomain           string               `yaml:"dns_domain"`
+	DNSUpstream         []string             `yaml:"dns_upstream"`
 
 	QueryPeers    bool
 	QueryNodeInfo bool
+	QueryMetrics  bool
+
+	QueryAuthorizedPeers bool
+	Authorize            []string
+	Deauthorize          []string
 }
 
 type P2PVPN struct {
-	Config Config
-	nic    *nic.VirtualNIC
+	Config   Config
+	nic      *nic.VirtualNIC
+	nicReady chan struct{}
+	acl      *acl.ACL
+	routes   *routeManager
+	network  string
+	leased   disco.IPLease
+	stop     context.CancelCauseFunc
 }
 
 func (v *P2PVPN) Run(ctx context.Context) (err error) {
+	ctx, v.stop = context.WithCancelCause(ctx)
+	defer v.stop(nil)
 	rootlessMode := len(v.Config.Forwards) > 0 || v.Config.ProxyConfig.Listen != ""
 
-	var card nic.NIC
-	if rootlessMode {
-		card = &gvisor.GvisorCard{Config: v.Config.NICConfig, Stack: rootless.CreateGvisorStack()}
-	} else {
-		card, err = tun.Create(v.Config.NICConfig)
-		if err != nil {
-			return err
+	// the nic is created after the addresses are leased, peer events wait for it
+	v.nicReady = make(chan struct{})
+	nicReady := sync.OnceFunc(func() { close(v.nicReady) })
+	defer nicReady()
+
+	v.nic = &nic.VirtualNIC{}
+	v.acl = &acl.ACL{Labels: v.Config.Labels, VNIC: v.nic}
+	v.routes = &routeManager{
+		IfName:       v.Config.NICConfig.Name,
+		ExitNode:     v.Config.ExitNode,
+		AcceptRoutes: v.Config.AcceptRoutes,
+		VNIC:         v.nic,
+		Servers:      strings.Split(v.Config.Server, ","),
+	}
+	for _, cidr := range v.Config.AcceptRoutesWithin {
+		if _, within, err := net.ParseCIDR(cidr); err == nil {
+			v.routes.AcceptWithin = append(v.routes.AcceptWithin, within)
 		}
 	}
+	defer v.routes.Close()
 
 	c, err := v.listenPacketConn(ctx)
 	if err != nil {
-		err1 := card.Close()
-		return errors.Join(err, err1)
+		return err
 	}
 	c.SetTransportMode(v.Config.P2pTransportMode)
-	v.nic = &nic.VirtualNIC{NIC: card}
+	v.acl.PacketConn = c
+
+	if err := v.applyIPLease(c.IPLease()); err != nil {
+		return errors.Join(err, c.Close())
+	}
+
+	var card nic.NIC
+	if rootlessMode {
+		card = &gvisor.GvisorCard{Config: v.Config.NICConfig, Stack: rootless.CreateGvisorStack()}
+		v.routes.Gvisor = card.(*gvisor.GvisorCard)
+	} else if card, err = tun.Create(v.Config.NICConfig); err != nil {
+		return errors.Join(err, c.Close())
+	}
+	v.nic.NIC = card
+	nicReady()
+
+	if err := v.enableSNAT(rootlessMode); err != nil {
+		return errors.Join(err, card.Close(), c.Close())
+	}
+	defer v.disableSNAT()
 
 	var wg sync.WaitGroup
 	defer wg.Wait()
+	if v.Config.DNS {
+		v.startDNS(ctx, &wg, card)
+	}
+
 	if rootlessMode {
 		if err := (&rootless.ForwardEngine{
 			GvisorCard: card.(*gvisor.GvisorCard),
@@ -282,17 +445,32 @@ func (v *P2PVPN) Run(ctx context.Context) (err error) {
 		}
 	}
 
+	vpnInstance := vpn.New(vpn.Config{
+		MTU:              v.Config.NICConfig.MTU,
+		InboundHandlers:  []vpn.InboundHandler{v.acl},
+		OutboundHandlers: []vpn.OutboundHandler{v.acl},
+		OnRouteAdd: func(dst net.IPNet, _ net.IP) {
+			if ones, _ := dst.Mask.Size(); ones <= 1 {
+				return // the exit node routes cover all local addresses
+			}
+			disco.AddIgnoredLocalCIDRs(dst.String())
+		},
+		OnRouteRemove: func(dst net.IPNet, _ net.IP) { disco.RemoveIgnoredLocalCIDRs(dst.String()) },
+	})
 	if err := (&server.Server{
 		Vnic:       v.nic,
 		PacketConn: c,
+		VPN:        vpnInstance,
 		Version:    Version}).Start(ctx, &wg); err != nil {
 		slog.Warn("[IPC] Run http server", "err", err)
 	}
-	return vpn.New(vpn.Config{
-		MTU:           v.Config.NICConfig.MTU,
-		OnRouteAdd:    func(dst net.IPNet, _ net.IP) { disco.AddIgnoredLocalCIDRs(dst.String()) },
-		OnRouteRemove: func(dst net.IPNet, _ net.IP) { disco.RemoveIgnoredLocalCIDRs(dst.String()) },
-	}).Run(ctx, v.nic, c)
+	if err := vpnInstance.Run(ctx, v.nic, c); err != nil {
+		return err
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		return cause
+	}
+	return nil
 }
 
 func (v *P2PVPN) listenPacketConn(ctx context.Context) (c *p2p.PacketConn, err error) {
@@ -309,11 +487,15 @@ func (v *P2PVPN) listenPacketConn(ctx context.Context) (c *p2p.PacketConn, err e
 		p2p.PeerMeta("st", fmt.Sprintf("%d", time.Now().Unix())),
 		p2p.ListenPeerUp(v.onPeerUp),
 		p2p.ListenPeerLeave(v.onPeerLeave),
+		p2p.ListenNetworkMeta(v.onNetworkMeta),
 		p2p.KeepAlivePeriod(6 * time.Second),
 	}
 	for _, l := range v.Config.Labels {
 		p2pOptions = append(p2pOptions, p2p.PeerMeta("label", l))
 	}
+	for _, route := range v.advertisedRoutes() {
+		p2pOptions = append(p2pOptions, p2p.PeerMeta("label", "route="+route))
+	}
 	if v.Config.UDPPort > 0 {
 		p2pOptions = append(p2pOptions, p2p.ListenUDPPort(v.Config.UDPPort))
 	}
@@ -333,6 +515,27 @@ func (v *P2PVPN) listenPacketConn(ctx context.Context) (c *p2p.PacketConn, err e
 		disco.AddIgnoredLocalCIDRs(v.Config.NICConfig.IPv6)
 		p2pOptions = append(p2pOptions, p2p.PeerAlias2(ipv6.Addr().String()))
 	}
+	if v.leaseRequired() {
+		p2pOptions = append(p2pOptions, p2p.RequestIPLease(), p2p.ListenIPLeaseChange(v.onIPLeaseChange))
+		if v.Config.PrivateKey == "" {
+			if v.Config.PrivateKey, err = leaseKey(); err != nil {
+				return nil, fmt.Errorf("load private key: %w", err)
+			}
+		}
+	}
+	if psk, err := v.psk(); err != nil {
+		return nil, err
+	} else if psk != nil {
+		p2pOptions = append(p2pOptions, p2p.ListenPeerPSK(psk))
+	}
+	if authorizedPeers, err := v.authorizedPeers(); err != nil {
+		return nil, err
+	} else if authorizedPeers != nil {
+		p2pOptions = append(p2pOptions, p2p.ListenAuthorizedPeers(authorizedPeers))
+	}
+	if v.Config.RequireSignedMeta {
+		p2pOptions = append(p2pOptions, p2p.RequireSignedPeerMeta())
+	}
 	if v.Config.PrivateKey != "" {
 		p2pOptions = append(p2pOptions, p2p.ListenPeerCurve25519(v.Config.PrivateKey))
 	} else {
@@ -343,6 +546,9 @@ func (v *P2PVPN) listenPacketConn(ctx context.Context) (c *p2p.PacketConn, err e
 	if err != nil {
 		return
 	}
+	if secret, err := secretStore.NetworkSecret(); err == nil {
+		v.network = secret.Network
+	}
 	peermap, err := disco.NewServer(v.Config.Server, secretStore)
 	if err != nil {
 		return
@@ -351,12 +557,155 @@ func (v *P2PVPN) listenPacketConn(ctx context.Context) (c *p2p.PacketConn, err e
 	return p2p.ListenPacketContext(ctx, peermap, p2pOptions...)
 }
 
+// psk reads the pre-shared key from the flag or the file, nil is returned if not set
+func (v *P2PVPN) psk() ([]byte, error) {
+	if v.Config.PSK != "" {
+		return []byte(v.Config.PSK), nil
+	}
+	if v.Config.PSKFile == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(v.Config.PSKFile)
+	if err != nil {
+		return nil, fmt.Errorf("read psk file: %w", err)
+	}
+	return bytes.TrimSpace(b), nil
+}
+
+// authorizedPeers loads the authorized peers from the file and the flags, nil is returned if neither is set
+func (v *P2PVPN) authorizedPeers() (*p2p.AuthorizedPeers, error) {
+	if v.Config.AuthorizedPeersFile == "" && len(v.Config.AuthorizedPeers) == 0 {
+		return nil, nil
+	}
+	peers := &p2p.AuthorizedPeers{}
+	if v.Config.AuthorizedPeersFile != "" {
+		loaded, err := p2p.LoadAuthorizedPeers(v.Config.AuthorizedPeersFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("load authorized peers: %w", err)
+		}
+		if loaded != nil {
+			peers = loaded
+		}
+	}
+	// peers from the flags are not saved to the file
+	peers.FilePath = ""
+	for _, s := range v.Config.AuthorizedPeers {
+		peerID, ip, err := p2p.ParseAuthorizedPeer(s)
+		if err != nil {
+			return nil, err
+		}
+		peers.Set(peerID, ip)
+	}
+	peers.FilePath = v.Config.AuthorizedPeersFile
+	return peers, nil
+}
+
 func (v *P2PVPN) onPeerUp(pi disco.PeerID, m url.Values) {
+	if !v.waitNIC() {
+		return
+	}
 	v.nic.AddPeer(nic.Peer{Addr: pi, IPv4: m.Get("alias1"), IPv6: m.Get("alias2"), Meta: m})
+	v.routes.Sync(pi, m)
 }
 
 func (v *P2PVPN) onPeerLeave(pi disco.PeerID) {
+	if !v.waitNIC() {
+		return
+	}
 	v.nic.LabelPeer(pi, "node.off")
+	v.routes.Remove(pi)
+}
+
+// waitNIC waits until the nic is created, false is returned if the vpn exits before that
+func (v *P2PVPN) waitNIC() bool {
+	<-v.nicReady
+	return v.nic.NIC != nil
+}
+
+// advertisedRoutes returns the routes advertised by this node, exit node routes included
+func (v *P2PVPN) advertisedRoutes() []string {
+	routes := slices.Clone(v.Config.AdvertiseRoutes)
+	if v.Config.AdvertiseExitNode {
+		if v.Config.NICConfig.IPv4 != "" || v.leaseRequired() {
+			routes = append(routes, "0.0.0.0/0")
+		}
+		if v.Config.NICConfig.IPv6 != "" || v.leaseRequired() {
+			routes = append(routes, "::/0")
+		}
+	}
+	return routes
+}
+
+// enableSNAT masquerades the traffic from the pg network which is forwarded by this node
+func (v *P2PVPN) enableSNAT(rootlessMode bool) error {
+	if len(v.advertisedRoutes()) == 0 {
+		return nil
+	}
+	if rootlessMode {
+		slog.Warn("[Route] Advertised routes are not forwarded in rootless mode")
+		return nil
+	}
+	for _, subnet := range v.subnets() {
+		for _, dst := range v.forwardedDsts(subnet) {
+			if err := netlink.EnableSNAT(v.Config.NICConfig.Name, subnet, dst); err != nil {
+				if errors.Is(err, errors.ErrUnsupported) {
+					slog.Warn("[Route] SNAT is only supported on linux, forwarding must be set up manually")
+					return nil
+				}
+				return fmt.Errorf("enable snat: %w", err)
+			}
+			if dst == nil {
+				slog.Info("[Route] SNAT enabled", "src", subnet, "dst", "any")
+				continue
+			}
+			slog.Info("[Route] SNAT enabled", "src", subnet, "dst", dst)
+		}
+	}
+	return nil
+}
+
+func (v *P2PVPN) disableSNAT() {
+	if len(v.advertisedRoutes()) == 0 {
+		return
+	}
+	for _, subnet := range v.subnets() {
+		for _, dst := range v.forwardedDsts(subnet) {
+			if err := netlink.DisableSNAT(v.Config.NICConfig.Name, subnet, dst); err != nil {
+				slog.Debug("[Route] Disable SNAT", "src", subnet, "dst", dst, "err", err)
+			}
+		}
+	}
+}
+
+// forwardedDsts returns the advertised routes of the subnet family, which are forwarded for the subnet.
+// The exit node forwards all destinations, it is the nil one
+func (v *P2PVPN) forwardedDsts(subnet *net.IPNet) (dsts []*net.IPNet) {
+	if v.Config.AdvertiseExitNode {
+		return []*net.IPNet{nil}
+	}
+	for _, route := range v.Config.AdvertiseRoutes {
+		_, dst, err := net.ParseCIDR(route)
+		if err != nil || (dst.IP.To4() == nil) != (subnet.IP.To4() == nil) {
+			continue
+		}
+		dsts = append(dsts, dst)
+	}
+	return
+}
+
+func (v *P2PVPN) subnets() (subnets []*net.IPNet) {
+	for _, cidr := range []string{v.Config.NICConfig.IPv4, v.Config.NICConfig.IPv6} {
+		if _, subnet, err := net.ParseCIDR(cidr); err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return
+}
+
+func (v *P2PVPN) onNetworkMeta(meta url.Values) {
+	if err := v.acl.Update(meta["acl"]); err != nil {
+		slog.Error("[ACL] Invalid rules, keep the current rules", "err", err)
+	}
 }
 
 func (v *P2PVPN) loginIfNecessary(ctx context.Context) (disco.SecretStore, error) {
@@ -395,7 +744,16 @@ func (v *P2PVPN) loginIfNecessary(ctx context.Context) (disco.SecretStore, error
 }
 
 func (v *P2PVPN) requestNetworkSecret(ctx context.Context) (disco.NetworkSecret, error) {
-	join, err := network.JoinOIDC("", v.Config.Server)
+	servers, err := disco.NewServer(v.Config.Server, &disco.NetworkSecret{})
+	if err != nil {
+		return disco.NetworkSecret{}, err
+	}
+	server, err := servers.Reachable(ctx)
+	if err != nil {
+		slog.Error("JoinNetwork failed", "err", err)
+		return disco.NetworkSecret{}, err
+	}
+	join, err := network.JoinOIDC("", server)
 	if err != nil {
 		slog.Error("JoinNetwork failed", "err", err)
 		return disco.NetworkSecret{}, err
@@ -22,22 +22,26 @@ var (
 	Version = "dev"
 )
 
-type stuns []string
+type stringSlice []string
 
-func (s *stuns) String() string {
+func (s *stringSlice) String() string {
 	return strings.Join(*s, ",")
 }
 
-func (s *stuns) Set(stun string) error {
-	*s = append(*s, stun)
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
 	return nil
 }
 
 func main() {
 	var (
-		configPath string
-		logLevel   int
-		stuns      stuns
+		configPath   string
+		logLevel     int
+		stuns        stringSlice
+		clusterNodes stringSlice
+		nodeName     string
+		ipamIPv4     string
+		ipamIPv6     string
 	)
 	flag.StringVar(&configPath, "config", "config.yml", "")
 	flag.StringVar(&configPath, "c", "config.yml", "config file")
@@ -49,6 +53,14 @@ func main() {
 	flag.StringVar(&commandConfig.Listen, "l", "127.0.0.1:9987", "listen http address")
 	flag.StringVar(&commandConfig.SecretKey, "secret-key", "", "key to generate network secret (defaut generate a random one)")
 	flag.StringVar(&commandConfig.PublicNetwork, "pubnet", "", "public network (leave blank to disable public network)")
+	flag.StringVar(&commandConfig.StateFile, "state", "", "file to persist networks state (leave blank to keep state in memory only)")
+	flag.StringVar(&commandConfig.RevocationFile, "revocation-file", "", "file to persist revoked networks, secrets and peers (leave blank to keep them in memory only)")
+	flag.Var(&clusterNodes, "cluster-node", "other pgmap node url of the cluster (e.g. ws://10.0.0.2:9987/pg)")
+	flag.StringVar(&nodeName, "node-name", "", "unique node name in the cluster (default generate a random one)")
+	flag.StringVar(&ipamIPv4, "ipam-ipv4", "", "ipv4 pool to lease addresses to vpn peers (e.g. 100.64.0.0/16)")
+	flag.StringVar(&commandConfig.MetricsToken, "metrics-token", "", "bearer token to scrape /metrics (leave blank to accept the admin and exporter tokens only)")
+	flag.BoolVar(&commandConfig.RejectLegacyTokens, "reject-legacy-tokens", false, "reject the legacy aes-cbc network secrets and exporter tokens")
+	flag.StringVar(&ipamIPv6, "ipam-ipv6", "", "ipv6 pool to lease addresses to vpn peers (e.g. fd00:100:64::/64)")
 	flag.BoolFunc("version", "", printVersion)
 	flag.BoolFunc("v", "print version", printVersion)
 
@@ -56,6 +68,13 @@ func main() {
 	flag.Parse()
 
 	commandConfig.STUNs = stuns
+	if len(clusterNodes) > 0 || nodeName != "" {
+		commandConfig.Cluster = &config.ClusterConfig{NodeName: nodeName, Nodes: clusterNodes}
+	}
+
+	if ipamIPv4 != "" || ipamIPv6 != "" {
+		commandConfig.IPAM = &config.IPAMConfig{IPv4: ipamIPv4, IPv6: ipamIPv6}
+	}
 
 	slog.SetLogLoggerLevel(slog.Level(logLevel))
 	if err := run(commandConfig, configPath); err != nil {
@@ -90,10 +109,18 @@ func usage() {
 	fmt.Printf("Run a peermap server daemon\n\n")
 	fmt.Printf("Usage of %s:\n", os.Args[0])
 	fmt.Printf("  -c, --config string\n\t%s (default is \"%s\")\n", flag.Lookup("c").Usage, flag.Lookup("c").DefValue)
+	fmt.Printf("  --cluster-node []string\n\t%s\n", flag.Lookup("cluster-node").Usage)
+	fmt.Printf("  --ipam-ipv4 string\n\t%s\n", flag.Lookup("ipam-ipv4").Usage)
+	fmt.Printf("  --ipam-ipv6 string\n\t%s\n", flag.Lookup("ipam-ipv6").Usage)
 	fmt.Printf("  -l, --listen string\n\t%s (default is \"%s\")\n", flag.Lookup("l").Usage, flag.Lookup("l").DefValue)
 	fmt.Printf("  --loglevel int\n\t%s\n", flag.Lookup("loglevel").Usage)
+	fmt.Printf("  --metrics-token string\n\t%s\n", flag.Lookup("metrics-token").Usage)
+	fmt.Printf("  --node-name string\n\t%s\n", flag.Lookup("node-name").Usage)
 	fmt.Printf("  --pubnet string\n\t%s\n", flag.Lookup("pubnet").Usage)
+	fmt.Printf("  --reject-legacy-tokens\n\t%s\n", flag.Lookup("reject-legacy-tokens").Usage)
+	fmt.Printf("  --revocation-file string\n\t%s\n", flag.Lookup("revocation-file").Usage)
 	fmt.Printf("  --secret-key string\n\t%s\n", flag.Lookup("secret-key").Usage)
+	fmt.Printf("  --state string\n\t%s\n", flag.Lookup("state").Usage)
 	fmt.Printf("  --stun []string\n\t%s\n", flag.Lookup("stun").Usage)
 	fmt.Printf("  -v, --version\n\t%s\n", flag.Lookup("v").Usage)
 }
@@ -2,6 +2,7 @@ package connmux
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -16,12 +17,72 @@ import (
 )
 
 const (
-	CMD_DATA = 0
-	CMD_FIN  = 1
+	CMD_DATA          = 0
+	CMD_FIN           = 1
+	CMD_WINDOW_UPDATE = 2 // DATA is the 4 bytes window increment
+	CMD_PING          = 3 // SEQ 0 is the ping, 1 is the ack. DATA is the 8 bytes opaque ping id
+	CMD_GOAWAY        = 4 // no more streams will be accepted, the opened streams continue
+
+	// HELLO_SEQ is the FIN of the seq 0 (never used by the streams), the legacy peers ignore it.
+	// DATA is the 1 byte features and 1 byte ack flag, ack is the reply to the peer's HELLO
+	HELLO_SEQ = 0
+
+	// FEATURE_FLOW_CONTROL enables WINDOW_UPDATE and the stream windows
+	FEATURE_FLOW_CONTROL = 1 << 0
+	// FEATURE_PING enables PING and GOAWAY
+	FEATURE_PING = 1 << 1
+
+	features = FEATURE_FLOW_CONTROL | FEATURE_PING
 
 	HEADER_LEN = 8
+
+	// MAX_FRAME_DATA is limited by the 2 bytes LEN
+	MAX_FRAME_DATA = 65535
+	// INITIAL_STREAM_WINDOW is the bytes a stream can send before a WINDOW_UPDATE
+	INITIAL_STREAM_WINDOW = 256 * 1024
+)
+
+var (
+	ErrGoAway         = errors.New("connmux: session is going away")
+	ErrTooManyStreams = errors.New("connmux: too many streams")
+	ErrWindowExceeded = errors.New("connmux: stream window exceeded")
+	ErrUnsupported    = errors.New("connmux: not supported by the peer")
+
+	// errFlowControlStarted retries the DATA reserved before the peer's HELLO
+	errFlowControlStarted = errors.New("connmux: flow control started")
 )
 
+type Config struct {
+	// StreamWindow is the receive window of each stream, not less than INITIAL_STREAM_WINDOW
+	StreamWindow uint32
+	// MaxStreams limits the concurrent streams of the session, 0 means unlimited
+	MaxStreams int
+	// KeepaliveInterval is the interval of PING, 0 disables the keepalive
+	KeepaliveInterval time.Duration
+	// KeepaliveTimeout closes the session if nothing received in time
+	KeepaliveTimeout time.Duration
+}
+
+type Option func(cfg *Config)
+
+func StreamWindow(window uint32) Option {
+	return func(cfg *Config) {
+		cfg.StreamWindow = max(window, INITIAL_STREAM_WINDOW)
+	}
+}
+
+func MaxStreams(n int) Option {
+	return func(cfg *Config) {
+		cfg.MaxStreams = n
+	}
+}
+
+func Keepalive(interval, timeout time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.KeepaliveInterval, cfg.KeepaliveTimeout = interval, timeout
+	}
+}
+
 type SeqGen interface {
 	GenSeq() uint32
 }
@@ -62,80 +123,203 @@ type MuxConn struct {
 	closeOnce sync.Once
 	fin       chan struct{}
 	finWait   chan struct{}
-	inbound   chan []byte
 	seq       uint32
 	s         *MuxSession
 
-	buf []byte
+	mut       sync.Mutex
+	inbound   [][]byte // never blocks the session, it is limited by the window
+	readable  chan struct{}
+	eof       bool
+	window    uint32 // receive window
+	recvAvail int64  // bytes the peer can send
+	consumed  int64  // bytes read but not updated to the peer
+	credit    int64  // bytes can send
+	writable  chan struct{}
+	announce  uint32 // window increment sent after the first DATA of the dialed stream
 
 	deadlineRead N.Deadline
 }
 
+func (s *MuxSession) newConn(seq uint32) *MuxConn {
+	return &MuxConn{
+		fin:       make(chan struct{}),
+		finWait:   make(chan struct{}),
+		seq:       seq,
+		s:         s,
+		readable:  make(chan struct{}, 1),
+		writable:  make(chan struct{}, 1),
+		window:    s.cfg.StreamWindow,
+		recvAvail: int64(s.cfg.StreamWindow),
+		credit:    INITIAL_STREAM_WINDOW,
+	}
+}
+
 func (c *MuxConn) Seq() uint32 {
 	return c.seq
 }
 
 func (c *MuxConn) Read(b []byte) (n int, err error) {
-	if c.buf != nil {
-		n = copy(b, c.buf)
-		if n < len(c.buf) {
-			c.buf = c.buf[n:]
-		} else {
-			c.buf = nil
+	for {
+		c.mut.Lock()
+		if len(c.inbound) > 0 {
+			n = copy(b, c.inbound[0])
+			if n < len(c.inbound[0]) {
+				c.inbound[0] = c.inbound[0][n:]
+			} else {
+				c.inbound = c.inbound[1:]
+			}
+			c.mut.Unlock()
+			c.consume(n)
+			return
 		}
-		return
-	}
-
-	select {
-	case _, ok := <-c.deadlineRead.Deadline():
-		if !ok {
+		eof := c.eof
+		c.mut.Unlock()
+		if eof {
 			return 0, io.EOF
 		}
-		return 0, N.ErrDeadline
-	case wsb, ok := <-c.inbound:
-		if !ok {
-			return 0, io.EOF
+		select {
+		case _, ok := <-c.deadlineRead.Deadline():
+			if !ok {
+				return 0, io.EOF
+			}
+			return 0, N.ErrDeadline
+		case <-c.readable:
 		}
-		n = copy(b, wsb)
-		if n < len(wsb) {
-			c.buf = wsb[n:]
+	}
+}
+
+func (c *MuxConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size, flowControl, err := c.reserve(min(len(p), MAX_FRAME_DATA))
+		if err != nil {
+			return n, err
 		}
-		return
+		if err := c.writeData(p[:size], flowControl); err != nil {
+			if errors.Is(err, errFlowControlStarted) {
+				continue
+			}
+			return n, err
+		}
+		n += size
+		p = p[size:]
 	}
+	return
 }
 
-func (c *MuxConn) Write(p []byte) (int, error) {
-	b := []byte{0, 0}
-	b = append(b, binary.BigEndian.AppendUint16(nil, uint16(len(p)))...)
-	b = append(b, binary.BigEndian.AppendUint32(nil, c.seq)...)
-	b = append(b, p...)
+// writeData writes the DATA reserved by reserve. The DATA reserved without the flow control is
+// retried if the peer's HELLO arrived meanwhile, the peer limits the stream after the HELLO ack
+func (c *MuxConn) writeData(p []byte, flowControl bool) error {
+	b := buildFrame(CMD_DATA, c.seq, p)
 	c.s.w.Lock()
-	defer c.s.w.Unlock()
 	select {
 	case <-c.fin:
-		return 0, io.ErrClosedPipe
+		c.s.w.Unlock()
+		return io.ErrClosedPipe
 	default:
 	}
-	n, err := c.s.c.Write(b)
+	if !flowControl {
+		if c.s.peerSupports(FEATURE_FLOW_CONTROL) {
+			c.s.w.Unlock()
+			return errFlowControlStarted
+		}
+		c.mut.Lock()
+		c.credit -= int64(len(p)) // keeps the credit in step with the peer's window
+		c.mut.Unlock()
+	}
+	_, err := c.s.c.Write(b)
+	c.s.w.Unlock()
 	if err != nil {
-		return max(0, n-HEADER_LEN), err
+		return err
 	}
-	return max(0, n-HEADER_LEN), nil
+	if c.announce > 0 && c.s.peerSupports(FEATURE_FLOW_CONTROL) { // the peer knows the stream now
+		increment := c.announce
+		c.announce = 0
+		return c.s.writeFrame(CMD_WINDOW_UPDATE, c.seq, binary.BigEndian.AppendUint32(nil, increment))
+	}
+	return nil
+}
+
+// reserve waits for the send window, returns the bytes can be sent. The window is not
+// waited for unless the peer supports the flow control, the legacy peers never update it
+func (c *MuxConn) reserve(size int) (int, bool, error) {
+	for {
+		if !c.s.peerSupports(FEATURE_FLOW_CONTROL) {
+			return size, false, nil
+		}
+		c.mut.Lock()
+		if c.credit > 0 {
+			size = int(min(int64(size), c.credit))
+			c.credit -= int64(size)
+			c.mut.Unlock()
+			return size, true, nil
+		}
+		c.mut.Unlock()
+		select {
+		case <-c.fin:
+			return 0, false, io.ErrClosedPipe
+		case <-c.s.exit:
+			return 0, false, io.ErrClosedPipe
+		case <-c.writable:
+		}
+	}
+}
+
+// push queues the DATA from the peer, the peer must not send more than the window
+// once it acknowledged our HELLO
+func (c *MuxConn) push(data []byte) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if int64(len(data)) > c.recvAvail && c.s.peerAcked.Load() && c.s.peerSupports(FEATURE_FLOW_CONTROL) {
+		return fmt.Errorf("%w: seq %d", ErrWindowExceeded, c.seq)
+	}
+	c.recvAvail -= int64(len(data))
+	if c.eof {
+		return nil
+	}
+	c.inbound = append(c.inbound, data)
+	notify(c.readable)
+	return nil
+}
+
+// consume sends WINDOW_UPDATE after the half window is read
+func (c *MuxConn) consume(n int) {
+	c.mut.Lock()
+	c.consumed += int64(n)
+	if c.consumed < int64(c.window/2) || !c.s.peerSupports(FEATURE_FLOW_CONTROL) {
+		c.mut.Unlock()
+		return
+	}
+	increment := c.consumed
+	c.consumed = 0
+	c.recvAvail += increment
+	c.mut.Unlock()
+	if err := c.s.writeFrame(CMD_WINDOW_UPDATE, c.seq, binary.BigEndian.AppendUint32(nil, uint32(increment))); err != nil {
+		slog.Debug("MuxConnWindowUpdate", "seq", c.seq, "err", err)
+	}
+}
+
+func (c *MuxConn) updateWindow(increment uint32) {
+	c.mut.Lock()
+	c.credit += int64(increment)
+	c.mut.Unlock()
+	notify(c.writable)
+}
+
+// closeRead makes Read return EOF after the queued data
+func (c *MuxConn) closeRead() {
+	c.mut.Lock()
+	c.eof = true
+	c.mut.Unlock()
+	notify(c.readable)
 }
 
 func (c *MuxConn) Close() error {
 	closeConn := func() {
 		close(c.fin) // disable write
 
-		b := []byte{0, 1}
-		b = append(b, binary.BigEndian.AppendUint16(nil, uint16(0))...)
-		b = append(b, binary.BigEndian.AppendUint32(nil, c.seq)...)
-
-		c.s.w.Lock()
-		if _, err := c.s.c.Write(b); err != nil { // send FIN
+		if err := c.s.writeFrame(CMD_FIN, c.seq, nil); err != nil { // send FIN
 			slog.Warn("MuxConnFIN", "err", err)
 		}
-		c.s.w.Unlock()
 		slog.Debug("MuxConnClosed", "seq", c.seq, "state", "CLOSE_WAIT")
 
 		go func() { // FIN WAIT
@@ -151,13 +335,16 @@ func (c *MuxConn) Close() error {
 			c.s.r.Unlock()
 
 			for range 20 { // wait read done
-				if len(c.inbound) == 0 {
+				c.mut.Lock()
+				pending := len(c.inbound)
+				c.mut.Unlock()
+				if pending == 0 {
 					break
 				}
 				time.Sleep(10 * time.Millisecond) // avoid busy wait
 			}
 
-			close(c.inbound) // disable read
+			c.closeRead() // disable read
 			c.deadlineRead.Close()
 			slog.Debug("MuxConnClosed", "seq", c.seq, "state", "CLOSED")
 		}()
@@ -207,6 +394,7 @@ func (c *MuxConn) SetWriteDeadline(t time.Time) error {
 
 type MuxSession struct {
 	r, w      sync.RWMutex
+	cfg       Config
 	closeOnce sync.Once
 	closed    atomic.Bool
 	exit      chan struct{}
@@ -215,6 +403,17 @@ type MuxSession struct {
 	c         io.ReadWriteCloser
 	accepts   map[uint32]*MuxConn
 	dials     map[uint32]*MuxConn
+
+	lastRecv     atomic.Int64
+	goAway       atomic.Bool // sent GOAWAY
+	remoteGoAway atomic.Bool // received GOAWAY
+	pingMut      sync.Mutex
+	pings        map[uint64]chan struct{}
+
+	hello        chan struct{} // closed on the peer's HELLO
+	helloOnce    sync.Once
+	peerFeatures atomic.Uint32 // 0 until the HELLO, the legacy peers never send it
+	peerAcked    atomic.Bool   // the peer acknowledged our HELLO
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -237,10 +436,66 @@ func (l *MuxSession) Close() error {
 		close(l.exit)
 		close(l.accept)
 		l.closed.Store(true)
+		l.r.RLock()
+		for _, c := range l.accepts {
+			c.closeRead()
+		}
+		for _, c := range l.dials {
+			c.closeRead()
+		}
+		l.r.RUnlock()
 	})
 	return l.c.Close()
 }
 
+// GoAway tells the peer that no more streams will be accepted, the opened streams are not affected.
+// The streams opened by the legacy peer are refused silently
+func (l *MuxSession) GoAway() error {
+	l.goAway.Store(true)
+	if !l.peerSupports(FEATURE_PING) {
+		return nil
+	}
+	return l.writeFrame(CMD_GOAWAY, 0, nil)
+}
+
+// Ping sends a PING and waits for the ack, returns the round trip time.
+// It waits for the peer's HELLO first, ErrUnsupported if the peer does not support PING
+func (l *MuxSession) Ping(ctx context.Context) (time.Duration, error) {
+	select {
+	case <-l.hello:
+	case <-l.exit:
+		return 0, io.ErrClosedPipe
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if !l.peerSupports(FEATURE_PING) {
+		return 0, ErrUnsupported
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	ack := make(chan struct{})
+	l.pingMut.Lock()
+	l.pings[binary.BigEndian.Uint64(id)] = ack
+	l.pingMut.Unlock()
+	defer func() {
+		l.pingMut.Lock()
+		delete(l.pings, binary.BigEndian.Uint64(id))
+		l.pingMut.Unlock()
+	}()
+	start := time.Now()
+	if err := l.writeFrame(CMD_PING, 0, id); err != nil {
+		return 0, err
+	}
+	select {
+	case <-ack:
+		return time.Since(start), nil
+	case <-l.exit:
+		return 0, io.ErrClosedPipe
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
 func (l *MuxSession) Closed() bool {
 	return l.closed.Load()
 }
@@ -253,6 +508,68 @@ func (l *MuxSession) Addr() net.Addr {
 	return nil
 }
 
+func (l *MuxSession) writeFrame(cmd byte, seq uint32, data []byte) error {
+	l.w.Lock()
+	defer l.w.Unlock()
+	_, err := l.c.Write(buildFrame(cmd, seq, data))
+	return err
+}
+
+func (l *MuxSession) peerSupports(feature uint32) bool {
+	return l.peerFeatures.Load()&feature != 0
+}
+
+// recvHello enables the features of the peer and acknowledges the HELLO. The DATA written after
+// the ack sees the features, so that it is limited by the stream window
+func (l *MuxSession) recvHello(data []byte) {
+	if len(data) != 2 {
+		return
+	}
+	if data[1] == 1 { // ack
+		l.peerAcked.Store(true)
+		return
+	}
+	slog.Debug("MuxSessionHello", "features", data[0])
+	l.peerFeatures.Store(uint32(data[0]))
+	l.helloOnce.Do(func() { close(l.hello) })
+	go l.writeControl(CMD_FIN, HELLO_SEQ, []byte{features, 1})
+}
+
+// writeControl writes the frame replied by nextFrame, it must not block reading the frames
+func (l *MuxSession) writeControl(cmd byte, seq uint32, data []byte) {
+	if err := l.writeFrame(cmd, seq, data); err != nil {
+		slog.Debug("MuxSessionWriteControl", "cmd", cmd, "seq", seq, "err", err)
+	}
+}
+
+// keepalive pings the peer and closes the session if nothing received in time
+func (l *MuxSession) keepalive() {
+	ticker := time.NewTicker(l.cfg.KeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.exit:
+			return
+		case <-ticker.C:
+		}
+		if !l.peerSupports(FEATURE_PING) { // the idle legacy peer is alive
+			continue
+		}
+		if idle := time.Since(time.Unix(0, l.lastRecv.Load())); idle > l.cfg.KeepaliveTimeout {
+			slog.Warn("MuxSessionKeepaliveTimeout", "idle", idle)
+			l.Close()
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), l.cfg.KeepaliveTimeout)
+			defer cancel()
+			if _, err := l.Ping(ctx); err != nil {
+				slog.Debug("MuxSessionPing", "err", err)
+			}
+		}()
+	}
+}
+
 func (l *MuxSession) run() {
 	defer l.Close()
 	for {
@@ -286,6 +603,7 @@ func (l *MuxSession) nextFrame() error {
 		return fmt.Errorf("unsupport connmux version %d", header[0])
 	}
 
+	l.lastRecv.Store(time.Now().UnixNano())
 	length := binary.BigEndian.Uint16(header[2:4])
 	seq := binary.BigEndian.Uint32(header[4:8])
 	cmd := header[1]
@@ -307,61 +625,142 @@ func (l *MuxSession) nextFrame() error {
 	}
 	l.r.RUnlock()
 
-	if cmd == CMD_DATA {
+	switch cmd {
+	case CMD_DATA:
 		if conn == nil {
-			conn = &MuxConn{
-				fin:     make(chan struct{}),
-				finWait: make(chan struct{}),
-				inbound: make(chan []byte, 128),
-				seq:     seq,
-				s:       l,
+			if conn = l.acceptStream(seq); conn == nil {
+				return nil
 			}
-			l.r.Lock()
-			l.accepts[seq] = conn
-			l.r.Unlock()
-			l.accept <- conn
 		}
-		conn.inbound <- data
-		return nil
-	}
-
-	if cmd == CMD_FIN {
+		return conn.push(data)
+	case CMD_FIN:
+		if seq == HELLO_SEQ {
+			l.recvHello(data)
+			return nil
+		}
 		if conn == nil {
 			return nil
 		}
-		close(conn.finWait)
-		conn.Close()
+		select {
+		case <-conn.finWait: // duplicated FIN
+		default:
+			close(conn.finWait)
+		}
+		go conn.Close()
+		return nil
+	case CMD_WINDOW_UPDATE:
+		if conn == nil || len(data) != 4 {
+			return nil
+		}
+		conn.updateWindow(binary.BigEndian.Uint32(data))
+		return nil
+	case CMD_PING:
+		if seq == 0 {
+			go l.writeControl(CMD_PING, 1, data)
+			return nil
+		}
+		if len(data) == 8 {
+			l.pingMut.Lock()
+			if ack, ok := l.pings[binary.BigEndian.Uint64(data)]; ok {
+				close(ack)
+				delete(l.pings, binary.BigEndian.Uint64(data))
+			}
+			l.pingMut.Unlock()
+		}
+		return nil
+	case CMD_GOAWAY:
+		slog.Debug("MuxSessionGoAway")
+		l.remoteGoAway.Store(true)
 		return nil
 	}
 	return fmt.Errorf("unsupport connmux cmd %d", cmd)
 }
 
+// acceptStream creates the stream opened by the peer, it is refused with FIN
+// after GOAWAY or the max streams exceeded
+func (l *MuxSession) acceptStream(seq uint32) *MuxConn {
+	l.r.Lock()
+	if l.goAway.Load() || l.cfg.MaxStreams > 0 && len(l.accepts)+len(l.dials) >= l.cfg.MaxStreams {
+		l.r.Unlock()
+		slog.Debug("MuxSessionRefuseStream", "seq", seq)
+		go l.writeControl(CMD_FIN, seq, nil)
+		return nil
+	}
+	conn := l.newConn(seq)
+	l.accepts[seq] = conn
+	l.r.Unlock()
+	if increment := conn.window - INITIAL_STREAM_WINDOW; increment > 0 && l.peerSupports(FEATURE_FLOW_CONTROL) {
+		go l.writeControl(CMD_WINDOW_UPDATE, seq, binary.BigEndian.AppendUint32(nil, increment))
+	}
+	l.accept <- conn
+	return conn
+}
+
 func (d *MuxSession) OpenStream() (net.Conn, error) {
 	if d.seqGen == nil {
 		return nil, errors.New("seq generator must not nil")
 	}
-	c := &MuxConn{
-		fin:     make(chan struct{}),
-		finWait: make(chan struct{}),
-		inbound: make(chan []byte, 128),
-		seq:     d.seqGen.GenSeq(),
-		s:       d,
+	if d.remoteGoAway.Load() {
+		return nil, ErrGoAway
 	}
 	d.r.Lock()
+	defer d.r.Unlock()
+	if d.cfg.MaxStreams > 0 && len(d.accepts)+len(d.dials) >= d.cfg.MaxStreams {
+		return nil, ErrTooManyStreams
+	}
+	c := d.newConn(d.seqGen.GenSeq())
+	c.announce = c.window - INITIAL_STREAM_WINDOW
 	d.dials[c.seq] = c
-	d.r.Unlock()
 	return c, nil
 }
 
-func Mux(conn io.ReadWriteCloser, seqGen SeqGen) *MuxSession {
+func Mux(conn io.ReadWriteCloser, seqGen SeqGen, opts ...Option) *MuxSession {
+	cfg := Config{
+		StreamWindow:      INITIAL_STREAM_WINDOW,
+		KeepaliveInterval: 30 * time.Second,
+		KeepaliveTimeout:  90 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	l := &MuxSession{
+		cfg:     cfg,
 		exit:    make(chan struct{}),
 		c:       conn,
 		seqGen:  seqGen,
 		accept:  make(chan net.Conn),
 		accepts: make(map[uint32]*MuxConn),
 		dials:   make(map[uint32]*MuxConn),
+		pings:   make(map[uint64]chan struct{}),
+		hello:   make(chan struct{}),
 	}
+	l.lastRecv.Store(time.Now().UnixNano())
+	// the HELLO is the first frame, it is written without blocking Mux (e.g. on the io.Pipe)
+	l.w.Lock()
+	go func() {
+		defer l.w.Unlock()
+		if _, err := conn.Write(buildFrame(CMD_FIN, HELLO_SEQ, []byte{features, 0})); err != nil {
+			slog.Debug("MuxSessionHello", "err", err)
+		}
+	}()
 	go l.run()
+	if cfg.KeepaliveInterval > 0 {
+		go l.keepalive()
+	}
 	return l
 }
+
+// buildFrame | VER | CMD | LEN | SEQ | DATA |
+func buildFrame(cmd byte, seq uint32, data []byte) []byte {
+	b := []byte{0, cmd}
+	b = append(b, binary.BigEndian.AppendUint16(nil, uint16(len(data)))...)
+	b = append(b, binary.BigEndian.AppendUint32(nil, seq)...)
+	return append(b, data...)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -2,7 +2,10 @@ package connmux_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +13,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/sigcn/pg/connmux"
 )
@@ -99,3 +103,154 @@ func TestMuxConnOpenAndAccept(t *testing.T) {
 		t.Fatalf("send and recv failed: %d", len(dataMap))
 	}
 }
+
+func TestPingAndGoAway(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s1 := connmux.Mux(c1, connmux.SeqEven)
+	s2 := connmux.Mux(c2, connmux.SeqOdd)
+	defer s1.Close()
+	defer s2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s1.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.GoAway(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.Ping(ctx); err != nil { // GOAWAY is received before the PING ack
+		t.Fatal(err)
+	}
+	if _, err := s2.OpenStream(); !errors.Is(err, connmux.ErrGoAway) {
+		t.Errorf("OpenStream after GOAWAY: %v", err)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s1 := connmux.Mux(c1, connmux.SeqEven)
+	s2 := connmux.Mux(c2, connmux.SeqOdd)
+	defer s1.Close()
+	defer s2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s1.Ping(ctx); err != nil { // the features are negotiated
+		t.Fatal(err)
+	}
+
+	c, _ := s1.OpenStream()
+	data := make([]byte, 4*connmux.INITIAL_STREAM_WINDOW)
+	rand.Read(data)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write(data)
+		done <- err
+	}()
+	accepted, err := s2.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("write is not limited by the window: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// the slow stream does not block the others
+	c1s, _ := s1.OpenStream()
+	c1s.Write([]byte("hello"))
+	other, _ := s2.Accept()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(other, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read the other stream %q, %v", buf, err)
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(accepted, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read the limited stream: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// legacyFrame is the frame of the peers without the flow control and PING
+func legacyFrame(cmd byte, seq uint32, data []byte) []byte {
+	b := []byte{0, cmd}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	b = binary.BigEndian.AppendUint32(b, seq)
+	return append(b, data...)
+}
+
+func TestLegacyPeer(t *testing.T) {
+	c, legacy := net.Pipe()
+	s := connmux.Mux(c, connmux.SeqEven, connmux.Keepalive(20*time.Millisecond, 50*time.Millisecond))
+	defer s.Close()
+
+	// the legacy peer reads DATA and FIN only, it never sends WINDOW_UPDATE
+	received := make(chan []byte, 1)
+	go func() {
+		var data []byte
+		header := make([]byte, connmux.HEADER_LEN)
+		for {
+			if _, err := io.ReadFull(legacy, header); err != nil {
+				return
+			}
+			b := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+			if _, err := io.ReadFull(legacy, b); err != nil {
+				return
+			}
+			seq := binary.BigEndian.Uint32(header[4:8])
+			switch {
+			case header[1] == connmux.CMD_DATA:
+				if data = append(data, b...); len(data) == 2*connmux.INITIAL_STREAM_WINDOW {
+					received <- data
+				}
+			case header[1] == connmux.CMD_FIN && seq == connmux.HELLO_SEQ: // ignored by the legacy peer
+			default:
+				t.Errorf("frame %v sent to the legacy peer", header)
+			}
+		}
+	}()
+
+	// the legacy peer sends more than the window
+	data := make([]byte, 2*connmux.INITIAL_STREAM_WINDOW)
+	rand.Read(data)
+	go func() {
+		for i := 0; i < len(data); i += connmux.MAX_FRAME_DATA {
+			legacy.Write(legacyFrame(connmux.CMD_DATA, 1, data[i:min(i+connmux.MAX_FRAME_DATA, len(data))]))
+		}
+	}()
+	accepted, err := s.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(accepted, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read from the legacy peer: %v", err)
+	}
+
+	// no stall at the initial window
+	if _, err := accepted.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-received:
+		if !bytes.Equal(b, data) {
+			t.Fatal("data corrupted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to the legacy peer stalled")
+	}
+
+	// the idle legacy peer is not pinged nor closed
+	time.Sleep(200 * time.Millisecond)
+	if s.Closed() {
+		t.Fatal("session closed by the keepalive")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ping the legacy peer: %v", err)
+	}
+}
@@ -33,6 +33,8 @@ func (code ControlCode) String() string {
 		return "CONTROL_CONN"
 	case CONTROL_SERVER_CONNECTED:
 		return "SERVER_CONNECTED"
+	case CONTROL_IP_LEASE_CHANGED:
+		return "IP_LEASE_CHANGED"
 	default:
 		return "UNDEFINED"
 	}
@@ -53,6 +55,7 @@ const (
 	CONTROL_PEER_LEAVE            ControlCode = 25
 	CONTROL_CONN                  ControlCode = 30
 	CONTROL_SERVER_CONNECTED      ControlCode = 50
+	CONTROL_IP_LEASE_CHANGED      ControlCode = 51
 )
 
 type NATType string
@@ -159,14 +162,21 @@ func (d *Disco) magic() []byte {
 type Datagram struct {
 	PeerID PeerID
 	Data   []byte
+	// Relayed is true when the datagram is received from a relay peer
+	Relayed bool
 }
 
-// TryDecrypt the datagram from peer
-func (d *Datagram) TryDecrypt(symmAlgo secure.SymmAlgo) []byte {
+// Decrypt the datagram from peer
+func (d *Datagram) Decrypt(symmAlgo secure.SymmAlgo) ([]byte, error) {
 	if symmAlgo == nil {
-		return d.Data
+		return d.Data, nil
 	}
-	b, err := symmAlgo.Decrypt(d.Data, d.PeerID.String())
+	return symmAlgo.Decrypt(d.Data, d.PeerID.String())
+}
+
+// TryDecrypt the datagram from peer
+func (d *Datagram) TryDecrypt(symmAlgo secure.SymmAlgo) []byte {
+	b, err := d.Decrypt(symmAlgo)
 	if err != nil {
 		slog.Debug("Datagram decrypt error", "err", err)
 		return d.Data
@@ -1,38 +1,148 @@
 package disco
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand/v2"
+	"net"
 	"net/url"
 	"os"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type Server struct {
 	Secret SecretStore
 	URL    string
+	// URLs is the ordered server list for failover, the first one is the same as URL
+	URLs []string
+	// Weights of URLs, nil if the list is ordered only. See Primary
+	Weights []int
 }
 
+// Servers returns all servers in failover order
+func (s *Server) Servers() []string {
+	if len(s.URLs) > 0 {
+		return s.URLs
+	}
+	return []string{s.URL}
+}
+
+// Primary returns the index of the server to connect first and fail back to.
+// It is the first server of an ordered list, or picked at random in proportion
+// to the weights, so the peers are spread across the servers
+func (s *Server) Primary() int {
+	total := 0
+	for _, w := range s.Weights {
+		total += w
+	}
+	if total == 0 || len(s.Weights) != len(s.Servers()) {
+		return 0
+	}
+	n := rand.IntN(total)
+	for i, w := range s.Weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return 0
+}
+
+// Reachable returns the first server accepts tcp connections, starting from the primary one
+func (s *Server) Reachable(ctx context.Context) (string, error) {
+	servers := s.Servers()
+	primary := s.Primary()
+	var errs []error
+	for i := range servers {
+		server := servers[(primary+i)%len(servers)]
+		probeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := Probe(probeCtx, server)
+		cancel()
+		if err == nil {
+			return server, nil
+		}
+		errs = append(errs, fmt.Errorf("probe server %s: %w", server, err))
+	}
+	return "", errors.Join(errs...)
+}
+
+// NewServer create a server, serverURL can be a comma separated list for failover.
+// A url with the `#weight=N` suffix makes the list weighted, the servers without it weigh 1
 func NewServer(serverURL string, store SecretStore) (*Server, error) {
+	return NewServers(strings.Split(serverURL, ","), store)
+}
+
+// NewServers create a server with an ordered or weighted list of urls,
+// connections fail over to the next one when current server is unreachable
+func NewServers(serverURLs []string, store SecretStore) (*Server, error) {
 	if store == nil {
 		return nil, errors.New("secret store is required")
 	}
 
-	server, err := url.Parse(serverURL)
-	if err != nil {
-		return nil, err
+	var urls []string
+	var weights []int
+	weighted := false
+	for _, serverURL := range serverURLs {
+		serverURL = strings.TrimSpace(serverURL)
+		if serverURL == "" {
+			continue
+		}
+		server, err := url.Parse(serverURL)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains([]string{"https", "wss", "http", "ws"}, server.Scheme) {
+			return nil, fmt.Errorf("unsupport server protocol: %s", server.String())
+		}
+		weight := 1
+		if server.Fragment != "" {
+			w, ok := strings.CutPrefix(server.Fragment, "weight=")
+			if weight, err = strconv.Atoi(w); !ok || err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid server weight: %s", serverURL)
+			}
+			server.Fragment = ""
+			weighted = true
+		}
+		urls = append(urls, server.String())
+		weights = append(weights, weight)
 	}
-	if !slices.Contains([]string{"https", "wss", "http", "ws"}, server.Scheme) {
-		return nil, fmt.Errorf("unsupport server protocol: %s", server.String())
+	if len(urls) == 0 {
+		return nil, errors.New("server url is required")
+	}
+	if !weighted {
+		weights = nil
 	}
 	return &Server{
-		Secret: store,
-		URL:    serverURL,
+		Secret:  store,
+		URL:     urls[0],
+		URLs:    urls,
+		Weights: weights,
 	}, nil
 }
 
+// Probe reports whether the server accepts tcp connections, it is cheaper than the websocket handshake
+func Probe(ctx context.Context, serverURL string) error {
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+	port := server.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "ws": "80", "https": "443", "wss": "443"}[server.Scheme]
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(server.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 type SecretStore interface {
 	NetworkSecret() (NetworkSecret, error)
 	UpdateNetworkSecret(NetworkSecret) error
@@ -44,6 +154,12 @@ type NetworkSecret struct {
 	Expire  time.Time `json:"expire"`
 }
 
+// IPLease is the vpn addresses (cidr) leased by the peermap server
+type IPLease struct {
+	IPv4 string
+	IPv6 string
+}
+
 func (s NetworkSecret) Expired() bool {
 	return time.Until(s.Expire) <= 0
 }
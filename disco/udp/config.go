@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/sigcn/pg/disco"
+	N "github.com/sigcn/pg/net"
 )
 
 var defaultDiscoConfig = DiscoConfig{
@@ -44,4 +45,8 @@ type UDPConfig struct {
 	ID                    disco.PeerID
 	PeerKeepaliveInterval time.Duration
 	DiscoMagic            func() []byte
+	AuthorizePeer         func(disco.PeerID) bool // nil if all peers are authorized
+	// ListenUDP listens the udp socket on the port, nil means the system udp socket.
+	// e.g. the sockets of N.VirtualNetwork to test the hole punching behind the NAT
+	ListenUDP func(port int) (N.UDPPacketConn, error)
 }
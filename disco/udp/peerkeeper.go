@@ -11,16 +11,17 @@ import (
 
 	"github.com/sigcn/pg/cache"
 	"github.com/sigcn/pg/disco"
+	N "github.com/sigcn/pg/net"
 )
 
 type peerkeeper struct {
-	udpConn    atomic.Pointer[net.UDPConn]
+	udpConn    atomic.Pointer[N.UDPPacketConn]
 	peerID     disco.PeerID
 	states     map[string]*PeerState // key is udp addr
 	createTime time.Time
 
 	exitSig           chan struct{}
-	ping              func(udpConn *net.UDPConn, peerID disco.PeerID, addr *net.UDPAddr)
+	ping              func(udpConn N.UDPPacketConn, peerID disco.PeerID, addr *net.UDPAddr)
 	keepaliveInterval time.Duration
 
 	statesMutex sync.RWMutex
@@ -43,7 +44,7 @@ func (peer *peerkeeper) heartbeat(addr *net.UDPAddr) {
 	}
 	slog.Info("[UDP] AddPeer", "peer", peer.peerID, "addr", addr)
 	peer.states[addr.String()] = &PeerState{Addr: addr, LastActiveTime: time.Now(), PeerID: peer.peerID}
-	peer.ping(peer.udpConn.Load(), peer.peerID, addr)
+	peer.ping(*peer.udpConn.Load(), peer.peerID, addr)
 }
 
 func (peer *peerkeeper) healthcheck() {
@@ -108,10 +109,10 @@ func (peer *peerkeeper) writeUDP(p []byte) (int, error) {
 	if peerState := peer.selectPeerUDP(); p != nil {
 		slog.Log(context.Background(), -3, "[UDP] WriteTo", "peer", peer.peerID, "addr", peerState.Addr)
 		if time.Since(peerState.LastActiveTime) > peer.keepaliveInterval+time.Second {
-			peer.udpConn.Load().WriteTo(p, peerState.Addr)
+			(*peer.udpConn.Load()).WriteTo(p, peerState.Addr)
 			return 0, ErrUDPConnInactive
 		}
-		return peer.udpConn.Load().WriteTo(p, peerState.Addr)
+		return (*peer.udpConn.Load()).WriteTo(p, peerState.Addr)
 	}
 	return 0, net.ErrClosed
 }
@@ -126,7 +127,7 @@ func (peer *peerkeeper) run() {
 		}
 		peer.statesMutex.RUnlock()
 		for _, addr := range addrs {
-			peer.ping(peer.udpConn.Load(), peer.peerID, addr)
+			peer.ping(*peer.udpConn.Load(), peer.peerID, addr)
 		}
 	}
 	for {
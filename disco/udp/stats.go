@@ -0,0 +1,42 @@
+package udp
+
+import "sync/atomic"
+
+// DiscoStats is the counters of the udp hole punching
+type DiscoStats struct {
+	DiscoAttempts        uint64 `json:"disco_attempts"`
+	EasyChallengePackets uint64 `json:"easy_challenge_packets"`
+	HardChallengePackets uint64 `json:"hard_challenge_packets"`
+	HardChallengeHits    uint64 `json:"hard_challenge_hits"`
+	PortScanPackets      uint64 `json:"port_scan_packets"`
+	PortScanHits         uint64 `json:"port_scan_hits"`
+	RelayedPackets       uint64 `json:"relayed_packets"`
+	UnknownPeerPackets   uint64 `json:"unknown_peer_packets"`
+	UnauthorizedPackets  uint64 `json:"unauthorized_packets"`
+}
+
+type discoStats struct {
+	discoAttempts        atomic.Uint64
+	easyChallengePackets atomic.Uint64
+	hardChallengePackets atomic.Uint64
+	hardChallengeHits    atomic.Uint64
+	portScanPackets      atomic.Uint64
+	portScanHits         atomic.Uint64
+	relayedPackets       atomic.Uint64
+	unknownPeerPackets   atomic.Uint64
+	unauthorizedPackets  atomic.Uint64
+}
+
+func (s *discoStats) load() DiscoStats {
+	return DiscoStats{
+		DiscoAttempts:        s.discoAttempts.Load(),
+		EasyChallengePackets: s.easyChallengePackets.Load(),
+		HardChallengePackets: s.hardChallengePackets.Load(),
+		HardChallengeHits:    s.hardChallengeHits.Load(),
+		PortScanPackets:      s.portScanPackets.Load(),
+		PortScanHits:         s.portScanHits.Load(),
+		RelayedPackets:       s.relayedPackets.Load(),
+		UnknownPeerPackets:   s.unknownPeerPackets.Load(),
+		UnauthorizedPackets:  s.unauthorizedPackets.Load(),
+	}
+}
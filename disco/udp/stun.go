@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	N "github.com/sigcn/pg/net"
 	"github.com/sigcn/pg/stun"
 )
 
@@ -25,7 +26,7 @@ func (rt *stunRoundTripper) init() {
 	})
 }
 
-func (rt *stunRoundTripper) roundTrip(ctx context.Context, udpConn *net.UDPConn, stunServer string) (*net.UDPAddr, error) {
+func (rt *stunRoundTripper) roundTrip(ctx context.Context, udpConn N.UDPPacketConn, stunServer string) (*net.UDPAddr, error) {
 	rt.init()
 	txID := stun.NewTxID()
 	ch := make(chan stunResponse)
@@ -17,6 +17,7 @@ import (
 
 	"github.com/sigcn/pg/cache"
 	"github.com/sigcn/pg/disco"
+	N "github.com/sigcn/pg/net"
 	"github.com/sigcn/pg/stun"
 	"golang.org/x/time/rate"
 )
@@ -30,7 +31,7 @@ var (
 
 type UDPConn struct {
 	udpConnsMutex sync.RWMutex
-	udpConns      []*net.UDPConn
+	udpConns      []N.UDPPacketConn
 
 	closedSig chan int
 	closedWG  sync.WaitGroup
@@ -50,6 +51,8 @@ type UDPConn struct {
 	natInfo atomic.Pointer[disco.NATInfo]
 
 	cachePeers cache.CacheValue[[]PeerState]
+
+	stats discoStats
 }
 
 func (c *UDPConn) Close() error {
@@ -89,6 +92,11 @@ func (c *UDPConn) SetWriteBuffer(bytes int) error {
 	return nil
 }
 
+// DiscoStats load the counters of the udp hole punching
+func (c *UDPConn) DiscoStats() DiscoStats {
+	return c.stats.load()
+}
+
 func (c *UDPConn) NATEvents() <-chan *disco.NATInfo {
 	return c.natEvents
 }
@@ -223,8 +231,9 @@ func (c *UDPConn) DetectNAT(ctx context.Context, stunServers []string) (info dis
 
 func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.Endpoint) {
 	slog.Log(context.Background(), -2, "RecvPeerAddr", "peer", udpAddr.ID, "udp", udpAddr.Addr, "nat", udpAddr.Type.String())
+	c.stats.discoAttempts.Add(1)
 
-	easyChallenges := func(udpConn *net.UDPConn, wg *sync.WaitGroup, packetCounter *int32) {
+	easyChallenges := func(udpConn N.UDPPacketConn, wg *sync.WaitGroup, packetCounter *int32) {
 		defer wg.Done()
 		atomic.AddInt32(packetCounter, 1)
 		c.discoPing(udpConn, udpAddr.ID, udpAddr.Addr)
@@ -247,7 +256,7 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.Endpoint) {
 		}
 	}
 
-	hardChallenges := func(udpConn *net.UDPConn, packetCounter *int32) {
+	hardChallenges := func(udpConn N.UDPPacketConn, packetCounter *int32) {
 		rl := rate.NewLimiter(rate.Limit(256), 256)
 		for range 2000 {
 			select {
@@ -257,6 +266,7 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.Endpoint) {
 			}
 			if ctx, ok := c.findPeer(udpAddr.ID); ok && ctx.ready() {
 				slog.Info("[UDP] HardChallengesHit", "peer", udpAddr.ID)
+				c.stats.hardChallengeHits.Add(1)
 				return
 			}
 			if err := rl.Wait(context.Background()); err != nil {
@@ -281,6 +291,7 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.Endpoint) {
 		var packetCounter int32
 		slog.Log(context.Background(), -2, "[UDP] HardChallenges", "peer", udpAddr.ID, "addr", udpAddr.Addr)
 		hardChallenges(udpConn, &packetCounter)
+		c.stats.hardChallengePackets.Add(uint64(packetCounter))
 		slog.Log(context.Background(), -2, "[UDP] HardChallenges", "peer", udpAddr.ID, "addr", udpAddr.Addr, "packet_count", packetCounter)
 		return
 	}
@@ -298,6 +309,7 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.Endpoint) {
 	}
 	c.udpConnsMutex.RUnlock()
 	wg.Wait()
+	c.stats.easyChallengePackets.Add(uint64(packetCounter))
 	slog.Log(context.Background(), -2, "[UDP] EasyChallenges", "peer", udpAddr.ID, "addr", udpAddr.Addr, "packet_count", packetCounter)
 
 	if keeper, ok := c.findPeer(udpAddr.ID); (ok && keeper.ready()) || (udpAddr.Addr.IP.To4() == nil) || udpAddr.Addr.IP.IsPrivate() {
@@ -325,6 +337,8 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.Endpoint) {
 		}
 		if keeper, ok := c.findPeer(udpAddr.ID); ok && keeper.ready() {
 			slog.Info("[UDP] PortScanHit", "peer", udpAddr.ID, "port", p)
+			c.stats.portScanHits.Add(1)
+			c.stats.portScanPackets.Add(uint64(packetCounter))
 			return
 		}
 		if err := rl.Wait(context.Background()); err != nil {
@@ -334,6 +348,7 @@ func (c *UDPConn) RunDiscoMessageSendLoop(udpAddr disco.Endpoint) {
 		udpConn.WriteToUDP(c.disco.NewPing(c.cfg.ID), &net.UDPAddr{IP: udpAddr.Addr.IP, Port: p})
 		packetCounter++
 	}
+	c.stats.portScanPackets.Add(uint64(packetCounter))
 	slog.Log(context.Background(), -2, "[UDP] PortScan", "peer", udpAddr.ID, "addr", udpAddr.Addr, "packet_count", packetCounter)
 }
 
@@ -380,16 +395,19 @@ func (c *UDPConn) RestartListener() error {
 	c.udpConns = c.udpConns[:0]
 
 	// listen new connection(s)
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.cfg.Port})
+	conn, err := c.cfg.ListenUDP(c.cfg.Port)
 	if err != nil {
 		return fmt.Errorf("listen udp error: %w", err)
 	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && c.cfg.Port == 0 {
+		c.cfg.Port = addr.Port // keep the picked port on restart
+	}
 	go c.udpRead(conn)
 	c.udpConns = append(c.udpConns, conn)
 
 	if info := c.natInfo.Load(); info != nil && info.Type == disco.Hard {
 		for i := range 255 {
-			conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.cfg.Port + 1 + i})
+			conn, err := c.cfg.ListenUDP(c.cfg.Port + 1 + i)
 			if err != nil {
 				slog.Warn("[UDP] Listen", "err", err)
 				continue
@@ -402,7 +420,7 @@ func (c *UDPConn) RestartListener() error {
 	return nil
 }
 
-func (c *UDPConn) mainUDP() (*net.UDPConn, error) {
+func (c *UDPConn) mainUDP() (N.UDPPacketConn, error) {
 	c.udpConnsMutex.RLock()
 	defer c.udpConnsMutex.RUnlock()
 	if c.udpConns == nil {
@@ -411,20 +429,20 @@ func (c *UDPConn) mainUDP() (*net.UDPConn, error) {
 	return c.udpConns[0], nil
 }
 
-func (c *UDPConn) discoPing(udpConn *net.UDPConn, peerID disco.PeerID, peerAddr *net.UDPAddr) {
+func (c *UDPConn) discoPing(udpConn N.UDPPacketConn, peerID disco.PeerID, peerAddr *net.UDPAddr) {
 	slog.Debug("[UDP] Ping", "peer", peerID, "addr", peerAddr)
 	udpConn.WriteToUDP(c.disco.NewPing(c.cfg.ID), peerAddr)
 }
 
-func (c *UDPConn) tryGetPeerkeeper(udpConn *net.UDPConn, peerID disco.PeerID) *peerkeeper {
+func (c *UDPConn) tryGetPeerkeeper(udpConn N.UDPPacketConn, peerID disco.PeerID) *peerkeeper {
 	if !c.peersIndexMutex.TryRLock() {
 		return nil
 	}
 	ctx, ok := c.peersIndex[peerID]
 	c.peersIndexMutex.RUnlock()
 	if ok {
-		if ctx.udpConn.Load() != udpConn {
-			ctx.udpConn.Store(udpConn)
+		if *ctx.udpConn.Load() != udpConn {
+			ctx.udpConn.Store(&udpConn)
 		}
 		return ctx
 	}
@@ -442,13 +460,13 @@ func (c *UDPConn) tryGetPeerkeeper(udpConn *net.UDPConn, peerID disco.PeerID) *p
 		ping:              c.discoPing,
 		keepaliveInterval: c.cfg.PeerKeepaliveInterval,
 	}
-	pkeeper.udpConn.Store(udpConn)
+	pkeeper.udpConn.Store(&udpConn)
 	c.peersIndex[peerID] = &pkeeper
 	go pkeeper.run()
 	return &pkeeper
 }
 
-func (c *UDPConn) udpRead(udpConn *net.UDPConn) {
+func (c *UDPConn) udpRead(udpConn N.UDPPacketConn) {
 	c.closedWG.Add(1)
 	defer c.closedWG.Done()
 	buf := make([]byte, 65535)
@@ -473,6 +491,10 @@ func (c *UDPConn) udpRead(udpConn *net.UDPConn) {
 			if disco.IsIgnoredLocalIP(peerAddr.IP) { // ignore packet from ip in the ignore list
 				continue
 			}
+			if !c.authorized(peerID) {
+				c.stats.unauthorizedPackets.Add(1)
+				continue
+			}
 			c.tryGetPeerkeeper(udpConn, peerID).heartbeat(peerAddr)
 			continue
 		}
@@ -487,16 +509,26 @@ func (c *UDPConn) udpRead(udpConn *net.UDPConn) {
 		peerID := c.findPeerID(peerAddr)
 		if peerID.Len() == 0 {
 			slog.Warn("[UDP] Recv udp packet but peer not found", "peer_addr", peerAddr)
+			c.stats.unknownPeerPackets.Add(1)
 			continue
 		}
 		c.tryGetPeerkeeper(udpConn, peerID).heartbeat(peerAddr)
 		slog.Log(context.Background(), -3, "[UDP] ReadFrom", "peer", peerID, "addr", peerAddr)
 		if pkt, dst := c.relayProtocol.tryToDst(buf[:n], peerID); pkt != nil {
+			if !c.authorized(dst) {
+				c.stats.unauthorizedPackets.Add(1)
+				continue
+			}
 			c.WriteTo(pkt, dst) // relay to dest
+			c.stats.relayedPackets.Add(1)
 			continue
 		}
 		if pkt, src := c.relayProtocol.tryRecv(buf[:n]); pkt != nil {
-			c.datagrams <- &disco.Datagram{PeerID: src, Data: pkt} // recv from relay
+			if !c.authorized(src) {
+				c.stats.unauthorizedPackets.Add(1)
+				continue
+			}
+			c.datagrams <- &disco.Datagram{PeerID: src, Data: pkt, Relayed: true} // recv from relay
 			continue
 		}
 		b := append([]byte(nil), buf[:n]...)
@@ -560,6 +592,10 @@ func (c *UDPConn) findPeerID(udpAddr *net.UDPAddr) disco.PeerID {
 	return cache.LoadTTL(udpAddr.String(), time.Millisecond, doFind)
 }
 
+func (c *UDPConn) authorized(peerID disco.PeerID) bool {
+	return c.cfg.AuthorizePeer == nil || c.cfg.AuthorizePeer(peerID)
+}
+
 // FindPeer is used to find ready peer context by peer id
 func (c *UDPConn) findPeer(peerID disco.PeerID) (*peerkeeper, bool) {
 	c.peersIndexMutex.RLock()
@@ -577,6 +613,11 @@ func ListenUDP(cfg UDPConfig) (*UDPConn, error) {
 	if cfg.PeerKeepaliveInterval < time.Second {
 		cfg.PeerKeepaliveInterval = 10 * time.Second
 	}
+	if cfg.ListenUDP == nil {
+		cfg.ListenUDP = func(port int) (N.UDPPacketConn, error) {
+			return net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		}
+	}
 
 	udpConn := UDPConn{
 		cfg:        cfg,
@@ -1,11 +1,13 @@
 package udp
 
 import (
+	"context"
 	"net"
 	"testing"
 	"time"
 
 	"github.com/sigcn/pg/disco"
+	N "github.com/sigcn/pg/net"
 )
 
 /*
@@ -119,3 +121,105 @@ func BenchmarkFindPeerID(b *testing.B) {
 		udpConn.findPeerID(&net.UDPAddr{IP: net.ParseIP("192.168.0.40"), Port: 12345})
 	}
 }
+
+// listenBehindNAT listens the UDPConn on the private address behind the virtual NAT,
+// the local interfaces are not used so that only the stun addresses are found
+func listenBehindNAT(t *testing.T, nat *N.NAT, id disco.PeerID) *UDPConn {
+	t.Helper()
+	c, err := ListenUDP(UDPConfig{
+		ID:          id,
+		DisableIPv4: true,
+		DisableIPv6: true,
+		ListenUDP: func(port int) (N.UDPPacketConn, error) {
+			return nat.ListenUDP(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: port})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func listenSTUNs(t *testing.T, vnet *N.VirtualNetwork) (servers []string) {
+	t.Helper()
+	for i := range 2 {
+		conn, err := vnet.ListenSTUN(&net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i+1)), Port: 3478})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		servers = append(servers, conn.LocalAddr().String())
+	}
+	return
+}
+
+func TestDetectNAT(t *testing.T) {
+	vnet := N.NewVirtualNetwork()
+	stuns := listenSTUNs(t, vnet)
+	for _, mapping := range []N.NATMapping{N.EndpointIndependentMapping, N.SymmetricMapping} {
+		nat, err := vnet.NewNAT(net.IPv4(203, 0, 113, byte(mapping+1)), mapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := listenBehindNAT(t, nat, disco.PeerID(mapping.String()))
+		info := c.DetectNAT(context.Background(), stuns)
+		want := disco.Easy
+		if mapping == N.SymmetricMapping {
+			want = disco.Hard
+		}
+		if info.Type != want || len(info.Addrs) != 2 || !info.Addrs[0].IP.Equal(nat.PublicIP()) {
+			t.Errorf("%s NAT: %s %v", mapping, info.Type, info.Addrs)
+		}
+	}
+}
+
+func TestHolePunching(t *testing.T) {
+	vnet := N.NewVirtualNetwork()
+	stuns := listenSTUNs(t, vnet)
+	natA, _ := vnet.NewNAT(net.IPv4(203, 0, 113, 1), N.EndpointIndependentMapping)
+	natB, _ := vnet.NewNAT(net.IPv4(203, 0, 113, 2), N.EndpointIndependentMapping)
+	a, b := listenBehindNAT(t, natA, "a"), listenBehindNAT(t, natB, "b")
+	infoA, infoB := a.DetectNAT(context.Background(), stuns), b.DetectNAT(context.Background(), stuns)
+	if infoA.Type != disco.Easy || infoB.Type != disco.Easy {
+		t.Fatalf("nat %s %s", infoA.Type, infoB.Type)
+	}
+
+	// the NAT drops the packets from the addresses the host has not sent to
+	outsider, _ := vnet.ListenUDP(&net.UDPAddr{IP: net.IPv4(203, 0, 113, 9)})
+	defer outsider.Close()
+	outsider.WriteTo((&disco.Disco{}).NewPing("outsider"), infoB.Addrs[0])
+
+	go a.RunDiscoMessageSendLoop(disco.Endpoint{ID: "b", Addr: infoB.Addrs[0], Type: infoB.Type})
+	go b.RunDiscoMessageSendLoop(disco.Endpoint{ID: "a", Addr: infoA.Addrs[0], Type: infoA.Type})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, okA := a.findPeer("b")
+		_, okB := b.findPeer("a")
+		if okA && okB {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hole punching failed: %v %v", okA, okB)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := b.findPeer("outsider"); ok {
+		t.Error("the NAT accepted the unsolicited packet")
+	}
+
+	if _, err := a.WriteTo([]byte("hello"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case datagram := <-b.Datagrams():
+		if datagram.PeerID != "a" || string(datagram.Data) != "hello" {
+			t.Fatalf("datagram %s %q", datagram.PeerID, datagram.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("datagram is not received")
+	}
+	if stats := a.DiscoStats(); stats.DiscoAttempts == 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
@@ -29,6 +30,9 @@ var (
 	_ disco.ControllerManager = (*WSConn)(nil)
 )
 
+// failbackInterval is the interval to probe the primary server after failover
+const failbackInterval = time.Minute
+
 type Event struct {
 	ControlCode disco.ControlCode
 	Data        any
@@ -37,7 +41,11 @@ type Event struct {
 type WSConn struct {
 	rawConn           atomic.Pointer[websocket.Conn]
 	server            *disco.Server
-	connectedServer   string
+	serverIndex       atomic.Int32
+	primaryIndex      int32
+	connectedServer   atomic.Pointer[string]
+	ipLease           atomic.Pointer[disco.IPLease]
+	serverError       atomic.Pointer[langs.Error]
 	peerID            disco.PeerID
 	metadata          url.Values
 	closedSig         chan int
@@ -177,8 +185,29 @@ func (c *WSConn) STUNs() []string {
 	return c.stuns
 }
 
+// IPLease is the addresses leased by the peermap server, it is requested by the `ipam` metadata
+func (c *WSConn) IPLease() disco.IPLease {
+	if lease := c.ipLease.Load(); lease != nil {
+		return *lease
+	}
+	return disco.IPLease{}
+}
+
+// ServerError is the error which the last connection is rejected with by the peermap server,
+// nil is returned if the connection is accepted
+func (c *WSConn) ServerError() error {
+	if err := c.serverError.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// ServerURL is the active server url
 func (c *WSConn) ServerURL() string {
-	return c.connectedServer
+	if server := c.connectedServer.Load(); server != nil {
+		return *server
+	}
+	return ""
 }
 
 func (c *WSConn) Register(ctr disco.Controller) {
@@ -211,7 +240,8 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 	handshake.Set("X-Nonce", langs.NewNonce())
 	handshake.Set("X-Metadata", c.metadata.Encode())
 	if server == "" {
-		server = c.server.URL
+		servers := c.server.Servers()
+		server = servers[int(c.serverIndex.Load())%len(servers)]
 	}
 	peermap, err := url.Parse(server)
 	if err != nil {
@@ -234,6 +264,7 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 		var err langs.Error
 		json.NewDecoder(httpResp.Body).Decode(&err)
 		defer httpResp.Body.Close()
+		c.serverError.Store(&err)
 		return err
 	}
 	if httpResp != nil && httpResp.StatusCode == http.StatusTemporaryRedirect {
@@ -244,6 +275,7 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 		return fmt.Errorf("dial server %s: %w", server, err)
 	}
 	slog.Info("[WS] Connect", "server", server, "latency", time.Since(t1))
+	c.serverError.Store(nil)
 	c.events <- Event{ControlCode: disco.CONTROL_SERVER_CONNECTED}
 
 	if err := c.configureSTUNs(httpResp.Header); err != nil {
@@ -254,9 +286,11 @@ func (c *WSConn) dial(ctx context.Context, server string) error {
 		return err
 	}
 
+	c.configureIPLease(httpResp.Header)
+
 	c.rawConn.Store(conn)
 	c.nonce = langs.MustParseNonce(httpResp.Header.Get("X-Nonce"))
-	c.connectedServer = server
+	c.connectedServer.Store(&server)
 	c.activeTime.Store(time.Now().Unix())
 	conn.SetPingHandler(func(appData string) error {
 		slog.Debug("[WS] RecvPing")
@@ -289,6 +323,28 @@ func (c *WSConn) configureSTUNs(respHeader http.Header) error {
 	return nil
 }
 
+func (c *WSConn) configureIPLease(respHeader http.Header) {
+	lease := disco.IPLease{IPv4: respHeader.Get("X-IPv4"), IPv6: respHeader.Get("X-IPv6")}
+	if lease == (disco.IPLease{}) {
+		return
+	}
+	old := c.ipLease.Swap(&lease)
+	if old == nil {
+		// request the same addresses when reconnecting
+		for k, cidr := range map[string]string{"alias1": lease.IPv4, "alias2": lease.IPv6} {
+			if prefix, err := netip.ParsePrefix(cidr); err == nil {
+				c.metadata.Set(k, prefix.Addr().String())
+			}
+		}
+		slog.Info("[WS] IPLease", "ipv4", lease.IPv4, "ipv6", lease.IPv6)
+		return
+	}
+	if *old != lease {
+		slog.Error("[WS] IPLease changed, restart is required", "old", *old, "new", lease)
+		c.events <- Event{ControlCode: disco.CONTROL_IP_LEASE_CHANGED, Data: lease}
+	}
+}
+
 func (c *WSConn) configureRatelimiter(respHeader http.Header) error {
 	limitArg := respHeader.Get("X-Limiter-Limit")
 	if limitArg == "" {
@@ -334,6 +390,7 @@ func (c *WSConn) configureRatelimiter(respHeader http.Header) error {
 }
 
 func (c *WSConn) runConnAliveDetector() {
+	lastFailback := time.Now()
 	for {
 		select {
 		case <-c.closedSig:
@@ -346,6 +403,10 @@ func (c *WSConn) runConnAliveDetector() {
 		if sec-c.activeTime.Load() > 25 {
 			c.RestartListener()
 		}
+		if time.Since(lastFailback) > failbackInterval {
+			lastFailback = time.Now()
+			c.failback()
+		}
 	}
 }
 
@@ -365,6 +426,8 @@ func (c *WSConn) runEventsReadLoop() {
 		retryWaitDuration := retryInitDuration
 		retryMaxDuration := 5 * time.Second
 		retryRate := 2
+		failoverThreshold := 3
+		failures := 0
 		for {
 			select {
 			case <-c.closedSig:
@@ -375,6 +438,15 @@ func (c *WSConn) runEventsReadLoop() {
 			if err := c.dial(context.Background(), ""); err != nil {
 				slog.Error("[WS] Connect", "err", err)
 				retryWaitDuration = max(retryWaitDuration*time.Duration(retryRate), retryInitDuration)
+				if rejected(err) {
+					// keep the server, the rejection is kept in ServerError for the caller
+					continue
+				}
+				if failures++; failures >= failoverThreshold && len(c.server.Servers()) > 1 {
+					failures = 0
+					retryWaitDuration = retryInitDuration
+					c.failover()
+				}
 				continue
 			}
 			break
@@ -408,6 +480,38 @@ func (c *WSConn) runEventsReadLoop() {
 	}
 }
 
+// rejected reports whether the server rejected the peer, e.g. the secret is expired or revoked.
+// Only the network and handshake errors fail over to the next server
+func rejected(err error) bool {
+	var serverErr langs.Error
+	return errors.As(err, &serverErr)
+}
+
+// failover switch to the next server in the list
+func (c *WSConn) failover() {
+	servers := c.server.Servers()
+	next := int(c.serverIndex.Add(1)) % len(servers)
+	slog.Warn("[WS] Failover", "server", servers[next])
+}
+
+// failback reconnects to the primary server when it is reachable again
+func (c *WSConn) failback() {
+	servers := c.server.Servers()
+	if int(c.serverIndex.Load())%len(servers) == int(c.primaryIndex) {
+		return
+	}
+	primary := servers[c.primaryIndex]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := disco.Probe(ctx, primary); err != nil {
+		slog.Debug("[WS] Failback", "server", primary, "err", err)
+		return
+	}
+	slog.Info("[WS] Failback", "server", primary)
+	c.serverIndex.Store(c.primaryIndex)
+	c.RestartListener()
+}
+
 func (c *WSConn) handleEvents(b []byte) {
 	logger := slog.With("type", disco.ControlCode(b[0]))
 	switch disco.ControlCode(b[0]) {
@@ -512,7 +616,18 @@ func Dial(ctx context.Context, self *disco.Peer, server *disco.Server) (*WSConn,
 		connEOF:     make(chan struct{}),
 		controllers: make(map[uint8][]disco.Controller),
 	}
-	if err := wsConn.dial(ctx, ""); err != nil {
+	wsConn.primaryIndex = int32(server.Primary())
+	wsConn.serverIndex.Store(wsConn.primaryIndex)
+	var err error
+	servers := server.Servers()
+	for i := range servers {
+		if err = wsConn.dial(ctx, ""); err == nil || rejected(err) || ctx.Err() != nil || i == len(servers)-1 {
+			break
+		}
+		slog.Warn("[WS] Connect", "err", err)
+		wsConn.failover()
+	}
+	if err != nil {
 		return nil, err
 	}
 	go wsConn.runEventsReadLoop()
@@ -1,16 +1,20 @@
 package fileshare
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sigcn/pg/disco"
@@ -19,48 +23,42 @@ import (
 
 type FileHandle struct {
 	Filename string
+	Mode     fs.FileMode // mode of the file, 0 if unknown (the peer of protocol v1)
+	ModTime  time.Time   // modification time of the file, zero if unknown (the peer of protocol v1)
 
 	c     net.Conn
 	index uint16
-	fSize uint32
+	fSize int64
 	f     io.Reader
 }
 
-func (h *FileHandle) Handshake(offset uint32, sha256Checksum []byte) error {
+// Handshake requests the file from the offset, sha256Checksum is of the local part [0, offset).
+// The protocol v2 is used unless the peer only knows v1, which limits the file size to 4GiB
+func (h *FileHandle) Handshake(offset int64, sha256Checksum []byte) error {
 	_, err := h.c.Write(buildGet(h.index, offset, sha256Checksum))
 	if err != nil {
 		return err
 	}
-	header := make([]byte, 5)
-	h.c.SetReadDeadline(time.Now().Add(5 * time.Second))
-	_, err = io.ReadFull(h.c, header)
+	// the peer hashes the part [0, offset) before the response, 100MiB/s at least
+	h.c.SetReadDeadline(time.Now().Add(5*time.Second + time.Duration(offset/(100<<20))*time.Second))
+	meta, err := readResponse(h.c)
 	if err != nil {
 		return fmt.Errorf("read header: %w", err)
 	}
 	h.c.SetReadDeadline(time.Time{})
-	switch header[0] {
-	case 0:
-	case 20:
-	case 1:
-		return errors.New("bad request. maybe the version is lower than peer")
-	case 2:
-		return errors.New("file not found")
-	case 4:
-		return errors.New("download file size is less than local file")
-	case 5:
-		return errors.New("local file is not part of the file to be downloaded")
-	default:
-		return errors.New("invalid protocol header")
-	}
-	if offset > 0 && header[0] != 20 {
+	if offset > 0 && !meta.resumed {
 		return errors.New("sha256 checksum non matched for [0, offset)")
 	}
-	h.fSize = binary.BigEndian.Uint32(header[1:])
-	h.f = io.LimitReader(h.c, int64(h.fSize-offset))
+	if meta.mode != 0 {
+		h.Mode = meta.mode
+	}
+	h.ModTime = meta.modTime
+	h.fSize = meta.size
+	h.f = io.LimitReader(h.c, h.fSize-offset)
 	return nil
 }
 
-func (h *FileHandle) File() (io.Reader, uint32, error) {
+func (h *FileHandle) File() (io.Reader, int64, error) {
 	if h.f == nil {
 		return nil, 0, errors.New("handshake first")
 	}
@@ -77,72 +75,179 @@ func (h *FileHandle) Sha256() ([]byte, error) {
 
 type Read func(f *FileHandle) error
 
+type ReadDir func(d *DirHandle) error
+
+// DirHandle is a directory shared by the manifest
+type DirHandle struct {
+	Manifest Manifest
+
+	ctx      context.Context
+	listener *rdt.RDTListener
+	peerID   disco.PeerID
+}
+
+// Download requests the files of the manifest concurrently over the same rdt listener,
+// read is called for each file with the Filename joined to the dir. All the files are
+// tried, the errors are joined
+func (h *DirHandle) Download(dir string, entries []ManifestEntry, parallel int, read Read) error {
+	var (
+		wg   sync.WaitGroup
+		mut  sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, max(parallel, 1))
+	for _, e := range entries {
+		localPath, ok := e.LocalPath(dir)
+		if !ok || e.Mode.IsDir() {
+			continue
+		}
+		select {
+		case <-h.ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if h.ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fh := FileHandle{Filename: localPath, Mode: e.Mode, index: e.Index}
+			if err := request(h.ctx, h.listener, h.peerID, &fh, read); err != nil {
+				mut.Lock()
+				defer mut.Unlock()
+				errs = append(errs, fmt.Errorf("%s: %w", e.Path, err))
+			}
+		}()
+	}
+	wg.Wait()
+	if err := h.ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
 type Downloader struct {
 	Network       string
 	Server        string
 	PrivateKey    string
 	ListenUDPPort int
+	RDTOptions    []rdt.Option
 }
 
-func (d *Downloader) Request(ctx context.Context, shareURL string, read Read) error {
+func (d *Downloader) listen() (*rdt.RDTListener, error) {
 	pnet := PublicNetwork{Name: d.Network, Server: d.Server, PrivateKey: d.PrivateKey}
 	packetConn, err := pnet.ListenPacket(d.ListenUDPPort)
 	if err != nil {
-		return fmt.Errorf("listen p2p packet failed: %w", err)
+		return nil, fmt.Errorf("listen p2p packet failed: %w", err)
 	}
 
-	listener, err := rdt.Listen(packetConn, rdt.EnableStatsServer(fmt.Sprintf(":%d", d.ListenUDPPort+100)))
+	listener, err := rdt.Listen(packetConn, append([]rdt.Option{rdt.EnableStatsServer(fmt.Sprintf(":%d", d.ListenUDPPort+100))}, d.RDTOptions...)...)
 	if err != nil {
-		return fmt.Errorf("listen rdt: %w", err)
+		return nil, fmt.Errorf("listen rdt: %w", err)
 	}
+	return listener, nil
+}
 
-	resourceURL, err := url.Parse(shareURL)
+func (d *Downloader) Request(ctx context.Context, shareURL string, read Read) error {
+	peerID, index, name, isDir, err := parseShareURL(shareURL)
 	if err != nil {
-		return fmt.Errorf("invalid URL: %w", err)
+		return err
 	}
-
-	dir, filename := path.Split(resourceURL.Path)
-	index, err := strconv.ParseInt(strings.Trim(dir, "/"), 10, 16)
+	if isDir {
+		return errors.New("the url is a shared directory, request it by RequestDir")
+	}
+	listener, err := d.listen()
 	if err != nil {
-		return fmt.Errorf("invalid URL: %w", err)
+		return err
 	}
+	defer listener.Close()
+	return request(ctx, listener, peerID, &FileHandle{Filename: name, index: index}, read)
+}
 
-	fn, err := url.QueryUnescape(filename)
+// RequestDir downloads the manifest of the shared directory, the files are requested by DirHandle.Download
+func (d *Downloader) RequestDir(ctx context.Context, shareURL string, read ReadDir) error {
+	peerID, index, _, isDir, err := parseShareURL(shareURL)
 	if err != nil {
-		fn = filename
+		return err
 	}
+	if !isDir {
+		return errors.New("the url is not a shared directory, request it by Request")
+	}
+	listener, err := d.listen()
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	handle := DirHandle{ctx: ctx, listener: listener, peerID: peerID}
+	err = request(ctx, listener, peerID, &FileHandle{index: index}, func(fh *FileHandle) error {
+		if err := fh.Handshake(0, nil); err != nil {
+			return err
+		}
+		r, _, _ := fh.File()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+		checksum, err := fh.Sha256()
+		if err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(b); !bytes.Equal(sum[:], checksum) {
+			return errors.New("manifest checksum mismatched")
+		}
+		return json.Unmarshal(b, &handle.Manifest)
+	})
+	if err != nil {
+		return fmt.Errorf("request manifest: %w", err)
+	}
+	if err := handle.Manifest.validate(); err != nil {
+		return err
+	}
+	return read(&handle)
+}
 
-	conn, err := listener.OpenStream(disco.PeerID(resourceURL.Host))
+// request opens a stream to the peer for the file
+func request(ctx context.Context, listener *rdt.RDTListener, peerID disco.PeerID, fh *FileHandle, read Read) error {
+	conn, err := listener.OpenStream(peerID)
 	if err != nil {
 		return fmt.Errorf("dial server failed: %w", err)
 	}
 	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
 	go func() { // watch exit program event
-		<-ctx.Done()
-		conn.Write(buildClose())
-		conn.Close()
+		select {
+		case <-ctx.Done():
+			conn.Write(buildClose())
+			conn.Close()
+		case <-done:
+		}
 	}()
 	defer conn.Write(buildClose())
-	return read(&FileHandle{
-		Filename: fn,
-		c:        conn,
-		index:    uint16(index),
-	})
+	fh.c = conn
+	return read(fh)
 }
 
-func buildGet(index uint16, partSize uint32, checksum []byte) []byte {
-	header := []byte{0, 0}
-	if partSize > 0 {
-		header[1] = 36
+// parseShareURL parses pg://peer/index/name of a file, or pg://peer/index/name/ of a directory
+func parseShareURL(shareURL string) (peerID disco.PeerID, index uint16, name string, isDir bool, err error) {
+	resourceURL, err := url.Parse(shareURL)
+	if err != nil {
+		return "", 0, "", false, fmt.Errorf("invalid URL: %w", err)
 	}
-	header = append(header, binary.BigEndian.AppendUint16(nil, index)...)
-	if partSize > 0 {
-		header = append(header, binary.BigEndian.AppendUint32(nil, partSize)...)
-		header = append(header, checksum...)
+
+	p := strings.Trim(resourceURL.Path, "/")
+	isDir = strings.HasSuffix(resourceURL.Path, "/") && strings.Contains(p, "/")
+	dir, filename := path.Split(p)
+	i, err := strconv.ParseUint(strings.Trim(dir, "/"), 10, 16)
+	if err != nil {
+		return "", 0, "", false, fmt.Errorf("invalid URL: %w", err)
 	}
-	return header
-}
 
-func buildClose() []byte {
-	return []byte{1}
+	name, err = url.QueryUnescape(filename)
+	if err != nil {
+		name = filename
+	}
+	return disco.PeerID(resourceURL.Host), uint16(i), name, isDir, nil
 }
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/url"
 	"os"
@@ -18,6 +18,7 @@ import (
 	"sync"
 
 	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/langs"
 	"github.com/sigcn/pg/rdt"
 )
 
@@ -27,14 +28,22 @@ type FileManager struct {
 	PrivateKey    string
 	ListenUDPPort int
 	ProgressBar   func(total int64, desc string) ProgressBar
+	RDTOptions    []rdt.Option // e.g. rdt.EnableFEC() over lossy relays
+	ShareDirs     bool         // share a directory by one url with the manifest, instead of a url per file
 
 	mutex     sync.RWMutex
 	index     int
-	files     map[int]string
+	files     map[int]sharedFile
+	dirs      map[int]*sharedDir
 	filesInit sync.Once
 	peerID    disco.PeerID
 }
 
+type sharedFile struct {
+	path  string
+	inDir bool // listed in the manifest of a shared dir
+}
+
 func (m *FileManager) ListenNetwork() (net.Listener, error) {
 	pnet := PublicNetwork{Name: m.Network, Server: m.Server, PrivateKey: m.PrivateKey}
 	packetConn, err := pnet.ListenPacket(m.ListenUDPPort)
@@ -42,7 +51,7 @@ func (m *FileManager) ListenNetwork() (net.Listener, error) {
 		return nil, fmt.Errorf("listen p2p packet failed: %w", err)
 	}
 
-	listener, err := rdt.Listen(packetConn, rdt.EnableStatsServer(fmt.Sprintf(":%d", m.ListenUDPPort+100)))
+	listener, err := rdt.Listen(packetConn, append([]rdt.Option{rdt.EnableStatsServer(fmt.Sprintf(":%d", m.ListenUDPPort+100))}, m.RDTOptions...)...)
 	if err != nil {
 		return nil, fmt.Errorf("listen rdt: %w", err)
 	}
@@ -51,9 +60,16 @@ func (m *FileManager) ListenNetwork() (net.Listener, error) {
 }
 
 func (m *FileManager) SharedURLs() ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	var ret []string
 	for k, v := range m.files {
-		ret = append(ret, fmt.Sprintf("pg://%s/%d/%s", m.peerID, k, url.QueryEscape(filepath.Base(v))))
+		if !v.inDir {
+			ret = append(ret, fmt.Sprintf("pg://%s/%d/%s", m.peerID, k, url.QueryEscape(filepath.Base(v.path))))
+		}
+	}
+	for k, v := range m.dirs {
+		ret = append(ret, fmt.Sprintf("pg://%s/%d/%s/", m.peerID, k, url.QueryEscape(v.name)))
 	}
 	if ret == nil {
 		return nil, errors.New("no file to share")
@@ -81,7 +97,7 @@ func (m *FileManager) Serve(ctx context.Context, listener net.Listener) error {
 			<-ctx.Done()
 			conn.Close()
 		}()
-		m.handleRequest(conn.RemoteAddr().String(), conn)
+		go m.handleRequest(conn.RemoteAddr().String(), conn)
 	}
 }
 
@@ -93,6 +109,13 @@ func (fm *FileManager) addAbs(absPath string) error {
 	if fileStat.Mode()&os.ModeSymlink != 0 {
 		return nil
 	}
+	fm.filesInit.Do(func() {
+		fm.files = make(map[int]sharedFile)
+		fm.dirs = make(map[int]*sharedDir)
+	})
+	if fileStat.IsDir() && fm.ShareDirs {
+		return fm.addDir(absPath)
+	}
 	if fileStat.IsDir() {
 		files, err := os.ReadDir(absPath)
 		if err != nil {
@@ -103,8 +126,7 @@ func (fm *FileManager) addAbs(absPath string) error {
 		}
 		return nil
 	}
-	fm.filesInit.Do(func() { fm.files = make(map[int]string) })
-	fm.files[fm.index] = absPath
+	fm.files[fm.index] = sharedFile{path: absPath}
 	fm.index++
 	return nil
 }
@@ -129,26 +151,35 @@ func (fm *FileManager) Add(file string) error {
 func (fm *FileManager) openFile(index uint16) (*os.File, error) {
 	fm.mutex.RLock()
 	defer fm.mutex.RUnlock()
-	if absPath, ok := fm.files[int(index)]; ok {
-		return os.Open(absPath)
+	if file, ok := fm.files[int(index)]; ok {
+		return os.Open(file.path)
 	}
 	return nil, os.ErrNotExist
 }
 
+func (fm *FileManager) sharedDir(index uint16) (*sharedDir, bool) {
+	fm.mutex.RLock()
+	defer fm.mutex.RUnlock()
+	dir, ok := fm.dirs[int(index)]
+	return dir, ok
+}
+
 func (m *FileManager) handleRequest(peerID string, conn net.Conn) {
 	defer conn.Close()
-	header := make([]byte, 4)
-	_, err := io.ReadFull(conn, header)
-	if err != nil || header[0] != 0 {
-		conn.Write(buildErr(1)) // invalid magic
-		slog.Error("Magic not verified", "err", err)
+	req, err := readGet(conn)
+	if err != nil {
+		conn.Write(buildErr(req.version, langs.Err(err)))
+		slog.Error("Invalid request", "err", err)
 		return
 	}
 
-	index := binary.BigEndian.Uint16(header[2:])
-	f, err := m.openFile(index)
+	if dir, ok := m.sharedDir(req.index); ok {
+		m.serveManifest(conn, dir, req)
+		return
+	}
+	f, err := m.openFile(req.index)
 	if err != nil {
-		conn.Write(buildErr(2)) // not found
+		conn.Write(buildErr(req.version, ErrFileNotFound))
 		slog.Error("Open file failed", "err", err)
 		return
 	}
@@ -156,30 +187,27 @@ func (m *FileManager) handleRequest(peerID string, conn net.Conn) {
 
 	stat, err := f.Stat()
 	if err != nil {
+		conn.Write(buildErr(req.version, ErrFileNotFound))
+		slog.Error("Stat file failed", "err", err)
 		return
 	}
-
-	length := header[1]
-	info := make([]byte, length)
-	if _, err = io.ReadFull(conn, info); err != nil {
-		conn.Write(buildErr(3)) // invalid protocol
-		slog.Error("Read info", "err", err)
+	if req.version < protocolV2 && stat.Size() > math.MaxUint32 {
+		conn.Write(buildErr(req.version, ErrFileTooLarge))
+		slog.Error("Request file larger than 4GiB by protocol v1", "file", f.Name())
 		return
 	}
 
 	sha256Checksum := sha256.New()
 
-	if len(info) > 0 {
-		partSize := binary.BigEndian.Uint32(info[:4])
-		partChecksum := info[4:36]
-		if partSize > uint32(stat.Size()) {
-			conn.Write(buildErr(4)) // part size greater than total file size
+	if req.checksum != nil {
+		if req.offset > stat.Size() {
+			conn.Write(buildErr(req.version, ErrLocalFileLarger))
 			slog.Error("Request file part size greater than total file size")
 			return
 		}
-		io.CopyN(sha256Checksum, f, int64(partSize))
-		if !bytes.Equal(sha256Checksum.Sum(nil), partChecksum) {
-			conn.Write(buildErr(5)) // not part of file
+		io.CopyN(sha256Checksum, f, req.offset)
+		if !bytes.Equal(sha256Checksum.Sum(nil), req.checksum) {
+			conn.Write(buildErr(req.version, ErrNotPartOfFile))
 			slog.Error("Request not part of file", "file", f.Name())
 			return
 		}
@@ -187,7 +215,7 @@ func (m *FileManager) handleRequest(peerID string, conn net.Conn) {
 
 	pos, err := f.Seek(0, io.SeekCurrent)
 	resume := err == nil && pos > 0
-	conn.Write(buildOK(stat.Size(), resume))
+	conn.Write(buildOK(req.version, fileMeta{size: stat.Size(), modTime: stat.ModTime(), mode: stat.Mode(), resumed: resume}))
 	go func() {
 		header := make([]byte, 1)
 		io.ReadFull(conn, header)
@@ -211,17 +239,20 @@ func (m *FileManager) handleRequest(peerID string, conn net.Conn) {
 	conn.Write(checksum)
 }
 
-func buildOK(fileSize int64, resume bool) []byte {
-	pkt := []byte{0}
-	if resume {
-		pkt[0] = 20
+// serveManifest sends the manifest as a file, the resuming is not supported
+func (m *FileManager) serveManifest(conn net.Conn, dir *sharedDir, req getRequest) {
+	if req.offset > 0 {
+		conn.Write(buildErr(req.version, ErrInvalidProtocol)) // the manifest is always downloaded from the beginning
+		return
 	}
-	pkt = append(pkt, binary.BigEndian.AppendUint32(nil, uint32(fileSize))...)
-	return pkt
-}
-
-func buildErr(code byte) []byte {
-	pkt := make([]byte, 5)
-	pkt[0] = code
-	return pkt
+	manifest, err := dir.build()
+	if err != nil {
+		conn.Write(buildErr(req.version, ErrFileNotFound))
+		slog.Error("Build manifest failed", "dir", dir.root, "err", err)
+		return
+	}
+	checksum := sha256.Sum256(manifest)
+	conn.Write(buildOK(req.version, fileMeta{size: int64(len(manifest))}))
+	conn.Write(manifest)
+	conn.Write(checksum[:])
 }
@@ -0,0 +1,153 @@
+package fileshare
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// Manifest is the file tree of a shared directory
+type Manifest struct {
+	Name    string          `json:"name"`
+	Entries []ManifestEntry `json:"entries"` // parent directories go before their children
+}
+
+// ManifestEntry is a file or a directory in the shared directory
+type ManifestEntry struct {
+	Path   string      `json:"path"` // slash separated, relative to the shared directory
+	Index  uint16      `json:"index"`
+	Size   int64       `json:"size"`
+	Mode   fs.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256,omitempty"` // hex encoded, empty for directories
+}
+
+// LocalPath returns the path of the entry under the dir, false if the entry escapes the dir
+func (e ManifestEntry) LocalPath(dir string) (string, bool) {
+	p := filepath.FromSlash(e.Path)
+	if !filepath.IsLocal(p) {
+		return "", false
+	}
+	return filepath.Join(dir, p), true
+}
+
+// Matches reports whether the local file is the same as the entry
+func (e ManifestEntry) Matches(localPath string) bool {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil || stat.Size() != e.Size || !stat.Mode().IsRegular() {
+		return false
+	}
+	sum, err := sha256Sum(f)
+	return err == nil && sum == e.SHA256
+}
+
+// sharedDir is a directory shared by one url, the sha256 of files are computed on the first request
+type sharedDir struct {
+	name    string
+	root    string
+	entries []ManifestEntry
+
+	once     sync.Once
+	manifest []byte
+	err      error
+}
+
+// addDir registers the files of the directory, they are listed in the manifest instead of the shared urls
+func (fm *FileManager) addDir(absPath string) error {
+	dir := sharedDir{name: filepath.Base(absPath), root: absPath}
+	err := filepath.WalkDir(absPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == absPath || d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(absPath, p)
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{Path: filepath.ToSlash(rel), Mode: info.Mode()}
+		if d.IsDir() {
+			dir.entries = append(dir.entries, entry)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if fm.index >= math.MaxUint16 {
+			return errors.New("too many files to share")
+		}
+		entry.Index, entry.Size = uint16(fm.index), info.Size()
+		dir.entries = append(dir.entries, entry)
+		fm.files[fm.index] = sharedFile{path: p, inDir: true}
+		fm.index++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk dir: %s: %w", absPath, err)
+	}
+	fm.dirs[fm.index] = &dir
+	fm.index++
+	return nil
+}
+
+// build marshals the manifest with the sha256 of files
+func (d *sharedDir) build() ([]byte, error) {
+	d.once.Do(func() {
+		manifest := Manifest{Name: d.name, Entries: d.entries}
+		for i, e := range manifest.Entries {
+			if e.Mode.IsDir() {
+				continue
+			}
+			f, err := os.Open(filepath.Join(d.root, filepath.FromSlash(e.Path)))
+			if err != nil {
+				d.err = err
+				return
+			}
+			manifest.Entries[i].SHA256, d.err = sha256Sum(f)
+			f.Close()
+			if d.err != nil {
+				return
+			}
+		}
+		d.manifest, d.err = json.Marshal(manifest)
+	})
+	return d.manifest, d.err
+}
+
+// validate rejects the manifest with entries escape the shared directory
+func (m *Manifest) validate() error {
+	if m.Name == "" || m.Name != path.Base(m.Name) || !filepath.IsLocal(m.Name) {
+		return fmt.Errorf("invalid manifest name %q", m.Name)
+	}
+	for _, e := range m.Entries {
+		if _, ok := e.LocalPath("."); !ok || e.Path != path.Clean(e.Path) {
+			return fmt.Errorf("invalid manifest entry %q", e.Path)
+		}
+	}
+	return nil
+}
+
+func sha256Sum(r io.Reader) (string, error) {
+	sum := sha256.New()
+	if _, err := io.Copy(sum, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,134 @@
+package fileshare
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "share")
+	files := map[string]string{
+		"a.txt":      "hello",
+		"sub/b.bin":  "world",
+		"sub/deep/c": "",
+	}
+	for p, content := range files {
+		writeFile(t, filepath.Join(root, filepath.FromSlash(p)), content)
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink(filepath.Join(root, "a.txt"), filepath.Join(root, "link")) // not shared
+
+	fm := FileManager{ShareDirs: true}
+	if err := fm.Add(root); err != nil {
+		t.Fatal(err)
+	}
+	dir, ok := fm.sharedDir(uint16(len(files)))
+	if !ok {
+		t.Fatal("dir is not shared after its files")
+	}
+	b, err := dir.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Name != "share" {
+		t.Errorf("name %q", manifest.Name)
+	}
+
+	// parent directories go before their children
+	var paths []string
+	for _, e := range manifest.Entries {
+		paths = append(paths, e.Path)
+	}
+	if want := []string{"a.txt", "empty", "sub", "sub/b.bin", "sub/deep", "sub/deep/c"}; !slices.Equal(paths, want) {
+		t.Fatalf("entries %q, want %q", paths, want)
+	}
+	for _, e := range manifest.Entries {
+		if e.Mode.IsDir() {
+			if e.SHA256 != "" {
+				t.Errorf("%s: sha256 of the dir", e.Path)
+			}
+			continue
+		}
+		sum := sha256.Sum256([]byte(files[e.Path]))
+		if e.Size != int64(len(files[e.Path])) || e.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: size %d, sha256 %s", e.Path, e.Size, e.SHA256)
+		}
+		// the index serves the file of the entry
+		f, err := fm.openFile(e.Index)
+		if err != nil {
+			t.Fatalf("%s: %v", e.Path, err)
+		}
+		f.Close()
+		localPath, ok := e.LocalPath(root)
+		if !ok || f.Name() != localPath {
+			t.Errorf("%s: index %d serves %s", e.Path, e.Index, f.Name())
+		}
+		if !e.Matches(localPath) {
+			t.Errorf("%s: the local file does not match", e.Path)
+		}
+	}
+
+	// the downloaded file is verified by the size and the sha256
+	entry := manifest.Entries[0]
+	copied := filepath.Join(t.TempDir(), "a.txt")
+	writeFile(t, copied, "hello")
+	if !entry.Matches(copied) {
+		t.Error("the same file does not match")
+	}
+	writeFile(t, copied, "hellO")
+	if entry.Matches(copied) {
+		t.Error("the modified file matches")
+	}
+	writeFile(t, copied, "hello!")
+	if entry.Matches(copied) {
+		t.Error("the longer file matches")
+	}
+	if entry.Matches(filepath.Join(t.TempDir(), "missing")) {
+		t.Error("the missing file matches")
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		manifest Manifest
+		valid    bool
+	}{
+		{"valid", Manifest{Name: "share", Entries: []ManifestEntry{{Path: "a"}, {Path: "sub/b"}}}, true},
+		{"empty name", Manifest{Name: ""}, false},
+		{"parent name", Manifest{Name: ".."}, false},
+		{"nested name", Manifest{Name: "a/b"}, false},
+		{"parent entry", Manifest{Name: "share", Entries: []ManifestEntry{{Path: "../a"}}}, false},
+		{"absolute entry", Manifest{Name: "share", Entries: []ManifestEntry{{Path: "/etc/passwd"}}}, false},
+		{"unclean entry", Manifest{Name: "share", Entries: []ManifestEntry{{Path: "sub/../../a"}}}, false},
+		{"redundant entry", Manifest{Name: "share", Entries: []ManifestEntry{{Path: "sub//a"}}}, false},
+	} {
+		if err := c.manifest.validate(); (err == nil) != c.valid {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
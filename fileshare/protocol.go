@@ -0,0 +1,193 @@
+package fileshare
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"time"
+
+	"github.com/sigcn/pg/langs"
+)
+
+// The request is [0][infoLen1][index2][info]. The v1 info is empty or [partSize4][sha256 32] of the
+// local part for resuming. The v2 info appends [version1][offset8] to the v1 info, so the v1 peers
+// still understand it as a v1 request.
+//
+// The v1 response is [status1][size4], status is 0, 20 (resumed) or the error code.
+// The v2 response is [0xF2][code2][flags1][size8][mtime8][mode4].
+// The file data and the sha256 of the whole file follow the successful response
+
+const (
+	protocolV1 byte = 1
+	protocolV2 byte = 2
+
+	v1InfoSize     = 36
+	v2InfoSize     = v1InfoSize + 9
+	v1ResponseSize = 5
+	v2ResponseSize = 24
+	v2ResponseMark = 0xF2
+
+	v1StatusResumed byte = 20
+	v2FlagResumed   byte = 1
+)
+
+var (
+	ErrBadRequest      = langs.Error{Code: 1, Msg: "bad request. maybe the version is lower than peer"}
+	ErrFileNotFound    = langs.Error{Code: 2, Msg: "file not found"}
+	ErrInvalidProtocol = langs.Error{Code: 3, Msg: "invalid protocol header"}
+	ErrLocalFileLarger = langs.Error{Code: 4, Msg: "download file size is less than local file"}
+	ErrNotPartOfFile   = langs.Error{Code: 5, Msg: "local file is not part of the file to be downloaded"}
+	ErrFileTooLarge    = langs.Error{Code: 6, Msg: "file is larger than 4GiB, the peer requires protocol v2"}
+
+	protocolErrors = []langs.Error{ErrBadRequest, ErrFileNotFound, ErrInvalidProtocol, ErrLocalFileLarger, ErrNotPartOfFile, ErrFileTooLarge}
+)
+
+func protocolError(code int) langs.Error {
+	for _, e := range protocolErrors {
+		if e.Code == code {
+			return e
+		}
+	}
+	return langs.Error{Code: code, Msg: "unknown error"}
+}
+
+type getRequest struct {
+	version  byte
+	index    uint16
+	offset   int64
+	checksum []byte // sha256 of [0, offset), nil if not resuming
+}
+
+// buildGet builds the v2 request. The v1 part resumes the offset within 4GiB only,
+// the v1 peers reject the larger offset as not part of the file
+func buildGet(index uint16, offset int64, checksum []byte) []byte {
+	header := []byte{0, v2InfoSize}
+	header = binary.BigEndian.AppendUint16(header, index)
+	var partSize uint32
+	if offset <= math.MaxUint32 {
+		partSize = uint32(offset)
+	}
+	if offset == 0 {
+		empty := sha256.Sum256(nil)
+		checksum = empty[:]
+	}
+	header = binary.BigEndian.AppendUint32(header, partSize)
+	header = append(header, checksum...)
+	header = append(header, protocolV2)
+	return binary.BigEndian.AppendUint64(header, uint64(offset))
+}
+
+// readGet reads the request of both versions, the error is a langs.Error
+func readGet(r io.Reader) (req getRequest, err error) {
+	req.version = protocolV1
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil || header[0] != 0 {
+		return req, ErrBadRequest
+	}
+	req.index = binary.BigEndian.Uint16(header[2:])
+	info := make([]byte, header[1])
+	if _, err := io.ReadFull(r, info); err != nil {
+		return req, ErrInvalidProtocol
+	}
+	if len(info) == 0 {
+		return req, nil
+	}
+	if len(info) < v1InfoSize {
+		return req, ErrInvalidProtocol
+	}
+	req.offset = int64(binary.BigEndian.Uint32(info[:4]))
+	req.checksum = info[4:v1InfoSize]
+	if len(info) >= v2InfoSize && info[v1InfoSize] >= protocolV2 {
+		req.version = protocolV2
+		req.offset = int64(binary.BigEndian.Uint64(info[v1InfoSize+1 : v2InfoSize]))
+		if req.offset < 0 {
+			return req, ErrInvalidProtocol
+		}
+		if req.offset == 0 {
+			req.checksum = nil
+		}
+	}
+	return req, nil
+}
+
+type fileMeta struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+	resumed bool
+}
+
+func buildOK(version byte, meta fileMeta) []byte {
+	if version < protocolV2 {
+		pkt := []byte{0}
+		if meta.resumed {
+			pkt[0] = v1StatusResumed
+		}
+		return binary.BigEndian.AppendUint32(pkt, uint32(meta.size))
+	}
+	pkt := []byte{v2ResponseMark, 0, 0, 0}
+	if meta.resumed {
+		pkt[3] |= v2FlagResumed
+	}
+	var mtime int64
+	if !meta.modTime.IsZero() {
+		mtime = meta.modTime.UnixNano()
+	}
+	pkt = binary.BigEndian.AppendUint64(pkt, uint64(meta.size))
+	pkt = binary.BigEndian.AppendUint64(pkt, uint64(mtime))
+	return binary.BigEndian.AppendUint32(pkt, uint32(meta.mode))
+}
+
+func buildErr(version byte, e langs.Error) []byte {
+	if version < protocolV2 {
+		pkt := make([]byte, v1ResponseSize)
+		pkt[0] = byte(e.Code)
+		return pkt
+	}
+	pkt := make([]byte, v2ResponseSize)
+	pkt[0] = v2ResponseMark
+	binary.BigEndian.PutUint16(pkt[1:], uint16(e.Code))
+	return pkt
+}
+
+// readResponse reads the response of both versions, the v1 peers reply the v1 response to the v2 request
+func readResponse(r io.Reader) (meta fileMeta, err error) {
+	header := make([]byte, v2ResponseSize)
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return meta, err
+	}
+	if header[0] != v2ResponseMark {
+		if _, err := io.ReadFull(r, header[1:v1ResponseSize]); err != nil {
+			return meta, err
+		}
+		if header[0] != 0 && header[0] != v1StatusResumed {
+			return meta, protocolError(int(header[0]))
+		}
+		meta.resumed = header[0] == v1StatusResumed
+		meta.size = int64(binary.BigEndian.Uint32(header[1:]))
+		return meta, nil
+	}
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return meta, err
+	}
+	if code := binary.BigEndian.Uint16(header[1:]); code != 0 {
+		return meta, protocolError(int(code))
+	}
+	meta.resumed = header[3]&v2FlagResumed != 0
+	meta.size = int64(binary.BigEndian.Uint64(header[4:]))
+	if meta.size < 0 {
+		return meta, fmt.Errorf("invalid file size %d", meta.size)
+	}
+	if mtime := int64(binary.BigEndian.Uint64(header[12:])); mtime != 0 {
+		meta.modTime = time.Unix(0, mtime)
+	}
+	meta.mode = fs.FileMode(binary.BigEndian.Uint32(header[20:]))
+	return meta, nil
+}
+
+func buildClose() []byte {
+	return []byte{1}
+}
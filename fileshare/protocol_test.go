@@ -0,0 +1,118 @@
+package fileshare
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"math"
+	"testing"
+	"time"
+)
+
+// v1Get builds the request of the v1 peers
+func v1Get(index uint16, partSize uint32, checksum []byte) []byte {
+	header := []byte{0, 0}
+	header = binary.BigEndian.AppendUint16(header, index)
+	if checksum == nil {
+		return header
+	}
+	header[1] = v1InfoSize
+	header = binary.BigEndian.AppendUint32(header, partSize)
+	return append(header, checksum...)
+}
+
+func TestReadGet(t *testing.T) {
+	checksum := sha256.Sum256([]byte("part"))
+	for _, c := range []struct {
+		name string
+		pkt  []byte
+		want getRequest
+	}{
+		{"v1", v1Get(3, 0, nil), getRequest{version: protocolV1, index: 3}},
+		{"v1 resume", v1Get(3, 4, checksum[:]), getRequest{version: protocolV1, index: 3, offset: 4, checksum: checksum[:]}},
+		{"v2", buildGet(3, 0, nil), getRequest{version: protocolV2, index: 3}},
+		{"v2 resume", buildGet(3, 4, checksum[:]), getRequest{version: protocolV2, index: 3, offset: 4, checksum: checksum[:]}},
+		{"v2 resume over 4GiB", buildGet(3, math.MaxUint32+1, checksum[:]), getRequest{version: protocolV2, index: 3, offset: math.MaxUint32 + 1, checksum: checksum[:]}},
+	} {
+		req, err := readGet(bytes.NewReader(c.pkt))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if req.version != c.want.version || req.index != c.want.index || req.offset != c.want.offset || !bytes.Equal(req.checksum, c.want.checksum) {
+			t.Errorf("%s: %+v, want %+v", c.name, req, c.want)
+		}
+	}
+
+	if _, err := readGet(bytes.NewReader(buildClose())); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("close as request: %v", err)
+	}
+	if _, err := readGet(bytes.NewReader(v1Get(3, 4, checksum[:16]))); !errors.Is(err, ErrInvalidProtocol) {
+		t.Errorf("truncated request: %v", err)
+	}
+}
+
+// TestV2GetByV1Peer reads the v2 request as the v1 peers do, the info is [partSize4][sha256 32] and the rest is ignored
+func TestV2GetByV1Peer(t *testing.T) {
+	checksum := sha256.Sum256([]byte("part"))
+	empty := sha256.Sum256(nil)
+	for _, c := range []struct {
+		offset           int64
+		checksum         []byte
+		partSize         uint32
+		expectedChecksum []byte
+	}{
+		{0, nil, 0, empty[:]},
+		{4, checksum[:], 4, checksum[:]},
+		{math.MaxUint32 + 1, checksum[:], 0, checksum[:]},
+	} {
+		pkt := buildGet(7, c.offset, c.checksum)
+		if pkt[0] != 0 || int(pkt[1]) != len(pkt)-4 || binary.BigEndian.Uint16(pkt[2:]) != 7 {
+			t.Fatalf("header %x", pkt[:4])
+		}
+		info := pkt[4:]
+		if binary.BigEndian.Uint32(info) != c.partSize || !bytes.Equal(info[4:v1InfoSize], c.expectedChecksum) {
+			t.Errorf("offset %d: v1 info %x", c.offset, info[:v1InfoSize])
+		}
+	}
+}
+
+func TestResponse(t *testing.T) {
+	mtime := time.Unix(1700000000, 123)
+	for _, c := range []struct {
+		version byte
+		meta    fileMeta
+		want    fileMeta
+	}{
+		{protocolV1, fileMeta{size: 1024, modTime: mtime, mode: 0o644}, fileMeta{size: 1024}},
+		{protocolV1, fileMeta{size: 1024, resumed: true}, fileMeta{size: 1024, resumed: true}},
+		{protocolV2, fileMeta{size: 1024, modTime: mtime, mode: 0o644}, fileMeta{size: 1024, modTime: mtime, mode: 0o644}},
+		{protocolV2, fileMeta{size: math.MaxUint32 + 1, resumed: true, mode: fs.ModeDir}, fileMeta{size: math.MaxUint32 + 1, resumed: true, mode: fs.ModeDir}},
+	} {
+		pkt := buildOK(c.version, c.meta)
+		if c.version == protocolV1 && len(pkt) != v1ResponseSize || c.version == protocolV2 && len(pkt) != v2ResponseSize {
+			t.Fatalf("v%d response size %d", c.version, len(pkt))
+		}
+		r := bytes.NewReader(append(pkt, "data"...))
+		meta, err := readResponse(r)
+		if err != nil {
+			t.Fatalf("v%d: %v", c.version, err)
+		}
+		if meta.size != c.want.size || meta.resumed != c.want.resumed || meta.mode != c.want.mode || !meta.modTime.Equal(c.want.modTime) {
+			t.Errorf("v%d: %+v, want %+v", c.version, meta, c.want)
+		}
+		if r.Len() != 4 {
+			t.Errorf("v%d: the file data is consumed", c.version)
+		}
+	}
+
+	for _, version := range []byte{protocolV1, protocolV2} {
+		for _, e := range protocolErrors {
+			_, err := readResponse(bytes.NewReader(buildErr(version, e)))
+			if !errors.Is(err, e) {
+				t.Errorf("v%d: %v, want %v", version, err, e)
+			}
+		}
+	}
+}
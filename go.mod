@@ -5,6 +5,7 @@ go 1.24
 toolchain go1.24.1
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/coreos/go-oidc/v3 v3.13.0
 	github.com/google/gopacket v1.1.19
 	github.com/gorilla/websocket v1.5.3
@@ -0,0 +1,256 @@
+package net
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPPacketConn is the udp socket used by the disco, it is implemented
+// by *net.UDPConn, LossyPacketConn and VirtualUDPConn
+type UDPPacketConn interface {
+	net.PacketConn
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+var (
+	_ UDPPacketConn = (*net.UDPConn)(nil)
+	_ UDPPacketConn = (*LossyPacketConn)(nil)
+)
+
+// LinkConfig is the impairments of the emulated link
+type LinkConfig struct {
+	Loss      float64       // probability of dropping a packet
+	Duplicate float64       // probability of sending a packet twice
+	Reorder   float64       // probability of holding a packet for another Latency+Jitter (1ms at least)
+	Latency   time.Duration // one way delay
+	Jitter    time.Duration // random delay in [0, Jitter) added to the latency
+	MTU       int           // larger packets are dropped, 0 means unlimited
+	Bandwidth int           // bytes per second, 0 means unlimited
+	QueueSize int           // bytes queued by the bandwidth limit, the tail is dropped. default 64KiB
+	Seed      int64         // the same seed makes the same decisions for the same packets, 0 picks a random one
+}
+
+// LinkStats is the counters of the emulated link
+type LinkStats struct {
+	Sent       uint64
+	Dropped    uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+// LossyPacketConn wraps the net.PacketConn, the written packets are impaired as
+// the LinkConfig before they reach the wrapped conn. Reading is not affected
+type LossyPacketConn struct {
+	net.PacketConn
+	cfg LinkConfig
+
+	mut       sync.Mutex
+	rand      *rand.Rand
+	busyUntil time.Time
+	queue     delayQueue
+	seq       uint64
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	sent, dropped, duplicated, reordered atomic.Uint64
+}
+
+// NewLossyPacketConn wraps the conn, impair both sides of a link by wrapping the two conns
+func NewLossyPacketConn(conn net.PacketConn, cfg LinkConfig) *LossyPacketConn {
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = 64 * 1024
+	}
+	c := &LossyPacketConn{
+		PacketConn: conn,
+		cfg:        cfg,
+		rand:       rand.New(rand.NewSource(cfg.Seed)),
+		wake:       make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+	go c.runDeliverLoop()
+	return c
+}
+
+// Stats returns the counters of the link
+func (c *LossyPacketConn) Stats() LinkStats {
+	return LinkStats{
+		Sent:       c.sent.Load(),
+		Dropped:    c.dropped.Load(),
+		Duplicated: c.duplicated.Load(),
+		Reordered:  c.reordered.Load(),
+	}
+}
+
+// WriteTo always succeeds unless the conn is closed, the lost packets are dropped silently
+func (c *LossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, &net.OpError{Op: "write", Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: addr, Err: net.ErrClosed}
+	default:
+	}
+	if c.cfg.MTU > 0 && len(p) > c.cfg.MTU {
+		c.dropped.Add(1)
+		return len(p), nil
+	}
+	now := time.Now()
+	c.mut.Lock()
+	if c.rand.Float64() < c.cfg.Loss {
+		c.mut.Unlock()
+		c.dropped.Add(1)
+		return len(p), nil
+	}
+	deliverAt := now
+	if c.cfg.Bandwidth > 0 {
+		start := maxTime(c.busyUntil, now)
+		if backlog := int(start.Sub(now).Seconds() * float64(c.cfg.Bandwidth)); backlog+len(p) > c.cfg.QueueSize {
+			c.mut.Unlock()
+			c.dropped.Add(1)
+			return len(p), nil
+		}
+		c.busyUntil = start.Add(time.Duration(float64(len(p)) / float64(c.cfg.Bandwidth) * float64(time.Second)))
+		deliverAt = c.busyUntil
+	}
+	delays := []time.Duration{c.delay()}
+	if c.rand.Float64() < c.cfg.Duplicate {
+		delays = append(delays, c.delay())
+		c.duplicated.Add(1)
+	}
+	pkt := append([]byte(nil), p...)
+	if len(delays) == 1 && delays[0] == 0 && deliverAt.Equal(now) {
+		c.mut.Unlock()
+		c.sent.Add(1)
+		return c.PacketConn.WriteTo(pkt, addr)
+	}
+	for _, delay := range delays {
+		c.seq++
+		heap.Push(&c.queue, &delayedPacket{seq: c.seq, deliverAt: deliverAt.Add(delay), pkt: pkt, addr: addr})
+	}
+	c.mut.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// WriteToUDP implements the UDPPacketConn
+func (c *LossyPacketConn) WriteToUDP(p []byte, addr *net.UDPAddr) (int, error) {
+	return c.WriteTo(p, addr)
+}
+
+// ReadFromUDP implements the UDPPacketConn
+func (c *LossyPacketConn) ReadFromUDP(p []byte) (int, *net.UDPAddr, error) {
+	if conn, ok := c.PacketConn.(UDPPacketConn); ok {
+		return conn.ReadFromUDP(p)
+	}
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	udpAddr, _ := addr.(*net.UDPAddr)
+	return n, udpAddr, err
+}
+
+// SetReadBuffer implements the UDPPacketConn
+func (c *LossyPacketConn) SetReadBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(UDPPacketConn); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+// SetWriteBuffer implements the UDPPacketConn
+func (c *LossyPacketConn) SetWriteBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(UDPPacketConn); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+// Close closes the wrapped conn, the delayed packets are dropped
+func (c *LossyPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.PacketConn.Close()
+}
+
+// delay is the latency of a packet, c.mut must be held
+func (c *LossyPacketConn) delay() time.Duration {
+	delay := c.cfg.Latency
+	if c.cfg.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.cfg.Jitter)))
+	}
+	if c.rand.Float64() < c.cfg.Reorder {
+		delay += max(c.cfg.Latency+c.cfg.Jitter, time.Millisecond)
+		c.reordered.Add(1)
+	}
+	return delay
+}
+
+func (c *LossyPacketConn) runDeliverLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		c.mut.Lock()
+		var wait time.Duration = time.Hour
+		for c.queue.Len() > 0 {
+			next := c.queue[0]
+			if wait = time.Until(next.deliverAt); wait > 0 {
+				break
+			}
+			heap.Pop(&c.queue)
+			c.mut.Unlock()
+			c.sent.Add(1)
+			c.PacketConn.WriteTo(next.pkt, next.addr)
+			c.mut.Lock()
+		}
+		c.mut.Unlock()
+		timer.Reset(wait)
+		select {
+		case <-c.closed:
+			return
+		case <-c.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+type delayedPacket struct {
+	seq       uint64
+	deliverAt time.Time
+	pkt       []byte
+	addr      net.Addr
+}
+
+// delayQueue is the packets ordered by the delivery time
+type delayQueue []*delayedPacket
+
+func (q delayQueue) Len() int { return len(q) }
+func (q delayQueue) Less(i, j int) bool {
+	if q[i].deliverAt.Equal(q[j].deliverAt) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].deliverAt.Before(q[j].deliverAt)
+}
+func (q delayQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *delayQueue) Push(x any)   { *q = append(*q, x.(*delayedPacket)) }
+func (q *delayQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,353 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sigcn/pg/stun"
+)
+
+var _ UDPPacketConn = (*VirtualUDPConn)(nil)
+
+// NATMapping is how the NAT maps the internal address to the public port
+type NATMapping int
+
+const (
+	// EndpointIndependentMapping uses the same public port for all the destinations (easy NAT)
+	EndpointIndependentMapping NATMapping = iota
+	// SymmetricMapping uses a new public port for each destination (hard NAT)
+	SymmetricMapping
+)
+
+func (m NATMapping) String() string {
+	if m == SymmetricMapping {
+		return "symmetric"
+	}
+	return "endpoint-independent"
+}
+
+// VirtualNetwork is an in-memory udp network for the tests. The hosts behind
+// a NAT are reachable only by the addresses they have sent packets to
+type VirtualNetwork struct {
+	mut   sync.RWMutex
+	conns map[netip.AddrPort]*VirtualUDPConn
+	nats  map[netip.Addr]*NAT
+}
+
+func NewVirtualNetwork() *VirtualNetwork {
+	return &VirtualNetwork{
+		conns: make(map[netip.AddrPort]*VirtualUDPConn),
+		nats:  make(map[netip.Addr]*NAT),
+	}
+}
+
+// ListenUDP listens on the public address, port 0 picks a free port
+func (n *VirtualNetwork) ListenUDP(addr *net.UDPAddr) (*VirtualUDPConn, error) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	ip, err := parseVirtualIP(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := n.nats[ip]; ok {
+		return nil, fmt.Errorf("address %s is used by the NAT", ip)
+	}
+	return listenVirtual(n.conns, ip, addr.Port, n.deliver, func(c *VirtualUDPConn) {
+		n.mut.Lock()
+		defer n.mut.Unlock()
+		delete(n.conns, c.addr)
+	})
+}
+
+// ListenSTUN runs a stun server on the public address, the binding request is answered with
+// the address it comes from, i.e. the public address mapped by the NAT. Close the conn to stop it
+func (n *VirtualNetwork) ListenSTUN(addr *net.UDPAddr) (*VirtualUDPConn, error) {
+	conn, err := n.ListenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	go conn.serveSTUN()
+	return conn, nil
+}
+
+// NewNAT creates a NAT with the public ip, the hosts behind it are listened by NAT.ListenUDP
+func (n *VirtualNetwork) NewNAT(publicIP net.IP, mapping NATMapping) (*NAT, error) {
+	ip, ok := netip.AddrFromSlice(publicIP)
+	if !ok {
+		return nil, errors.New("invalid NAT public ip")
+	}
+	ip = ip.Unmap()
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if _, ok := n.nats[ip]; ok {
+		return nil, fmt.Errorf("NAT %s already exists", ip)
+	}
+	nat := &NAT{
+		network:  n,
+		publicIP: ip,
+		mapping:  mapping,
+		conns:    make(map[netip.AddrPort]*VirtualUDPConn),
+		outbound: make(map[natKey]uint16),
+		inbound:  make(map[uint16]*natBinding),
+		nextPort: 20000,
+	}
+	n.nats[ip] = nat
+	return nat, nil
+}
+
+func (n *VirtualNetwork) deliver(src, dst netip.AddrPort, p []byte) {
+	n.mut.RLock()
+	conn, ok := n.conns[dst]
+	nat := n.nats[dst.Addr()]
+	n.mut.RUnlock()
+	if ok {
+		conn.enqueue(src, p)
+		return
+	}
+	if nat != nil {
+		nat.receive(src, dst, p)
+	}
+}
+
+type natKey struct {
+	internal, remote netip.AddrPort
+}
+
+type natBinding struct {
+	internal netip.AddrPort
+	permits  map[netip.AddrPort]struct{} // address and port dependent filtering
+}
+
+// NAT translates the private addresses to the public ip. The inbound packets are
+// accepted only from the addresses the internal host has sent packets to
+type NAT struct {
+	network  *VirtualNetwork
+	publicIP netip.Addr
+	mapping  NATMapping
+
+	mut      sync.Mutex
+	conns    map[netip.AddrPort]*VirtualUDPConn
+	outbound map[natKey]uint16
+	inbound  map[uint16]*natBinding
+	nextPort uint16
+}
+
+// ListenUDP listens on the private address behind the NAT, port 0 picks a free port
+func (nat *NAT) ListenUDP(addr *net.UDPAddr) (*VirtualUDPConn, error) {
+	nat.mut.Lock()
+	defer nat.mut.Unlock()
+	ip, err := parseVirtualIP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return listenVirtual(nat.conns, ip, addr.Port, nat.send, func(c *VirtualUDPConn) {
+		nat.mut.Lock()
+		defer nat.mut.Unlock()
+		delete(nat.conns, c.addr)
+	})
+}
+
+// PublicIP returns the public ip of the NAT
+func (nat *NAT) PublicIP() net.IP {
+	return nat.publicIP.AsSlice()
+}
+
+// Mapping returns the mapping behavior of the NAT
+func (nat *NAT) Mapping() NATMapping {
+	return nat.mapping
+}
+
+func (nat *NAT) send(src, dst netip.AddrPort, p []byte) {
+	key := natKey{internal: src}
+	if nat.mapping == SymmetricMapping {
+		key.remote = dst
+	}
+	nat.mut.Lock()
+	port, ok := nat.outbound[key]
+	if !ok {
+		for nat.inbound[nat.nextPort] != nil || nat.nextPort < 1024 {
+			nat.nextPort++
+		}
+		port = nat.nextPort
+		nat.nextPort++
+		nat.outbound[key] = port
+		nat.inbound[port] = &natBinding{internal: src, permits: make(map[netip.AddrPort]struct{})}
+	}
+	nat.inbound[port].permits[dst] = struct{}{}
+	nat.mut.Unlock()
+	nat.network.deliver(netip.AddrPortFrom(nat.publicIP, port), dst, p)
+}
+
+func (nat *NAT) receive(src, dst netip.AddrPort, p []byte) {
+	nat.mut.Lock()
+	binding, ok := nat.inbound[dst.Port()]
+	if !ok {
+		nat.mut.Unlock()
+		return
+	}
+	_, permitted := binding.permits[src]
+	conn := nat.conns[binding.internal]
+	nat.mut.Unlock()
+	if permitted && conn != nil {
+		conn.enqueue(src, p)
+	}
+}
+
+type virtualPacket struct {
+	src netip.AddrPort
+	pkt []byte
+}
+
+// VirtualUDPConn is the udp socket of the VirtualNetwork
+type VirtualUDPConn struct {
+	addr      netip.AddrPort
+	route     func(src, dst netip.AddrPort, p []byte)
+	release   func(*VirtualUDPConn)
+	inbound   chan virtualPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	deadlineRead Deadline
+}
+
+func listenVirtual(conns map[netip.AddrPort]*VirtualUDPConn, ip netip.Addr, port int,
+	route func(src, dst netip.AddrPort, p []byte), release func(*VirtualUDPConn)) (*VirtualUDPConn, error) {
+	if port == 0 {
+		for port = 10000; port < 65536; port++ {
+			if _, ok := conns[netip.AddrPortFrom(ip, uint16(port))]; !ok {
+				break
+			}
+		}
+	}
+	addr := netip.AddrPortFrom(ip, uint16(port))
+	if _, ok := conns[addr]; ok || port > 65535 {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: net.UDPAddrFromAddrPort(addr), Err: errors.New("address already in use")}
+	}
+	c := &VirtualUDPConn{
+		addr:    addr,
+		route:   route,
+		release: release,
+		inbound: make(chan virtualPacket, 1024),
+		closed:  make(chan struct{}),
+	}
+	conns[addr] = c
+	return c, nil
+}
+
+func parseVirtualIP(addr *net.UDPAddr) (netip.Addr, error) {
+	if addr == nil {
+		return netip.Addr{}, errors.New("virtual address is required")
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok || ip.IsUnspecified() {
+		return netip.Addr{}, fmt.Errorf("invalid virtual ip %s", addr.IP)
+	}
+	return ip.Unmap(), nil
+}
+
+// enqueue drops the packet if the receive buffer is full
+func (c *VirtualUDPConn) enqueue(src netip.AddrPort, p []byte) {
+	select {
+	case <-c.closed:
+	case c.inbound <- virtualPacket{src: src, pkt: append([]byte(nil), p...)}:
+	default:
+	}
+}
+
+func (c *VirtualUDPConn) serveSTUN() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := c.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		txID, err := stun.ParseBindingRequest(buf[:n])
+		if err != nil {
+			continue
+		}
+		c.WriteToUDP(stun.Response(txID, addr.AddrPort()), addr)
+	}
+}
+
+func (c *VirtualUDPConn) ReadFromUDP(p []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Source: c.LocalAddr(), Err: net.ErrClosed}
+	case _, ok := <-c.deadlineRead.Deadline():
+		if !ok {
+			return 0, nil, &net.OpError{Op: "read", Net: "udp", Source: c.LocalAddr(), Err: net.ErrClosed}
+		}
+		return 0, nil, ErrDeadline
+	case pkt := <-c.inbound:
+		return copy(p, pkt.pkt), net.UDPAddrFromAddrPort(pkt.src), nil
+	}
+}
+
+func (c *VirtualUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDP(p)
+	if addr == nil { // not a typed nil
+		return n, nil, err
+	}
+	return n, addr, err
+}
+
+func (c *VirtualUDPConn) WriteToUDP(p []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: net.ErrClosed}
+	default:
+	}
+	dst := addr.AddrPort()
+	c.route(c.addr, netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()), p)
+	return len(p), nil
+}
+
+func (c *VirtualUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: net.InvalidAddrError("not a udp address")}
+	}
+	return c.WriteToUDP(p, udpAddr)
+}
+
+func (c *VirtualUDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.deadlineRead.Close()
+		c.release(c)
+	})
+	return nil
+}
+
+func (c *VirtualUDPConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.addr)
+}
+
+func (c *VirtualUDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *VirtualUDPConn) SetReadDeadline(t time.Time) error {
+	c.deadlineRead.SetDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is not needed, the write never blocks
+func (c *VirtualUDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *VirtualUDPConn) SetReadBuffer(bytes int) error {
+	return nil
+}
+
+func (c *VirtualUDPConn) SetWriteBuffer(bytes int) error {
+	return nil
+}
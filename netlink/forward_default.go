@@ -0,0 +1,24 @@
+//go:build !linux
+
+package netlink
+
+import (
+	"errors"
+	"net"
+)
+
+func EnableSNAT(string, *net.IPNet, *net.IPNet) error {
+	return errors.ErrUnsupported
+}
+
+func DisableSNAT(string, *net.IPNet, *net.IPNet) error {
+	return errors.ErrUnsupported
+}
+
+func AddBypassRoute(net.IP) error {
+	return errors.ErrUnsupported
+}
+
+func DelBypassRoute(net.IP) error {
+	return errors.ErrUnsupported
+}
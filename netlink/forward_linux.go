@@ -0,0 +1,106 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/vishvananda/netlink"
+)
+
+// EnableSNAT enables ip forwarding and masquerades the packets from src to dst which leave through other
+// interfaces. The nil dst matches all destinations, which is for the exit node only
+func EnableSNAT(ifName string, src, dst *net.IPNet) error {
+	iptables, forwarding := "iptables", "/proc/sys/net/ipv4/ip_forward"
+	if src.IP.To4() == nil {
+		iptables, forwarding = "ip6tables", "/proc/sys/net/ipv6/conf/all/forwarding"
+	}
+	if err := os.WriteFile(forwarding, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable ip forwarding: %w", err)
+	}
+	for _, rule := range snatRules(ifName, src, dst) {
+		if exec.Command(iptables, append([]string{"-C"}, rule...)...).Run() == nil {
+			continue // rule exists
+		}
+		if out, err := exec.Command(iptables, append([]string{"-A"}, rule...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", iptables, err, out)
+		}
+	}
+	return nil
+}
+
+// DisableSNAT removes the rules added by EnableSNAT, ip forwarding is kept
+func DisableSNAT(ifName string, src, dst *net.IPNet) error {
+	iptables := "iptables"
+	if src.IP.To4() == nil {
+		iptables = "ip6tables"
+	}
+	var errs []error
+	for _, rule := range snatRules(ifName, src, dst) {
+		if out, err := exec.Command(iptables, append([]string{"-D"}, rule...)...).CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w: %s", iptables, err, out))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func snatRules(ifName string, src, dst *net.IPNet) [][]string {
+	if dst == nil {
+		return [][]string{
+			{"POSTROUTING", "-t", "nat", "-s", src.String(), "!", "-o", ifName, "-j", "MASQUERADE"},
+			{"FORWARD", "-i", ifName, "-j", "ACCEPT"},
+			{"FORWARD", "-o", ifName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		}
+	}
+	return [][]string{
+		{"POSTROUTING", "-t", "nat", "-s", src.String(), "-d", dst.String(), "!", "-o", ifName, "-j", "MASQUERADE"},
+		{"FORWARD", "-i", ifName, "-s", src.String(), "-d", dst.String(), "-j", "ACCEPT"},
+		{"FORWARD", "-o", ifName, "-s", dst.String(), "-d", src.String(), "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+// AddBypassRoute routes the ip through the system default gateway,
+// so that the traffic to the ip is not captured by the exit node routes
+func AddBypassRoute(ip net.IP) error {
+	gw, err := defaultGateway(ip)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteReplace(&netlink.Route{Dst: hostIPNet(ip), Gw: gw.Gw, LinkIndex: gw.LinkIndex})
+}
+
+func DelBypassRoute(ip net.IP) error {
+	return netlink.RouteDel(&netlink.Route{Dst: hostIPNet(ip)})
+}
+
+func defaultGateway(ip net.IP) (*netlink.Route, error) {
+	family := netlink.FAMILY_V4
+	if ip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r.Gw == nil {
+			continue
+		}
+		if r.Dst == nil {
+			return &r, nil
+		}
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			return &r, nil
+		}
+	}
+	return nil, errors.New("default gateway not found")
+}
+
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
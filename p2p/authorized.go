@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sigcn/pg/disco"
+	"storj.io/common/base58"
+)
+
+// AuthorizedPeers is the allowlist of the peer public keys, each peer may pin the virtual ip it
+// claims (alias1/alias2). Peers not in the list are ignored at disco, relay and datagram level
+type AuthorizedPeers struct {
+	FilePath string // edits are saved to the file if it is not empty
+
+	mut      sync.RWMutex
+	peers    map[disco.PeerID]string // pinned ip as value, empty if not pinned
+	onChange func()
+}
+
+// ParseAuthorizedPeer parses the `<base58 public key>[=<ip>]` string
+func ParseAuthorizedPeer(s string) (disco.PeerID, string, error) {
+	key, ip, _ := strings.Cut(strings.TrimSpace(s), "=")
+	if _, err := ecdh.X25519().NewPublicKey(base58.Decode(key)); err != nil {
+		return "", "", fmt.Errorf("invalid peer public key %q", key)
+	}
+	if ip != "" && net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid pinned ip %q", ip)
+	}
+	return disco.PeerID(key), ip, nil
+}
+
+// LoadAuthorizedPeers reads the authorized peers from the file,
+// one `<base58 public key>[=<ip>]` per line, lines start with # are ignored
+func LoadAuthorizedPeers(filePath string) (*AuthorizedPeers, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	peers := AuthorizedPeers{FilePath: filePath, peers: make(map[disco.PeerID]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peerID, ip, err := ParseAuthorizedPeer(line)
+		if err != nil {
+			return nil, err
+		}
+		peers.peers[peerID] = ip
+	}
+	return &peers, scanner.Err()
+}
+
+// Allowed reports whether the peer is in the list, all peers are allowed by the nil list
+func (a *AuthorizedPeers) Allowed(peerID disco.PeerID) bool {
+	if a == nil {
+		return true
+	}
+	a.mut.RLock()
+	defer a.mut.RUnlock()
+	_, ok := a.peers[peerID]
+	return ok
+}
+
+// AllowedMeta reports whether the peer is in the list and claims the pinned ip
+func (a *AuthorizedPeers) AllowedMeta(peerID disco.PeerID, meta url.Values) bool {
+	if a == nil {
+		return true
+	}
+	a.mut.RLock()
+	defer a.mut.RUnlock()
+	ip, ok := a.peers[peerID]
+	if !ok {
+		return false
+	}
+	if ip == "" {
+		return true
+	}
+	pinned := net.ParseIP(ip)
+	return pinned.Equal(net.ParseIP(meta.Get("alias1"))) || pinned.Equal(net.ParseIP(meta.Get("alias2")))
+}
+
+// List returns the authorized peers and their pinned ips
+func (a *AuthorizedPeers) List() map[disco.PeerID]string {
+	a.mut.RLock()
+	defer a.mut.RUnlock()
+	return maps.Clone(a.peers)
+}
+
+// Set adds the peer or updates its pinned ip
+func (a *AuthorizedPeers) Set(peerID disco.PeerID, ip string) error {
+	if _, _, err := ParseAuthorizedPeer(peerID.String() + "=" + ip); err != nil {
+		return err
+	}
+	a.mut.Lock()
+	if a.peers == nil {
+		a.peers = make(map[disco.PeerID]string)
+	}
+	a.peers[peerID] = ip
+	a.mut.Unlock()
+	return a.changed()
+}
+
+// Del removes the peer
+func (a *AuthorizedPeers) Del(peerID disco.PeerID) error {
+	a.mut.Lock()
+	delete(a.peers, peerID)
+	a.mut.Unlock()
+	return a.changed()
+}
+
+func (a *AuthorizedPeers) changed() error {
+	a.mut.RLock()
+	onChange := a.onChange
+	a.mut.RUnlock()
+	if onChange != nil {
+		go onChange()
+	}
+	return a.save()
+}
+
+func (a *AuthorizedPeers) save() error {
+	if a.FilePath == "" {
+		return nil
+	}
+	a.mut.RLock()
+	var sb strings.Builder
+	for _, peerID := range slices.Sorted(maps.Keys(a.peers)) {
+		sb.WriteString(peerID.String())
+		if ip := a.peers[peerID]; ip != "" {
+			sb.WriteString("=" + ip)
+		}
+		sb.WriteString("\n")
+	}
+	a.mut.RUnlock()
+	return os.WriteFile(a.FilePath, []byte(sb.String()), 0600)
+}
+
+func (a *AuthorizedPeers) setOnChange(onChange func()) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.onChange = onChange
+}
@@ -4,10 +4,12 @@ import (
 	"crypto/ecdh"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"net/url"
 	"time"
 
 	"github.com/sigcn/pg/disco"
+	N "github.com/sigcn/pg/net"
 	"github.com/sigcn/pg/secure"
 	"github.com/sigcn/pg/secure/chacha20poly1305"
 	"storj.io/common/base58"
@@ -20,20 +22,30 @@ func SetDefaultSymmAlgo(symmAlgo func(secure.ProvideSecretKey) secure.SymmAlgo)
 }
 
 type Config struct {
-	UDPPort         int
-	DisableIPv6     bool
-	DisableIPv4     bool
-	PeerInfo        disco.Peer
-	SymmAlgo        secure.SymmAlgo
-	OnPeer          OnPeer
-	OnPeerLeave     OnPeerLeave
-	KeepAlivePeriod time.Duration
-	MinDiscoPeriod  time.Duration
+	UDPPort           int
+	DisableIPv6       bool
+	DisableIPv4       bool
+	PeerInfo          disco.Peer
+	SymmAlgo          secure.SymmAlgo
+	PSK               []byte
+	AuthorizedPeers   *AuthorizedPeers
+	RequireSignedMeta bool // ignore the peers without the metadata signature
+	OnPeer            OnPeer
+	OnPeerLeave       OnPeerLeave
+	OnNetworkMeta     OnNetworkMeta
+	OnIPLeaseChange   OnIPLeaseChange
+	KeepAlivePeriod   time.Duration
+	MinDiscoPeriod    time.Duration
+	ListenUDP         func(port int) (N.UDPPacketConn, error)
+
+	privateKey *ecdh.PrivateKey // signs the peer metadata
 }
 
 type Option func(cfg *Config) error
 type OnPeer func(disco.PeerID, url.Values)
 type OnPeerLeave func(disco.PeerID)
+type OnNetworkMeta func(url.Values)
+type OnIPLeaseChange func(disco.IPLease)
 
 var (
 	OptionNoOp Option = func(cfg *Config) error { return nil }
@@ -46,6 +58,18 @@ func ListenUDPPort(port int) Option {
 	}
 }
 
+// ListenUDPFunc replaces the system udp socket, e.g. N.NewLossyPacketConn or the
+// sockets of N.VirtualNetwork to test the p2p stack on an impaired network
+func ListenUDPFunc(listenUDP func(port int) (N.UDPPacketConn, error)) Option {
+	return func(cfg *Config) error {
+		if listenUDP == nil {
+			return errors.New("listen udp func is required")
+		}
+		cfg.ListenUDP = listenUDP
+		return nil
+	}
+}
+
 func ListenPeerID(id string) Option {
 	return func(cfg *Config) error {
 		if cfg.SymmAlgo != nil {
@@ -84,9 +108,48 @@ func ListenPeerCurve25519(privateKey string) Option {
 			if err != nil {
 				return nil, err
 			}
-			return priv.ECDH(pub)
+			secret, err := priv.ECDH(pub)
+			// cfg.PSK is read on use, so the options order doesn't matter
+			if err != nil || len(cfg.PSK) == 0 {
+				return secret, err
+			}
+			return secure.MixPSK(secret, cfg.PSK)
 		})
 		cfg.PeerInfo.ID = disco.PeerID(base58.Encode(priv.PublicKey().Bytes()))
+		cfg.privateKey = priv
+		return nil
+	}
+}
+
+// ListenPeerPSK mixes the pre-shared key of the network into the secret keys of peers,
+// peers without the same pre-shared key can not decrypt or inject traffic
+func ListenPeerPSK(psk []byte) Option {
+	return func(cfg *Config) error {
+		if len(psk) < 16 {
+			return errors.New("pre-shared key must be at least 16 bytes")
+		}
+		cfg.PSK = psk
+		return nil
+	}
+}
+
+// ListenAuthorizedPeers only accepts the peers in the allowlist
+func ListenAuthorizedPeers(peers *AuthorizedPeers) Option {
+	return func(cfg *Config) error {
+		if peers == nil {
+			return errors.New("authorized peers is required")
+		}
+		cfg.AuthorizedPeers = peers
+		return nil
+	}
+}
+
+// RequireSignedPeerMeta only accepts the peers whose metadata is signed by the curve25519 key bound to
+// the peer id, and whose vpn addresses and labels are covered by the signature. So the addresses
+// leased by the peermap server ipam are not accepted
+func RequireSignedPeerMeta() Option {
+	return func(cfg *Config) error {
+		cfg.RequireSignedMeta = true
 		return nil
 	}
 }
@@ -121,6 +184,40 @@ func ListenPeerLeave(onPeerLeave OnPeerLeave) Option {
 	}
 }
 
+// ListenNetworkMeta listen the network metadata (e.g. acl rules) pushed from the peermap server
+func ListenNetworkMeta(onNetworkMeta OnNetworkMeta) Option {
+	return func(cfg *Config) error {
+		cfg.OnNetworkMeta = onNetworkMeta
+		return nil
+	}
+}
+
+// ListenIPLeaseChange listen the addresses leased by another peermap server after reconnecting,
+// e.g. failover to a cluster node which leased the addresses to another peer
+func ListenIPLeaseChange(onIPLeaseChange OnIPLeaseChange) Option {
+	return func(cfg *Config) error {
+		cfg.OnIPLeaseChange = onIPLeaseChange
+		return nil
+	}
+}
+
+// RequestIPLease requests the vpn addresses from the peermap server ipam, see PacketConn.IPLease.
+// networks is ipv4 or ipv6, both are requested by default
+func RequestIPLease(networks ...string) Option {
+	return func(cfg *Config) error {
+		if len(networks) == 0 {
+			networks = []string{"ipv4", "ipv6"}
+		}
+		for _, network := range networks {
+			if network != "ipv4" && network != "ipv6" {
+				return fmt.Errorf("invalid ipam network %q", network)
+			}
+			cfg.PeerInfo.WithMeta("ipam", network)
+		}
+		return nil
+	}
+}
+
 func PeerSilenceMode() Option {
 	return func(cfg *Config) error {
 		cfg.PeerInfo.WithSilenceMode()
@@ -18,21 +18,25 @@ import (
 	"github.com/sigcn/pg/disco"
 	"github.com/sigcn/pg/disco/udp"
 	"github.com/sigcn/pg/disco/ws"
+	"github.com/sigcn/pg/langs"
 	N "github.com/sigcn/pg/net"
 	"github.com/sigcn/pg/netlink"
+	"github.com/sigcn/pg/secure"
 	"storj.io/common/base58"
 )
 
 var (
 	_ net.PacketConn = (*PacketConn)(nil)
 
-	ErrNoRelayPeer = errors.New("no relay peer")
+	ErrNoRelayPeer       = errors.New("no relay peer")
+	ErrPeerNotAuthorized = errors.New("peer is not authorized")
 )
 
 type NodeInfo struct {
-	ID      disco.PeerID  `json:"id"`
-	Meta    url.Values    `json:"meta"`
-	NATInfo disco.NATInfo `json:"nat"`
+	ID          disco.PeerID  `json:"id"`
+	Meta        url.Values    `json:"meta"`
+	NATInfo     disco.NATInfo `json:"nat"`
+	ServerError string        `json:"server_error,omitempty"` // the peermap server rejects this node, e.g. vpn address conflict
 }
 
 type PacketConn struct {
@@ -42,14 +46,19 @@ type PacketConn struct {
 	udpConn           *udp.UDPConn
 	wsConn            *ws.WSConn
 	peerMap           *lru.Cache[disco.PeerID, url.Values]
+	peerOnline        map[disco.PeerID]struct{}
+	metaSignTime      map[disco.PeerID]int64 // latest metadata signing time of peers, not evicted to keep rejecting the stale ones
 	peerMapMutex      sync.RWMutex
 	discoCooling      *lru.Cache[disco.PeerID, time.Time]
 	discoCoolingMutex sync.Mutex
 	transportMode     TransportMode
 
 	deadlineRead N.Deadline
+	received     chan *disco.Datagram // decrypted by receiveLoop
 
 	relayPeerIndex atomic.Uint64
+
+	stats stats
 }
 
 // ReadFrom reads a packet from the connection,
@@ -73,23 +82,72 @@ func (c *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 		}
 		err = N.ErrDeadline
 		return
-	case datagram, ok := <-c.wsConn.Datagrams():
+	case datagram, ok := <-c.received:
 		if !ok {
 			err = net.ErrClosed
 			return
 		}
-		addr = datagram.PeerID
-		n = copy(p, datagram.TryDecrypt(c.cfg.SymmAlgo))
-		return
-	case datagram, ok := <-c.udpConn.Datagrams():
-		if !ok {
-			err = net.ErrClosed
+		return copy(p, datagram.Data), datagram.PeerID, nil
+	}
+}
+
+// receiveLoop decrypts the datagrams of all transports independent of ReadFrom, so the handshakes
+// and keepalives of the SymmAlgo are processed even if the application only writes
+func (c *PacketConn) receiveLoop() {
+	defer close(c.received)
+	for {
+		select {
+		case <-c.closeChan:
 			return
+		case datagram, ok := <-c.wsConn.Datagrams():
+			if !ok {
+				return
+			}
+			c.receive(datagram, transportServerRelay)
+		case datagram, ok := <-c.udpConn.Datagrams():
+			if !ok {
+				return
+			}
+			c.receive(datagram, langs.IfElse(datagram.Relayed, transportPeerRelay, transportDirect))
 		}
-		addr = datagram.PeerID
-		n = copy(p, datagram.TryDecrypt(c.cfg.SymmAlgo))
+	}
+}
+
+// receive passes the decrypted datagram to ReadFrom, it blocks until ReadFrom takes it or the conn is closed,
+// so a slow reader applies backpressure to the transports
+func (c *PacketConn) receive(datagram *disco.Datagram, transport transport) {
+	if !c.cfg.AuthorizedPeers.Allowed(datagram.PeerID) {
+		return
+	}
+	b, ok := c.decrypt(datagram)
+	if !ok {
 		return
 	}
+	c.stats.rx(datagram.PeerID, transport, len(b))
+	select {
+	case c.received <- &disco.Datagram{PeerID: datagram.PeerID, Data: b}:
+	case <-c.closeChan:
+	}
+}
+
+// decrypt decrypts the datagram, false is returned if the datagram must be dropped.
+// The datagrams failed to decrypt are dropped, so peers with another key or pre-shared key can not inject packets
+func (c *PacketConn) decrypt(datagram *disco.Datagram) ([]byte, bool) {
+	b, err := datagram.Decrypt(c.cfg.SymmAlgo)
+	if errors.Is(err, secure.ErrReplayed) {
+		slog.Debug("Datagram replayed", "peer", datagram.PeerID)
+		c.stats.replayDrops.Add(1)
+		return nil, false
+	}
+	if errors.Is(err, secure.ErrHandshake) {
+		return nil, false
+	}
+	if err != nil {
+		slog.Debug("Datagram decrypt error", "peer", datagram.PeerID, "err", err)
+		c.stats.decryptFailures.Add(1)
+		return nil, false
+	}
+	return b, true
 }
 
 // WriteTo writes a packet with payload p to addr.
@@ -108,36 +166,77 @@ func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	default:
 	}
 
+	if !c.cfg.AuthorizedPeers.Allowed(addr.(disco.PeerID)) {
+		return 0, ErrPeerNotAuthorized
+	}
+
 	datagram := disco.Datagram{PeerID: addr.(disco.PeerID), Data: p}
-	p = datagram.TryEncrypt(c.cfg.SymmAlgo)
+	b, err := c.encrypt(&datagram)
+	if errors.Is(err, secure.ErrHandshake) {
+		return len(p), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return c.write(b, datagram.PeerID)
+}
 
+// write writes the encrypted packet to peer directly or through relays
+func (c *PacketConn) write(p []byte, peerID disco.PeerID) (n int, err error) {
 	if c.transportMode == MODE_FORCE_RELAY {
-		return len(p), c.wsConn.WriteTo(p, datagram.PeerID, disco.CONTROL_RELAY)
+		return c.writeToServerRelay(p, peerID)
 	}
 
 	if c.transportMode == MODE_FORCE_PEER_RELAY {
-		relay := c.relayPeer(datagram.PeerID)
+		relay := c.relayPeer(peerID)
 		if relay == "" {
 			return 0, ErrNoRelayPeer
 		}
-		return c.udpConn.RelayTo(relay, p, datagram.PeerID)
+		if n, err = c.udpConn.RelayTo(relay, p, peerID); err == nil {
+			c.stats.tx(peerID, transportPeerRelay, len(p))
+		}
+		return
 	}
 
-	if n, err = c.udpConn.WriteTo(p, datagram.PeerID); err == nil {
+	if n, err = c.udpConn.WriteTo(p, peerID); err == nil {
+		c.stats.tx(peerID, transportDirect, n)
 		return
 	}
 
 	if !errors.Is(err, udp.ErrUDPConnInactive) {
-		c.TryLeadDisco(datagram.PeerID)
+		c.TryLeadDisco(peerID)
 	}
 
-	if relay := c.relayPeer(datagram.PeerID); relay != "" {
-		if n, err = c.udpConn.RelayTo(relay, p, datagram.PeerID); err == nil {
+	if relay := c.relayPeer(peerID); relay != "" {
+		if n, err = c.udpConn.RelayTo(relay, p, peerID); err == nil {
+			c.stats.tx(peerID, transportPeerRelay, len(p))
 			return
 		}
 	}
 
-	return len(p), c.wsConn.WriteTo(p, datagram.PeerID, disco.CONTROL_RELAY)
+	return c.writeToServerRelay(p, peerID)
+}
+
+func (c *PacketConn) writeToServerRelay(p []byte, peerID disco.PeerID) (int, error) {
+	if err := c.wsConn.WriteTo(p, peerID, disco.CONTROL_RELAY); err != nil {
+		return len(p), err
+	}
+	c.stats.tx(peerID, transportServerRelay, len(p))
+	return len(p), nil
+}
+
+// encrypt encrypts the datagram, secure.ErrHandshake is returned if the datagram is queued by the handshake.
+// The datagram is never sent in plaintext when encryption fails
+func (c *PacketConn) encrypt(datagram *disco.Datagram) ([]byte, error) {
+	if c.cfg.SymmAlgo == nil {
+		return datagram.Data, nil
+	}
+	b, err := c.cfg.SymmAlgo.Encrypt(datagram.Data, datagram.PeerID.String())
+	if err != nil && !errors.Is(err, secure.ErrHandshake) {
+		slog.Debug("Datagram encrypt error", "peer", datagram.PeerID, "err", err)
+		c.stats.encryptFailures.Add(1)
+	}
+	return b, err
 }
 
 // Close closes the connection.
@@ -238,7 +337,12 @@ func (c *PacketConn) ServerStream() io.ReadWriter {
 	return c.wsConn
 }
 
-// ServerURL is the connected peermap server url
+// IPLease returns the addresses leased by the peermap server, see RequestIPLease
+func (c *PacketConn) IPLease() disco.IPLease {
+	return c.wsConn.IPLease()
+}
+
+// ServerURL is the active peermap server url, it changes when failover to another server
 func (c *PacketConn) ServerURL() string {
 	return c.wsConn.ServerURL()
 }
@@ -261,10 +365,30 @@ func (c *PacketConn) SharedKey(peerID disco.PeerID) ([]byte, error) {
 	return c.cfg.SymmAlgo.SecretKey()(peerID.String())
 }
 
+// PeerStats get the traffic counters of all peers
+func (c *PacketConn) PeerStats() map[disco.PeerID]PeerStat {
+	return c.stats.peerStats()
+}
+
+// CryptoStat get the counters of datagram encryption failures
+func (c *PacketConn) CryptoStat() CryptoStat {
+	return CryptoStat{
+		EncryptFailures: c.stats.encryptFailures.Load(),
+		DecryptFailures: c.stats.decryptFailures.Load(),
+		ReplayDrops:     c.stats.replayDrops.Load(),
+	}
+}
+
+// DiscoStats get the counters of the udp hole punching
+func (c *PacketConn) DiscoStats() udp.DiscoStats {
+	return c.udpConn.DiscoStats()
+}
+
 // PeerMeta find peer metadata from all found peers
 func (c *PacketConn) PeerMeta(peerID disco.PeerID) url.Values {
-	c.peerMapMutex.RLock()
-	defer c.peerMapMutex.RUnlock()
+	// the lru cache reorders on Get
+	c.peerMapMutex.Lock()
+	defer c.peerMapMutex.Unlock()
 	if meta, ok := c.peerMap.Get(peerID); ok {
 		return meta
 	}
@@ -276,11 +400,43 @@ func (c *PacketConn) NodeInfo() NodeInfo {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	natInfo := c.udpConn.DetectNAT(ctx, c.wsConn.STUNs())
-	return NodeInfo{
+	info := NodeInfo{
 		ID:      c.cfg.PeerInfo.ID,
 		Meta:    c.cfg.PeerInfo.Metadata,
 		NATInfo: natInfo,
 	}
+	if err := c.wsConn.ServerError(); err != nil {
+		info.ServerError = err.Error()
+	}
+	return info
+}
+
+// AuthorizedPeers returns the allowlist of peers, nil if all peers are allowed
+func (c *PacketConn) AuthorizedPeers() *AuthorizedPeers {
+	return c.cfg.AuthorizedPeers
+}
+
+// applyAuthorizedPeers re-evaluates the online peers after the authorized peers are changed
+func (c *PacketConn) applyAuthorizedPeers() {
+	c.peerMapMutex.Lock()
+	peers := make(map[disco.PeerID]url.Values, len(c.peerOnline))
+	for peerID := range c.peerOnline {
+		peers[peerID], _ = c.peerMap.Get(peerID)
+	}
+	c.peerMapMutex.Unlock()
+	for peerID, meta := range peers {
+		if !c.cfg.AuthorizedPeers.AllowedMeta(peerID, meta) {
+			if onLeave := c.cfg.OnPeerLeave; onLeave != nil {
+				onLeave(peerID)
+			}
+			continue
+		}
+		c.udpConn.GenerateLocalAddrsSends(peerID, c.wsConn.STUNs())
+		c.TryLeadDisco(peerID)
+		if onPeer := c.cfg.OnPeer; onPeer != nil {
+			onPeer(peerID, meta)
+		}
+	}
 }
 
 // relayPeer find the suitable relay peer
@@ -290,7 +446,7 @@ func (c *PacketConn) relayPeer(peerID disco.PeerID) disco.PeerID {
 		for range len(peers) {
 			index := c.relayPeerIndex.Add(1) % uint64(len(peers))
 			p := peers[index]
-			if p.PeerID == peerID {
+			if p.PeerID == peerID || !c.cfg.AuthorizedPeers.Allowed(p.PeerID) {
 				continue
 			}
 			meta := c.PeerMeta(p.PeerID)
@@ -372,29 +528,64 @@ func (c *PacketConn) eventsHandle() {
 		switch e.ControlCode {
 		case disco.CONTROL_NEW_PEER:
 			peer := e.Data.(*disco.Peer)
-			c.udpConn.GenerateLocalAddrsSends(peer.ID, c.wsConn.STUNs())
+			if err := c.verifyPeerMeta(peer.ID, peer.Metadata); err != nil {
+				slog.Warn("[P2P] Ignore the peer", "peer", peer.ID, "err", err)
+				return
+			}
 			c.peerMapMutex.Lock()
 			c.peerMap.Put(peer.ID, peer.Metadata)
+			c.peerOnline[peer.ID] = struct{}{}
 			c.peerMapMutex.Unlock()
+			if !c.cfg.AuthorizedPeers.AllowedMeta(peer.ID, peer.Metadata) {
+				slog.Info("[P2P] Ignore the unauthorized peer", "peer", peer.ID)
+				return
+			}
+			c.udpConn.GenerateLocalAddrsSends(peer.ID, c.wsConn.STUNs())
 			if onPeer := c.cfg.OnPeer; onPeer != nil {
 				go onPeer(peer.ID, peer.Metadata)
 			}
 		case disco.CONTROL_PEER_LEAVE:
+			c.peerMapMutex.Lock()
+			delete(c.peerOnline, e.Data.(disco.PeerID))
+			c.peerMapMutex.Unlock()
+			c.stats.forget(e.Data.(disco.PeerID))
 			if onLeave := c.cfg.OnPeerLeave; onLeave != nil {
 				go onLeave(e.Data.(disco.PeerID))
 			}
 		case disco.CONTROL_UPDATE_META:
 			peer := e.Data.(*disco.Peer)
+			if peer.ID.Len() == 0 { // network metadata
+				if onNetworkMeta := c.cfg.OnNetworkMeta; onNetworkMeta != nil {
+					onNetworkMeta(peer.Metadata)
+				}
+				return
+			}
+			if err := c.verifyPeerMeta(peer.ID, peer.Metadata); err != nil {
+				slog.Warn("[P2P] Ignore the peer metadata update", "peer", peer.ID, "err", err)
+				return
+			}
 			c.peerMapMutex.Lock()
 			c.peerMap.Put(peer.ID, peer.Metadata)
 			c.peerMapMutex.Unlock()
+			if !c.cfg.AuthorizedPeers.AllowedMeta(peer.ID, peer.Metadata) {
+				if onLeave := c.cfg.OnPeerLeave; onLeave != nil {
+					onLeave(peer.ID)
+				}
+				return
+			}
 			if onPeer := c.cfg.OnPeer; onPeer != nil {
 				onPeer(peer.ID, peer.Metadata)
 			}
 		case disco.CONTROL_NEW_PEER_UDP_ADDR:
-			c.udpConn.RunDiscoMessageSendLoop(e.Data.(disco.Endpoint))
+			if endpoint := e.Data.(disco.Endpoint); c.cfg.AuthorizedPeers.Allowed(endpoint.ID) {
+				c.udpConn.RunDiscoMessageSendLoop(endpoint)
+			}
 		case disco.CONTROL_SERVER_CONNECTED:
 			go c.udpConn.DetectNAT(context.Background(), c.wsConn.STUNs())
+		case disco.CONTROL_IP_LEASE_CHANGED:
+			if onIPLeaseChange := c.cfg.OnIPLeaseChange; onIPLeaseChange != nil {
+				onIPLeaseChange(e.Data.(disco.IPLease))
+			}
 		}
 	}
 
@@ -460,6 +651,14 @@ func ListenPacketContext(ctx context.Context, server *disco.Server, opts ...Opti
 			return nil, fmt.Errorf("config error: %w", err)
 		}
 	}
+	if cfg.privateKey != nil {
+		if cfg.PeerInfo.Metadata == nil {
+			cfg.PeerInfo.Metadata = url.Values{}
+		}
+		if err := signMeta(cfg.privateKey, cfg.PeerInfo.ID, cfg.PeerInfo.Metadata); err != nil {
+			return nil, fmt.Errorf("sign peer metadata: %w", err)
+		}
+	}
 
 	udpConn, err := udp.ListenUDP(udp.UDPConfig{
 		Port:                  cfg.UDPPort,
@@ -467,6 +666,8 @@ func ListenPacketContext(ctx context.Context, server *disco.Server, opts ...Opti
 		DisableIPv6:           cfg.DisableIPv6,
 		ID:                    cfg.PeerInfo.ID,
 		PeerKeepaliveInterval: cfg.KeepAlivePeriod,
+		AuthorizePeer:         cfg.AuthorizedPeers.Allowed,
+		ListenUDP:             cfg.ListenUDP,
 	})
 	if err != nil {
 		return nil, err
@@ -485,9 +686,28 @@ func ListenPacketContext(ctx context.Context, server *disco.Server, opts ...Opti
 		udpConn:      udpConn,
 		wsConn:       wsConn,
 		peerMap:      lru.New[disco.PeerID, url.Values](1024),
+		peerOnline:   make(map[disco.PeerID]struct{}),
+		metaSignTime: make(map[disco.PeerID]int64),
 		discoCooling: lru.New[disco.PeerID, time.Time](1024),
+		received:     make(chan *disco.Datagram, 1024),
+	}
+	if cfg.AuthorizedPeers != nil {
+		cfg.AuthorizedPeers.setOnChange(pc.applyAuthorizedPeers)
+	}
+	if binder, ok := cfg.SymmAlgo.(secure.LocalBinder); ok {
+		binder.BindLocal(cfg.PeerInfo.ID.String())
+	}
+	if binder, ok := cfg.SymmAlgo.(secure.StaticKeyBinder); ok && cfg.privateKey != nil {
+		binder.BindStaticKey(cfg.privateKey)
+	}
+	if handshaker, ok := cfg.SymmAlgo.(secure.Handshaker); ok {
+		handshaker.BindSender(func(b []byte, pubKey string) error {
+			_, err := pc.write(b, disco.PeerID(pubKey))
+			return err
+		})
 	}
 	go pc.eventsHandle()
 	go pc.networkChangeDetect()
+	go pc.receiveLoop()
 	return &pc, nil
 }
@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/secure/xeddsa"
+	"storj.io/common/base58"
+)
+
+var (
+	ErrPeerMetaUnsigned     = errors.New("peer metadata is not signed")
+	ErrPeerMetaBadSignature = errors.New("peer metadata signature mismatch")
+	ErrPeerMetaReplayed     = errors.New("peer metadata is older than the one seen")
+)
+
+// signMeta signs the self-asserted metadata with the private key bound to the peer id.
+// The signed keys are listed in `sigkeys`, keys added by the peermap server later
+// (e.g. nat, addr) are not covered. The signing time `sigts` is signed as well, so
+// the stale metadata can not be replayed
+func signMeta(privateKey *ecdh.PrivateKey, peerID disco.PeerID, meta url.Values) error {
+	meta.Del("sig")
+	meta.Del("sigkeys")
+	meta.Set("sigts", strconv.FormatInt(time.Now().UnixNano(), 10))
+	var keys []string
+	for k := range meta {
+		if k != "ipam" { // removed by the peermap server
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	sig, err := xeddsa.Sign(privateKey, metaSignedMessage(peerID, meta, keys))
+	if err != nil {
+		return err
+	}
+	meta.Set("sigkeys", strings.Join(keys, ","))
+	meta.Set("sig", base58.Encode(sig))
+	return nil
+}
+
+// verifyMeta verifies the metadata signature made by the peer, the signing time is returned.
+// The unsigned metadata is accepted with zero time unless required, so do the unsigned vpn
+// addresses which are leased by the peermap server
+func verifyMeta(peerID disco.PeerID, meta url.Values, required bool) (int64, error) {
+	sig := meta.Get("sig")
+	if sig == "" {
+		if required {
+			return 0, ErrPeerMetaUnsigned
+		}
+		return 0, nil
+	}
+	var keys []string
+	if sigkeys := meta.Get("sigkeys"); sigkeys != "" {
+		keys = strings.Split(sigkeys, ",")
+	}
+	if !slices.Contains(keys, "sigts") {
+		return 0, ErrPeerMetaBadSignature
+	}
+	signTime, err := strconv.ParseInt(meta.Get("sigts"), 10, 64)
+	if err != nil || signTime <= 0 {
+		return 0, ErrPeerMetaBadSignature
+	}
+	if !xeddsa.Verify(base58.Decode(peerID.String()), metaSignedMessage(peerID, meta, keys), base58.Decode(sig)) {
+		return 0, ErrPeerMetaBadSignature
+	}
+	if required {
+		for _, k := range []string{"alias1", "alias2", "label"} {
+			if meta.Has(k) && !slices.Contains(keys, k) {
+				return 0, ErrPeerMetaUnsigned
+			}
+		}
+	}
+	return signTime, nil
+}
+
+// verifyPeerMeta verifies the metadata of the peer. Once the peer is seen signing its metadata, the
+// unsigned metadata and the metadata signed before the latest one seen are rejected, so the peermap
+// server can not strip the signature or replay the stale metadata of the peer
+func (c *PacketConn) verifyPeerMeta(peerID disco.PeerID, meta url.Values) error {
+	c.peerMapMutex.Lock()
+	defer c.peerMapMutex.Unlock()
+	lastSignTime, signed := c.metaSignTime[peerID]
+	signTime, err := verifyMeta(peerID, meta, c.cfg.RequireSignedMeta || signed)
+	if err != nil {
+		return err
+	}
+	if signTime == 0 {
+		return nil
+	}
+	if signTime < lastSignTime {
+		return ErrPeerMetaReplayed
+	}
+	c.metaSignTime[peerID] = signTime
+	return nil
+}
+
+func metaSignedMessage(peerID disco.PeerID, meta url.Values, keys []string) []byte {
+	signed := url.Values{}
+	for _, k := range keys {
+		if v, ok := meta[k]; ok {
+			signed[k] = v
+		}
+	}
+	return []byte("peerguard meta\x00" + peerID.String() + "\x00" + strings.Join(keys, ",") + "\x00" + signed.Encode())
+}
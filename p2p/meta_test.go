@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/sigcn/pg/disco"
+	"storj.io/common/base58"
+)
+
+func signedMeta(t *testing.T, priv *ecdh.PrivateKey, meta url.Values) url.Values {
+	t.Helper()
+	if err := signMeta(priv, disco.PeerID(base58.Encode(priv.PublicKey().Bytes())), meta); err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+func TestVerifyMeta(t *testing.T) {
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	peerID := disco.PeerID(base58.Encode(priv.PublicKey().Bytes()))
+	meta := signedMeta(t, priv, url.Values{"alias1": {"100.64.0.1"}, "label": {"a", "b"}, "ipam": {"ipv4"}})
+
+	signTime, err := verifyMeta(peerID, meta, true)
+	if err != nil || strconv.FormatInt(signTime, 10) != meta.Get("sigts") {
+		t.Fatalf("verifyMeta = %d, %v", signTime, err)
+	}
+	// keys added by the peermap server are not covered
+	meta.Del("ipam")
+	meta.Set("nat", "easy")
+	if _, err := verifyMeta(peerID, meta, false); err != nil {
+		t.Errorf("verifyMeta with the server keys: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(meta url.Values)
+		err    error
+	}{
+		{"alias", func(meta url.Values) { meta.Set("alias1", "100.64.0.2") }, ErrPeerMetaBadSignature},
+		{"label", func(meta url.Values) { meta.Add("label", "c") }, ErrPeerMetaBadSignature},
+		{"time", func(meta url.Values) { meta.Set("sigts", "1") }, ErrPeerMetaBadSignature},
+		{"no time", func(meta url.Values) { meta.Set("sigkeys", "alias1,label") }, ErrPeerMetaBadSignature},
+		{"unsigned alias", func(meta url.Values) { meta.Set("alias2", "fd00::2") }, ErrPeerMetaUnsigned},
+		{"unsigned", func(meta url.Values) { meta.Del("sig") }, ErrPeerMetaUnsigned},
+	}
+	for _, c := range cases {
+		modified := url.Values{}
+		for k, v := range meta {
+			modified[k] = append([]string(nil), v...)
+		}
+		c.modify(modified)
+		if _, err := verifyMeta(peerID, modified, true); !errors.Is(err, c.err) {
+			t.Errorf("%s: verifyMeta = %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if _, err := verifyMeta(disco.PeerID(base58.Encode(other.PublicKey().Bytes())), meta, false); !errors.Is(err, ErrPeerMetaBadSignature) {
+		t.Errorf("metadata of another peer: %v", err)
+	}
+	if _, err := verifyMeta(peerID, url.Values{"alias1": {"100.64.0.1"}}, false); err != nil {
+		t.Errorf("unsigned metadata is not required: %v", err)
+	}
+}
+
+func TestVerifyPeerMeta(t *testing.T) {
+	c := PacketConn{metaSignTime: make(map[disco.PeerID]int64)}
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	peerID := disco.PeerID(base58.Encode(priv.PublicKey().Bytes()))
+
+	if err := c.verifyPeerMeta(peerID, url.Values{"alias1": {"100.64.0.1"}}); err != nil {
+		t.Fatalf("unsigned metadata before signed: %v", err)
+	}
+	stale := signedMeta(t, priv, url.Values{"alias1": {"100.64.0.1"}})
+	latest := signedMeta(t, priv, url.Values{"alias1": {"100.64.0.2"}})
+	if err := c.verifyPeerMeta(peerID, latest); err != nil {
+		t.Fatal(err)
+	}
+	// the same metadata is broadcast again after the server keys updated
+	if err := c.verifyPeerMeta(peerID, latest); err != nil {
+		t.Errorf("metadata broadcast again: %v", err)
+	}
+	if err := c.verifyPeerMeta(peerID, stale); !errors.Is(err, ErrPeerMetaReplayed) {
+		t.Errorf("stale metadata: %v", err)
+	}
+	if err := c.verifyPeerMeta(peerID, url.Values{"alias1": {"100.64.0.1"}}); !errors.Is(err, ErrPeerMetaUnsigned) {
+		t.Errorf("unsigned metadata after signed: %v", err)
+	}
+}
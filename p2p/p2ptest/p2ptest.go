@@ -0,0 +1,258 @@
+// Package p2ptest runs a peermap server and the p2p peers in process, so the tests cover
+// the control plane, websocket signaling, udp hole punching and crypto without external services
+package p2ptest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/disco/udp"
+	"github.com/sigcn/pg/p2p"
+	"github.com/sigcn/pg/peermap"
+	"github.com/sigcn/pg/peermap/config"
+	"github.com/sigcn/pg/stun"
+)
+
+// Network is a peermap server listening on an ephemeral loopback port and the peers joined it.
+// Two stun servers run on the loopback as well, so the peers see themselves behind an easy NAT
+// and can relay packets for each other
+type Network struct {
+	ID      string // network of the peers
+	URL     string // peermap server url, e.g. http://127.0.0.1:34567/pg
+	PeerMap *peermap.PeerMap
+
+	cfg         config.Config
+	peerOptions []p2p.Option
+	disableSTUN bool
+
+	stuns  []*net.UDPConn
+	cancel context.CancelFunc
+	served chan struct{}
+
+	mut   sync.Mutex
+	peers []*p2p.PacketConn
+}
+
+type Option func(n *Network) error
+
+// NetworkID sets the network of the peers, default is p2ptest
+func NetworkID(id string) Option {
+	return func(n *Network) error {
+		if id == "" {
+			return errors.New("network id is required")
+		}
+		n.ID = id
+		return nil
+	}
+}
+
+// PeerMapConfig modifies the peermap server config, the listen address and stun servers are overwritten
+func PeerMapConfig(modify func(cfg *config.Config)) Option {
+	return func(n *Network) error {
+		modify(&n.cfg)
+		return nil
+	}
+}
+
+// PeerOptions are applied to all the peers after the generated key and the ephemeral udp port
+func PeerOptions(opts ...p2p.Option) Option {
+	return func(n *Network) error {
+		n.peerOptions = append(n.peerOptions, opts...)
+		return nil
+	}
+}
+
+// DisableSTUN runs no stun server, the peers find each other by the lan addresses only
+func DisableSTUN() Option {
+	return func(n *Network) error {
+		n.disableSTUN = true
+		return nil
+	}
+}
+
+// NewNetwork starts the peermap server and joins the peers to it
+func NewNetwork(peers int, opts ...Option) (*Network, error) {
+	n := Network{ID: "p2ptest", served: make(chan struct{})}
+	for _, opt := range opts {
+		if err := opt(&n); err != nil {
+			return nil, err
+		}
+	}
+	if err := n.start(); err != nil {
+		n.Close()
+		return nil, err
+	}
+	for range peers {
+		if _, err := n.AddPeer(); err != nil {
+			n.Close()
+			return nil, err
+		}
+	}
+	return &n, nil
+}
+
+func (n *Network) start() error {
+	n.cfg.STUNs = nil
+	if !n.disableSTUN {
+		for range 2 {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				return fmt.Errorf("listen stun: %w", err)
+			}
+			n.stuns = append(n.stuns, conn)
+			n.cfg.STUNs = append(n.cfg.STUNs, conn.LocalAddr().String())
+			go serveSTUN(conn)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("listen peermap: %w", err)
+	}
+	n.cfg.Listen = ln.Addr().String()
+	n.PeerMap, err = peermap.New(n.cfg)
+	if err != nil {
+		ln.Close()
+		return fmt.Errorf("new peermap: %w", err)
+	}
+	n.URL = fmt.Sprintf("http://%s/pg", ln.Addr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n.cancel = cancel
+	go func() {
+		defer close(n.served)
+		if err := n.PeerMap.ServeListener(ctx, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			n.cancel()
+		}
+	}()
+	return nil
+}
+
+// AddPeer joins a new peer with a generated curve25519 key and a new network secret
+func (n *Network) AddPeer(opts ...p2p.Option) (*p2p.PacketConn, error) {
+	secret, err := n.PeerMap.Grant(n.ID, "")
+	if err != nil {
+		return nil, fmt.Errorf("grant secret: %w", err)
+	}
+	server, err := disco.NewServer(n.URL, &secret)
+	if err != nil {
+		return nil, err
+	}
+	options := append([]p2p.Option{p2p.ListenPeerSecure(), p2p.ListenUDPPort(0)}, n.peerOptions...)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	peer, err := p2p.ListenPacketContext(ctx, server, append(options, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	n.peers = append(n.peers, peer)
+	return peer, nil
+}
+
+// Peers returns the peers in the joined order
+func (n *Network) Peers() []*p2p.PacketConn {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	return slices.Clone(n.peers)
+}
+
+// SetTransportMode forces all the peers to the transport, see p2p.PacketConn.SetTransportMode.
+// p2p.MODE_FORCE_PEER_RELAY needs a third peer which has direct paths to both sides
+func (n *Network) SetTransportMode(mode p2p.TransportMode) {
+	for _, peer := range n.Peers() {
+		peer.SetTransportMode(mode)
+	}
+}
+
+// WaitPeers waits until every peer is notified of all the others by the peermap server
+func (n *Network) WaitPeers(ctx context.Context) error {
+	return n.wait(ctx, func(a, b *p2p.PacketConn) bool {
+		return a.PeerMeta(b.LocalAddr().(disco.PeerID)) != nil
+	})
+}
+
+// WaitDirect waits until the udp hole punching between the two peers succeeded
+func (n *Network) WaitDirect(ctx context.Context, a, b *p2p.PacketConn) error {
+	return waitUntil(ctx, func() bool {
+		return direct(a, b) && direct(b, a)
+	})
+}
+
+// WaitAllDirect waits until every pair of the peers has a direct path
+func (n *Network) WaitAllDirect(ctx context.Context) error {
+	return n.wait(ctx, direct)
+}
+
+// Close closes all the peers, the peermap server and the stun servers
+func (n *Network) Close() error {
+	for _, peer := range n.Peers() {
+		peer.Close()
+	}
+	if n.cancel != nil {
+		n.cancel()
+		<-n.served
+	}
+	for _, conn := range n.stuns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (n *Network) wait(ctx context.Context, ready func(a, b *p2p.PacketConn) bool) error {
+	return waitUntil(ctx, func() bool {
+		peers := n.Peers()
+		for _, a := range peers {
+			for _, b := range peers {
+				if a != b && !ready(a, b) {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+func waitUntil(ctx context.Context, ready func() bool) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for !ready() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// direct reports whether a has the direct path to b
+func direct(a, b *p2p.PacketConn) bool {
+	return slices.ContainsFunc(a.PeerStore().Peers(), func(p udp.PeerState) bool {
+		return p.PeerID == b.LocalAddr().(disco.PeerID)
+	})
+}
+
+// serveSTUN answers the binding requests with the source address
+func serveSTUN(conn *net.UDPConn) {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		txID, err := stun.ParseBindingRequest(buf[:n])
+		if err != nil {
+			continue
+		}
+		conn.WriteToUDPAddrPort(stun.Response(txID, addr), addr)
+	}
+}
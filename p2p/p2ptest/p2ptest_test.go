@@ -0,0 +1,104 @@
+package p2ptest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sigcn/pg/p2p"
+	"github.com/sigcn/pg/p2p/p2ptest"
+)
+
+func TestNetwork(t *testing.T) {
+	network, err := p2ptest.NewNetwork(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer network.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := network.WaitPeers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := network.Peers()[0], network.Peers()[1]
+	for _, mode := range []p2p.TransportMode{p2p.MODE_FORCE_RELAY, p2p.MODE_DEFAULT} {
+		network.SetTransportMode(mode)
+		if err := exchange(a, b, []byte("hello")); err != nil {
+			t.Fatalf("mode %v: %v", mode, err)
+		}
+	}
+	if err := network.WaitDirect(ctx, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := exchange(a, b, []byte("direct")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPSKMismatch(t *testing.T) {
+	network, err := p2ptest.NewNetwork(2, p2ptest.PeerOptions(p2p.ListenPeerPSK([]byte("0123456789abcdef"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer network.Close()
+	intruder, err := network.AddPeer(p2p.ListenPeerPSK([]byte("fedcba9876543210")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := network.WaitPeers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	network.SetTransportMode(p2p.MODE_FORCE_RELAY)
+
+	a, b := network.Peers()[0], network.Peers()[1]
+	// the relayed packets of the intruder and b are not ordered, b keeps sending until the intruder one is dropped
+	for a.CryptoStat().DecryptFailures == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the packet of the intruder is not counted as a decrypt failure")
+		}
+		if _, err := intruder.WriteTo([]byte("injected"), a.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if err := exchange(b, a, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// exchange sends the message from a to b and checks b receives exactly it
+func exchange(a, b *p2p.PacketConn, msg []byte) error {
+	errChan := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		b.SetReadDeadline(time.Now().Add(5 * time.Second))
+		defer b.SetReadDeadline(time.Time{})
+		n, addr, err := b.ReadFrom(buf)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		if addr.String() != a.LocalAddr().String() || !bytes.Equal(buf[:n], msg) {
+			errChan <- errors.New("unexpected packet " + string(buf[:n]) + " from " + addr.String())
+			return
+		}
+		errChan <- nil
+	}()
+	// resend until received, the first packets may be dropped during hole punching
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := a.WriteTo(msg, b.LocalAddr()); err != nil {
+			return err
+		}
+		select {
+		case err := <-errChan:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sigcn/pg/disco"
+)
+
+type transport int
+
+const (
+	transportDirect transport = iota
+	transportPeerRelay
+	transportServerRelay
+)
+
+// TrafficStat is the packets and bytes counters of one transport
+type TrafficStat struct {
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+}
+
+// PeerStat is the traffic counters with a peer split by transport
+type PeerStat struct {
+	Direct      TrafficStat `json:"direct"`
+	PeerRelay   TrafficStat `json:"peer_relay"`
+	ServerRelay TrafficStat `json:"server_relay"`
+}
+
+// CryptoStat is the counters of datagram encryption failures
+type CryptoStat struct {
+	EncryptFailures uint64 `json:"encrypt_failures"`
+	DecryptFailures uint64 `json:"decrypt_failures"`
+	ReplayDrops     uint64 `json:"replay_drops"`
+}
+
+type trafficCounter struct {
+	rxPackets, rxBytes atomic.Uint64
+	txPackets, txBytes atomic.Uint64
+}
+
+func (c *trafficCounter) load() TrafficStat {
+	return TrafficStat{
+		RxPackets: c.rxPackets.Load(),
+		RxBytes:   c.rxBytes.Load(),
+		TxPackets: c.txPackets.Load(),
+		TxBytes:   c.txBytes.Load(),
+	}
+}
+
+type stats struct {
+	peers           sync.Map // disco.PeerID as key, *[3]trafficCounter as value
+	encryptFailures atomic.Uint64
+	decryptFailures atomic.Uint64
+	replayDrops     atomic.Uint64
+}
+
+func (s *stats) counter(peerID disco.PeerID, t transport) *trafficCounter {
+	v, ok := s.peers.Load(peerID)
+	if !ok {
+		v, _ = s.peers.LoadOrStore(peerID, &[3]trafficCounter{})
+	}
+	return &v.(*[3]trafficCounter)[t]
+}
+
+func (s *stats) rx(peerID disco.PeerID, t transport, n int) {
+	c := s.counter(peerID, t)
+	c.rxPackets.Add(1)
+	c.rxBytes.Add(uint64(n))
+}
+
+func (s *stats) tx(peerID disco.PeerID, t transport, n int) {
+	c := s.counter(peerID, t)
+	c.txPackets.Add(1)
+	c.txBytes.Add(uint64(n))
+}
+
+// forget drops the counters of the peer left the network
+func (s *stats) forget(peerID disco.PeerID) {
+	s.peers.Delete(peerID)
+}
+
+func (s *stats) peerStats() map[disco.PeerID]PeerStat {
+	ret := make(map[disco.PeerID]PeerStat)
+	s.peers.Range(func(key, value any) bool {
+		counters := value.(*[3]trafficCounter)
+		ret[key.(disco.PeerID)] = PeerStat{
+			Direct:      counters[transportDirect].load(),
+			PeerRelay:   counters[transportPeerRelay].load(),
+			ServerRelay: counters[transportServerRelay].load(),
+		}
+		return true
+	})
+	return ret
+}
@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sigcn/pg/disco"
 	"github.com/sigcn/pg/langs"
 	"github.com/sigcn/pg/peermap/api/types"
 	"github.com/sigcn/pg/peermap/auth"
@@ -27,10 +28,12 @@ var (
 type contextKey string
 
 type ApiV1 struct {
-	Config    config.Config
-	Auth      *auth.Authenticator
-	PeerStore types.PeerStore
-	Grant     oidc.Grant
+	Config      config.Config
+	Auth        *auth.Authenticator
+	Revocations *auth.RevocationList
+	PeerStore   types.PeerStore
+	Grant       oidc.Grant
+	Refresh     func(auth.JSONSecret) (disco.NetworkSecret, error)
 
 	mux      http.ServeMux
 	initOnce sync.Once
@@ -53,13 +56,17 @@ func (a *ApiV1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		langs.Err(err).MarshalTo(w)
 		return
 	}
+	if a.Revocations.Revoked(secret, "") {
+		auth.ErrRevoked.MarshalTo(w)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/api/v1/r5/") && !secret.Admin {
 		ErrForbidden.MarshalTo(w)
 		return
 	}
 	if time.Until(time.Unix(secret.Deadline, 0)) <
 		a.Config.SecretValidityPeriod-a.Config.SecretRotationPeriod {
-		if newSecret, err := a.Grant(secret.Network, langs.IfElse(secret.Admin, "PG_ADM", "")); err == nil {
+		if newSecret, err := a.Refresh(secret); err == nil {
 			b, _ := json.Marshal(newSecret)
 			w.Header().Add("X-Set-Token", string(b))
 		}
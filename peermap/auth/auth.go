@@ -1,21 +1,30 @@
 package auth
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"time"
 
 	"github.com/sigcn/pg/langs"
 	"github.com/sigcn/pg/secure/aescbc"
+	"github.com/sigcn/pg/secure/aesgcm"
 )
 
+// tokenV2 is the first byte of the AES-256-GCM sealed tokens, the legacy tokens are AES-CBC encrypted without the version
+const tokenV2 byte = 2
+
+var tokenV2AD = []byte("pg-secret-v2")
+
 var (
 	ErrInvalidToken = langs.Error{Code: 9000, Msg: "invalid token"}
 	ErrTokenExpired = langs.Error{Code: 9001, Msg: "token expired"}
 )
 
 type JSONSecret struct {
+	ID        string   `json:"id,omitzero"` // kept when the secret is refreshed, empty in the legacy secrets
 	Network   string   `json:"n"`
 	Admin     bool     `json:"adm,omitzero"`
 	Alias     string   `json:"n1,omitzero"`
@@ -27,10 +36,12 @@ type Net struct {
 	ID        string
 	Alias     string
 	Neighbors []string
+	SecretID  string // id of the refreshed secret, a new one is generated if empty
 }
 
 type Authenticator struct {
-	key []byte
+	key          []byte
+	rejectLegacy bool
 }
 
 func NewAuthenticator(key string) *Authenticator {
@@ -38,20 +49,36 @@ func NewAuthenticator(key string) *Authenticator {
 	return &Authenticator{key: sum[:]}
 }
 
+// RejectLegacy rejects the unauthenticated AES-CBC tokens, they are accepted by default during the transition period
+func (auth *Authenticator) RejectLegacy(reject bool) *Authenticator {
+	auth.rejectLegacy = reject
+	return auth
+}
+
 func (auth *Authenticator) GenerateSecret(n Net, validDuration time.Duration) (string, error) {
 	return auth.GenerateSecretAdmin(false, n, validDuration)
 }
 
 func (auth *Authenticator) GenerateSecretAdmin(adm bool, n Net, validDuration time.Duration) (string, error) {
+	secretID := n.SecretID
+	if secretID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		secretID = hex.EncodeToString(id)
+	}
 	b, _ := json.Marshal(JSONSecret{
+		ID:        secretID,
 		Network:   n.ID,
 		Admin:     adm,
 		Alias:     n.Alias,
 		Neighbors: n.Neighbors,
 		Deadline:  time.Now().Add(validDuration).Unix(),
 	})
-	chiperData, err := aescbc.Encrypt(auth.key, b)
-	return base64.URLEncoding.EncodeToString(chiperData), err
+	chiperData, err := aesgcm.Seal(auth.key, b, tokenV2AD)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(append([]byte{tokenV2}, chiperData...)), nil
 }
 
 func (auth *Authenticator) ParseSecret(networkIDChiper string) (JSONSecret, error) {
@@ -59,7 +86,7 @@ func (auth *Authenticator) ParseSecret(networkIDChiper string) (JSONSecret, erro
 	if err != nil {
 		return JSONSecret{}, ErrInvalidToken
 	}
-	plainData, err := aescbc.Decrypt(auth.key, chiperData)
+	plainData, err := auth.open(chiperData)
 	if err != nil {
 		return JSONSecret{}, ErrInvalidToken
 	}
@@ -75,3 +102,15 @@ func (auth *Authenticator) ParseSecret(networkIDChiper string) (JSONSecret, erro
 	}
 	return token, nil
 }
+
+func (auth *Authenticator) open(chiperData []byte) ([]byte, error) {
+	if len(chiperData) > 0 && chiperData[0] == tokenV2 {
+		if plainData, err := aesgcm.Open(auth.key, chiperData[1:], tokenV2AD); err == nil {
+			return plainData, nil
+		}
+	}
+	if auth.rejectLegacy {
+		return nil, ErrInvalidToken
+	}
+	return aescbc.Decrypt(auth.key, chiperData)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sigcn/pg/secure/aescbc"
+)
+
+func TestSecret(t *testing.T) {
+	auth := NewAuthenticator("key")
+	secret, err := auth.GenerateSecretAdmin(true, Net{ID: "pg", Alias: "alias", Neighbors: []string{"n1"}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := base64.URLEncoding.DecodeString(secret)
+	if b[0] != tokenV2 {
+		t.Fatalf("secret version %d", b[0])
+	}
+	token, err := auth.ParseSecret(secret)
+	if err != nil || token.Network != "pg" || !token.Admin || token.Alias != "alias" || token.ID == "" {
+		t.Fatalf("ParseSecret = %+v, %v", token, err)
+	}
+
+	// the refreshed secret keeps the id
+	refreshed, _ := auth.GenerateSecret(Net{ID: "pg", SecretID: token.ID}, time.Hour)
+	if token1, err := auth.ParseSecret(refreshed); err != nil || token1.ID != token.ID || token1.Admin {
+		t.Errorf("refreshed secret = %+v, %v", token1, err)
+	}
+
+	if _, err := NewAuthenticator("other").ParseSecret(secret); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("parsed with another key: %v", err)
+	}
+	b[len(b)-1] ^= 1
+	if _, err := auth.ParseSecret(base64.URLEncoding.EncodeToString(b)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("parsed the tampered secret: %v", err)
+	}
+	if _, err := auth.ParseSecret("!"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("parsed the invalid base64: %v", err)
+	}
+
+	expired, _ := auth.GenerateSecret(Net{ID: "pg"}, -time.Second)
+	if _, err := auth.ParseSecret(expired); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("parsed the expired secret: %v", err)
+	}
+}
+
+func TestLegacySecret(t *testing.T) {
+	auth := NewAuthenticator("key")
+	b, _ := json.Marshal(JSONSecret{Network: "pg", Deadline: time.Now().Add(time.Hour).Unix()})
+	chiperData, err := aescbc.Encrypt(auth.key, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := base64.URLEncoding.EncodeToString(chiperData)
+
+	token, err := auth.ParseSecret(legacy)
+	if err != nil || token.Network != "pg" || token.ID != "" {
+		t.Fatalf("ParseSecret legacy = %+v, %v", token, err)
+	}
+	if _, err := auth.RejectLegacy(true).ParseSecret(legacy); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("legacy secret is accepted: %v", err)
+	}
+}
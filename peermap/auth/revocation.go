@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sigcn/pg/langs"
+)
+
+var ErrRevoked = langs.Error{Code: 9002, Msg: "secret or peer is revoked"}
+
+const (
+	RevokeNetwork = "network"
+	RevokeSecret  = "secret"
+	RevokePeer    = "peer"
+)
+
+// Revocations is the revocation time of the networks, secret ids and peer ids
+type Revocations struct {
+	Networks map[string]time.Time `json:"networks,omitempty"`
+	Secrets  map[string]time.Time `json:"secrets,omitempty"`
+	Peers    map[string]time.Time `json:"peers,omitempty"`
+}
+
+// RevocationList rejects the revoked network secrets and peers. It is saved to the
+// json file if FilePath is not empty, or lives only in memory
+type RevocationList struct {
+	FilePath string
+
+	mut         sync.RWMutex
+	revocations *Revocations
+}
+
+// Revoked reports whether the secret or the peer is revoked, peerID can be empty
+func (l *RevocationList) Revoked(secret JSONSecret, peerID string) bool {
+	if l == nil {
+		return false
+	}
+	l.mut.RLock()
+	defer l.mut.RUnlock()
+	if l.revocations == nil {
+		return false
+	}
+	if _, ok := l.revocations.Networks[secret.Network]; ok {
+		return true
+	}
+	if _, ok := l.revocations.Secrets[secret.ID]; ok && secret.ID != "" {
+		return true
+	}
+	_, ok := l.revocations.Peers[peerID]
+	return ok && peerID != ""
+}
+
+// Revoke adds the network, secret id or peer id to the list
+func (l *RevocationList) Revoke(kind, id string) error {
+	return l.edit(kind, id, func(m map[string]time.Time) { m[id] = time.Now() })
+}
+
+// Unrevoke removes the network, secret id or peer id from the list
+func (l *RevocationList) Unrevoke(kind, id string) error {
+	return l.edit(kind, id, func(m map[string]time.Time) { delete(m, id) })
+}
+
+// List returns a copy of the revocations
+func (l *RevocationList) List() (Revocations, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if err := l.load(); err != nil {
+		return Revocations{}, err
+	}
+	return Revocations{
+		Networks: maps.Clone(l.revocations.Networks),
+		Secrets:  maps.Clone(l.revocations.Secrets),
+		Peers:    maps.Clone(l.revocations.Peers),
+	}, nil
+}
+
+// Load reads the revocations from the file
+func (l *RevocationList) Load() error {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return l.load()
+}
+
+func (l *RevocationList) edit(kind, id string, edit func(map[string]time.Time)) error {
+	if id == "" {
+		return errors.New("revocation id is required")
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if err := l.load(); err != nil {
+		return err
+	}
+	switch kind {
+	case RevokeNetwork:
+		edit(l.revocations.Networks)
+	case RevokeSecret:
+		edit(l.revocations.Secrets)
+	case RevokePeer:
+		edit(l.revocations.Peers)
+	default:
+		return fmt.Errorf("unknown revocation kind %q", kind)
+	}
+	return l.save()
+}
+
+func (l *RevocationList) load() error {
+	if l.revocations != nil {
+		return nil
+	}
+	var revocations Revocations
+	if l.FilePath != "" {
+		b, err := os.ReadFile(l.FilePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("revocation file(%s) open failed: %w", l.FilePath, err)
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &revocations); err != nil {
+				return fmt.Errorf("revocation file(%s) decode failed: %w", l.FilePath, err)
+			}
+		}
+	}
+	for _, m := range []*map[string]time.Time{&revocations.Networks, &revocations.Secrets, &revocations.Peers} {
+		if *m == nil {
+			*m = make(map[string]time.Time)
+		}
+	}
+	l.revocations = &revocations
+	return nil
+}
+
+func (l *RevocationList) save() error {
+	if l.FilePath == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(l.revocations, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temp file then rename it, the revocation file is never half written
+	f, err := os.CreateTemp(filepath.Dir(l.FilePath), filepath.Base(l.FilePath)+".*")
+	if err != nil {
+		return fmt.Errorf("revocation file(%s) create failed: %w", l.FilePath, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("revocation file(%s) write failed: %w", l.FilePath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("revocation file(%s) write failed: %w", l.FilePath, err)
+	}
+	if err := os.Rename(f.Name(), l.FilePath); err != nil {
+		return fmt.Errorf("revocation file(%s) replace failed: %w", l.FilePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+package peermap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sigcn/pg/disco"
+	exporterauth "github.com/sigcn/pg/peermap/exporter/auth"
+)
+
+type clusterOp byte
+
+const (
+	CLUSTER_PEER_UP   clusterOp = 1
+	CLUSTER_PEER_DOWN clusterOp = 2
+	CLUSTER_DELIVER   clusterOp = 3
+	CLUSTER_REVOKE    clusterOp = 4
+	CLUSTER_UNREVOKE  clusterOp = 5
+	CLUSTER_KICK      clusterOp = 6
+)
+
+func (op clusterOp) String() string {
+	switch op {
+	case CLUSTER_PEER_UP:
+		return "PEER_UP"
+	case CLUSTER_PEER_DOWN:
+		return "PEER_DOWN"
+	case CLUSTER_DELIVER:
+		return "DELIVER"
+	case CLUSTER_REVOKE:
+		return "REVOKE"
+	case CLUSTER_UNREVOKE:
+		return "UNREVOKE"
+	case CLUSTER_KICK:
+		return "KICK"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+// clusterFrame is the message exchanged between pgmap nodes
+//
+//	op(1) | networkLen(2) | network | peerIDLen(1) | peerID | payload
+type clusterFrame struct {
+	op      clusterOp
+	network string
+	peerID  disco.PeerID
+	payload []byte
+}
+
+func (f clusterFrame) marshal() []byte {
+	b := make([]byte, 0, 4+len(f.network)+len(f.peerID)+len(f.payload))
+	b = append(b, byte(f.op))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.network)))
+	b = append(b, f.network...)
+	b = append(b, f.peerID.Len())
+	b = append(b, f.peerID.Bytes()...)
+	return append(b, f.payload...)
+}
+
+func (f *clusterFrame) unmarshal(b []byte) error {
+	if len(b) < 4 {
+		return errors.New("cluster frame too short")
+	}
+	f.op = clusterOp(b[0])
+	netLen := int(binary.BigEndian.Uint16(b[1:3]))
+	if len(b) < 4+netLen {
+		return errors.New("cluster frame network truncated")
+	}
+	f.network = string(b[3 : 3+netLen])
+	peerLen := int(b[3+netLen])
+	s := 4 + netLen
+	if len(b) < s+peerLen {
+		return errors.New("cluster frame peer truncated")
+	}
+	f.peerID = disco.PeerID(b[s : s+peerLen])
+	f.payload = b[s+peerLen:]
+	return nil
+}
+
+// remotePeer is a peer connected to another pgmap node of the cluster
+type remotePeer struct {
+	node     string
+	network  string
+	id       disco.PeerID
+	metadata url.Values
+}
+
+// clusterNode is the outbound link to another pgmap node
+type clusterNode struct {
+	name string
+	conn *websocket.Conn
+	wMut sync.Mutex
+}
+
+func (n *clusterNode) send(f clusterFrame) error {
+	n.wMut.Lock()
+	defer n.wMut.Unlock()
+	return n.conn.WriteMessage(websocket.BinaryMessage, f.marshal())
+}
+
+// cluster shares peer locations between pgmap nodes, and forwards the
+// relay/disco frames to the node which the target peer is connected to
+type cluster struct {
+	pm            *PeerMap
+	name          string
+	nodeURLs      []string
+	authenticator *exporterauth.Authenticator
+
+	nodesMutex sync.RWMutex
+	nodes      map[string]*clusterNode
+
+	peersMutex sync.RWMutex
+	peers      map[string]*remotePeer
+}
+
+func (c *cluster) run(ctx context.Context) {
+	for _, nodeURL := range c.nodeURLs {
+		go c.runDialLoop(ctx, nodeURL)
+	}
+}
+
+func (c *cluster) runDialLoop(ctx context.Context, nodeURL string) {
+	for {
+		if err := c.dial(ctx, nodeURL); err != nil {
+			slog.Error("[Cluster] Connect", "node", nodeURL, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (c *cluster) dial(ctx context.Context, nodeURL string) error {
+	nodeServer, err := url.Parse(nodeURL)
+	if err != nil {
+		return fmt.Errorf("invalid node url: %w", err)
+	}
+	switch nodeServer.Scheme {
+	case "http":
+		nodeServer.Scheme = "ws"
+	case "https":
+		nodeServer.Scheme = "wss"
+	}
+	nodeServer.Path = path.Join(nodeServer.Path, "/cluster")
+	token, err := c.authenticator.GenerateToken(exporterauth.Instruction{ExpiredAt: time.Now().Add(10 * time.Second).Unix()})
+	if err != nil {
+		return err
+	}
+	handshake := http.Header{}
+	handshake.Set("X-Token", token)
+	handshake.Set("X-Node", c.name)
+	conn, httpResp, err := websocket.DefaultDialer.DialContext(ctx, nodeServer.String(), handshake)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	node := &clusterNode{name: httpResp.Header.Get("X-Node"), conn: conn}
+	if node.name == "" || node.name == c.name {
+		return fmt.Errorf("invalid node name %q", node.name)
+	}
+	c.nodesMutex.Lock()
+	c.nodes[node.name] = node
+	c.nodesMutex.Unlock()
+	defer func() {
+		c.nodesMutex.Lock()
+		if c.nodes[node.name] == node {
+			delete(c.nodes, node.name)
+		}
+		c.nodesMutex.Unlock()
+	}()
+	slog.Info("[Cluster] Connected", "node", node.name, "url", nodeURL)
+
+	// let the remote node know all peers connected to me
+	for _, p := range c.pm.localPeers() {
+		if err := node.send(clusterFrame{
+			op:      CLUSTER_PEER_UP,
+			network: p.networkSecret.Network,
+			peerID:  p.id,
+			payload: []byte(p.metadata.Encode()),
+		}); err != nil {
+			return err
+		}
+	}
+
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+	go func() {
+		ticker := time.NewTicker(12 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closeChan:
+				return
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+			}
+			node.wMut.Lock()
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+			node.wMut.Unlock()
+			if err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return fmt.Errorf("node %s disconnected: %w", node.name, err)
+		}
+	}
+}
+
+// HandleConnect accepts the inbound link from another pgmap node
+func (c *cluster) HandleConnect(w http.ResponseWriter, r *http.Request) {
+	if err := c.pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	nodeName := r.Header.Get("X-Node")
+	if nodeName == "" || nodeName == c.name {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	upgradeHeader := http.Header{}
+	upgradeHeader.Set("X-Node", c.name)
+	conn, err := c.pm.wsUpgrader.Upgrade(w, r, upgradeHeader)
+	if err != nil {
+		slog.Error("[Cluster] Upgrade", "node", nodeName, "err", err)
+		return
+	}
+	defer conn.Close()
+	defer c.removeNodePeers(nodeName)
+	slog.Info("[Cluster] Accepted", "node", nodeName)
+	for {
+		mt, b, err := conn.ReadMessage()
+		if err != nil {
+			slog.Info("[Cluster] Disconnected", "node", nodeName, "err", err)
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		var f clusterFrame
+		if err := f.unmarshal(b); err != nil {
+			slog.Error("[Cluster] InvalidFrame", "node", nodeName, "err", err)
+			continue
+		}
+		slog.Debug("[Cluster] Frame", "node", nodeName, "op", f.op, "network", f.network, "peer", f.peerID)
+		switch f.op {
+		case CLUSTER_PEER_UP:
+			c.handlePeerUp(nodeName, f)
+		case CLUSTER_PEER_DOWN:
+			c.handlePeerDown(nodeName, f)
+		case CLUSTER_DELIVER:
+			c.handleDeliver(f)
+		case CLUSTER_REVOKE, CLUSTER_UNREVOKE:
+			c.handleRevoke(f)
+		case CLUSTER_KICK:
+			c.handleKick(f)
+		}
+	}
+}
+
+func (c *cluster) handlePeerUp(nodeName string, f clusterFrame) {
+	meta, err := url.ParseQuery(string(f.payload))
+	if err != nil {
+		slog.Error("[Cluster] PeerUp", "peer", f.peerID, "err", err)
+		return
+	}
+	c.peersMutex.Lock()
+	_, exists := c.peers[f.peerID.String()]
+	rp := &remotePeer{node: nodeName, network: f.network, id: f.peerID, metadata: meta}
+	c.peers[f.peerID.String()] = rp
+	c.peersMutex.Unlock()
+
+	ctx, ok := c.pm.getNetwork(f.network)
+	if !ok {
+		return
+	}
+	if exists {
+		for _, target := range ctx.peerList(f.peerID) {
+			target.write(newPeerFrame(disco.CONTROL_UPDATE_META, rp.id, rp.metadata))
+		}
+		return
+	}
+	if meta.Has("silenceMode") || c.pm.cfg.PublicNetwork == f.network {
+		return
+	}
+	for _, target := range ctx.peerList(f.peerID) {
+		if target.metadata.Has("silenceMode") {
+			continue
+		}
+		target.leadRemoteDisco(rp)
+	}
+}
+
+func (c *cluster) handlePeerDown(nodeName string, f clusterFrame) {
+	c.peersMutex.Lock()
+	rp, ok := c.peers[f.peerID.String()]
+	if !ok || rp.node != nodeName {
+		c.peersMutex.Unlock()
+		return
+	}
+	delete(c.peers, f.peerID.String())
+	c.peersMutex.Unlock()
+	c.notifyLeave(rp)
+}
+
+func (c *cluster) handleDeliver(f clusterFrame) {
+	target, err := c.pm.getPeer(f.network, f.peerID)
+	if err != nil {
+		slog.Debug("[Cluster] Deliver", "err", err)
+		return
+	}
+	target.write(f.payload)
+}
+
+// handleRevoke applies the revocation made on another node to the local revocation list,
+// the frames are not forwarded, every node receives them from the origin node
+func (c *cluster) handleRevoke(f clusterFrame) {
+	revocation, err := url.ParseQuery(string(f.payload))
+	if err != nil {
+		slog.Error("[Cluster] Revoke", "err", err)
+		return
+	}
+	kind, id := revocation.Get("kind"), revocation.Get("id")
+	if f.op == CLUSTER_UNREVOKE {
+		err = c.pm.revocations.Unrevoke(kind, id)
+	} else {
+		err = c.pm.revocations.Revoke(kind, id)
+	}
+	if err != nil {
+		slog.Error("[Cluster] Revoke", "op", f.op, "kind", kind, "id", id, "err", err)
+		return
+	}
+	slog.Info("[Cluster] Revoke", "op", f.op, "kind", kind, "id", id)
+	if f.op == CLUSTER_REVOKE {
+		c.pm.disconnectRevoked()
+	}
+}
+
+func (c *cluster) handleKick(f clusterFrame) {
+	peer, err := c.pm.getPeer(f.network, f.peerID)
+	if err != nil {
+		slog.Debug("[Cluster] Kick", "err", err)
+		return
+	}
+	slog.Info("[Cluster] KickPeer", "network", f.network, "peer", f.peerID)
+	peer.Close()
+}
+
+func (c *cluster) removeNodePeers(nodeName string) {
+	var removed []*remotePeer
+	c.peersMutex.Lock()
+	for k, v := range c.peers {
+		if v.node == nodeName {
+			removed = append(removed, v)
+			delete(c.peers, k)
+		}
+	}
+	c.peersMutex.Unlock()
+	for _, rp := range removed {
+		c.notifyLeave(rp)
+	}
+}
+
+func (c *cluster) notifyLeave(rp *remotePeer) {
+	ctx, ok := c.pm.getNetwork(rp.network)
+	if !ok {
+		return
+	}
+	for _, target := range ctx.peerList(rp.id) {
+		target.write(newPeerFrame(disco.CONTROL_PEER_LEAVE, rp.id, nil))
+	}
+}
+
+// getPeer find the peer connected to another node, peers of the neighbor networks are included
+func (c *cluster) getPeer(network string, peerID disco.PeerID) (*remotePeer, bool) {
+	c.peersMutex.RLock()
+	rp, ok := c.peers[peerID.String()]
+	c.peersMutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if rp.network == network {
+		return rp, true
+	}
+	if ctx, ok := c.pm.getNetwork(network); ok && slices.Contains(ctx.neighbors, rp.network) {
+		return rp, true
+	}
+	return nil, false
+}
+
+// networkPeers returns the remote peers in the network
+func (c *cluster) networkPeers(network string) (peers []*remotePeer) {
+	c.peersMutex.RLock()
+	defer c.peersMutex.RUnlock()
+	for _, v := range c.peers {
+		if v.network == network {
+			peers = append(peers, v)
+		}
+	}
+	return
+}
+
+func (c *cluster) deliver(rp *remotePeer, b []byte) error {
+	c.nodesMutex.RLock()
+	node, ok := c.nodes[rp.node]
+	c.nodesMutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("node %s is unreachable", rp.node)
+	}
+	return node.send(clusterFrame{op: CLUSTER_DELIVER, network: rp.network, peerID: rp.id, payload: b})
+}
+
+func (c *cluster) announce(op clusterOp, p *peerConn) {
+	f := clusterFrame{op: op, network: p.networkSecret.Network, peerID: p.id}
+	if op == CLUSTER_PEER_UP {
+		f.payload = []byte(p.metadata.Encode())
+	}
+	c.broadcast(f)
+}
+
+// revoke sends the revocation change to all nodes, so do their revocation lists
+func (c *cluster) revoke(op clusterOp, kind, id string) {
+	c.broadcast(clusterFrame{op: op, payload: []byte(url.Values{"kind": {kind}, "id": {id}}.Encode())})
+}
+
+// kick disconnects the peer connected to another node, false is returned if the peer is not found
+func (c *cluster) kick(peerID disco.PeerID) (bool, error) {
+	c.peersMutex.RLock()
+	rp, ok := c.peers[peerID.String()]
+	c.peersMutex.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	c.nodesMutex.RLock()
+	node, ok := c.nodes[rp.node]
+	c.nodesMutex.RUnlock()
+	if !ok {
+		return true, fmt.Errorf("node %s is unreachable", rp.node)
+	}
+	return true, node.send(clusterFrame{op: CLUSTER_KICK, network: rp.network, peerID: rp.id})
+}
+
+func (c *cluster) broadcast(f clusterFrame) {
+	c.nodesMutex.RLock()
+	nodes := make([]*clusterNode, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.nodesMutex.RUnlock()
+	for _, node := range nodes {
+		if err := node.send(f); err != nil {
+			slog.Debug("[Cluster] Broadcast", "node", node.name, "op", f.op, "err", err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package peermap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/disco/ws"
+	"github.com/sigcn/pg/langs"
+	"github.com/sigcn/pg/peermap/auth"
+	"github.com/sigcn/pg/peermap/config"
+	"github.com/sigcn/pg/peermap/exporter"
+)
+
+func TestClusterFrame(t *testing.T) {
+	for _, f := range []clusterFrame{
+		{op: CLUSTER_PEER_UP, network: "net1", peerID: "peer1", payload: []byte("alias1=100.64.0.1")},
+		{op: CLUSTER_DELIVER, network: "net1", peerID: "peer1", payload: []byte{0, 1, 2}},
+		{op: CLUSTER_KICK, network: "net1", peerID: "peer1"},
+		{op: CLUSTER_REVOKE, payload: []byte("id=peer1&kind=peer")},
+	} {
+		b := f.marshal()
+		var got clusterFrame
+		if err := got.unmarshal(b); err != nil {
+			t.Fatalf("%s: %v", f.op, err)
+		}
+		if got.op != f.op || got.network != f.network || got.peerID != f.peerID || !bytes.Equal(got.payload, f.payload) {
+			t.Errorf("%s: %+v, want %+v", f.op, got, f)
+		}
+		// the payload is the rest of the frame, all shorter frames without the full header are invalid
+		for i := range 4 + len(f.network) + len(f.peerID) {
+			if err := got.unmarshal(b[:i]); err == nil {
+				t.Errorf("%s: truncated frame %x is accepted", f.op, b[:i])
+			}
+		}
+	}
+}
+
+// newCluster runs the pgmap nodes dialing each other, the node urls are the same as the peers connect to
+func newCluster(t *testing.T, n int) (nodes []*PeerMap, urls []string) {
+	t.Helper()
+	servers := make([]*httptest.Server, n)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls = append(urls, fmt.Sprintf("http://%s/pg", servers[i].Listener.Addr()))
+	}
+	for i, server := range servers {
+		pm, err := New(config.Config{
+			SecretKey: "cluster-test-secret",
+			Cluster: &config.ClusterConfig{
+				NodeName: fmt.Sprintf("node%d", i),
+				Nodes:    slices.Delete(slices.Clone(urls), i, i+1),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Config.Handler = pm.httpServer.Handler
+		server.Start()
+		t.Cleanup(server.Close)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		pm.cluster.run(ctx)
+		nodes = append(nodes, pm)
+	}
+	waitFor(t, "nodes connected", func() bool {
+		for _, pm := range nodes {
+			pm.cluster.nodesMutex.RLock()
+			connected := len(pm.cluster.nodes)
+			pm.cluster.nodesMutex.RUnlock()
+			if connected != n-1 {
+				return false
+			}
+		}
+		return true
+	})
+	return
+}
+
+// dialPeer connects the peer to the node by a secret granted by the node
+func dialPeer(t *testing.T, pm *PeerMap, url string, id disco.PeerID) (*ws.WSConn, error) {
+	t.Helper()
+	secret, err := pm.Grant("cluster", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return ws.Dial(ctx, &disco.Peer{ID: id}, &disco.Server{Secret: &secret, URL: url})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	nodes, urls := newCluster(t, 2)
+	a, err := dialPeer(t, nodes[0], urls[0], "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeA := sync.OnceValue(a.Close)
+	defer closeA()
+	b, err := dialPeer(t, nodes[1], urls[1], "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	waitFor(t, "peers up", func() bool {
+		_, okA := nodes[1].cluster.getPeer("cluster", "a")
+		_, okB := nodes[0].cluster.getPeer("cluster", "b")
+		return okA && okB
+	})
+
+	// the relay frame is delivered by the node which the target peer is connected to
+	if err := a.WriteTo([]byte("hello"), "b", disco.CONTROL_RELAY); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case datagram := <-b.Datagrams():
+		if datagram.PeerID != "a" || string(datagram.Data) != "hello" {
+			t.Fatalf("datagram %s %q", datagram.PeerID, datagram.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay frame is not delivered across nodes")
+	}
+
+	// the peer is kicked by its own node
+	peerB, err := nodes[1].getPeer("cluster", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := nodes[0].cluster.kick("b"); !found || err != nil {
+		t.Fatalf("kick b: %v, %v", found, err)
+	}
+	select {
+	case <-peerB.closeChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("b is not kicked")
+	}
+
+	// the other nodes see the peer down
+	closeA()
+	waitFor(t, "a down", func() bool {
+		_, ok := nodes[1].cluster.getPeer("cluster", "a")
+		return !ok
+	})
+}
+
+func TestClusterRevoke(t *testing.T) {
+	nodes, urls := newCluster(t, 2)
+	b, err := dialPeer(t, nodes[1], urls[1], "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	peerB, err := nodes[1].getPeer("cluster", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer revoked on node0 is disconnected by node1, which it is connected to
+	client, err := exporter.NewClient(urls[0], "cluster-test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Revoke(auth.RevokePeer, "b"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-peerB.closeChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("revoked peer is not disconnected by the other node")
+	}
+
+	// and node1 rejects it from now on
+	_, err = dialPeer(t, nodes[1], urls[1], "b")
+	var serverErr langs.Error
+	if !errors.As(err, &serverErr) || serverErr.Code != auth.ErrRevoked.Code {
+		t.Fatalf("dial revoked peer: %v", err)
+	}
+	if c, err := dialPeer(t, nodes[1], urls[1], "c"); err != nil {
+		t.Errorf("dial peer c: %v", err)
+	} else {
+		c.Close()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"os"
 	"time"
 
@@ -72,6 +73,44 @@ func (c *RateLimiterConfig) check() error {
 	return nil
 }
 
+type ClusterConfig struct {
+	NodeName string   `yaml:"node_name"`
+	Nodes    []string `yaml:"nodes"`
+}
+
+// IPAMConfig is the address pools leased to the vpn peers, each network has its own leases.
+// Leases are not shared between cluster nodes
+type IPAMConfig struct {
+	IPv4      string        `yaml:"ipv4"`       // e.g. 100.64.0.0/16
+	IPv6      string        `yaml:"ipv6"`       // e.g. fd00:100:64::/64
+	LeaseTime time.Duration `yaml:"lease_time"` // lease of offline peers can be reclaimed after it
+}
+
+func (c *IPAMConfig) check() error {
+	for _, pool := range []string{c.IPv4, c.IPv6} {
+		if pool == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(pool)
+		if err != nil {
+			return err
+		}
+		if prefix.Masked() != prefix {
+			return fmt.Errorf("pool %s is not a network address", pool)
+		}
+	}
+	if c.IPv4 != "" && !netip.MustParsePrefix(c.IPv4).Addr().Is4() {
+		return errors.New("ipv4 pool must be an ipv4 prefix")
+	}
+	if c.IPv6 != "" && !netip.MustParsePrefix(c.IPv6).Addr().Is6() {
+		return errors.New("ipv6 pool must be an ipv6 prefix")
+	}
+	if c.LeaseTime == 0 {
+		c.LeaseTime = 30 * 24 * time.Hour
+	}
+	return nil
+}
+
 type Config struct {
 	Listen               string                    `yaml:"listen"`
 	SecretKey            string                    `yaml:"secret_key"`
@@ -81,6 +120,12 @@ type Config struct {
 	RateLimiter          *RateLimiterConfig        `yaml:"rate_limiter,omitempty"`
 	SecretRotationPeriod time.Duration             `yaml:"secret_rotation_period"`
 	SecretValidityPeriod time.Duration             `yaml:"secret_validity_period"`
+	StateFile            string                    `yaml:"state_file"`
+	RevocationFile       string                    `yaml:"revocation_file"`
+	Cluster              *ClusterConfig            `yaml:"cluster,omitempty"`
+	MetricsToken         string                    `yaml:"metrics_token"`
+	IPAM                 *IPAMConfig               `yaml:"ipam,omitempty"`
+	RejectLegacyTokens   bool                      `yaml:"reject_legacy_tokens"`
 }
 
 func (cfg *Config) ApplyDefaults() error {
@@ -101,6 +146,11 @@ func (cfg *Config) ApplyDefaults() error {
 			return fmt.Errorf("ratelimiter: %w", err)
 		}
 	}
+	if cfg.IPAM != nil {
+		if err := cfg.IPAM.check(); err != nil {
+			return fmt.Errorf("ipam: %w", err)
+		}
+	}
 	if cfg.SecretValidityPeriod == 0 {
 		cfg.SecretValidityPeriod = 4 * time.Hour
 	}
@@ -110,6 +160,13 @@ func (cfg *Config) ApplyDefaults() error {
 	if cfg.SecretRotationPeriod >= cfg.SecretValidityPeriod {
 		return errors.New("secret rotation period must less than validity period")
 	}
+	if cfg.Cluster != nil && cfg.Cluster.NodeName == "" {
+		nodeName := make([]byte, 4)
+		rand.Read(nodeName)
+		hostname, _ := os.Hostname()
+		cfg.Cluster.NodeName = fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(nodeName))
+		slog.Info("ClusterNodeName " + cfg.Cluster.NodeName)
+	}
 	for _, provider := range cfg.OIDCProviders {
 		oidc.AddProvider(provider)
 	}
@@ -129,6 +186,40 @@ func (cfg *Config) Overwrite(cfg1 Config) {
 	if len(cfg1.PublicNetwork) > 0 {
 		cfg.PublicNetwork = cfg1.PublicNetwork
 	}
+	if len(cfg1.StateFile) > 0 {
+		cfg.StateFile = cfg1.StateFile
+	}
+	if len(cfg1.RevocationFile) > 0 {
+		cfg.RevocationFile = cfg1.RevocationFile
+	}
+	if len(cfg1.MetricsToken) > 0 {
+		cfg.MetricsToken = cfg1.MetricsToken
+	}
+	if cfg1.RejectLegacyTokens {
+		cfg.RejectLegacyTokens = true
+	}
+	if cfg1.IPAM != nil {
+		if cfg.IPAM == nil {
+			cfg.IPAM = &IPAMConfig{}
+		}
+		if len(cfg1.IPAM.IPv4) > 0 {
+			cfg.IPAM.IPv4 = cfg1.IPAM.IPv4
+		}
+		if len(cfg1.IPAM.IPv6) > 0 {
+			cfg.IPAM.IPv6 = cfg1.IPAM.IPv6
+		}
+	}
+	if cfg1.Cluster != nil {
+		if cfg.Cluster == nil {
+			cfg.Cluster = &ClusterConfig{}
+		}
+		if len(cfg1.Cluster.NodeName) > 0 {
+			cfg.Cluster.NodeName = cfg1.Cluster.NodeName
+		}
+		if len(cfg1.Cluster.Nodes) > 0 {
+			cfg.Cluster.Nodes = cfg1.Cluster.Nodes
+		}
+	}
 }
 
 func ReadConfig(configFile string) (cfg Config, err error) {
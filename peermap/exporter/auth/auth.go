@@ -9,21 +9,40 @@ import (
 
 	"github.com/sigcn/pg/secure"
 	"github.com/sigcn/pg/secure/aescbc"
+	"github.com/sigcn/pg/secure/aesgcm"
 )
 
+const (
+	// tokenV1 is the first byte of the plain text of the legacy AES-CBC tokens
+	tokenV1 byte = 1
+	// tokenV2 is the first byte of the AES-256-GCM sealed tokens
+	tokenV2 byte = 2
+)
+
+var tokenV2AD = []byte("pg-exporter-v2")
+
 type Authenticator struct {
-	algo secure.SymmAlgo
+	key          []byte
+	algo         secure.SymmAlgo
+	rejectLegacy bool
 }
 
 func New(secretKey string) *Authenticator {
 	sum := sha256.Sum256([]byte(secretKey))
 	return &Authenticator{
+		key: sum[:],
 		algo: aescbc.New(func(pubKey string) ([]byte, error) {
 			return sum[:], nil
 		}),
 	}
 }
 
+// RejectLegacy rejects the unauthenticated AES-CBC tokens, they are accepted by default during the transition period
+func (a *Authenticator) RejectLegacy(reject bool) *Authenticator {
+	a.rejectLegacy = reject
+	return a
+}
+
 type Instruction struct {
 	ExpiredAt int64 `json:"expired_at"`
 }
@@ -33,15 +52,14 @@ func (a *Authenticator) CheckToken(token string) (*Instruction, error) {
 	if err != nil {
 		return nil, err
 	}
-	plain, err := a.algo.Decrypt(b, "")
+	plain, err := a.open(b)
 	if err != nil {
 		return nil, err
 	}
-	if plain[0] != 1 {
+	var ins Instruction
+	if err := json.Unmarshal(plain, &ins); err != nil {
 		return nil, errors.New("invalid token")
 	}
-	var ins Instruction
-	json.Unmarshal(plain[1:], &ins)
 	if ins.ExpiredAt-time.Now().Unix() <= 0 {
 		return nil, errors.New("token expired")
 	}
@@ -53,9 +71,29 @@ func (a *Authenticator) GenerateToken(ins Instruction) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	chiper, err := a.algo.Encrypt(append([]byte{1}, b...), "")
+	chiper, err := aesgcm.Seal(a.key, b, tokenV2AD)
 	if err != nil {
 		return "", err
 	}
-	return base64.StdEncoding.EncodeToString(chiper), nil
+	return base64.StdEncoding.EncodeToString(append([]byte{tokenV2}, chiper...)), nil
+}
+
+func (a *Authenticator) open(b []byte) ([]byte, error) {
+	if len(b) > 0 && b[0] == tokenV2 {
+		plain, err := aesgcm.Open(a.key, b[1:], tokenV2AD)
+		if err == nil {
+			return plain, nil
+		}
+	}
+	if a.rejectLegacy {
+		return nil, errors.New("invalid token")
+	}
+	plain, err := a.algo.Decrypt(b, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) == 0 || plain[0] != tokenV1 {
+		return nil, errors.New("invalid token")
+	}
+	return plain[1:], nil
 }
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	a := New("key")
+	token, err := a.GenerateToken(Instruction{ExpiredAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := base64.StdEncoding.DecodeString(token); b[0] != tokenV2 {
+		t.Fatalf("token version %d", b[0])
+	}
+	if _, err := a.CheckToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New("other").CheckToken(token); err == nil {
+		t.Error("checked with another key")
+	}
+
+	expired, _ := a.GenerateToken(Instruction{ExpiredAt: time.Now().Add(-time.Second).Unix()})
+	if _, err := a.CheckToken(expired); err == nil {
+		t.Error("expired token is accepted")
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	a := New("key")
+	b, _ := json.Marshal(Instruction{ExpiredAt: time.Now().Add(time.Hour).Unix()})
+	chiper, err := a.algo.Encrypt(append([]byte{tokenV1}, b...), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := base64.StdEncoding.EncodeToString(chiper)
+	if _, err := a.CheckToken(legacy); err != nil {
+		t.Fatalf("legacy token: %v", err)
+	}
+	// the legacy tokens without the version are invalid
+	chiper, _ = a.algo.Encrypt(b, "")
+	if _, err := a.CheckToken(base64.StdEncoding.EncodeToString(chiper)); err == nil {
+		t.Error("legacy token without the version is accepted")
+	}
+	if _, err := a.RejectLegacy(true).CheckToken(legacy); err == nil {
+		t.Error("legacy token is accepted")
+	}
+}
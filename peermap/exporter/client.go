@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/sigcn/pg/peermap/exporter/auth"
@@ -122,3 +124,52 @@ func (c *Client) PutNetworkMeta(network string, request NetworkMeta) error {
 	}
 	return nil
 }
+
+func (c *Client) Revocations() (*Revocations, error) {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, "/revocations")
+	resp, err := c.c.Get(peermap.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("got unexpected status: " + resp.Status)
+	}
+	defer resp.Body.Close()
+	var revocations Revocations
+	json.NewDecoder(resp.Body).Decode(&revocations)
+	return &revocations, nil
+}
+
+// Revoke revokes the network, secret id or peer id, kind is one of network, secret and peer
+func (c *Client) Revoke(kind, id string) error {
+	return c.do(http.MethodPut, fmt.Sprintf("/revocations/%s/%s", kind, id))
+}
+
+func (c *Client) Unrevoke(kind, id string) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/revocations/%s/%s", kind, id))
+}
+
+// Kick disconnects the peer from the peermap server
+func (c *Client) Kick(peerID string) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/peers/%s", peerID))
+}
+
+func (c *Client) do(method, p string) error {
+	peermap := *c.peermapURL
+	peermap.Path = path.Join(peermap.Path, p)
+	r, err := http.NewRequest(method, peermap.String(), nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	resp, err := c.c.Do(r)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("got unexpected status: %s %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
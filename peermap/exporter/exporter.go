@@ -1,5 +1,7 @@
 package exporter
 
+import "time"
+
 type NetworkHead struct {
 	ID         string `json:"n"`
 	Alias      string `json:"n1,omitempty"`
@@ -16,4 +18,12 @@ type Network struct {
 type NetworkMeta struct {
 	Alias     string   `json:"alias"`
 	Neighbors []string `json:"neighbors"`
+	ACL       []string `json:"acl"` // nil means unchanged when put
+}
+
+// Revocations is the revocation time of the networks, secret ids and peer ids
+type Revocations struct {
+	Networks map[string]time.Time `json:"networks,omitempty"`
+	Secrets  map[string]time.Time `json:"secrets,omitempty"`
+	Peers    map[string]time.Time `json:"peers,omitempty"`
 }
@@ -0,0 +1,125 @@
+package peermap
+
+import (
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/peermap/config"
+)
+
+// IPLease is the vpn addresses leased to a peer
+type IPLease struct {
+	IPv4      string    `json:"ipv4,omitempty"`
+	IPv6      string    `json:"ipv6,omitempty"`
+	RenewTime time.Time `json:"renewTime"`
+}
+
+// leaseIP leases the addresses of the families requested by the `ipam` metadata to the peer,
+// and sets them to the alias1/alias2 metadata. The leased address of the peer or the alias in
+// metadata is preferred, so the peer keeps its address when reconnecting. The reserved addresses
+// are in used by the peers of other cluster nodes, the leases themselves are not shared across nodes.
+// The release func restores the previous lease of the peer, it is called if the peer is not admitted
+func (ctx *networkContext) leaseIP(cfg config.IPAMConfig, peerID disco.PeerID, meta url.Values, reserved ...string) (IPLease, func(), error) {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	if ctx.leases == nil {
+		ctx.leases = make(map[string]IPLease)
+	}
+	// reclaim the expired leases of offline peers
+	for id, l := range ctx.leases {
+		if time.Since(l.RenewTime) < cfg.LeaseTime {
+			continue
+		}
+		if _, ok := ctx.getPeer(disco.PeerID(id)); ok {
+			continue
+		}
+		delete(ctx.leases, id)
+	}
+
+	used := make(map[netip.Addr]struct{})
+	markUsed := func(ips ...string) {
+		for _, ip := range ips {
+			if addr, err := netip.ParseAddr(ip); err == nil {
+				used[addr] = struct{}{}
+			}
+		}
+	}
+	for id, l := range ctx.leases {
+		if id != peerID.String() {
+			markUsed(l.IPv4, l.IPv6)
+		}
+	}
+	for _, p := range ctx.peerList(peerID) {
+		markUsed(p.metadata.Get("alias1"), p.metadata.Get("alias2"))
+	}
+	markUsed(reserved...)
+
+	leased, hasLeased := ctx.leases[peerID.String()]
+	lease := IPLease{RenewTime: time.Now()}
+	for _, family := range meta["ipam"] {
+		var err error
+		switch family {
+		case "ipv4":
+			lease.IPv4, err = allocateIP(cfg.IPv4, used, leased.IPv4, meta.Get("alias1"))
+		case "ipv6":
+			lease.IPv6, err = allocateIP(cfg.IPv6, used, leased.IPv6, meta.Get("alias2"))
+		}
+		if err != nil {
+			return IPLease{}, func() {}, err
+		}
+	}
+	if lease.IPv4 == "" && lease.IPv6 == "" {
+		return lease, func() {}, nil
+	}
+	if lease.IPv4 != "" {
+		meta.Set("alias1", lease.IPv4)
+	}
+	if lease.IPv6 != "" {
+		meta.Set("alias2", lease.IPv6)
+	}
+	ctx.leases[peerID.String()] = lease
+	release := func() {
+		ctx.metaMutex.Lock()
+		defer ctx.metaMutex.Unlock()
+		if ctx.leases[peerID.String()] != lease {
+			return // leased again
+		}
+		if hasLeased {
+			ctx.leases[peerID.String()] = leased
+			return
+		}
+		delete(ctx.leases, peerID.String())
+	}
+	return lease, release, nil
+}
+
+// allocateIP finds an unused host address in the pool, candidates are tried first
+func allocateIP(pool string, used map[netip.Addr]struct{}, candidates ...string) (string, error) {
+	if pool == "" {
+		return "", nil
+	}
+	prefix := netip.MustParsePrefix(pool)
+	available := func(addr netip.Addr) bool {
+		if !prefix.Contains(addr) || addr == prefix.Addr() {
+			return false
+		}
+		if addr.Is4() && !prefix.Contains(addr.Next()) { // broadcast address
+			return false
+		}
+		_, ok := used[addr]
+		return !ok
+	}
+	for _, candidate := range candidates {
+		if addr, err := netip.ParseAddr(candidate); err == nil && available(addr) {
+			return addr.String(), nil
+		}
+	}
+	for addr := prefix.Addr().Next(); prefix.Contains(addr); addr = addr.Next() {
+		if available(addr) {
+			return addr.String(), nil
+		}
+	}
+	return "", ErrIPAMPoolExhausted
+}
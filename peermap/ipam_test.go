@@ -0,0 +1,102 @@
+package peermap
+
+import (
+	"errors"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/peermap/config"
+)
+
+func TestAllocateIP(t *testing.T) {
+	used := map[netip.Addr]struct{}{netip.MustParseAddr("100.64.0.1"): {}}
+	cases := []struct {
+		pool       string
+		candidates []string
+		want       string
+	}{
+		{"", nil, ""},
+		{"100.64.0.0/30", nil, "100.64.0.2"},
+		{"100.64.0.0/24", []string{"100.64.0.9"}, "100.64.0.9"},
+		{"100.64.0.0/24", []string{"100.64.0.1", "", "100.64.1.9", "100.64.0.0", "100.64.0.255", "100.64.0.7"}, "100.64.0.7"},
+		{"fd00::/64", []string{"fd00::1"}, "fd00::1"},
+		{"fd00::/126", []string{"fd00::"}, "fd00::1"},
+	}
+	for _, c := range cases {
+		ip, err := allocateIP(c.pool, used, c.candidates...)
+		if err != nil || ip != c.want {
+			t.Errorf("allocateIP(%s, %v) = %s, %v, want %s", c.pool, c.candidates, ip, err, c.want)
+		}
+	}
+
+	// network and broadcast addresses are skipped
+	used[netip.MustParseAddr("100.64.0.2")] = struct{}{}
+	if ip, err := allocateIP("100.64.0.0/30", used); !errors.Is(err, ErrIPAMPoolExhausted) {
+		t.Errorf("allocateIP in the exhausted pool = %s, %v", ip, err)
+	}
+}
+
+func TestLeaseIP(t *testing.T) {
+	cfg := config.IPAMConfig{IPv4: "100.64.0.0/29", IPv6: "fd00::/64", LeaseTime: time.Hour}
+	ctx := &networkContext{peers: make(map[string]*peerConn)}
+	lease := func(peerID string, reserved ...string) (IPLease, url.Values, error) {
+		meta := url.Values{"ipam": {"ipv4", "ipv6"}}
+		l, _, err := ctx.leaseIP(cfg, disco.PeerID(peerID), meta, reserved...)
+		return l, meta, err
+	}
+
+	l1, meta, err := lease("p1")
+	if err != nil || l1.IPv4 != "100.64.0.1" || l1.IPv6 != "fd00::1" {
+		t.Fatalf("lease p1 = %+v, %v", l1, err)
+	}
+	if meta.Get("alias1") != l1.IPv4 || meta.Get("alias2") != l1.IPv6 {
+		t.Errorf("aliases of p1 = %v", meta)
+	}
+	// the addresses in used by the peers of other cluster nodes are skipped
+	l2, _, err := lease("p2", "100.64.0.2", "")
+	if err != nil || l2.IPv4 != "100.64.0.3" {
+		t.Fatalf("lease p2 = %+v, %v", l2, err)
+	}
+	// the peer keeps its address when reconnecting
+	if l, _, err := lease("p1"); err != nil || l.IPv4 != l1.IPv4 || l.IPv6 != l1.IPv6 {
+		t.Errorf("renew p1 = %+v, %v", l, err)
+	}
+	for _, id := range []string{"p3", "p4", "p5", "p6"} {
+		if _, _, err := lease(id); err != nil {
+			t.Fatalf("lease %s: %v", id, err)
+		}
+	}
+	if l, _, err := lease("p7"); !errors.Is(err, ErrIPAMPoolExhausted) {
+		t.Fatalf("lease in the exhausted pool = %+v, %v", l, err)
+	}
+
+	// the expired leases of offline peers are reclaimed
+	expired := ctx.leases["p2"]
+	expired.RenewTime = time.Now().Add(-2 * cfg.LeaseTime)
+	ctx.leases["p2"] = expired
+	if l, _, err := lease("p7"); err != nil || l.IPv4 != l2.IPv4 {
+		t.Errorf("lease p7 = %+v, %v, want %s", l, err, l2.IPv4)
+	}
+
+	// the lease of the peer not admitted is released, the previous one is restored
+	_, release, err := ctx.leaseIP(cfg, "p8", url.Values{"ipam": {"ipv6"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, ok := ctx.leases["p8"]; ok {
+		t.Error("the lease of p8 is not released")
+	}
+	previous := ctx.leases["p1"]
+	_, release, err = ctx.leaseIP(cfg, "p1", url.Values{"ipam": {"ipv4", "ipv6"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if ctx.leases["p1"] != previous {
+		t.Errorf("lease of p1 = %+v, want %+v", ctx.leases["p1"], previous)
+	}
+}
@@ -0,0 +1,168 @@
+package peermap
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sigcn/pg/disco"
+	"golang.org/x/time/rate"
+)
+
+type metrics struct {
+	wsConnects          atomic.Uint64
+	wsDisconnects       atomic.Uint64
+	wsRejects           atomic.Uint64
+	secretRotations     atomic.Uint64
+	discoLimiterWaits   atomic.Uint64
+	discoLimiterWaitNs  atomic.Uint64
+	relayLimiterWaits   atomic.Uint64
+	relayLimiterWaitNs  atomic.Uint64
+	streamLimiterWaits  atomic.Uint64
+	streamLimiterWaitNs atomic.Uint64
+}
+
+// waitN waits the limiter and records the time waited
+func waitN(limiter *rate.Limiter, n int, waits, waitNs *atomic.Uint64) {
+	start := time.Now()
+	limiter.WaitN(context.Background(), n)
+	if d := time.Since(start); d > time.Millisecond {
+		waits.Add(1)
+		waitNs.Add(uint64(d.Nanoseconds()))
+	}
+}
+
+type networkStat struct {
+	relayRx  atomic.Uint64
+	streamTx atomic.Uint64
+	streamRx atomic.Uint64
+}
+
+// HandleMetrics exports the server metrics in prometheus text format
+func (pm *PeerMap) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkMetricsToken(w, r); err != nil {
+		return
+	}
+	type networkMetrics struct {
+		id       string
+		peers    int
+		nat      map[disco.NATType]int
+		relayRx  uint64
+		streamTx uint64
+		streamRx uint64
+	}
+	var networks []networkMetrics
+	pm.networkMapMutex.RLock()
+	for k, v := range pm.networkMap {
+		m := networkMetrics{
+			id:       k,
+			nat:      make(map[disco.NATType]int),
+			relayRx:  v.stat.relayRx.Load(),
+			streamTx: v.stat.streamTx.Load(),
+			streamRx: v.stat.streamRx.Load(),
+		}
+		for _, peer := range v.peerList("") {
+			m.peers++
+			m.nat[disco.NATType(peer.metadata.Get("nat"))]++
+		}
+		networks = append(networks, m)
+	}
+	pm.networkMapMutex.RUnlock()
+	slices.SortFunc(networks, func(a, b networkMetrics) int { return strings.Compare(a.id, b.id) })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricsWriter{w: w}
+	mw.header("pgmap_networks", "gauge", "Number of networks")
+	mw.sample("pgmap_networks", nil, len(networks))
+
+	mw.header("pgmap_network_peers", "gauge", "Number of peers connected to the network")
+	for _, n := range networks {
+		mw.sample("pgmap_network_peers", []string{"network", n.id}, n.peers)
+	}
+	mw.header("pgmap_network_peers_nat", "gauge", "Number of peers connected to the network by NAT type")
+	for _, n := range networks {
+		natTypes := make([]disco.NATType, 0, len(n.nat))
+		for t := range n.nat {
+			natTypes = append(natTypes, t)
+		}
+		slices.Sort(natTypes)
+		for _, t := range natTypes {
+			mw.sample("pgmap_network_peers_nat", []string{"network", n.id, "nat", t.String()}, n.nat[t])
+		}
+	}
+	mw.header("pgmap_network_relay_bytes_total", "counter", "Bytes relayed by the server in the network")
+	for _, n := range networks {
+		mw.sample("pgmap_network_relay_bytes_total", []string{"network", n.id}, n.relayRx)
+	}
+	mw.header("pgmap_network_stream_bytes_total", "counter", "Bytes transferred through the server stream in the network")
+	for _, n := range networks {
+		mw.sample("pgmap_network_stream_bytes_total", []string{"network", n.id, "direction", "tx"}, n.streamTx)
+		mw.sample("pgmap_network_stream_bytes_total", []string{"network", n.id, "direction", "rx"}, n.streamRx)
+	}
+
+	mw.header("pgmap_ratelimiter_waits_total", "counter", "Times of the ratelimiter blocked a peer")
+	mw.sample("pgmap_ratelimiter_waits_total", []string{"limiter", "disco"}, pm.metrics.discoLimiterWaits.Load())
+	mw.sample("pgmap_ratelimiter_waits_total", []string{"limiter", "relay"}, pm.metrics.relayLimiterWaits.Load())
+	mw.sample("pgmap_ratelimiter_waits_total", []string{"limiter", "stream"}, pm.metrics.streamLimiterWaits.Load())
+	mw.header("pgmap_ratelimiter_wait_seconds_total", "counter", "Time spent waiting on the ratelimiter")
+	mw.sample("pgmap_ratelimiter_wait_seconds_total", []string{"limiter", "disco"}, seconds(pm.metrics.discoLimiterWaitNs.Load()))
+	mw.sample("pgmap_ratelimiter_wait_seconds_total", []string{"limiter", "relay"}, seconds(pm.metrics.relayLimiterWaitNs.Load()))
+	mw.sample("pgmap_ratelimiter_wait_seconds_total", []string{"limiter", "stream"}, seconds(pm.metrics.streamLimiterWaitNs.Load()))
+
+	mw.header("pgmap_websocket_connects_total", "counter", "Websocket connections accepted")
+	mw.sample("pgmap_websocket_connects_total", nil, pm.metrics.wsConnects.Load())
+	mw.header("pgmap_websocket_disconnects_total", "counter", "Websocket connections closed")
+	mw.sample("pgmap_websocket_disconnects_total", nil, pm.metrics.wsDisconnects.Load())
+	mw.header("pgmap_websocket_rejects_total", "counter", "Websocket connections rejected")
+	mw.sample("pgmap_websocket_rejects_total", nil, pm.metrics.wsRejects.Load())
+	mw.header("pgmap_secret_rotations_total", "counter", "Network secrets rotated to peers")
+	mw.sample("pgmap_secret_rotations_total", nil, pm.metrics.secretRotations.Load())
+}
+
+// checkMetricsToken accepts the bearer token in config or the exporter token
+func (pm *PeerMap) checkMetricsToken(w http.ResponseWriter, r *http.Request) error {
+	if pm.cfg.MetricsToken != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(pm.cfg.MetricsToken)) == 1 {
+			return nil
+		}
+	}
+	return pm.checkAdminToken(w, r)
+}
+
+func seconds(ns uint64) float64 {
+	return time.Duration(ns).Seconds()
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample, labels is the key value pairs
+func (mw metricsWriter) sample(name string, labels []string, value any) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labels) > 1 {
+		sb.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		sb.WriteByte('}')
+	}
+	fmt.Fprintf(mw.w, "%s %v\n", sb.String(), value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
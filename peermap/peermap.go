@@ -9,8 +9,11 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"slices"
 	"strings"
@@ -33,8 +36,10 @@ import (
 
 var (
 	ErrAddressAlreadyInuse  = langs.Error{Code: 4000, Msg: "the network address is already in use"}
+	ErrAliasAlreadyInuse    = langs.Error{Code: 4001, Msg: "the vpn address is already in use"}
 	ErrNetworkSecretExpired = langs.Error{Code: 4030, Msg: "network secret is expired"}
 	ErrParseMetadataFailed  = langs.Error{Code: 4050, Msg: "parse metadata failed"}
+	ErrIPAMPoolExhausted    = langs.Error{Code: 4060, Msg: "no available address in the ipam pool"}
 
 	_ io.ReadWriter = (*peerConn)(nil)
 )
@@ -71,9 +76,10 @@ type peerConn struct {
 func (p *peerConn) Read(b []byte) (n int, err error) {
 	defer func() {
 		if p.connRRL != nil && n > 0 {
-			p.connRRL.WaitN(context.Background(), n)
+			waitN(p.connRRL, n, &p.peerMap.metrics.streamLimiterWaits, &p.peerMap.metrics.streamLimiterWaitNs)
 		}
 		p.stat.StreamRx += uint64(n)
+		p.networkContext.stat.streamRx.Add(uint64(n))
 	}()
 	if p.connBuf != nil {
 		n = copy(b, p.connBuf)
@@ -98,18 +104,20 @@ func (p *peerConn) Read(b []byte) (n int, err error) {
 
 func (p *peerConn) Write(b []byte) (n int, err error) {
 	if p.connWRL != nil && len(b) > 0 {
-		p.connWRL.WaitN(context.Background(), len(b))
+		waitN(p.connWRL, len(b), &p.peerMap.metrics.streamLimiterWaits, &p.peerMap.metrics.streamLimiterWaitNs)
 	}
 	err = p.write(append(append([]byte(nil), disco.CONTROL_CONN.Byte()), b...))
 	if err != nil {
 		return
 	}
 	p.stat.StreamTx += uint64(len(b))
+	p.networkContext.stat.streamTx.Add(uint64(len(b)))
 	return len(b), nil
 }
 
 func (p *peerConn) Close() error {
 	p.closeOnce.Do(func() {
+		p.peerMap.metrics.wsDisconnects.Add(1)
 		p.peerMap.removePeer(p.networkSecret.Network, p.id)
 		_ = p.conn.WriteControl(websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(2*time.Second))
@@ -117,6 +125,9 @@ func (p *peerConn) Close() error {
 		close(p.closeChan)
 		close(p.connData)
 		p.broadcastLeave()
+		if p.peerMap.cluster != nil {
+			p.peerMap.cluster.announce(CLUSTER_PEER_DOWN, p)
+		}
 	})
 	return nil
 }
@@ -125,10 +136,14 @@ func (p *peerConn) String() string {
 	p.metadata.Set("rrx", fmt.Sprintf("%d", p.stat.RelayRx))
 	p.metadata.Set("stx", fmt.Sprintf("%d", p.stat.StreamTx))
 	p.metadata.Set("srx", fmt.Sprintf("%d", p.stat.StreamRx))
+	query := maps.Clone(p.metadata)
+	if p.networkSecret.ID != "" {
+		query.Set("sid", p.networkSecret.ID) // for the secret revocation
+	}
 	return (&url.URL{
 		Scheme:   "pg",
 		Host:     string(p.id),
-		RawQuery: p.metadata.Encode(),
+		RawQuery: query.Encode(),
 	}).String()
 }
 
@@ -148,6 +163,12 @@ func (p *peerConn) writeWS(messageType int, b []byte) error {
 func (p *peerConn) start() {
 	go p.readMessageLoop()
 	go p.keepalive()
+	if p.peerMap.cluster != nil {
+		p.peerMap.cluster.announce(CLUSTER_PEER_UP, p)
+	}
+	if frame := p.networkContext.metaFrame(); frame != nil {
+		p.write(frame)
+	}
 	if p.metadata.Has("silenceMode") {
 		return
 	}
@@ -172,32 +193,41 @@ func (p *peerConn) start() {
 }
 
 func (p *peerConn) leadDisco(target *peerConn) {
-	myMeta := []byte(p.metadata.Encode())
-	b := make([]byte, 2+len(p.id)+len(myMeta))
-	b[0] = disco.CONTROL_NEW_PEER.Byte()
-	b[1] = p.id.Len()
-	copy(b[2:], p.id.Bytes())
-	copy(b[len(p.id)+2:], myMeta)
-	target.write(b)
-
-	peerMeta := []byte(target.metadata.Encode())
-	b1 := make([]byte, 2+len(target.id)+len(peerMeta))
-	b1[0] = disco.CONTROL_NEW_PEER.Byte()
-	b1[1] = target.id.Len()
-	copy(b1[2:], target.id.Bytes())
-	copy(b1[len(target.id)+2:], peerMeta)
-	p.write(b1)
+	target.write(newPeerFrame(disco.CONTROL_NEW_PEER, p.id, p.metadata))
+	p.write(newPeerFrame(disco.CONTROL_NEW_PEER, target.id, target.metadata))
 }
 
-func (p *peerConn) relayTo(target *peerConn, b []byte) {
+func (p *peerConn) leadRemoteDisco(target *remotePeer) {
+	if err := p.peerMap.cluster.deliver(target, newPeerFrame(disco.CONTROL_NEW_PEER, p.id, p.metadata)); err != nil {
+		slog.Debug("LeadRemoteDisco", "peer", target.id, "err", err)
+		return
+	}
+	p.write(newPeerFrame(disco.CONTROL_NEW_PEER, target.id, target.metadata))
+}
+
+func (p *peerConn) relayFrame(b []byte) []byte {
 	data := b[b[1]+2:]
 	bb := make([]byte, 2+len(p.id)+len(data))
 	bb[0] = b[0]
 	bb[1] = p.id.Len()
 	copy(bb[2:p.id.Len()+2], p.id.Bytes())
 	copy(bb[p.id.Len()+2:], data)
-	_ = target.write(bb)
+	return bb
+}
+
+func (p *peerConn) relayTo(target *peerConn, b []byte) {
+	_ = target.write(p.relayFrame(b))
 	p.stat.RelayRx += uint64(len(b))
+	p.networkContext.stat.relayRx.Add(uint64(len(b)))
+}
+
+func (p *peerConn) relayToRemote(target *remotePeer, b []byte) {
+	if err := p.peerMap.cluster.deliver(target, p.relayFrame(b)); err != nil {
+		slog.Debug("RelayToRemote", "peer", target.id, "err", err)
+		return
+	}
+	p.stat.RelayRx += uint64(len(b))
+	p.networkContext.stat.relayRx.Add(uint64(len(b)))
 }
 
 func (p *peerConn) broadcast(b []byte) {
@@ -218,19 +248,14 @@ func (p *peerConn) broadcast(b []byte) {
 }
 
 func (p *peerConn) broadcastMeta() {
-	myMeta := []byte(p.metadata.Encode())
-	b := append([]byte(nil), disco.CONTROL_UPDATE_META.Byte())
-	b = append(b, p.id.Len())
-	b = append(b, p.id.Bytes()...)
-	b = append(b, myMeta...)
-	p.broadcast(b)
+	p.broadcast(newPeerFrame(disco.CONTROL_UPDATE_META, p.id, p.metadata))
+	if p.peerMap.cluster != nil {
+		p.peerMap.cluster.announce(CLUSTER_PEER_UP, p)
+	}
 }
 
 func (p *peerConn) broadcastLeave() {
-	b := append([]byte(nil), disco.CONTROL_PEER_LEAVE.Byte())
-	b = append(b, p.id.Len())
-	b = append(b, p.id.Bytes()...)
-	p.broadcast(b)
+	p.broadcast(newPeerFrame(disco.CONTROL_PEER_LEAVE, p.id, nil))
 }
 
 func (p *peerConn) readMessageLoop() {
@@ -256,9 +281,9 @@ func (p *peerConn) readMessageLoop() {
 			b[i] = v ^ p.nonce
 		}
 		if slices.Contains([]disco.ControlCode{disco.CONTROL_LEAD_DISCO, disco.CONTROL_NEW_PEER_UDP_ADDR}, disco.ControlCode(b[0])) {
-			p.networkContext.disoRatelimiter.WaitN(context.Background(), len(b))
+			waitN(p.networkContext.disoRatelimiter, len(b), &p.peerMap.metrics.discoLimiterWaits, &p.peerMap.metrics.discoLimiterWaitNs)
 		} else if p.relayRatelimiter != nil {
-			p.relayRatelimiter.WaitN(context.Background(), len(b))
+			waitN(p.relayRatelimiter, len(b), &p.peerMap.metrics.relayLimiterWaits, &p.peerMap.metrics.relayLimiterWaitNs)
 		}
 		if b[0] == disco.CONTROL_CONN.Byte() {
 			p.connData <- b[1:]
@@ -272,6 +297,16 @@ func (p *peerConn) readMessageLoop() {
 		slog.Debug("PeerEvent", "op", disco.ControlCode(b[0]), "from", p.id, "to", tgtPeerID)
 		tgtPeer, err := p.peerMap.getPeer(p.networkSecret.Network, tgtPeerID)
 		if err != nil {
+			if p.peerMap.cluster != nil {
+				if rp, ok := p.peerMap.cluster.getPeer(p.networkSecret.Network, tgtPeerID); ok {
+					if b[0] == disco.CONTROL_LEAD_DISCO.Byte() {
+						p.leadRemoteDisco(rp)
+						continue
+					}
+					p.relayToRemote(rp, b)
+					continue
+				}
+			}
 			slog.Debug("FindPeer failed", "detail", err)
 			continue
 		}
@@ -335,6 +370,7 @@ func (p *peerConn) updateSecret() error {
 		ID:        p.networkSecret.Network,
 		Alias:     p.networkContext.alias,
 		Neighbors: p.networkContext.neighbors,
+		SecretID:  p.networkSecret.ID,
 	}, false)
 	if err != nil {
 		slog.Error("NetworkSecretRefresh", "err", err)
@@ -353,6 +389,7 @@ func (p *peerConn) updateSecret() error {
 		return err
 	}
 	p.networkSecret, _ = p.peerMap.authenticator.ParseSecret(secret.Secret)
+	p.peerMap.metrics.secretRotations.Add(1)
 	return nil
 }
 
@@ -374,6 +411,7 @@ type networkContext struct {
 	peersMutex      sync.RWMutex
 	peers           map[string]*peerConn
 	disoRatelimiter *rate.Limiter
+	stat            networkStat
 	createTime      time.Time
 	updateTime      time.Time
 
@@ -381,6 +419,8 @@ type networkContext struct {
 	metaMutex sync.Mutex
 	alias     string
 	neighbors []string
+	acl       []string
+	leases    map[string]IPLease // peer id as key
 }
 
 func (ctx *networkContext) removePeer(id disco.PeerID) {
@@ -396,42 +436,82 @@ func (ctx *networkContext) getPeer(id disco.PeerID) (*peerConn, bool) {
 	return p, ok
 }
 
+// peerList returns the peers in network exclude the specified one
+func (ctx *networkContext) peerList(exclude disco.PeerID) []*peerConn {
+	ctx.peersMutex.RLock()
+	defer ctx.peersMutex.RUnlock()
+	peers := make([]*peerConn, 0, len(ctx.peers))
+	for k, v := range ctx.peers {
+		if k == exclude.String() {
+			continue
+		}
+		peers = append(peers, v)
+	}
+	return peers
+}
+
 func (ctx *networkContext) peerCount() int {
 	ctx.peersMutex.RLock()
 	defer ctx.peersMutex.RUnlock()
 	return len(ctx.peers)
 }
 
-func (ctx *networkContext) SetIfAbsent(peerID string, p *peerConn) bool {
-	ctx.peersMutex.Lock()
-	if p1, ok := ctx.peers[peerID]; ok {
+// SetIfAbsent adds the peer if neither its id nor its vpn address (alias1/alias2) is taken by an alive peer
+func (ctx *networkContext) SetIfAbsent(peerID string, p *peerConn) error {
+	for {
+		ctx.peersMutex.Lock()
+		p1, err := ctx.conflictPeer(peerID, p.metadata)
+		if p1 == nil {
+			ctx.peers[peerID] = p
+			ctx.peersMutex.Unlock()
+			return nil
+		}
 		ctx.peersMutex.Unlock()
 		if p1.checkAlive() {
-			return false
+			return err
 		}
+		// p1 is closed by checkAlive, make sure it is removed
 		ctx.peersMutex.Lock()
+		if ctx.peers[p1.id.String()] == p1 {
+			delete(ctx.peers, p1.id.String())
+		}
+		ctx.peersMutex.Unlock()
 	}
-	ctx.peers[peerID] = p
-	ctx.peersMutex.Unlock()
-	return true
 }
 
-func (ctx *networkContext) initMeta(n auth.Net, updateTime time.Time) {
+// conflictPeer finds the peer which has the same id or vpn address, peersMutex must be held
+func (ctx *networkContext) conflictPeer(peerID string, meta url.Values) (*peerConn, error) {
+	if p, ok := ctx.peers[peerID]; ok {
+		return p, ErrAddressAlreadyInuse
+	}
+	for _, p := range ctx.peers {
+		if aliasConflict(p.metadata, meta) {
+			return p, ErrAliasAlreadyInuse
+		}
+	}
+	return nil, nil
+}
+
+func (ctx *networkContext) initMeta(n auth.Net, updateTime time.Time) bool {
 	ctx.metaMutex.Lock()
 	defer ctx.metaMutex.Unlock()
 	if ctx.updateTime.After(updateTime) {
-		return
+		return false
+	}
+	if ctx.updateTime.Equal(updateTime) && ctx.alias == n.Alias && slices.Equal(ctx.neighbors, n.Neighbors) {
+		return false
 	}
 	ctx.updateTime = updateTime
 	ctx.alias = n.Alias
 	ctx.neighbors = n.Neighbors
+	return true
 }
 
-func (ctx *networkContext) updateMeta(n auth.Net) error {
+func (ctx *networkContext) updateMeta(n auth.Net) bool {
 	ctx.metaMutex.Lock()
 	defer ctx.metaMutex.Unlock()
 	if ctx.alias == n.Alias && slices.Equal(ctx.neighbors, n.Neighbors) {
-		return nil
+		return false
 	}
 	ctx.updateTime = time.Now()
 	ctx.neighbors = n.Neighbors
@@ -441,15 +521,48 @@ func (ctx *networkContext) updateMeta(n auth.Net) error {
 	for _, v := range ctx.peers {
 		v.updateSecret()
 	}
-	return nil
+	return true
 }
 
-type NetState struct {
-	ID         string    `json:"id"`
-	Alias      string    `json:"alias"`
-	Neighbors  []string  `json:"neighbors"`
-	CreateTime time.Time `json:"createTime"`
-	UpdateTime time.Time `json:"updateTime"`
+// updateACL replaces the acl rules and pushes them to all peers in the network
+func (ctx *networkContext) updateACL(acl []string) bool {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	if slices.Equal(ctx.acl, acl) {
+		return false
+	}
+	ctx.updateTime = time.Now()
+	ctx.acl = acl
+	frame := newPeerFrame(disco.CONTROL_UPDATE_META, "", url.Values{"acl": acl})
+	for _, v := range ctx.peerList("") {
+		v.write(append([]byte(nil), frame...))
+	}
+	return true
+}
+
+// metaFrame returns the network metadata frame, it is a CONTROL_UPDATE_META frame without peer id.
+// nil is returned if there is no acl rule, the peers without acl support take the frame as a peer without id
+func (ctx *networkContext) metaFrame() []byte {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	if len(ctx.acl) == 0 {
+		return nil
+	}
+	return newPeerFrame(disco.CONTROL_UPDATE_META, "", url.Values{"acl": ctx.acl})
+}
+
+func (ctx *networkContext) state() NetState {
+	ctx.metaMutex.Lock()
+	defer ctx.metaMutex.Unlock()
+	return NetState{
+		ID:         ctx.id,
+		Alias:      ctx.alias,
+		Neighbors:  ctx.neighbors,
+		ACL:        ctx.acl,
+		Leases:     maps.Clone(ctx.leases),
+		CreateTime: ctx.createTime,
+		UpdateTime: ctx.updateTime,
+	}
 }
 
 type PeerMap struct {
@@ -462,6 +575,20 @@ type PeerMap struct {
 	cfg                   config.Config
 	authenticator         *auth.Authenticator
 	exporterAuthenticator *exporterauth.Authenticator
+	revocations           *auth.RevocationList
+	stateStore            StateStore
+	cluster               *cluster
+	metrics               metrics
+}
+
+// localPeers returns all peers connected to this pgmap node
+func (pm *PeerMap) localPeers() (peers []*peerConn) {
+	pm.networkMapMutex.RLock()
+	defer pm.networkMapMutex.RUnlock()
+	for _, ctx := range pm.networkMap {
+		peers = append(peers, ctx.peerList("")...)
+	}
+	return
 }
 
 func (pm *PeerMap) removePeer(network string, id disco.PeerID) {
@@ -514,6 +641,16 @@ func (pm *PeerMap) FindPeer(network string, filter func(url.Values) bool) ([]*pe
 }
 
 func (pm *PeerMap) Serve(ctx context.Context) error {
+	ln, err := net.Listen("tcp", pm.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	return pm.ServeListener(ctx, ln)
+}
+
+// ServeListener serves on the listener instead of the config.Config Listen address,
+// e.g. an ephemeral port of the tests. The listener is closed when ctx is done
+func (pm *PeerMap) ServeListener(ctx context.Context, ln net.Listener) error {
 	slog.Debug("ApplyConfig", "cfg", pm.cfg)
 	// watch sigterm for exit
 	var wg sync.WaitGroup
@@ -525,9 +662,13 @@ func (pm *PeerMap) Serve(ctx context.Context) error {
 		pm.httpServer.Shutdown(context.Background())
 	}()
 
+	if pm.cluster != nil {
+		pm.cluster.run(ctx)
+	}
+
 	// serving http
-	slog.Info("Serving for http now", "listen", pm.cfg.Listen)
-	err := pm.httpServer.ListenAndServe()
+	slog.Info("Serving for http now", "listen", ln.Addr())
+	err := pm.httpServer.Serve(ln)
 	wg.Wait()
 	return err
 }
@@ -578,7 +719,7 @@ func (pm *PeerMap) HandleGetNetworkMeta(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	json.NewEncoder(w).Encode(exporter.NetworkMeta{Alias: ctx.alias, Neighbors: ctx.neighbors})
+	json.NewEncoder(w).Encode(exporter.NetworkMeta{Alias: ctx.alias, Neighbors: ctx.neighbors, ACL: ctx.acl})
 }
 
 func (pm *PeerMap) HandlePutNetworkMeta(w http.ResponseWriter, r *http.Request) {
@@ -596,11 +737,17 @@ func (pm *PeerMap) HandlePutNetworkMeta(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := ctx.updateMeta(auth.Net{
+	changed := ctx.updateMeta(auth.Net{
 		Alias:     request.Alias,
 		Neighbors: request.Neighbors,
-	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if request.ACL != nil && ctx.updateACL(request.ACL) {
+		changed = true
+	}
+	if changed {
+		if err := pm.saveNetState(ctx); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 	}
 }
 
@@ -614,6 +761,7 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 		secret, err := pm.authenticator.ParseSecret(networkSecrest)
 		if err != nil {
 			slog.Debug("Authenticate failed", "err", err, "network", jsonSecret.Network, "secret", r.Header.Get("X-Network"))
+			pm.metrics.wsRejects.Add(1)
 			w.WriteHeader(http.StatusForbidden)
 			ErrNetworkSecretExpired.MarshalTo(w)
 			return
@@ -624,6 +772,14 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 	peerID := r.Header.Get("X-PeerID")
 	nonce := langs.MustParseNonce(r.Header.Get("X-Nonce"))
 
+	if pm.revocations.Revoked(jsonSecret, peerID) {
+		slog.Debug("Revoked", "network", jsonSecret.Network, "secret", jsonSecret.ID, "peer", peerID)
+		pm.metrics.wsRejects.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+		auth.ErrRevoked.MarshalTo(w)
+		return
+	}
+
 	pm.networkMapMutex.RLock()
 	networkCtx, ok := pm.networkMap[jsonSecret.Network]
 	pm.networkMapMutex.RUnlock()
@@ -640,9 +796,13 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 		pm.networkMapMutex.Unlock()
 	}
 
-	networkCtx.initMeta(
+	if networkCtx.initMeta(
 		auth.Net{Alias: jsonSecret.Alias, Neighbors: jsonSecret.Neighbors},
-		time.Unix(jsonSecret.Deadline, 0).Add(-pm.cfg.SecretValidityPeriod))
+		time.Unix(jsonSecret.Deadline, 0).Add(-pm.cfg.SecretValidityPeriod)) {
+		if err := pm.saveNetState(networkCtx); err != nil {
+			slog.Error("SaveNetState", "network", jsonSecret.Network, "err", err)
+		}
+	}
 
 	var rateLimiter, srLimiter, swLimiter *rate.Limiter
 	if pm.cfg.RateLimiter != nil && pm.cfg.RateLimiter.Relay.Limit > 0 {
@@ -672,6 +832,7 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 	if len(metadata) > 0 {
 		meta, err := url.ParseQuery(metadata)
 		if err != nil {
+			pm.metrics.wsRejects.Add(1)
 			w.WriteHeader(http.StatusForbidden)
 			ErrParseMetadataFailed.Wrap(err).Wrap(errors.New(metadata)).MarshalTo(w)
 			return
@@ -679,12 +840,58 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 		peer.metadata = meta
 	}
 
-	if ok := networkCtx.SetIfAbsent(peerID, &peer); !ok {
-		slog.Debug("Address is already in used", "addr", peerID)
+	var lease IPLease
+	releaseIP := func() {}
+	if pm.cfg.IPAM != nil && peer.metadata.Has("ipam") {
+		var reserved []string
+		if pm.cluster != nil {
+			for _, rp := range pm.cluster.networkPeers(jsonSecret.Network) {
+				if rp.id != peer.id {
+					reserved = append(reserved, rp.metadata.Get("alias1"), rp.metadata.Get("alias2"))
+				}
+			}
+		}
+		var err error
+		if lease, releaseIP, err = networkCtx.leaseIP(*pm.cfg.IPAM, peer.id, peer.metadata, reserved...); err != nil {
+			slog.Warn("LeaseIP", "network", jsonSecret.Network, "peer", peerID, "err", err)
+			pm.metrics.wsRejects.Add(1)
+			w.WriteHeader(http.StatusForbidden)
+			langs.Err(err).MarshalTo(w)
+			return
+		}
+	}
+	peer.metadata.Del("ipam")
+
+	if pm.cluster != nil {
+		for _, rp := range pm.cluster.networkPeers(jsonSecret.Network) {
+			if rp.id != peer.id && aliasConflict(rp.metadata, peer.metadata) {
+				slog.Warn("Alias is already in used", "network", jsonSecret.Network, "peer", peerID, "owner", rp.id, "node", rp.node)
+				releaseIP()
+				pm.metrics.wsRejects.Add(1)
+				w.WriteHeader(http.StatusForbidden)
+				ErrAliasAlreadyInuse.MarshalTo(w)
+				return
+			}
+		}
+	}
+
+	if err := networkCtx.SetIfAbsent(peerID, &peer); err != nil {
+		if errors.Is(err, ErrAliasAlreadyInuse) {
+			slog.Warn("Alias is already in used", "network", jsonSecret.Network, "peer", peerID, "alias1", peer.metadata.Get("alias1"), "alias2", peer.metadata.Get("alias2"))
+		} else {
+			slog.Debug("Address is already in used", "addr", peerID)
+		}
+		releaseIP()
+		pm.metrics.wsRejects.Add(1)
 		w.WriteHeader(http.StatusForbidden)
-		ErrAddressAlreadyInuse.MarshalTo(w)
+		langs.Err(err).MarshalTo(w)
 		return
 	}
+	if lease.IPv4 != "" || lease.IPv6 != "" {
+		if err := pm.saveNetState(networkCtx); err != nil {
+			slog.Error("SaveNetState", "network", jsonSecret.Network, "err", err)
+		}
+	}
 	pm.peerMapMutex.Lock()
 	pm.peerMap[peerID] = networkCtx
 	pm.peerMapMutex.Unlock()
@@ -692,6 +899,12 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 	upgradeHeader.Set("X-Nonce", r.Header.Get("X-Nonce"))
 	stuns, _ := json.Marshal(pm.cfg.STUNs)
 	upgradeHeader.Set("X-STUNs", base64.StdEncoding.EncodeToString(stuns))
+	if lease.IPv4 != "" {
+		upgradeHeader.Set("X-IPv4", fmt.Sprintf("%s/%d", lease.IPv4, netip.MustParsePrefix(pm.cfg.IPAM.IPv4).Bits()))
+	}
+	if lease.IPv6 != "" {
+		upgradeHeader.Set("X-IPv6", fmt.Sprintf("%s/%d", lease.IPv6, netip.MustParsePrefix(pm.cfg.IPAM.IPv6).Bits()))
+	}
 	if pm.cfg.RateLimiter != nil {
 		if pm.cfg.RateLimiter.Relay.Limit > 0 {
 			upgradeHeader.Set("X-Limiter-Burst", fmt.Sprintf("%d", pm.cfg.RateLimiter.Relay.Burst))
@@ -709,6 +922,7 @@ func (pm *PeerMap) HandlePeerPacketConnect(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	peer.conn = wsConn
+	pm.metrics.wsConnects.Add(1)
 	peer.start()
 	slog.Debug("PeerConnected", "network", jsonSecret.Network, "peer", peerID)
 }
@@ -722,6 +936,102 @@ func (pm *PeerMap) Grant(network, state string) (disco.NetworkSecret, error) {
 	return pm.generateSecret(n, strings.HasPrefix(state, "PG_ADM"))
 }
 
+// RefreshSecret generates a new secret which keeps the id of the secret
+func (pm *PeerMap) RefreshSecret(secret auth.JSONSecret) (disco.NetworkSecret, error) {
+	n := auth.Net{ID: secret.Network, SecretID: secret.ID}
+	if ctx, ok := pm.getNetwork(secret.Network); ok {
+		n.Alias = ctx.alias
+		n.Neighbors = ctx.neighbors
+	}
+	return pm.generateSecret(n, secret.Admin)
+}
+
+// HandleQueryRevocations lists the revoked networks, secret ids and peer ids
+func (pm *PeerMap) HandleQueryRevocations(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	revocations, err := pm.revocations.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(exporter.Revocations(revocations))
+}
+
+// HandleRevoke revokes the network, secret id or peer id, the affected peers are disconnected immediately.
+// The revocation is sent to the other cluster nodes, which save it to their own revocation lists
+func (pm *PeerMap) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	if err := pm.revocations.Revoke(r.PathValue("kind"), r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Revoke", "kind", r.PathValue("kind"), "id", r.PathValue("id"))
+	if pm.cluster != nil {
+		pm.cluster.revoke(CLUSTER_REVOKE, r.PathValue("kind"), r.PathValue("id"))
+	}
+	pm.disconnectRevoked()
+}
+
+// disconnectRevoked disconnects the local peers revoked
+func (pm *PeerMap) disconnectRevoked() {
+	for _, peer := range pm.localPeers() {
+		if pm.revocations.Revoked(peer.networkSecret, peer.id.String()) {
+			slog.Info("RevokedPeerDisconnected", "network", peer.networkSecret.Network, "peer", peer.id)
+			peer.Close()
+		}
+	}
+}
+
+// HandleUnrevoke removes the network, secret id or peer id from the revocation list
+func (pm *PeerMap) HandleUnrevoke(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	if err := pm.revocations.Unrevoke(r.PathValue("kind"), r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Unrevoke", "kind", r.PathValue("kind"), "id", r.PathValue("id"))
+	if pm.cluster != nil {
+		pm.cluster.revoke(CLUSTER_UNREVOKE, r.PathValue("kind"), r.PathValue("id"))
+	}
+}
+
+// HandleKickPeer disconnects the peer, it is free to reconnect unless revoked.
+// The peer connected to another cluster node is kicked by that node
+func (pm *PeerMap) HandleKickPeer(w http.ResponseWriter, r *http.Request) {
+	if err := pm.checkAdminToken(w, r); err != nil {
+		return
+	}
+	peerID := disco.PeerID(r.PathValue("peer"))
+	pm.peerMapMutex.RLock()
+	ctx, ok := pm.peerMap[peerID.String()]
+	pm.peerMapMutex.RUnlock()
+	if ok {
+		if peer, ok := ctx.getPeer(peerID); ok {
+			slog.Info("KickPeer", "network", peer.networkSecret.Network, "peer", peerID)
+			peer.Close()
+			return
+		}
+	}
+	if pm.cluster != nil {
+		found, err := pm.cluster.kick(peerID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if found {
+			slog.Info("KickPeer", "peer", peerID, "cluster", true)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
 func (pm *PeerMap) Peers(network string) (peers []string, err error) {
 	netctx, ok := pm.getNetwork(network)
 	if !ok {
@@ -747,9 +1057,51 @@ func (pm *PeerMap) newNetworkContext(state NetState) *networkContext {
 		updateTime:      state.UpdateTime,
 		alias:           state.Alias,
 		neighbors:       state.Neighbors,
+		acl:             state.ACL,
+		leases:          state.Leases,
 	}
 }
 
+// aliasConflict reports whether the peers have the same vpn address
+func aliasConflict(meta1, meta2 url.Values) bool {
+	for _, k := range []string{"alias1", "alias2"} {
+		addr1, err1 := netip.ParseAddr(meta1.Get(k))
+		addr2, err2 := netip.ParseAddr(meta2.Get(k))
+		if err1 == nil && err2 == nil && addr1 == addr2 {
+			return true
+		}
+	}
+	return false
+}
+
+func newPeerFrame(code disco.ControlCode, id disco.PeerID, meta url.Values) []byte {
+	b := append([]byte(nil), code.Byte())
+	b = append(b, id.Len())
+	b = append(b, id.Bytes()...)
+	if meta != nil {
+		b = append(b, meta.Encode()...)
+	}
+	return b
+}
+
+func (pm *PeerMap) saveNetState(ctx *networkContext) error {
+	return pm.stateStore.SaveNetState(ctx.state())
+}
+
+func (pm *PeerMap) loadNetStates() error {
+	states, err := pm.stateStore.LoadNetStates()
+	if err != nil {
+		return err
+	}
+	pm.networkMapMutex.Lock()
+	defer pm.networkMapMutex.Unlock()
+	for _, state := range states {
+		pm.networkMap[state.ID] = pm.newNetworkContext(state)
+	}
+	slog.Info("NetStatesLoaded", "count", len(states))
+	return nil
+}
+
 func (pm *PeerMap) generateSecret(n auth.Net, adm bool) (disco.NetworkSecret, error) {
 	secret, err := auth.NewAuthenticator(pm.cfg.SecretKey).
 		GenerateSecretAdmin(adm, n, pm.cfg.SecretValidityPeriod)
@@ -775,7 +1127,20 @@ func (pm *PeerMap) checkAdminToken(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
-func New(cfg config.Config) (*PeerMap, error) {
+type Option func(pm *PeerMap) error
+
+// WithStateStore replaces the state store specified by config.Config StateFile
+func WithStateStore(store StateStore) Option {
+	return func(pm *PeerMap) error {
+		if store == nil {
+			return errors.New("state store is required")
+		}
+		pm.stateStore = store
+		return nil
+	}
+}
+
+func New(cfg config.Config, opts ...Option) (*PeerMap, error) {
 	if err := cfg.ApplyDefaults(); err != nil {
 		return nil, err
 	}
@@ -784,20 +1149,61 @@ func New(cfg config.Config) (*PeerMap, error) {
 		wsUpgrader:            &websocket.Upgrader{},
 		networkMap:            make(map[string]*networkContext),
 		peerMap:               make(map[string]*networkContext),
-		authenticator:         auth.NewAuthenticator(cfg.SecretKey),
-		exporterAuthenticator: exporterauth.New(cfg.SecretKey),
+		authenticator:         auth.NewAuthenticator(cfg.SecretKey).RejectLegacy(cfg.RejectLegacyTokens),
+		exporterAuthenticator: exporterauth.New(cfg.SecretKey).RejectLegacy(cfg.RejectLegacyTokens),
 		cfg:                   cfg,
+		revocations:           &auth.RevocationList{FilePath: cfg.RevocationFile},
+		stateStore:            &MemoryStateStore{},
+	}
+	if cfg.StateFile != "" {
+		pm.stateStore = &StateFile{FilePath: cfg.StateFile}
+	}
+	for _, opt := range opts {
+		if err := opt(&pm); err != nil {
+			return nil, err
+		}
+	}
+	if err := pm.loadNetStates(); err != nil {
+		return nil, fmt.Errorf("load networks state: %w", err)
+	}
+	if err := pm.revocations.Load(); err != nil {
+		return nil, fmt.Errorf("load revocations: %w", err)
+	}
+	if cfg.Cluster != nil {
+		pm.cluster = &cluster{
+			pm:            &pm,
+			name:          cfg.Cluster.NodeName,
+			nodeURLs:      cfg.Cluster.Nodes,
+			authenticator: pm.exporterAuthenticator,
+			nodes:         make(map[string]*clusterNode),
+			peers:         make(map[string]*remotePeer),
+		}
 	}
 
 	mux := http.NewServeMux()
 	pm.httpServer = &http.Server{Handler: mux, Addr: cfg.Listen}
-	mux.Handle("/api/v1/", &api.ApiV1{Config: cfg, Auth: pm.authenticator, Grant: pm.Grant, PeerStore: &pm})
+	mux.Handle("/api/v1/", &api.ApiV1{
+		Config:      cfg,
+		Auth:        pm.authenticator,
+		Revocations: pm.revocations,
+		Grant:       pm.Grant,
+		Refresh:     pm.RefreshSecret,
+		PeerStore:   &pm,
+	})
 	mux.HandleFunc("/", ui.HandleStaticFiles)
 	mux.HandleFunc("GET /pg", pm.HandlePeerPacketConnect)
 	mux.HandleFunc("GET /pg/networks", pm.HandleQueryNetworks)
 	mux.HandleFunc("GET /pg/peers", pm.HandleQueryNetworkPeers)
 	mux.HandleFunc("GET /pg/networks/{network}/meta", pm.HandleGetNetworkMeta)
 	mux.HandleFunc("PUT /pg/networks/{network}/meta", pm.HandlePutNetworkMeta)
+	mux.HandleFunc("DELETE /pg/peers/{peer}", pm.HandleKickPeer)
+	mux.HandleFunc("GET /pg/revocations", pm.HandleQueryRevocations)
+	mux.HandleFunc("PUT /pg/revocations/{kind}/{id}", pm.HandleRevoke)
+	mux.HandleFunc("DELETE /pg/revocations/{kind}/{id}", pm.HandleUnrevoke)
+	mux.HandleFunc("GET /metrics", pm.HandleMetrics)
+	if pm.cluster != nil {
+		mux.HandleFunc("GET /pg/cluster", pm.cluster.HandleConnect)
+	}
 
 	mux.Handle("GET /oidc/authorize/{provider}", &oidc.Authority{Grant: pm.Grant})
 	mux.HandleFunc("GET /oidc", oidc.OIDCSelector)
@@ -0,0 +1,127 @@
+package peermap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NetState struct {
+	ID         string             `json:"id"`
+	Alias      string             `json:"alias"`
+	Neighbors  []string           `json:"neighbors"`
+	ACL        []string           `json:"acl,omitempty"`
+	Leases     map[string]IPLease `json:"leases,omitempty"`
+	CreateTime time.Time          `json:"createTime"`
+	UpdateTime time.Time          `json:"updateTime"`
+}
+
+// StateStore persists the networks state so that it survives pgmap restarts
+type StateStore interface {
+	LoadNetStates() ([]NetState, error)
+	SaveNetState(NetState) error
+}
+
+// MemoryStateStore is a no-op store, the networks state lives only in memory
+type MemoryStateStore struct {
+}
+
+func (s *MemoryStateStore) LoadNetStates() ([]NetState, error) {
+	return nil, nil
+}
+
+func (s *MemoryStateStore) SaveNetState(NetState) error {
+	return nil
+}
+
+// StateFile stores all networks state in a json file
+type StateFile struct {
+	FilePath string
+
+	mut    sync.Mutex
+	states map[string]NetState
+}
+
+func (s *StateFile) LoadNetStates() ([]NetState, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	var states []NetState
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b NetState) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return states, nil
+}
+
+func (s *StateFile) SaveNetState(state NetState) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.states[state.ID] = state
+	return s.save()
+}
+
+func (s *StateFile) load() error {
+	if s.states != nil {
+		return nil
+	}
+	s.states = make(map[string]NetState)
+	f, err := os.Open(s.FilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("state file(%s) open failed: %w", s.FilePath, err)
+	}
+	defer f.Close()
+	var states []NetState
+	if err := json.NewDecoder(f).Decode(&states); err != nil {
+		return fmt.Errorf("state file(%s) decode failed: %w", s.FilePath, err)
+	}
+	for _, state := range states {
+		s.states[state.ID] = state
+	}
+	return nil
+}
+
+func (s *StateFile) save() error {
+	var states []NetState
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b NetState) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	// write to a temp file then rename it, the state file is never half written
+	f, err := os.CreateTemp(filepath.Dir(s.FilePath), filepath.Base(s.FilePath)+".*")
+	if err != nil {
+		return fmt.Errorf("state file(%s) create failed: %w", s.FilePath, err)
+	}
+	defer os.Remove(f.Name())
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(states); err != nil {
+		f.Close()
+		return fmt.Errorf("state file(%s) encode failed: %w", s.FilePath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("state file(%s) write failed: %w", s.FilePath, err)
+	}
+	if err := os.Rename(f.Name(), s.FilePath); err != nil {
+		return fmt.Errorf("state file(%s) replace failed: %w", s.FilePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package peermap
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	now := time.Now().Truncate(time.Second).UTC()
+	states := []NetState{{
+		ID:         "net1",
+		Alias:      "office",
+		Neighbors:  []string{"net2"},
+		ACL:        []string{"allow * -> *:22/tcp"},
+		Leases:     map[string]IPLease{"peer1": {IPv4: "100.64.0.1", IPv6: "fd00::1", RenewTime: now}},
+		CreateTime: now,
+		UpdateTime: now,
+	}, {
+		ID:         "net2",
+		CreateTime: now,
+		UpdateTime: now,
+	}}
+
+	store := StateFile{FilePath: path}
+	if loaded, err := store.LoadNetStates(); err != nil || len(loaded) != 0 {
+		t.Fatalf("load the missing file = %v, %v", loaded, err)
+	}
+	for _, state := range []NetState{states[1], states[0]} {
+		if err := store.SaveNetState(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no temp files are left beside the state file
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("files in the state dir: %v", entries)
+	}
+
+	loaded, err := (&StateFile{FilePath: path}).LoadNetStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, states) {
+		t.Errorf("loaded %+v, want %+v", loaded, states)
+	}
+
+	// the state is replaced by the id
+	states[1].Alias = "home"
+	if err := store.SaveNetState(states[1]); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = (&StateFile{FilePath: path}).LoadNetStates()
+	if err != nil || len(loaded) != 2 || loaded[1].Alias != "home" {
+		t.Errorf("loaded %+v, %v", loaded, err)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&StateFile{FilePath: path}).LoadNetStates(); err == nil {
+		t.Error("the corrupted state file is loaded")
+	}
+}
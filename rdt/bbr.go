@@ -0,0 +1,148 @@
+package rdt
+
+import "time"
+
+type bbrState int
+
+const (
+	bbrStartup bbrState = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+const (
+	bbrHighGain       = 2.885 // 2/ln2
+	bbrCwndGain       = 2
+	bbrBwRounds       = 10
+	bbrMinRTTExpiry   = 10 * time.Second
+	bbrProbeRTTTime   = 200 * time.Millisecond
+	bbrProbeRTTWindow = 4
+)
+
+var bbrCycleGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// bbr is a simplified BBR congestion control, it paces frames at the estimated bottleneck
+// bandwidth and keeps about two bandwidth-delay products in flight. Losses are ignored
+type bbr struct {
+	frameSize float64
+	state     bbrState
+
+	bwSamples [bbrBwRounds]float64 // delivery rate of the recent rounds in bytes per second
+	round     int
+	minRTT    time.Duration
+	minRTTAt  time.Time
+	lastAck   time.Time
+	ackGap    time.Duration // acks are aggregated by the nck queries
+
+	delivered      int
+	roundStart     time.Time
+	roundDelivered int
+
+	fullBw      float64
+	fullBwCount int
+	pacingGain  float64
+	cycleIndex  int
+	probeRTTEnd time.Time
+}
+
+// NewBBR creates the BBR-like congestion controller which paces the frames
+func NewBBR(frameSize int) CongestionController {
+	return &bbr{frameSize: float64(frameSize), pacingGain: bbrHighGain}
+}
+
+func (b *bbr) Name() string {
+	return "bbr"
+}
+
+func (b *bbr) bw() float64 {
+	var bw float64
+	for _, sample := range b.bwSamples {
+		bw = max(bw, sample)
+	}
+	return bw
+}
+
+// bdp is the bandwidth-delay product in frames, the gap of the aggregated acks is covered too
+func (b *bbr) bdp() float64 {
+	return b.bw() * max(b.minRTT, b.ackGap).Seconds() / b.frameSize
+}
+
+func (b *bbr) Window() int {
+	if b.state == bbrProbeRTT {
+		return bbrProbeRTTWindow
+	}
+	if b.bw() == 0 {
+		return initialWindow
+	}
+	gain := float64(bbrCwndGain)
+	if b.state == bbrStartup {
+		gain = bbrHighGain
+	}
+	return max(int(gain*b.bdp()), bbrProbeRTTWindow)
+}
+
+func (b *bbr) PacingRate() float64 {
+	return b.pacingGain * b.bw()
+}
+
+func (b *bbr) OnAck(now time.Time, frames, inflight int, rtt RTTStats) {
+	b.delivered += frames
+	if !b.lastAck.IsZero() {
+		b.ackGap = (3*b.ackGap + now.Sub(b.lastAck)) / 4
+	}
+	b.lastAck = now
+	if rtt.Latest > 0 && (b.minRTT == 0 || rtt.Latest <= b.minRTT) {
+		b.minRTT, b.minRTTAt = rtt.Latest, now
+	}
+	if b.roundStart.IsZero() {
+		b.roundStart, b.roundDelivered = now, b.delivered-frames
+		return
+	}
+	elapsed := now.Sub(b.roundStart)
+	if elapsed < max(b.minRTT, time.Millisecond) {
+		return
+	}
+	b.bwSamples[b.round%bbrBwRounds] = float64(b.delivered-b.roundDelivered) * b.frameSize / elapsed.Seconds()
+	b.round++
+	b.roundStart, b.roundDelivered = now, b.delivered
+	b.onRound(now, inflight)
+}
+
+func (b *bbr) onRound(now time.Time, inflight int) {
+	switch b.state {
+	case bbrStartup:
+		// the bandwidth stops growing by 25% for 3 rounds
+		if bw := b.bw(); bw >= b.fullBw*1.25 {
+			b.fullBw, b.fullBwCount = bw, 0
+		} else if b.fullBwCount++; b.fullBwCount >= 3 {
+			b.state, b.pacingGain = bbrDrain, 1/bbrHighGain
+		}
+	case bbrDrain:
+		if float64(inflight) <= b.bdp() {
+			b.state, b.cycleIndex = bbrProbeBW, 2
+			b.pacingGain = bbrCycleGains[b.cycleIndex]
+		}
+	case bbrProbeBW:
+		b.cycleIndex = (b.cycleIndex + 1) % len(bbrCycleGains)
+		b.pacingGain = bbrCycleGains[b.cycleIndex]
+	case bbrProbeRTT:
+		if now.After(b.probeRTTEnd) {
+			b.state, b.cycleIndex = bbrProbeBW, 2
+			b.pacingGain = bbrCycleGains[b.cycleIndex]
+		}
+	}
+	if b.state != bbrProbeRTT && b.state != bbrStartup && now.Sub(b.minRTTAt) > bbrMinRTTExpiry {
+		// drain the queue to measure the min rtt again
+		b.state, b.pacingGain = bbrProbeRTT, 1
+		b.probeRTTEnd = now.Add(bbrProbeRTTTime + b.minRTT)
+		b.minRTT = 0
+	}
+}
+
+func (b *bbr) OnLoss(now time.Time, frames int) {
+}
+
+func (b *bbr) OnTimeout(now time.Time) {
+	b.roundStart, b.lastAck = time.Time{}, time.Time{}
+}
@@ -1,11 +1,21 @@
 package rdt
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 type Config struct {
 	MTU               int
 	Interval          time.Duration
 	StatsServerListen string
+	HandshakeTimeout  time.Duration
+	DisableLegacy     bool
+	FEC               bool
+	MinRTO            time.Duration
+	MaxRTO            time.Duration
+	// NewCongestionController creates the congestion controller for each connection
+	NewCongestionController func(frameSize int) CongestionController
 }
 
 type Option func(cfg *Config) error
@@ -30,3 +40,51 @@ func EnableStatsServer(listenAddr string) Option {
 		return nil
 	}
 }
+
+// EnableFEC sends a xor parity frame for every group of frames, the receiver recovers a lost
+// frame of the group without the retransmission. The group size is adapted to the loss rate
+func EnableFEC() Option {
+	return func(cfg *Config) error {
+		cfg.FEC = true
+		return nil
+	}
+}
+
+// HandshakeTimeout limits the time OpenStream waits for the SYNACK
+func HandshakeTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) error {
+		cfg.HandshakeTimeout = timeout
+		return nil
+	}
+}
+
+// DisableLegacy fails OpenStream with the handshake timeout instead of falling back to
+// the legacy framing (no connection id, no handshake) when the peer does not answer the SYN
+func DisableLegacy() Option {
+	return func(cfg *Config) error {
+		cfg.DisableLegacy = true
+		return nil
+	}
+}
+
+// RTOBounds limits the retransmission timeout computed from the round trip time
+func RTOBounds(minRTO, maxRTO time.Duration) Option {
+	return func(cfg *Config) error {
+		if minRTO <= 0 || maxRTO < minRTO {
+			return errors.New("invalid rto bounds")
+		}
+		cfg.MinRTO, cfg.MaxRTO = minRTO, maxRTO
+		return nil
+	}
+}
+
+// Congestion sets the congestion controller, e.g. NewCUBIC (default) or NewBBR
+func Congestion(newController func(frameSize int) CongestionController) Option {
+	return func(cfg *Config) error {
+		if newController == nil {
+			return errors.New("congestion controller is required")
+		}
+		cfg.NewCongestionController = newController
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package rdt
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	initialWindow = 10
+	minWindow     = 2
+)
+
+// CongestionController decides how many frames can be in flight and how fast they are sent
+type CongestionController interface {
+	// Name is reported in Stat
+	Name() string
+	// Window returns the congestion window in frames
+	Window() int
+	// PacingRate returns the send rate in bytes per second, 0 means no pacing
+	PacingRate() float64
+	// OnAck is called when frames are acknowledged, inflight is the frames still unacknowledged
+	OnAck(now time.Time, frames, inflight int, rtt RTTStats)
+	// OnLoss is called when the frames are reported missing by the receiver
+	OnLoss(now time.Time, frames int)
+	// OnTimeout is called when the retransmission timer expires
+	OnTimeout(now time.Time)
+}
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// cubic is the CUBIC congestion control (RFC 8312) counted in frames
+type cubic struct {
+	frameSize     float64
+	cwnd          float64
+	ssthresh      float64
+	wMax          float64
+	k             float64
+	origin        float64
+	wEst          float64 // reno friendly window
+	epochStart    time.Time
+	lastReduction time.Time
+	srtt          time.Duration
+}
+
+// NewCUBIC creates the CUBIC congestion controller, it is the default one
+func NewCUBIC(frameSize int) CongestionController {
+	return &cubic{frameSize: float64(frameSize), cwnd: initialWindow, ssthresh: math.MaxFloat64}
+}
+
+func (c *cubic) Name() string {
+	return "cubic"
+}
+
+func (c *cubic) Window() int {
+	return int(c.cwnd)
+}
+
+func (c *cubic) PacingRate() float64 {
+	if c.srtt == 0 {
+		return 0
+	}
+	gain := 1.25
+	if c.cwnd < c.ssthresh {
+		gain = 2
+	}
+	return gain * c.cwnd * c.frameSize / c.srtt.Seconds()
+}
+
+func (c *cubic) OnAck(now time.Time, frames, inflight int, rtt RTTStats) {
+	c.srtt = rtt.SRTT
+	if c.cwnd < c.ssthresh { // slow start
+		c.cwnd += float64(frames)
+		return
+	}
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		c.wEst = c.cwnd
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+			c.origin = c.wMax
+		} else {
+			c.k = 0
+			c.origin = c.cwnd
+		}
+	}
+	t := now.Sub(c.epochStart).Seconds() + rtt.SRTT.Seconds()
+	target := c.origin + cubicC*math.Pow(t-c.k, 3)
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) * float64(frames) / c.cwnd
+	target = min(max(target, c.wEst), 1.5*c.cwnd)
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd * float64(frames)
+	} else {
+		c.cwnd += 0.01 * float64(frames) / c.cwnd
+	}
+}
+
+func (c *cubic) OnLoss(now time.Time, frames int) {
+	// reduce once per round trip
+	if now.Sub(c.lastReduction) < c.srtt {
+		return
+	}
+	c.lastReduction = now
+	c.epochStart = time.Time{}
+	if c.cwnd < c.wMax { // fast convergence
+		c.wMax = c.cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+	c.cwnd = max(c.cwnd*cubicBeta, minWindow)
+	c.ssthresh = c.cwnd
+}
+
+func (c *cubic) OnTimeout(now time.Time) {
+	c.lastReduction = now
+	c.epochStart = time.Time{}
+	c.wMax = c.cwnd
+	c.ssthresh = max(c.cwnd*cubicBeta, minWindow)
+	c.cwnd = minWindow
+}
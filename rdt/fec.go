@@ -0,0 +1,133 @@
+package rdt
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	minFECGroup = 2
+	maxFECGroup = 32
+	fecHistory  = 64 // delivered frames kept for decoding, not less than maxFECGroup
+	fecOverhead = 3  // [count1][len2] of the parity frame
+)
+
+// fecEncoder xors every group of data frames into a parity frame, the receiver recovers
+// a single lost frame of the group without waiting for the nck round trip
+type fecEncoder struct {
+	group    int     // frames per parity frame, adapted to the loss rate
+	lossRate float64 // losses reported by the nck
+
+	start  uint32
+	count  int
+	size   int    // frames in the current group
+	parity []byte // [len2][data] of the frames xored
+}
+
+func newFECEncoder() *fecEncoder {
+	return &fecEncoder{group: maxFECGroup}
+}
+
+// add xors the data frame into the group, the parity payload is returned when the group is full
+func (e *fecEncoder) add(no uint32, data []byte) (uint32, []byte) {
+	if e.count == 0 {
+		e.start, e.size = no, e.group
+		e.parity = e.parity[:0]
+	}
+	e.count++
+	e.parity = xorFrame(e.parity, data)
+	if e.count < e.size {
+		return 0, nil
+	}
+	return e.flush()
+}
+
+// flush returns the parity payload [count1][xor] of the partial group
+func (e *fecEncoder) flush() (uint32, []byte) {
+	if e.count == 0 {
+		return 0, nil
+	}
+	payload := append([]byte{byte(e.count)}, e.parity...)
+	e.count = 0
+	return e.start, payload
+}
+
+// adapt keeps about one loss in ten groups
+func (e *fecEncoder) adapt(lost, acked int) {
+	if lost+acked == 0 {
+		return
+	}
+	e.lossRate = 0.9*e.lossRate + 0.1*float64(lost)/float64(lost+acked)
+	group := maxFECGroup
+	if e.lossRate > 0 {
+		group = int(math.Min(0.1/e.lossRate, maxFECGroup))
+	}
+	e.group = max(group, minFECGroup)
+}
+
+// xorFrame xors [len2][data] into dst, dst grows to the longer one
+func xorFrame(dst, data []byte) []byte {
+	for len(dst) < len(data)+2 {
+		dst = append(dst, 0)
+	}
+	dst[0] ^= byte(len(data) >> 8)
+	dst[1] ^= byte(len(data))
+	for i, b := range data {
+		dst[i+2] ^= b
+	}
+	return dst
+}
+
+type fecFrame struct {
+	no   uint32
+	data []byte
+}
+
+// recordFEC keeps the delivered frame for decoding the parity arrives later
+func (c *rdtConn) recordFEC(no uint32, data []byte) {
+	c.fecHistory[no%fecHistory] = fecFrame{no: no, data: data}
+}
+
+// recvParity recovers the only missing frame of the group
+func (c *rdtConn) recvParity(start uint32, payload []byte) {
+	if len(payload) < fecOverhead || payload[0] == 0 {
+		return
+	}
+	acc := append([]byte(nil), payload[1:]...)
+	var missing uint32
+	for no := start; no < start+uint32(payload[0]); no++ {
+		data, ok := c.lookupFEC(no)
+		if ok {
+			if len(data)+2 > len(acc) {
+				return
+			}
+			xorFrame(acc, data)
+			continue
+		}
+		if missing > 0 {
+			return
+		}
+		missing = no
+	}
+	if missing == 0 || missing <= c.recvNO.Load() {
+		return
+	}
+	l := int(binary.BigEndian.Uint16(acc[:2]))
+	if l+2 > len(acc) {
+		return
+	}
+	c.recovered.Add(1)
+	c.recvData(missing, acc[2:2+l])
+}
+
+func (c *rdtConn) lookupFEC(no uint32) ([]byte, bool) {
+	if no <= c.recvNO.Load() {
+		if f := c.fecHistory[no%fecHistory]; f.no == no && f.data != nil {
+			return f.data, true
+		}
+	}
+	c.recvMutex.RLock()
+	defer c.recvMutex.RUnlock()
+	data, ok := c.recvPool[no]
+	return data, ok
+}
@@ -0,0 +1,62 @@
+package rdt
+
+import (
+	"bytes"
+	"testing"
+
+	N "github.com/sigcn/pg/net"
+)
+
+func TestFECRecovery(t *testing.T) {
+	l := listenLossy(t, N.LinkConfig{}, EnableFEC())
+	c := l.newConn(1, l.Addr(), false)
+	enc := newFECEncoder()
+	enc.group = 4
+
+	var frames [][]byte
+	for i := range 18 {
+		frames = append(frames, bytes.Repeat([]byte{byte(i)}, 100+i*37%200))
+	}
+	// one frame lost in each group, at the start, the middle and the end of the group,
+	// the partial group is flushed. The group of 15-18 loses two frames, it can not be recovered
+	lost := map[uint32]bool{2: true, 8: true, 9: true, 14: true, 15: true, 16: true}
+	deliverParity := func(start uint32, parity []byte) {
+		if parity != nil {
+			c.recvParity(start, parity)
+		}
+	}
+	for i, data := range frames {
+		no := uint32(i + 1)
+		if !lost[no] {
+			c.recvData(no, data)
+		}
+		deliverParity(enc.add(no, data))
+		if no == 14 {
+			deliverParity(enc.flush())
+		}
+	}
+
+	if recovered := c.recovered.Load(); recovered != 4 {
+		t.Errorf("recovered %d frames, want 4", recovered)
+	}
+	for i := range 14 {
+		select {
+		case data := <-c.inbound:
+			if !bytes.Equal(data, frames[i]) {
+				t.Fatalf("frame %d corrupted", i+1)
+			}
+		default:
+			t.Fatalf("frame %d is not delivered", i+1)
+		}
+	}
+	if c.recvNO.Load() != 14 {
+		t.Errorf("recvNO %d, want 14", c.recvNO.Load())
+	}
+	c.recvMutex.RLock()
+	defer c.recvMutex.RUnlock()
+	for no := uint32(15); no <= 16; no++ {
+		if _, ok := c.recvPool[no]; ok {
+			t.Errorf("frame %d is recovered from a group lost two frames", no)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package rdt
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -15,6 +16,19 @@ import (
 	N "github.com/sigcn/pg/net"
 )
 
+const (
+	headerSize       = 15 // [cmd1][id8][no4][len2]
+	legacyHeaderSize = 7  // [cmd1][no4][len2], the legacy connections are keyed by the remote address
+
+	cmdVersioned byte = 0x40 // marks the frames with the connection id, the legacy peers ignore them
+	cmdServer    byte = 0x80 // marks the frames sent by the accepted connection
+
+	// legacyFallbackAttempts is the unanswered SYNs before OpenStream falls back to the legacy framing
+	legacyFallbackAttempts = 3
+)
+
+var errLegacyPeer = errors.New("peer does not answer the handshake")
+
 const (
 	Established = 0
 	FIN_WAIT1   = 2
@@ -25,36 +39,71 @@ const (
 type nck struct {
 	no      uint32
 	missing []uint32
+	echo    time.Duration // the query time echoed by the receiver, 0 if absent
+}
+
+type nckQuery struct {
+	no   uint32
+	echo []byte
+}
+
+type sendFrame struct {
+	pkt     []byte
+	sentAt  time.Time
+	resends int
+}
+
+type pendingQuery struct {
+	no     uint32
+	sentAt time.Time
 }
 
 var _ net.Conn = (*rdtConn)(nil)
 
 type rdtConn struct {
+	id         uint64
+	legacy     bool // the baseline framing without the id and the handshake
+	hdr        int  // headerSize or legacyHeaderSize
 	server     bool
 	cfg        Config
 	window     uint32
 	frameSize  int
 	c          net.PacketConn
-	remoteAddr net.Addr
+	remoteAddr atomic.Pointer[net.Addr] // follows the latest packet, the connection migrates with it
+	release    func()
 
 	exit       chan struct{}
 	inbound    chan []byte
 	nck        chan nck
-	nckQuery   chan uint32
+	nckQuery   chan nckQuery
 	fin        chan uint32
 	finack     chan uint32
 	sendEvent  chan struct{}
+	synack     chan struct{}
 	inboundBuf []byte
 
-	recvNO, sentNO, ackNO uint32
+	recvNO, sentNO, ackNO atomic.Uint32 // accessed by the read loop, the writer and the event loops
 
 	recvPool  map[uint32][]byte
 	recvMutex sync.RWMutex
-	sendPool  map[uint32][]byte
+	sendPool  map[uint32]*sendFrame
 	sendMutex sync.RWMutex
 
-	rs    atomic.Uint32
-	state atomic.Int32 // 0 Established 2 FIN_WAIT 5 CLOSED
+	epoch    time.Time
+	ccMutex  sync.Mutex
+	cc       CongestionController
+	rtt      *rttEstimator
+	nextSend time.Time
+	query    pendingQuery
+
+	fec        *fecEncoder // nil if the fec is disabled
+	fecHistory [fecHistory]fecFrame
+
+	rs        atomic.Uint32
+	lost      atomic.Uint32
+	timeouts  atomic.Uint32
+	recovered atomic.Uint32
+	state     atomic.Int32 // 0 Established 2 FIN_WAIT 5 CLOSED
 
 	closeOnce sync.Once
 
@@ -78,10 +127,7 @@ func (c *rdtConn) Read(b []byte) (n int, err error) {
 			}
 			err = N.ErrDeadline
 			return
-		case pkt, ok := <-c.inbound:
-			if !ok {
-				return 0, io.EOF
-			}
+		case pkt := <-c.inbound:
 			c.inboundBuf = pkt
 		}
 	}
@@ -109,27 +155,46 @@ func (c *rdtConn) Write(b []byte) (n int, err error) {
 			length = len(b) - start
 		}
 		c.sendMutex.Lock()
-		if len(c.sendPool) >= int(c.window) {
+		if len(c.sendPool) >= c.sendWindow() {
 			c.sendMutex.Unlock()
 			for {
-				if _, ok := <-c.sendEvent; !ok {
+				select {
+				case <-c.exit:
 					err = c.wClosed
 					return
+				case <-c.sendEvent:
 				}
 				c.sendMutex.Lock()
-				if len(c.sendPool) >= int(c.window) {
+				if len(c.sendPool) >= c.sendWindow() {
 					c.sendMutex.Unlock()
 					continue
 				}
 				break
 			}
 		}
-		no := c.sentNO + 1
+		no := c.sentNO.Load() + 1
 		pkt := c.buildFrame(0, no, uint16(length), b[start:start+length])
-		c.sendPool[no] = pkt
-		c.sentNO++
+		frame := &sendFrame{pkt: pkt}
+		c.sendPool[no] = frame
+		c.sentNO.Store(no)
+		var parityNO uint32
+		var parity []byte
+		if c.fec != nil {
+			parityNO, parity = c.fec.add(no, pkt[c.hdr:])
+		}
+		c.sendMutex.Unlock()
+		c.pace(len(pkt))
+		c.sendMutex.Lock()
+		frame.sentAt = time.Now()
 		c.sendMutex.Unlock()
 		c.send(pkt)
+		c.sendParity(parityNO, parity)
+	}
+	if c.fec != nil {
+		c.sendMutex.Lock()
+		parityNO, parity := c.fec.flush()
+		c.sendMutex.Unlock()
+		c.sendParity(parityNO, parity)
 	}
 	n = len(b)
 	return
@@ -150,21 +215,16 @@ func (c *rdtConn) Close() error {
 			case <-c.fin:
 			}
 			c.state.Store(CLOSED)
-			close(c.fin)
-			close(c.nckQuery)
-			c.recvNO = 0
+			c.release()
+			c.recvNO.Store(0)
 			c.recvMutex.Lock()
 			clear(c.recvPool)
 			c.recvMutex.Unlock()
 		}()
+		// the channels sent by the read loop are not closed, the senders and receivers exit by c.exit
 		close(c.exit)
-		close(c.inbound)
-		close(c.nck)
-		close(c.finack)
-		close(c.sendEvent)
 		c.deadlineRead.Close()
-		c.inboundBuf = nil
-		c.sentNO = 0
+		c.sentNO.Store(0)
 		c.sendMutex.Lock()
 		clear(c.sendPool)
 		c.sendMutex.Unlock()
@@ -179,7 +239,7 @@ func (c *rdtConn) LocalAddr() net.Addr {
 
 // RemoteAddr returns the remote network address, if known.
 func (c *rdtConn) RemoteAddr() net.Addr {
-	return c.remoteAddr
+	return *c.remoteAddr.Load()
 }
 
 // SetDeadline sets the read and write deadlines associated
@@ -226,80 +286,208 @@ func (c *rdtConn) SetWriteDeadline(t time.Time) error {
 	return errors.ErrUnsupported
 }
 
+// sendWindow is the frames allowed in flight, the congestion window is bounded by the nck window
+func (c *rdtConn) sendWindow() int {
+	c.ccMutex.Lock()
+	defer c.ccMutex.Unlock()
+	return min(max(c.cc.Window(), minWindow), int(c.window))
+}
+
+// pace delays the frame to follow the pacing rate of the congestion controller
+func (c *rdtConn) pace(size int) {
+	c.ccMutex.Lock()
+	rate := c.cc.PacingRate()
+	if rate <= 0 {
+		c.ccMutex.Unlock()
+		return
+	}
+	now := time.Now()
+	c.nextSend = maxTime(c.nextSend, now).Add(time.Duration(float64(size) / rate * float64(time.Second)))
+	delay := c.nextSend.Sub(now)
+	c.ccMutex.Unlock()
+	if delay > time.Millisecond {
+		time.Sleep(delay)
+	}
+}
+
+// since returns the monotonic time since the connection created, it is echoed by the nck
+func (c *rdtConn) since() time.Duration {
+	return time.Since(c.epoch)
+}
+
 func (c *rdtConn) resend(nck nck) {
+	now := time.Now()
+	c.ccMutex.Lock()
+	if nck.echo > 0 {
+		c.rtt.sample(c.since() - nck.echo)
+	}
+	if c.query.no > 0 && nck.no >= c.query.no {
+		c.query = pendingQuery{}
+	}
+	srtt := c.rtt.stats.SRTT
+	c.ccMutex.Unlock()
+
+	var lost int
 	missing := map[uint32]struct{}{}
 	for _, n := range nck.missing {
-		c.sendMutex.RLock()
-		pkt, ok := c.sendPool[n]
-		c.sendMutex.RUnlock()
-		if ok {
-			c.send(pkt)
-			c.rs.Add(1)
-		}
 		missing[n] = struct{}{}
+		c.sendMutex.Lock()
+		frame, ok := c.sendPool[n]
+		// the frame sent within a round trip may be still on the way
+		if !ok || now.Sub(frame.sentAt) < srtt {
+			c.sendMutex.Unlock()
+			continue
+		}
+		frame.sentAt = now
+		frame.resends++
+		pkt := frame.pkt
+		c.sendMutex.Unlock()
+		c.send(pkt)
+		c.rs.Add(1)
+		lost++
 	}
+	var acked int
 	c.sendMutex.Lock()
 	for k := range c.sendPool {
 		if _, ok := missing[k]; !ok && k <= nck.no {
 			delete(c.sendPool, k)
+			acked++
 		}
 	}
+	inflight := len(c.sendPool)
 	c.sendMutex.Unlock()
-	defer func() { recover() }()
-	c.sendEvent <- struct{}{}
+
+	if c.fec != nil {
+		c.sendMutex.Lock()
+		c.fec.adapt(lost, acked)
+		c.sendMutex.Unlock()
+	}
+	c.ccMutex.Lock()
+	if lost > 0 {
+		c.lost.Add(uint32(lost))
+		c.cc.OnLoss(now, lost)
+	}
+	if acked > 0 {
+		c.cc.OnAck(now, acked, inflight, c.rtt.stats)
+	}
+	c.ccMutex.Unlock()
+	select {
+	case c.sendEvent <- struct{}{}:
+	default:
+	}
+}
+
+// sendParity sends the fec parity frame, it is not retransmitted
+func (c *rdtConn) sendParity(start uint32, parity []byte) {
+	if parity == nil {
+		return
+	}
+	pkt := c.buildFrame(5, start, uint16(len(parity)), parity)
+	c.pace(len(pkt))
+	c.send(pkt)
 }
 
 func (c *rdtConn) send(pkt []byte) {
 	if c.server {
-		pkt[0] |= 0x80
+		pkt[0] |= cmdServer
 	}
-	no := binary.BigEndian.Uint32(pkt[1:5])
-	slog.Debug("RDTSend", "cmd", pkt[0], "no", no, "peer", c.remoteAddr, "len", len(pkt))
+	no := binary.BigEndian.Uint32(pkt[c.hdr-6 : c.hdr-2])
+	slog.Debug("RDTSend", "cmd", pkt[0], "id", c.id, "no", no, "peer", c.RemoteAddr(), "len", len(pkt))
 	c.c.WriteTo(pkt, c.RemoteAddr())
 }
 
 func (c *rdtConn) buildFrame(cmd byte, no uint32, length uint16, data []byte) []byte {
-	pkt := []byte{cmd}
+	if c.legacy {
+		pkt := []byte{cmd}
+		pkt = append(pkt, binary.BigEndian.AppendUint32(nil, no)...)
+		pkt = append(pkt, binary.BigEndian.AppendUint16(nil, length)...)
+		return append(pkt, data...)
+	}
+	return buildFrame(cmd, c.id, no, length, data)
+}
+
+func buildFrame(cmd byte, id uint64, no uint32, length uint16, data []byte) []byte {
+	pkt := []byte{cmd | cmdVersioned}
+	pkt = append(pkt, binary.BigEndian.AppendUint64(nil, id)...)
 	pkt = append(pkt, binary.BigEndian.AppendUint32(nil, no)...)
 	pkt = append(pkt, binary.BigEndian.AppendUint16(nil, length)...)
 	pkt = append(pkt, data...)
 	return pkt
 }
 
-func (c *rdtConn) recv(pkt []byte) {
+func (c *rdtConn) recv(pkt []byte, addr net.Addr) {
 	defer func() {
 		if err := recover(); err != nil {
 			slog.Debug("Recv", "recover", err)
 		}
 	}()
-	no := binary.BigEndian.Uint32(pkt[1:5])
-	l := binary.BigEndian.Uint16(pkt[5:7])
-	slog.Debug("RDTRecv", "cmd", pkt[0], "no", no, "peer", c.remoteAddr, "len", len(pkt))
+	h := uint16(c.hdr)
+	no := binary.BigEndian.Uint32(pkt[h-6 : h-2])
+	l := binary.BigEndian.Uint16(pkt[h-2 : h])
+	slog.Debug("RDTRecv", "cmd", pkt[0], "id", c.id, "no", no, "peer", addr, "len", len(pkt))
+	if remoteAddr := c.RemoteAddr(); !c.legacy && addr.String() != remoteAddr.String() {
+		slog.Debug("RDTMigrate", "id", c.id, "from", remoteAddr, "to", addr)
+		c.remoteAddr.Store(&addr)
+	}
 	switch pkt[0] {
 	case 0: // DATA
-		c.recvData(no, pkt[7:l+7])
+		c.recvData(no, pkt[h:h+l])
 	case 1: // QueryNCK
-		c.nckQuery <- no
+		select {
+		case c.nckQuery <- nckQuery{no: no, echo: pkt[h : h+l]}:
+		case <-c.exit:
+		}
 	case 2: // NCK
 		nck := nck{no: no}
 		for i := range l / 4 {
-			s := 7 + i*4
+			s := h + i*4
 			nck.missing = append(nck.missing, binary.BigEndian.Uint32(pkt[s:s+4]))
 		}
-		if len(nck.missing) == 0 && nck.no > c.ackNO {
-			c.ackNO = nck.no
+		if len(pkt) >= int(h+l)+8 { // the echoed query time follows the missing list
+			nck.echo = time.Duration(binary.BigEndian.Uint64(pkt[h+l : h+l+8]))
+		}
+		if len(nck.missing) == 0 && nck.no > c.ackNO.Load() {
+			c.ackNO.Store(nck.no)
+		}
+		select {
+		case c.nck <- nck:
+		case <-c.exit:
 		}
-		c.nck <- nck
 	case 21: // FIN
-		if c.recvNO < no {
-			c.sendNCK(no)
+		if c.recvNO.Load() < no {
+			c.sendNCK(no, nil)
 			return
 		}
 		c.send(c.buildFrame(22, no, 0, nil)) // send FINACK
-		c.fin <- no
+		select {
+		case c.fin <- no:
+		default:
+		}
 		c.Close()
 	case 22: // FINACK
-		c.finack <- no
+		select {
+		case c.finack <- no:
+		default: // no FIN is waiting for it
+		}
+	case 5: // FEC
+		c.recvParity(no, pkt[h:h+l])
+	case 3: // SYN
+		c.send(c.buildFrame(4, 0, 0, nil)) // send SYNACK
+	case 4: // SYNACK
+		select {
+		case c.synack <- struct{}{}:
+		default:
+		}
+	case 23: // RST
+		if c.state.Load() == Established {
+			slog.Debug("RDTReset", "id", c.id, "peer", addr)
+			go c.Close()
+			return
+		}
+		select {
+		case c.fin <- no:
+		default:
+		}
 	}
 }
 
@@ -309,32 +497,43 @@ func (c *rdtConn) recvData(no uint32, data []byte) {
 		return
 	}
 	if no%c.window == 0 {
-		c.sendNCK(min(c.recvNO+c.window, no))
+		c.sendNCK(min(c.recvNO.Load()+c.window, no), nil)
 	}
-	if no <= c.recvNO {
+	recvNO := c.recvNO.Load()
+	if no <= recvNO {
 		return
 	}
-	if no == c.recvNO+1 {
-		c.inbound <- data
-		c.recvNO++
+	if no == recvNO+1 {
+		select {
+		case c.inbound <- data:
+		case <-c.exit:
+			return
+		}
+		recvNO = c.recvNO.Add(1)
+		c.recordFEC(recvNO, data)
 		for {
 			c.recvMutex.RLock()
-			k, ok := c.recvPool[c.recvNO+1]
+			k, ok := c.recvPool[recvNO+1]
 			c.recvMutex.RUnlock()
 			if ok {
 				c.recvMutex.Lock()
-				delete(c.recvPool, c.recvNO)
+				delete(c.recvPool, recvNO)
 				c.recvMutex.Unlock()
-				c.inbound <- k
-				c.recvNO++
+				select {
+				case c.inbound <- k:
+				case <-c.exit:
+					return
+				}
+				recvNO = c.recvNO.Add(1)
+				c.recordFEC(recvNO, k)
 				continue
 			}
 			break
 		}
 		return
 	}
-	if no-c.recvNO > c.window*2 {
-		c.sendNCK(c.recvNO + c.window)
+	if no-recvNO > c.window*2 {
+		c.sendNCK(recvNO+c.window, nil)
 		return
 	}
 	c.recvMutex.Lock()
@@ -343,13 +542,16 @@ func (c *rdtConn) recvData(no uint32, data []byte) {
 }
 
 func (c *rdtConn) askNCK(no uint32) {
-	c.send(c.buildFrame(1, no, 0, nil))
+	c.send(c.buildFrame(1, no, 8, binary.BigEndian.AppendUint64(nil, uint64(c.since()))))
 }
 
-func (c *rdtConn) sendNCK(no uint32) {
+// sendNCK reports the missing frames up to no, the echo of the query is appended out of the
+// frame length so that it is ignored by the peers which do not measure the round trip time
+func (c *rdtConn) sendNCK(no uint32, echo []byte) {
 	var missing uint16
 	var noData []byte
-	for i := c.recvNO + 1; i <= no; i++ {
+	recvNO := c.recvNO.Load()
+	for i := recvNO + 1; i <= no; i++ {
 		c.recvMutex.RLock()
 		_, ok := c.recvPool[i]
 		c.recvMutex.RUnlock()
@@ -359,9 +561,12 @@ func (c *rdtConn) sendNCK(no uint32) {
 		}
 	}
 	if missing > uint16(c.window) {
-		slog.Debug("NCKOverflow", "missing", missing, "ackcount", c.window, "no", no, "recvno", c.recvNO)
+		slog.Debug("NCKOverflow", "missing", missing, "ackcount", c.window, "no", no, "recvno", recvNO)
 		return
 	}
+	if len(echo) == 8 && c.hdr+len(noData)+len(echo) <= c.cfg.MTU {
+		noData = append(noData, echo...)
+	}
 	c.send(c.buildFrame(2, no, uint16(missing*4), noData))
 }
 
@@ -379,20 +584,17 @@ func (c *rdtConn) sendFIN() error {
 				return
 			default:
 			}
-			c.send(c.buildFrame(21, c.sentNO, 0, nil))
+			c.send(c.buildFrame(21, c.sentNO.Load(), 0, nil))
 			time.Sleep(50 * time.Millisecond)
 		}
 		c.finack <- 0
 	}()
 	for {
-		finack, ok := <-c.finack
-		if !ok {
-			return io.ErrClosedPipe
-		}
+		finack := <-c.finack
 		if finack == 0 {
 			return errors.New("timeout")
 		}
-		if finack != c.sentNO {
+		if finack != c.sentNO.Load() {
 			continue
 		}
 		close(exit)
@@ -407,13 +609,34 @@ func (c *rdtConn) runCheckLoop() {
 			return
 		default:
 		}
-		time.Sleep(c.cfg.Interval)
+		c.ccMutex.Lock()
+		srtt := c.rtt.stats.SRTT
+		c.ccMutex.Unlock()
+		interval := c.cfg.Interval
+		if srtt > 0 {
+			interval = min(max(srtt/4, 2*time.Millisecond), c.cfg.Interval)
+		}
+		time.Sleep(interval)
 		c.sendMutex.RLock()
 		count := len(c.sendPool)
 		c.sendMutex.RUnlock()
-		if count > 0 {
-			c.askNCK(min(c.sentNO, c.ackNO+c.window))
+		if count == 0 {
+			continue
+		}
+		no := min(c.sentNO.Load(), c.ackNO.Load()+c.window)
+		now := time.Now()
+		c.ccMutex.Lock()
+		if c.query.no == 0 {
+			c.query = pendingQuery{no: no, sentAt: now}
+		} else if now.Sub(c.query.sentAt) > c.rtt.rto {
+			// neither the frames nor the query are answered in time
+			c.rtt.backoff()
+			c.cc.OnTimeout(now)
+			c.timeouts.Add(1)
+			c.query = pendingQuery{no: no, sentAt: now}
 		}
+		c.ccMutex.Unlock()
+		c.askNCK(no)
 	}
 }
 
@@ -422,10 +645,7 @@ func (c *rdtConn) runNCKLoop() {
 		select {
 		case <-c.exit:
 			return
-		case nck, ok := <-c.nck:
-			if !ok {
-				return
-			}
+		case nck := <-c.nck:
 			c.resend(nck)
 		}
 	}
@@ -436,11 +656,41 @@ func (c *rdtConn) runNCKQueryLoop() {
 		select {
 		case <-c.exit:
 			return
-		case q, ok := <-c.nckQuery:
-			if !ok {
-				return
+		case q := <-c.nckQuery:
+			c.sendNCK(q.no, q.echo)
+		}
+	}
+}
+
+// handshake sends SYN until the SYNACK arrives, the first round trip is sampled if no SYN is lost.
+// The legacy peers ignore the SYN, errLegacyPeer is returned after legacyFallbackAttempts SYNs
+func (c *rdtConn) handshake(exit <-chan struct{}) error {
+	timeout := time.NewTimer(c.cfg.HandshakeTimeout)
+	defer timeout.Stop()
+	start := time.Now()
+	for i := 0; ; i++ {
+		c.send(c.buildFrame(3, 0, 0, nil))
+		retry := time.NewTimer(c.rtt.rto)
+		select {
+		case <-c.synack:
+			retry.Stop()
+			if i == 0 {
+				c.ccMutex.Lock()
+				c.rtt.sample(time.Since(start))
+				c.ccMutex.Unlock()
+			}
+			return nil
+		case <-retry.C:
+			if !c.cfg.DisableLegacy && i+1 >= legacyFallbackAttempts {
+				return errLegacyPeer
 			}
-			c.sendNCK(q)
+			c.rtt.backoff()
+		case <-timeout.C:
+			retry.Stop()
+			return &net.OpError{Op: "dial", Net: c.c.LocalAddr().Network(), Addr: c.RemoteAddr(), Err: errors.New("handshake timeout")}
+		case <-exit:
+			retry.Stop()
+			return &net.OpError{Op: "dial", Net: c.c.LocalAddr().Network(), Addr: c.RemoteAddr(), Err: errors.New("closed")}
 		}
 	}
 }
@@ -456,14 +706,18 @@ type RDTListener struct {
 	cfg                Config
 	c                  net.PacketConn
 	accept             chan *rdtConn
-	acceptConnMap      map[string]*rdtConn
+	acceptConnMap      map[uint64]*rdtConn
 	acceptConnMapMutex sync.RWMutex
-	openConnMap        map[string]*rdtConn
+	openConnMap        map[uint64]*rdtConn
 	openConnMapMutex   sync.RWMutex
-	exitSig            chan struct{}
+	// the connections of the legacy framing are keyed by the remote address,
+	// guarded by acceptConnMapMutex and openConnMapMutex
+	legacyAcceptConnMap map[string]*rdtConn
+	legacyOpenConnMap   map[string]*rdtConn
+	exitSig             chan struct{}
 }
 
-// Accept accept a connection from addr (0RTT)
+// Accept accept a connection opened by the remote peer
 func (l *RDTListener) Accept() (net.Conn, error) {
 	err := &net.OpError{
 		Op:  "accept",
@@ -491,25 +745,74 @@ func (l *RDTListener) Close() error {
 	for _, v := range l.acceptConnMap {
 		v.Close()
 	}
+	for _, v := range l.legacyAcceptConnMap {
+		v.Close()
+	}
 	l.acceptConnMapMutex.RUnlock()
 	l.openConnMapMutex.RLock()
 	for _, v := range l.openConnMap {
 		v.Close()
 	}
+	for _, v := range l.legacyOpenConnMap {
+		v.Close()
+	}
 	l.openConnMapMutex.RUnlock()
 	return l.c.Close()
 }
 
-// OpenStream open a connection to addr (0RTT)
+// OpenStream open a connection to addr after the SYN/SYNACK handshake.
+// Each connection has a random id, so that many connections to the same addr are allowed.
+// The peer not answering the SYN is treated as a legacy one unless DisableLegacy
 func (l *RDTListener) OpenStream(addr net.Addr) (net.Conn, error) {
-	c := l.newConn(addr)
 	l.openConnMapMutex.Lock()
-	defer l.openConnMapMutex.Unlock()
-	l.openConnMap[addr.String()] = c
+	var id uint64
+	for id == 0 || l.openConnMap[id] != nil {
+		id = randomID()
+	}
+	c := l.newConn(id, addr, false)
+	c.release = func() {
+		l.openConnMapMutex.Lock()
+		defer l.openConnMapMutex.Unlock()
+		if l.openConnMap[id] == c {
+			delete(l.openConnMap, id)
+		}
+	}
+	l.openConnMap[id] = c
+	l.openConnMapMutex.Unlock()
+	if err := c.handshake(l.exitSig); err != nil {
+		c.release()
+		if errors.Is(err, errLegacyPeer) {
+			slog.Debug("RDTLegacyFallback", "peer", addr)
+			return l.openLegacyStream(addr), nil
+		}
+		return nil, err
+	}
 	c.startEventLoopGroup()
 	return c, nil
 }
 
+// openLegacyStream opens the connection of the legacy framing, the first DATA frame opens it on the peer
+func (l *RDTListener) openLegacyStream(addr net.Addr) *rdtConn {
+	key := addr.String()
+	l.openConnMapMutex.Lock()
+	defer l.openConnMapMutex.Unlock()
+	if c, ok := l.legacyOpenConnMap[key]; ok {
+		c.Close()
+		delete(l.legacyOpenConnMap, key)
+	}
+	c := l.newConn(0, addr, true)
+	c.release = func() {
+		l.openConnMapMutex.Lock()
+		defer l.openConnMapMutex.Unlock()
+		if l.legacyOpenConnMap[key] == c {
+			delete(l.legacyOpenConnMap, key)
+		}
+	}
+	l.legacyOpenConnMap[key] = c
+	c.startEventLoopGroup()
+	return c
+}
+
 func (l *RDTListener) runPacketReadLoop() {
 	buf := make([]byte, 1500)
 	for {
@@ -525,7 +828,7 @@ func (l *RDTListener) runPacketReadLoop() {
 			}
 			panic(err)
 		}
-		if n < 7 {
+		if n < legacyHeaderSize {
 			slog.Error("RDT received invalid packet")
 			continue
 		}
@@ -534,57 +837,151 @@ func (l *RDTListener) runPacketReadLoop() {
 }
 
 func (l *RDTListener) recvPacket(pkt []byte, addr net.Addr) {
-	if 0x80&pkt[0] == 0x80 {
-		pkt[0] = pkt[0] << 1 >> 1
+	server, versioned := pkt[0]&cmdServer != 0, pkt[0]&cmdVersioned != 0
+	pkt[0] &^= cmdServer | cmdVersioned
+	if !versioned {
+		l.recvLegacyPacket(pkt, addr, server)
+		return
+	}
+	if len(pkt) < headerSize {
+		slog.Error("RDT received invalid packet")
+		return
+	}
+	id := binary.BigEndian.Uint64(pkt[1:9])
+	if server {
 		l.openConnMapMutex.RLock()
-		conn, ok := l.openConnMap[addr.String()]
+		conn, ok := l.openConnMap[id]
 		l.openConnMapMutex.RUnlock()
 		if ok {
-			conn.recv(pkt)
+			conn.recv(pkt, addr)
 			return
 		}
+		l.reset(pkt, id, addr, false)
+		return
 	}
 	l.acceptConnMapMutex.RLock()
-	conn, ok := l.acceptConnMap[addr.String()]
+	conn, ok := l.acceptConnMap[id]
 	l.acceptConnMapMutex.RUnlock()
 	if ok && conn.state.Load() < CLOSED {
-		conn.recv(pkt)
+		conn.recv(pkt, addr)
+		return
+	}
+	if pkt[0] != 3 { // the stale frames of the unknown connection
+		l.reset(pkt, id, addr, true)
 		return
 	}
 	l.acceptConnMapMutex.Lock()
 	defer l.acceptConnMapMutex.Unlock()
-	conn, ok = l.acceptConnMap[addr.String()]
+	conn, ok = l.acceptConnMap[id]
+	if ok && conn.state.Load() < CLOSED {
+		conn.recv(pkt, addr)
+		return
+	}
+	conn = l.newConn(id, addr, false)
+	conn.server = true
+	conn.release = func() {
+		l.acceptConnMapMutex.Lock()
+		defer l.acceptConnMapMutex.Unlock()
+		if l.acceptConnMap[id] == conn {
+			delete(l.acceptConnMap, id)
+		}
+	}
+	l.acceptConnMap[id] = conn
+	l.accept <- conn
+	conn.startEventLoopGroup()
+	conn.recv(pkt, addr)
+}
+
+// recvLegacyPacket handles the frames of the peers without the connection id, as the baseline does
+func (l *RDTListener) recvLegacyPacket(pkt []byte, addr net.Addr, server bool) {
+	key := addr.String()
+	if server {
+		l.openConnMapMutex.RLock()
+		conn, ok := l.legacyOpenConnMap[key]
+		l.openConnMapMutex.RUnlock()
+		if ok {
+			conn.recv(pkt, addr)
+		}
+		return
+	}
+	l.acceptConnMapMutex.RLock()
+	conn, ok := l.legacyAcceptConnMap[key]
+	l.acceptConnMapMutex.RUnlock()
 	if ok && conn.state.Load() < CLOSED {
-		conn.recv(pkt)
+		conn.recv(pkt, addr)
 		return
 	}
-	if pkt[0] != 0 {
+	if pkt[0] != 0 { // the legacy connection is opened by the DATA frame
 		return
 	}
-	conn = l.newConn(addr)
+	l.acceptConnMapMutex.Lock()
+	defer l.acceptConnMapMutex.Unlock()
+	conn, ok = l.legacyAcceptConnMap[key]
+	if ok && conn.state.Load() < CLOSED {
+		conn.recv(pkt, addr)
+		return
+	}
+	conn = l.newConn(0, addr, true)
 	conn.server = true
-	l.acceptConnMap[addr.String()] = conn
+	conn.release = func() {
+		l.acceptConnMapMutex.Lock()
+		defer l.acceptConnMapMutex.Unlock()
+		if l.legacyAcceptConnMap[key] == conn {
+			delete(l.legacyAcceptConnMap, key)
+		}
+	}
+	l.legacyAcceptConnMap[key] = conn
 	l.accept <- conn
 	conn.startEventLoopGroup()
-	conn.recv(pkt)
-}
-
-func (l *RDTListener) newConn(remoteAddr net.Addr) *rdtConn {
-	return &rdtConn{
-		cfg:        l.cfg,
-		window:     uint32((l.cfg.MTU - 7) / 4),
-		frameSize:  l.cfg.MTU - 7,
-		c:          l.c,
-		remoteAddr: remoteAddr,
-		exit:       make(chan struct{}),
-		inbound:    make(chan []byte, 1024),
-		nck:        make(chan nck, 256),
-		nckQuery:   make(chan uint32, 256),
-		fin:        make(chan uint32, 5),
-		finack:     make(chan uint32, 5),
-		sendEvent:  make(chan struct{}),
-		recvPool:   map[uint32][]byte{},
-		sendPool:   map[uint32][]byte{},
+	conn.recv(pkt, addr)
+}
+
+// reset tells the remote peer that the connection does not exist, e.g. it is opened before restart
+func (l *RDTListener) reset(pkt []byte, id uint64, addr net.Addr, server bool) {
+	if pkt[0] == 23 || pkt[0] == 22 { // RST, FINACK
+		return
+	}
+	rst := buildFrame(23, id, 0, 0, nil)
+	if server {
+		rst[0] |= cmdServer
+	}
+	l.c.WriteTo(rst, addr)
+}
+
+func (l *RDTListener) newConn(id uint64, remoteAddr net.Addr, legacy bool) *rdtConn {
+	hdr := headerSize
+	if legacy {
+		hdr = legacyHeaderSize
+	}
+	frameSize := l.cfg.MTU - hdr
+	var fec *fecEncoder
+	if l.cfg.FEC && !legacy { // the legacy peers do not know the parity frame
+		frameSize -= fecOverhead // the parity frame is not larger than the mtu
+		fec = newFECEncoder()
+	}
+	c := &rdtConn{
+		id:        id,
+		legacy:    legacy,
+		hdr:       hdr,
+		cfg:       l.cfg,
+		window:    uint32((l.cfg.MTU - hdr) / 4),
+		frameSize: frameSize,
+		epoch:     time.Now(),
+		cc:        l.cfg.NewCongestionController(frameSize),
+		fec:       fec,
+		rtt:       newRTTEstimator(l.cfg.MinRTO, l.cfg.MaxRTO),
+		c:         l.c,
+		release:   func() {},
+		exit:      make(chan struct{}),
+		inbound:   make(chan []byte, 1024),
+		nck:       make(chan nck, 256),
+		nckQuery:  make(chan nckQuery, 256),
+		fin:       make(chan uint32, 5),
+		finack:    make(chan uint32, 5),
+		sendEvent: make(chan struct{}, 1),
+		synack:    make(chan struct{}, 1),
+		recvPool:  map[uint32][]byte{},
+		sendPool:  map[uint32]*sendFrame{},
 		wClosed: &net.OpError{
 			Op:     "write",
 			Net:    l.c.LocalAddr().Network(),
@@ -593,12 +990,18 @@ func (l *RDTListener) newConn(remoteAddr net.Addr) *rdtConn {
 			Err:    errors.New("closed"),
 		},
 	}
+	c.remoteAddr.Store(&remoteAddr)
+	return c
 }
 
 func Listen(conn net.PacketConn, opts ...Option) (*RDTListener, error) {
 	cfg := Config{
-		MTU:      1428,
-		Interval: 100 * time.Millisecond,
+		MTU:                     1428,
+		Interval:                100 * time.Millisecond,
+		HandshakeTimeout:        10 * time.Second,
+		MinRTO:                  200 * time.Millisecond,
+		MaxRTO:                  60 * time.Second,
+		NewCongestionController: NewCUBIC,
 	}
 
 	for _, opt := range opts {
@@ -608,12 +1011,14 @@ func Listen(conn net.PacketConn, opts ...Option) (*RDTListener, error) {
 	}
 
 	l := RDTListener{
-		cfg:           cfg,
-		c:             conn,
-		accept:        make(chan *rdtConn, 512),
-		openConnMap:   map[string]*rdtConn{},
-		acceptConnMap: map[string]*rdtConn{},
-		exitSig:       make(chan struct{}),
+		cfg:                 cfg,
+		c:                   conn,
+		accept:              make(chan *rdtConn, 512),
+		openConnMap:         map[uint64]*rdtConn{},
+		acceptConnMap:       map[uint64]*rdtConn{},
+		legacyOpenConnMap:   map[string]*rdtConn{},
+		legacyAcceptConnMap: map[string]*rdtConn{},
+		exitSig:             make(chan struct{}),
 	}
 
 	if len(cfg.StatsServerListen) > 0 {
@@ -627,3 +1032,16 @@ func Listen(conn net.PacketConn, opts ...Option) (*RDTListener, error) {
 	go l.runPacketReadLoop()
 	return &l, nil
 }
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func randomID() uint64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,224 @@
+package rdt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	N "github.com/sigcn/pg/net"
+)
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// listenLossy listens the rdt on the impaired link, the link is closed by the test cleanup
+func listenLossy(t *testing.T, link N.LinkConfig, opts ...Option) *RDTListener {
+	t.Helper()
+	l, err := Listen(N.NewLossyPacketConn(listenUDP(t), link), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// pair opens a stream from a to b, the accepted one is returned as the second
+func pair(t *testing.T, a, b *RDTListener) (*rdtConn, *rdtConn) {
+	t.Helper()
+	c, err := a.OpenStream(b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the connection is accepted on the first frame
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := b.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	return c.(*rdtConn), accepted.(*rdtConn)
+}
+
+// transfer writes size random bytes to w, r must read the same
+func transfer(t *testing.T, w, r net.Conn, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	go w.Write(data)
+	got := make([]byte, size)
+	r.SetReadDeadline(time.Now().Add(30 * time.Second))
+	defer r.SetReadDeadline(time.Time{})
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	link := N.LinkConfig{Latency: 5 * time.Millisecond}
+	a, b := listenLossy(t, link), listenLossy(t, link)
+	c, accepted := pair(t, a, b)
+	if c.legacy || accepted.legacy || c.id != accepted.id {
+		t.Fatalf("legacy %v/%v, id %x/%x", c.legacy, accepted.legacy, c.id, accepted.id)
+	}
+	if srtt := c.stat().SRTT; srtt < 10*time.Millisecond {
+		t.Errorf("handshake srtt %v", srtt)
+	}
+	// many streams to the same addr
+	c1, accepted1 := pair(t, a, b)
+	if c1.id == c.id {
+		t.Fatal("same connection id")
+	}
+	transfer(t, c1, accepted1, 64*1024)
+	transfer(t, accepted, c, 64*1024)
+}
+
+func TestHandshakeLoss(t *testing.T) {
+	a := listenLossy(t, N.LinkConfig{Loss: 1}, RTOBounds(10*time.Millisecond, 50*time.Millisecond), DisableLegacy(), HandshakeTimeout(300*time.Millisecond))
+	b := listenLossy(t, N.LinkConfig{})
+	start := time.Now()
+	if _, err := a.OpenStream(b.Addr()); err == nil {
+		t.Fatal("opened over the broken link")
+	}
+	if d := time.Since(start); d < 300*time.Millisecond || d > 2*time.Second {
+		t.Errorf("handshake timeout after %v", d)
+	}
+}
+
+func TestReset(t *testing.T) {
+	a, b := listenLossy(t, N.LinkConfig{}), listenLossy(t, N.LinkConfig{})
+	c, _ := pair(t, a, b)
+	// b restarts, the connection is unknown
+	b.acceptConnMapMutex.Lock()
+	clear(b.acceptConnMap)
+	b.acceptConnMapMutex.Unlock()
+
+	c.Write([]byte("hello"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	if _, err := c.Read(make([]byte, 5)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read on the reset connection: %v", err)
+	}
+}
+
+func TestCongestion(t *testing.T) {
+	for _, cc := range []func(frameSize int) CongestionController{NewCUBIC, NewBBR} {
+		link := N.LinkConfig{Loss: 0.02, Reorder: 0.01, Latency: 5 * time.Millisecond, Jitter: time.Millisecond, Bandwidth: 4 << 20, Seed: 1}
+		a, b := listenLossy(t, link, Congestion(cc)), listenLossy(t, link, Congestion(cc))
+		c, accepted := pair(t, a, b)
+		transfer(t, c, accepted, 2<<20)
+		stat := c.stat()
+		if stat.Lost == 0 || stat.SRTT == 0 {
+			t.Errorf("%s: %+v", stat.CC, stat)
+		}
+	}
+}
+
+func TestFEC(t *testing.T) {
+	link := N.LinkConfig{Loss: 0.03, Latency: 5 * time.Millisecond, Seed: 1}
+	a, b := listenLossy(t, link, EnableFEC()), listenLossy(t, link, EnableFEC())
+	c, accepted := pair(t, a, b)
+	transfer(t, c, accepted, 1<<20)
+	if accepted.stat().Recovered == 0 {
+		t.Error("no frame is recovered by the parity")
+	}
+	if c.stat().FECGroup == 0 {
+		t.Error("fec is disabled")
+	}
+}
+
+func legacyFrame(cmd byte, no uint32, data []byte) []byte {
+	pkt := []byte{cmd}
+	pkt = binary.BigEndian.AppendUint32(pkt, no)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(data)))
+	return append(pkt, data...)
+}
+
+func TestLegacyPeer(t *testing.T) {
+	l := listenLossy(t, N.LinkConfig{})
+	peer := listenUDP(t)
+	defer peer.Close()
+
+	// the legacy peer opens the connection by the DATA frame
+	peer.WriteTo(legacyFrame(0, 1, []byte("hello")), l.Addr())
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	accepted.Write([]byte("world"))
+	pkt := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := peer.ReadFrom(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt[0]&cmdVersioned != 0 {
+			t.Fatalf("versioned frame %x sent to the legacy peer", pkt[:n])
+		}
+		if pkt[0] == cmdServer && n == legacyHeaderSize+5 { // DATA of the accepted connection
+			if string(pkt[legacyHeaderSize:n]) != "world" {
+				t.Fatalf("data %q", pkt[legacyHeaderSize:n])
+			}
+			break
+		}
+	}
+}
+
+func TestLegacyFallback(t *testing.T) {
+	l := listenLossy(t, N.LinkConfig{}, RTOBounds(10*time.Millisecond, 50*time.Millisecond))
+	peer := listenUDP(t)
+	defer peer.Close()
+
+	// the legacy peer ignores the SYN
+	c, err := l.OpenStream(peer.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.(*rdtConn).legacy {
+		t.Fatal("not fallen back to the legacy framing")
+	}
+	c.Write([]byte("hello"))
+	pkt := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := peer.ReadFrom(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt[0]&cmdVersioned != 0 {
+			continue // SYN
+		}
+		if !bytes.Equal(pkt[:n], legacyFrame(0, 1, []byte("hello"))) {
+			t.Fatalf("legacy frame %x", pkt[:n])
+		}
+		break
+	}
+
+	strict := listenLossy(t, N.LinkConfig{}, RTOBounds(10*time.Millisecond, 50*time.Millisecond), DisableLegacy(), HandshakeTimeout(300*time.Millisecond))
+	if _, err := strict.OpenStream(peer.LocalAddr()); err == nil {
+		t.Error("opened to the legacy peer with the legacy framing disabled")
+	}
+}
@@ -0,0 +1,49 @@
+package rdt
+
+import "time"
+
+// RTTStats is the round trip time estimated by the connection
+type RTTStats struct {
+	Latest time.Duration // the latest sample
+	SRTT   time.Duration // smoothed round trip time, 0 if no sample yet
+	RTTVar time.Duration
+	MinRTT time.Duration
+}
+
+// rttEstimator computes the retransmission timeout as RFC 6298 does
+type rttEstimator struct {
+	stats          RTTStats
+	rto            time.Duration
+	minRTO, maxRTO time.Duration
+}
+
+func newRTTEstimator(minRTO, maxRTO time.Duration) *rttEstimator {
+	return &rttEstimator{rto: min(max(time.Second, minRTO), maxRTO), minRTO: minRTO, maxRTO: maxRTO}
+}
+
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if rtt <= 0 {
+		rtt = time.Microsecond
+	}
+	e.stats.Latest = rtt
+	if e.stats.MinRTT == 0 || rtt < e.stats.MinRTT {
+		e.stats.MinRTT = rtt
+	}
+	if e.stats.SRTT == 0 {
+		e.stats.SRTT = rtt
+		e.stats.RTTVar = rtt / 2
+	} else {
+		diff := e.stats.SRTT - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.stats.RTTVar = (3*e.stats.RTTVar + diff) / 4
+		e.stats.SRTT = (7*e.stats.SRTT + rtt) / 8
+	}
+	e.rto = min(max(e.stats.SRTT+max(time.Millisecond, 4*e.stats.RTTVar), e.minRTO), e.maxRTO)
+}
+
+// backoff doubles the timeout after it expires, the next sample restores it
+func (e *rttEstimator) backoff() {
+	e.rto = min(2*e.rto, e.maxRTO)
+}
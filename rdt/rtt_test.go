@@ -0,0 +1,72 @@
+package rdt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	e := newRTTEstimator(10*time.Millisecond, 5*time.Second)
+	if e.rto != time.Second {
+		t.Fatalf("initial rto %s, want 1s", e.rto)
+	}
+
+	// the first sample: SRTT = R, RTTVAR = R/2, RTO = SRTT + 4*RTTVAR
+	e.sample(100 * time.Millisecond)
+	if e.stats.SRTT != 100*time.Millisecond || e.stats.RTTVar != 50*time.Millisecond || e.rto != 300*time.Millisecond {
+		t.Fatalf("first sample: %+v, rto %s", e.stats, e.rto)
+	}
+
+	// the later samples: RTTVAR = 3/4 RTTVAR + 1/4 |SRTT - R|, SRTT = 7/8 SRTT + 1/8 R
+	e.sample(200 * time.Millisecond)
+	if e.stats.RTTVar != 62500*time.Microsecond || e.stats.SRTT != 112500*time.Microsecond || e.rto != 362500*time.Microsecond {
+		t.Fatalf("second sample: %+v, rto %s", e.stats, e.rto)
+	}
+	if e.stats.Latest != 200*time.Millisecond || e.stats.MinRTT != 100*time.Millisecond {
+		t.Fatalf("latest %s, min %s", e.stats.Latest, e.stats.MinRTT)
+	}
+
+	// the timeout doubles up to the max, and the next sample restores it
+	e.backoff()
+	if e.rto != 725*time.Millisecond {
+		t.Fatalf("backoff rto %s", e.rto)
+	}
+	for range 5 {
+		e.backoff()
+	}
+	if e.rto != 5*time.Second {
+		t.Fatalf("rto %s exceeds the max", e.rto)
+	}
+	e.sample(112500 * time.Microsecond)
+	if e.rto >= time.Second {
+		t.Fatalf("rto %s is not restored by the sample", e.rto)
+	}
+}
+
+func TestRTTEstimatorBounds(t *testing.T) {
+	// the rto is not less than the min however small the variance is
+	e := newRTTEstimator(200*time.Millisecond, 5*time.Second)
+	for range 50 {
+		e.sample(time.Millisecond)
+	}
+	if e.rto != 200*time.Millisecond {
+		t.Errorf("rto %s, want the min 200ms", e.rto)
+	}
+
+	// nor more than the max, the initial rto is clamped as well
+	e = newRTTEstimator(10*time.Millisecond, 500*time.Millisecond)
+	if e.rto != 500*time.Millisecond {
+		t.Errorf("initial rto %s, want the max 500ms", e.rto)
+	}
+	e.sample(2 * time.Second)
+	if e.rto != 500*time.Millisecond {
+		t.Errorf("rto %s, want the max 500ms", e.rto)
+	}
+
+	// the zero sample is taken as the clock granularity
+	e = newRTTEstimator(0, time.Second)
+	e.sample(0)
+	if e.stats.SRTT != time.Microsecond || e.rto != time.Millisecond+time.Microsecond {
+		t.Errorf("zero sample: %+v, rto %s", e.stats, e.rto)
+	}
+}
@@ -4,47 +4,93 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Stat struct {
-	RemoteAddr string `json:"remoteAddr"`
-	RecvNO     uint32 `json:"recvNO"`
-	SentNO     uint32 `json:"sentNO"`
-	ACKNO      uint32 `json:"ackNO"`
-	State      int    `json:"state"`
-	RecvPool   int    `json:"recvPool"`
-	SendPool   int    `json:"sendPool"`
-	Resend     uint32 `json:"resend"`
+	ID         string        `json:"id"`
+	RemoteAddr string        `json:"remoteAddr"`
+	RecvNO     uint32        `json:"recvNO"`
+	SentNO     uint32        `json:"sentNO"`
+	ACKNO      uint32        `json:"ackNO"`
+	State      int           `json:"state"`
+	RecvPool   int           `json:"recvPool"`
+	SendPool   int           `json:"sendPool"`
+	Resend     uint32        `json:"resend"`
+	Lost       uint32        `json:"lost"`
+	Timeouts   uint32        `json:"timeouts"`
+	Recovered  uint32        `json:"recovered"` // frames recovered by the fec parity
+	FECGroup   int           `json:"fecGroup"`  // frames per parity, 0 if the fec is disabled
+	LossRate   float64       `json:"lossRate"`
+	CC         string        `json:"cc"`
+	CWnd       int           `json:"cwnd"`
+	PacingRate float64       `json:"pacingRate"` // bytes per second
+	SRTT       time.Duration `json:"srtt"`
+	RTTVar     time.Duration `json:"rttvar"`
+	MinRTT     time.Duration `json:"minRTT"`
+	RTO        time.Duration `json:"rto"`
+}
+
+func (c *rdtConn) stat() Stat {
+	c.recvMutex.RLock()
+	recvPool := len(c.recvPool)
+	c.recvMutex.RUnlock()
+	c.sendMutex.RLock()
+	sendPool := len(c.sendPool)
+	var fecGroup int
+	var lossRate float64
+	if c.fec != nil {
+		fecGroup, lossRate = c.fec.group, c.fec.lossRate
+	}
+	c.sendMutex.RUnlock()
+	c.ccMutex.Lock()
+	defer c.ccMutex.Unlock()
+	return Stat{
+		ID:         strconv.FormatUint(c.id, 16),
+		RemoteAddr: c.RemoteAddr().String(),
+		RecvNO:     c.recvNO.Load(),
+		SentNO:     c.sentNO.Load(),
+		ACKNO:      c.ackNO.Load(),
+		State:      int(c.state.Load()),
+		RecvPool:   recvPool,
+		SendPool:   sendPool,
+		Resend:     c.rs.Load(),
+		Lost:       c.lost.Load(),
+		Timeouts:   c.timeouts.Load(),
+		Recovered:  c.recovered.Load(),
+		FECGroup:   fecGroup,
+		LossRate:   lossRate,
+		CC:         c.cc.Name(),
+		CWnd:       c.cc.Window(),
+		PacingRate: c.cc.PacingRate(),
+		SRTT:       c.rtt.stats.SRTT,
+		RTTVar:     c.rtt.stats.RTTVar,
+		MinRTT:     c.rtt.stats.MinRTT,
+		RTO:        c.rtt.rto,
+	}
 }
 
 func runStatsHTTPServer(statsListener net.Listener, l *RDTListener) {
 	http.HandleFunc("/stat", func(w http.ResponseWriter, r *http.Request) {
 		var acceptStats []Stat
-		for k, v := range l.acceptConnMap {
-			acceptStats = append(acceptStats, Stat{
-				RemoteAddr: k,
-				RecvNO:     v.recvNO,
-				SentNO:     v.sentNO,
-				ACKNO:      v.ackNO,
-				State:      int(v.state.Load()),
-				RecvPool:   len(v.recvPool),
-				SendPool:   len(v.sendPool),
-				Resend:     v.rs.Load(),
-			})
+		l.acceptConnMapMutex.RLock()
+		for _, v := range l.acceptConnMap {
+			acceptStats = append(acceptStats, v.stat())
 		}
+		for _, v := range l.legacyAcceptConnMap {
+			acceptStats = append(acceptStats, v.stat())
+		}
+		l.acceptConnMapMutex.RUnlock()
 		var openStats []Stat
-		for k, v := range l.openConnMap {
-			openStats = append(openStats, Stat{
-				RemoteAddr: k,
-				RecvNO:     v.recvNO,
-				SentNO:     v.sentNO,
-				ACKNO:      v.ackNO,
-				State:      int(v.state.Load()),
-				RecvPool:   len(v.recvPool),
-				SendPool:   len(v.sendPool),
-				Resend:     v.rs.Load(),
-			})
+		l.openConnMapMutex.RLock()
+		for _, v := range l.openConnMap {
+			openStats = append(openStats, v.stat())
+		}
+		for _, v := range l.legacyOpenConnMap {
+			openStats = append(openStats, v.stat())
 		}
+		l.openConnMapMutex.RUnlock()
 		json.NewEncoder(w).Encode(map[string][]Stat{"accept": acceptStats, "open": openStats})
 	})
 	go http.Serve(statsListener, nil)
@@ -0,0 +1,205 @@
+package aesgcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sigcn/pg/cache/lru"
+	"github.com/sigcn/pg/secure"
+)
+
+var _ secure.LocalBinder = (*AESGCM)(nil)
+
+const (
+	saltSize    = 4
+	counterSize = 8
+	nonceSize   = saltSize + counterSize
+
+	// filtersSize bounds the replay filters, it is larger than the ciphers so that the
+	// filters survive the cipher eviction
+	filtersSize = 4096
+)
+
+// Seal encrypts and authenticates the data with a random nonce, the nonce is prepended to the ciphertext.
+// The key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256
+func Seal(key, data, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, data, additionalData), nil
+}
+
+// Open authenticates and decrypts the data sealed by Seal
+func Open(key, data, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("invalid data")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, errors.New("invalid data")
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AESGCM is the AES-GCM cipher with explicit per-packet nonces.
+//
+// The packet is in the form of [salt 4 bytes][counter 8 bytes][ciphertext]. Each direction has its own
+// key derived from the secret key and the ids of both peers (see BindLocal), and the counter starts from
+// the unix nanoseconds and increases by packet, so nonces are never reused by a key. The salt is random
+// per instance, it is the epoch of the sender. The receiver drops the replayed packets with a sliding
+// window per sender epoch, so the counter of a restarted peer is accepted even if its clock steps back
+type AESGCM struct {
+	mut              sync.Mutex
+	peers            *lru.Cache[string, *gcmPeer]
+	filters          *lru.Cache[epoch, *secure.ReplayFilter]
+	provideSecretKey secure.ProvideSecretKey
+	localID          atomic.Pointer[string]
+	salt             [saltSize]byte
+	counter          atomic.Uint64
+}
+
+type gcmPeer struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+}
+
+// epoch is an instance of the peer, a restarted peer is a new epoch
+type epoch struct {
+	pubKey string
+	salt   [saltSize]byte
+}
+
+func (s *AESGCM) Encrypt(data []byte, pubKey string) ([]byte, error) {
+	if s == nil {
+		return nil, errors.New("enc is disabled")
+	}
+	peer, err := s.ensurePeer(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, nonceSize, nonceSize+len(data)+peer.send.Overhead())
+	copy(b, s.salt[:])
+	binary.BigEndian.PutUint64(b[saltSize:], s.counter.Add(1))
+	return peer.send.Seal(b, b[:nonceSize], data, nil), nil
+}
+
+func (s *AESGCM) Decrypt(data []byte, pubKey string) ([]byte, error) {
+	if s == nil {
+		return nil, errors.New("dec is disabled")
+	}
+	peer, err := s.ensurePeer(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < nonceSize+peer.recv.Overhead() {
+		return nil, errors.New("invalid data")
+	}
+	plain, err := peer.recv.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("invalid data")
+	}
+	// the filter is created after the packet is authenticated, the forged epochs never evict the others
+	if !s.filter(epoch{pubKey: pubKey, salt: [saltSize]byte(data)}).Accept(binary.BigEndian.Uint64(data[saltSize:nonceSize])) {
+		return nil, secure.ErrReplayed
+	}
+	return plain, nil
+}
+
+func (s *AESGCM) SecretKey() secure.ProvideSecretKey {
+	return s.provideSecretKey
+}
+
+// BindLocal sets the id of this peer, the keys of both directions are derived from it and the peer id
+func (s *AESGCM) BindLocal(pubKey string) {
+	s.localID.Store(&pubKey)
+}
+
+func (s *AESGCM) ensurePeer(pubKey string) (*gcmPeer, error) {
+	s.mut.Lock()
+	peer, ok := s.peers.Get(pubKey)
+	s.mut.Unlock()
+	if ok {
+		return peer, nil
+	}
+	localID := s.localID.Load()
+	if localID == nil {
+		return nil, errors.New("local id is not bound")
+	}
+	secretKey, err := s.provideSecretKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	send, err := directionGCM(secretKey, *localID, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := directionGCM(secretKey, pubKey, *localID)
+	if err != nil {
+		return nil, err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	peer = &gcmPeer{send: send, recv: recv}
+	s.peers.Put(pubKey, peer)
+	return peer, nil
+}
+
+func (s *AESGCM) filter(e epoch) *secure.ReplayFilter {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	filter, ok := s.filters.Get(e)
+	if !ok {
+		filter = &secure.ReplayFilter{}
+		s.filters.Put(e, filter)
+	}
+	return filter
+}
+
+// directionGCM creates the cipher of the packets from sender to receiver, the key is derived from
+// the secret key and the sorted ids of the peers, the sender id makes the two directions differ
+func directionGCM(secretKey []byte, sender, receiver string) (cipher.AEAD, error) {
+	ids := []string{sender, receiver}
+	slices.Sort(ids)
+	key, err := hkdf.Key(sha256.New, secretKey, []byte(strings.Join(ids, ",")), "peerguard aesgcm "+sender, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+// New creates the AES-256-GCM SymmAlgo, BindLocal must be called before use
+func New(provideSecretKey secure.ProvideSecretKey) secure.SymmAlgo {
+	s := &AESGCM{
+		peers:            lru.New[string, *gcmPeer](1024),
+		filters:          lru.New[epoch, *secure.ReplayFilter](filtersSize),
+		provideSecretKey: provideSecretKey,
+	}
+	rand.Read(s.salt[:])
+	s.counter.Store(uint64(time.Now().UnixNano()))
+	return s
+}
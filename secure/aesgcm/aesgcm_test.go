@@ -0,0 +1,112 @@
+package aesgcm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sigcn/pg/secure"
+)
+
+func staticKey(pubKey string) ([]byte, error) {
+	return bytes.Repeat([]byte{1}, 32), nil
+}
+
+func newBound(id string) secure.SymmAlgo {
+	s := New(staticKey)
+	s.(secure.LocalBinder).BindLocal(id)
+	return s
+}
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{2}, 32)
+	b, err := Seal(key, []byte("hello"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := Open(key, b, []byte("ad")); err != nil || string(plain) != "hello" {
+		t.Fatalf("Open = %q, %v", plain, err)
+	}
+	if _, err := Open(key, b, []byte("other")); err == nil {
+		t.Error("opened with another additional data")
+	}
+	if _, err := Open(bytes.Repeat([]byte{3}, 32), b, []byte("ad")); err == nil {
+		t.Error("opened with another key")
+	}
+	if _, err := Open(key, b[:10], []byte("ad")); err == nil {
+		t.Error("opened the truncated data")
+	}
+}
+
+func TestAESGCM(t *testing.T) {
+	alice, bob := newBound("alice"), newBound("bob")
+	for i := range 10 {
+		msg := fmt.Appendf(nil, "hello %d", i)
+		b, err := alice.Encrypt(msg, "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := bob.Decrypt(b, "alice")
+		if err != nil || !bytes.Equal(plain, msg) {
+			t.Fatalf("Decrypt = %q, %v", plain, err)
+		}
+		if _, err := bob.Decrypt(b, "alice"); !errors.Is(err, secure.ErrReplayed) {
+			t.Fatalf("replayed packet: %v", err)
+		}
+		b, _ = bob.Encrypt(msg, "alice")
+		if plain, err := alice.Decrypt(b, "bob"); err != nil || !bytes.Equal(plain, msg) {
+			t.Fatalf("Decrypt = %q, %v", plain, err)
+		}
+	}
+
+	b, _ := alice.Encrypt([]byte("hello"), "bob")
+	// the two directions use different keys
+	if _, err := alice.Decrypt(b, "bob"); err == nil {
+		t.Error("reflected packet is accepted")
+	}
+	if _, err := newBound("carol").Decrypt(b, "alice"); err == nil {
+		t.Error("packet to another peer is accepted")
+	}
+	b[len(b)-1] ^= 1
+	if _, err := bob.Decrypt(b, "alice"); err == nil {
+		t.Error("tampered packet is accepted")
+	}
+
+	if _, err := New(staticKey).Encrypt([]byte("hello"), "bob"); err == nil {
+		t.Error("encrypted without the local id")
+	}
+}
+
+func TestReplayAfterEviction(t *testing.T) {
+	alice, bob := newBound("alice"), newBound("bob")
+	b, _ := alice.Encrypt([]byte("hello"), "bob")
+	if _, err := bob.Decrypt(b, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// evict the cipher of alice
+	for i := range 1024 {
+		bob.Encrypt(nil, fmt.Sprintf("peer%d", i))
+	}
+	if _, err := bob.Decrypt(b, "alice"); !errors.Is(err, secure.ErrReplayed) {
+		t.Errorf("replayed packet after eviction: %v", err)
+	}
+}
+
+func TestRestartedPeer(t *testing.T) {
+	alice, bob := newBound("alice"), newBound("bob")
+	b, _ := alice.Encrypt([]byte("hello"), "bob")
+	if _, err := bob.Decrypt(b, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// the clock of alice steps back across the restart
+	restarted := newBound("alice")
+	restarted.(*AESGCM).counter.Store(1)
+	b, _ = restarted.Encrypt([]byte("hello"), "bob")
+	if _, err := bob.Decrypt(b, "alice"); err != nil {
+		t.Errorf("packet of the restarted peer: %v", err)
+	}
+	if _, err := bob.Decrypt(b, "alice"); !errors.Is(err, secure.ErrReplayed) {
+		t.Errorf("replayed packet of the restarted peer: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package chacha20poly1305
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/sigcn/pg/cache/lru"
+	"github.com/sigcn/pg/secure"
+)
+
+var _ secure.SymmAlgo = (*CounterChacha20Poly1305)(nil)
+
+const (
+	saltSize    = 16
+	counterSize = 8
+
+	// filtersSize bounds the replay filters, it is larger than the ciphers so that the
+	// filters survive the cipher eviction
+	filtersSize = 4096
+)
+
+// CounterChacha20Poly1305 is the XChaCha20-Poly1305 cipher with explicit per-packet nonces.
+//
+// The packet is in the form of [salt 16 bytes][counter 8 bytes][ciphertext]. The salt is random per
+// instance, it is the epoch of the sender so that the counter starts from 1 without the clock, and
+// the two directions sharing the same key never reuse a nonce. The receiver drops the replayed packets
+// with a sliding window per sender epoch, the filters of the least recently seen epochs are evicted
+type CounterChacha20Poly1305 struct {
+	mut              sync.Mutex
+	cipher           *lru.Cache[string, cipher.AEAD]
+	filters          *lru.Cache[epoch, *secure.ReplayFilter]
+	provideSecretKey secure.ProvideSecretKey
+	salt             [saltSize]byte
+	counter          atomic.Uint64
+}
+
+// epoch is an instance of the peer, a restarted peer is a new epoch
+type epoch struct {
+	pubKey string
+	salt   [saltSize]byte
+}
+
+func (s *CounterChacha20Poly1305) Encrypt(data []byte, pubKey string) ([]byte, error) {
+	if s == nil {
+		return nil, errors.New("enc is disabled")
+	}
+	aead, err := s.ensureCipher(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, saltSize+counterSize, saltSize+counterSize+len(data)+aead.Overhead())
+	copy(b, s.salt[:])
+	binary.BigEndian.PutUint64(b[saltSize:], s.counter.Add(1))
+	return aead.Seal(b, b[:chacha20poly1305.NonceSizeX], data, nil), nil
+}
+
+func (s *CounterChacha20Poly1305) Decrypt(data []byte, pubKey string) ([]byte, error) {
+	if s == nil {
+		return nil, errors.New("dec is disabled")
+	}
+	if len(data) < chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, errors.New("invalid data")
+	}
+	if [saltSize]byte(data[:saltSize]) == s.salt {
+		return nil, errors.New("reflected packet")
+	}
+	aead, err := s.ensureCipher(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[:chacha20poly1305.NonceSizeX]
+	plain, err := aead.Open(nil, nonce, data[chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		return nil, errors.New("invalid data")
+	}
+	// the filter is created after the packet is authenticated, the forged epochs never evict the others
+	if !s.filter(epoch{pubKey: pubKey, salt: [saltSize]byte(nonce)}).Accept(binary.BigEndian.Uint64(nonce[saltSize:])) {
+		return nil, secure.ErrReplayed
+	}
+	return plain, nil
+}
+
+func (s *CounterChacha20Poly1305) SecretKey() secure.ProvideSecretKey {
+	return s.provideSecretKey
+}
+
+func (s *CounterChacha20Poly1305) ensureCipher(pubKey string) (cipher.AEAD, error) {
+	s.mut.Lock()
+	aead, ok := s.cipher.Get(pubKey)
+	s.mut.Unlock()
+	if ok {
+		return aead, nil
+	}
+	secretKey, err := s.provideSecretKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = chacha20poly1305.NewX(secretKey); err != nil {
+		return nil, err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.cipher.Put(pubKey, aead)
+	return aead, nil
+}
+
+func (s *CounterChacha20Poly1305) filter(e epoch) *secure.ReplayFilter {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	filter, ok := s.filters.Get(e)
+	if !ok {
+		filter = &secure.ReplayFilter{}
+		s.filters.Put(e, filter)
+	}
+	return filter
+}
+
+// NewCounter creates the XChaCha20-Poly1305 SymmAlgo with counter nonces and replay protection,
+// it is not compatible with New
+func NewCounter(provideSecretKey secure.ProvideSecretKey) secure.SymmAlgo {
+	s := &CounterChacha20Poly1305{
+		cipher:           lru.New[string, cipher.AEAD](1024),
+		filters:          lru.New[epoch, *secure.ReplayFilter](filtersSize),
+		provideSecretKey: provideSecretKey,
+	}
+	rand.Read(s.salt[:])
+	return s
+}
@@ -0,0 +1,82 @@
+package chacha20poly1305
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sigcn/pg/secure"
+)
+
+func staticKey(pubKey string) ([]byte, error) {
+	return bytes.Repeat([]byte{1}, 32), nil
+}
+
+func TestCounter(t *testing.T) {
+	alice, bob := NewCounter(staticKey), NewCounter(staticKey)
+	for i := range 10 {
+		msg := fmt.Appendf(nil, "hello %d", i)
+		b, err := alice.Encrypt(msg, "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := bob.Decrypt(b, "alice")
+		if err != nil || !bytes.Equal(plain, msg) {
+			t.Fatalf("Decrypt = %q, %v", plain, err)
+		}
+		if _, err := bob.Decrypt(b, "alice"); !errors.Is(err, secure.ErrReplayed) {
+			t.Fatalf("replayed packet: %v", err)
+		}
+	}
+
+	b, _ := alice.Encrypt([]byte("hello"), "bob")
+	if _, err := alice.Decrypt(b, "bob"); err == nil {
+		t.Error("reflected packet is accepted")
+	}
+	b[len(b)-1] ^= 1
+	if _, err := bob.Decrypt(b, "alice"); err == nil {
+		t.Error("tampered packet is accepted")
+	}
+	if _, err := bob.Decrypt(b[:20], "alice"); err == nil {
+		t.Error("truncated packet is accepted")
+	}
+
+	// the restarted peer is a new epoch, its counter starts over regardless of the clock
+	restarted := NewCounter(staticKey)
+	b, _ = restarted.Encrypt([]byte("hello"), "bob")
+	if _, err := bob.Decrypt(b, "alice"); err != nil {
+		t.Errorf("packet of the restarted peer: %v", err)
+	}
+	if _, err := bob.Decrypt(b, "alice"); !errors.Is(err, secure.ErrReplayed) {
+		t.Errorf("replayed packet of the restarted peer: %v", err)
+	}
+}
+
+func TestCounterFiltersBounded(t *testing.T) {
+	bob := NewCounter(staticKey).(*CounterChacha20Poly1305)
+	for range filtersSize + 10 {
+		b, _ := NewCounter(staticKey).Encrypt([]byte("hello"), "bob")
+		if _, err := bob.Decrypt(b, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(bob.filters.Dump()); n != filtersSize {
+		t.Errorf("%d filters, want %d", n, filtersSize)
+	}
+}
+
+func TestCounterReplayAfterEviction(t *testing.T) {
+	alice, bob := NewCounter(staticKey), NewCounter(staticKey)
+	b, _ := alice.Encrypt([]byte("hello"), "bob")
+	if _, err := bob.Decrypt(b, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// evict the cipher of alice
+	for i := range 1024 {
+		bob.Encrypt(nil, fmt.Sprintf("peer%d", i))
+	}
+	if _, err := bob.Decrypt(b, "alice"); !errors.Is(err, secure.ErrReplayed) {
+		t.Errorf("replayed packet after eviction: %v", err)
+	}
+}
@@ -0,0 +1,618 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"storj.io/common/base58"
+
+	"github.com/sigcn/pg/secure"
+)
+
+var _ secure.Handshaker = (*Noise)(nil)
+var _ secure.StaticKeyBinder = (*Noise)(nil)
+
+const (
+	msgInitiation byte = 1
+	msgResponse   byte = 2
+	msgData       byte = 4
+
+	keySize        = 32
+	initiationSize = 1 + 4 + keySize + keySize + chacha20poly1305.Overhead + 8 + chacha20poly1305.Overhead
+	responseSize   = 1 + 4 + 4 + keySize + chacha20poly1305.Overhead
+	dataHeaderSize = 1 + 4 + 8
+
+	// RekeyAfterTime is the session age after which the initiator starts a new handshake
+	RekeyAfterTime = 2 * time.Minute
+	// RejectAfterTime is the session age after which the session is not used anymore
+	RejectAfterTime = 3 * time.Minute
+	// RekeyAfterBytes is the payload size sent with a session after which a new handshake is started
+	RekeyAfterBytes = 1 << 30
+	// RekeyTimeout is the interval of the handshake retries
+	RekeyTimeout = 5 * time.Second
+
+	// maxPending is the count of packets queued by peer while the handshake is in progress
+	maxPending = 32
+)
+
+var (
+	protocolName = []byte("Noise_IKpsk1_25519_ChaChaPoly_SHA256")
+	prologue     = []byte("peerguard")
+)
+
+// Noise is the SymmAlgo which runs a Noise IKpsk1 handshake over the datagram path, and encrypts the
+// packets with the ephemeral session keys. The peer ids are the static public keys, the initiator sends
+// its static key encrypted and both sides are authenticated by the static private key bound by
+// BindStaticKey. The psk is the secret key provided by provideSecretKey, i.e. the static key exchange
+// mixed with the network pre-shared key if any. Compromising a private key doesn't decrypt the past traffic.
+//
+// Sessions are rekeyed after RekeyAfterTime or RekeyAfterBytes, and a new handshake is started when
+// a packet of an unknown session is received, so peers recover from restarts transparently.
+// The peers and sessions are dropped after RejectAfterTime without a handshake
+type Noise struct {
+	provideSecretKey secure.ProvideSecretKey
+	static           atomic.Pointer[ecdh.PrivateKey]
+	send             atomic.Pointer[func(b []byte, pubKey string) error]
+	timestamp        atomic.Uint64
+
+	mut      sync.RWMutex
+	peers    map[string]*peer
+	sessions map[uint32]*session // local index as key
+}
+
+type peer struct {
+	mut           sync.Mutex
+	id            string
+	static        *ecdh.PublicKey
+	current       *session
+	previous      *session
+	handshake     *handshake // initiated and waiting for the response
+	handshakeTime time.Time
+	timestamp     uint64       // of the latest initiation accepted
+	active        atomic.Int64 // unix nanoseconds of the latest handshake, the peer is dropped after RejectAfterTime
+	pending       [][]byte
+}
+
+type handshake struct {
+	localIndex uint32
+	ephemeral  *ecdh.PrivateKey
+	state      symmetricState
+}
+
+type session struct {
+	peer        *peer
+	localIndex  uint32
+	remoteIndex uint32
+	send        cipher.AEAD
+	recv        cipher.AEAD
+	initiator   bool
+	created     time.Time
+	counter     atomic.Uint64
+	sent        atomic.Uint64
+	confirmed   atomic.Bool // the responder must not send with the session before receiving from it
+	filter      secure.ReplayFilter
+}
+
+func (n *Noise) Encrypt(data []byte, pubKey string) ([]byte, error) {
+	if n == nil {
+		return nil, errors.New("enc is disabled")
+	}
+	p, err := n.peer(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	p.mut.Lock()
+	sess := p.sendSession()
+	var initiation []byte
+	if p.rekeyRequired(sess) {
+		if initiation, err = n.initiate(p); err != nil {
+			slog.Debug("[Noise] Initiate handshake", "peer", pubKey, "err", err)
+		}
+	}
+	if sess == nil {
+		if len(p.pending) < maxPending {
+			p.pending = append(p.pending, bytes.Clone(data))
+		}
+		p.mut.Unlock()
+		n.sendMessage(initiation, pubKey)
+		return nil, secure.ErrHandshake
+	}
+	p.mut.Unlock()
+	n.sendMessage(initiation, pubKey)
+	return sess.seal(data), nil
+}
+
+func (n *Noise) Decrypt(data []byte, pubKey string) ([]byte, error) {
+	if n == nil {
+		return nil, errors.New("dec is disabled")
+	}
+	if len(data) == 0 {
+		return nil, errors.New("invalid data")
+	}
+	switch data[0] {
+	case msgInitiation:
+		if err := n.handleInitiation(data, pubKey); err != nil {
+			slog.Debug("[Noise] Handle initiation", "peer", pubKey, "err", err)
+		}
+		return nil, secure.ErrHandshake
+	case msgResponse:
+		if err := n.handleResponse(data, pubKey); err != nil {
+			slog.Debug("[Noise] Handle response", "peer", pubKey, "err", err)
+		}
+		return nil, secure.ErrHandshake
+	case msgData:
+		return n.open(data, pubKey)
+	}
+	return nil, errors.New("invalid data")
+}
+
+func (n *Noise) SecretKey() secure.ProvideSecretKey {
+	return n.provideSecretKey
+}
+
+// BindSender sets the func which sends the handshake messages and the queued packets to peers
+func (n *Noise) BindSender(send func(b []byte, pubKey string) error) {
+	n.send.Store(&send)
+}
+
+// BindStaticKey sets the static private key of this peer, the handshakes fail until it is bound
+func (n *Noise) BindStaticKey(privateKey *ecdh.PrivateKey) {
+	n.static.Store(privateKey)
+}
+
+func (n *Noise) open(data []byte, pubKey string) ([]byte, error) {
+	if len(data) < dataHeaderSize+chacha20poly1305.Overhead {
+		return nil, errors.New("invalid data")
+	}
+	n.mut.RLock()
+	sess := n.sessions[binary.LittleEndian.Uint32(data[1:])]
+	n.mut.RUnlock()
+	if sess == nil || sess.expired() {
+		// the peer or this node restarted, or the session expired
+		n.requireHandshake(pubKey)
+		return nil, secure.ErrHandshake
+	}
+	if sess.peer.id != pubKey {
+		return nil, errors.New("session mismatched")
+	}
+	counter := binary.LittleEndian.Uint64(data[5:])
+	plain, err := sess.recv.Open(nil, nonce(counter), data[dataHeaderSize:], data[:dataHeaderSize])
+	if err != nil {
+		return nil, errors.New("invalid data")
+	}
+	if !sess.filter.Accept(counter) {
+		return nil, secure.ErrReplayed
+	}
+	if sess.confirmed.CompareAndSwap(false, true) {
+		// the packets queued while waiting for the confirmation
+		n.flushPending(sess.peer)
+	}
+	if len(plain) == 0 {
+		return nil, secure.ErrHandshake // keepalive
+	}
+	return plain, nil
+}
+
+// initiate creates the initiation message, p.mut must be held
+//
+//	-> e, es, s, ss, psk
+func (n *Noise) initiate(p *peer) ([]byte, error) {
+	static := n.static.Load()
+	if static == nil {
+		return nil, errors.New("static key is not bound")
+	}
+	psk, err := n.provideSecretKey(p.id)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	state := newSymmetricState(p.static.Bytes())
+	state.mixEphemeral(ephemeral.PublicKey().Bytes())
+	es, err := ephemeral.ECDH(p.static)
+	if err != nil {
+		return nil, err
+	}
+	state.mixKey(es)
+
+	localIndex := n.newIndex()
+	msg := make([]byte, 1+4, initiationSize)
+	msg[0] = msgInitiation
+	binary.LittleEndian.PutUint32(msg[1:], localIndex)
+	msg = append(msg, ephemeral.PublicKey().Bytes()...)
+	msg = append(msg, state.encryptAndHash(static.PublicKey().Bytes())...)
+	ss, err := static.ECDH(p.static)
+	if err != nil {
+		return nil, err
+	}
+	state.mixKey(ss)
+	state.mixKeyAndHash(psk)
+	msg = append(msg, state.encryptAndHash(binary.BigEndian.AppendUint64(nil, n.nextTimestamp()))...)
+
+	p.handshake = &handshake{localIndex: localIndex, ephemeral: ephemeral, state: state}
+	p.handshakeTime = time.Now()
+	p.active.Store(time.Now().UnixNano())
+	return msg, nil
+}
+
+// handleInitiation authenticates the initiator by its static key and responds
+//
+//	<- e, ee, se
+func (n *Noise) handleInitiation(data []byte, pubKey string) error {
+	if len(data) != initiationSize {
+		return errors.New("invalid initiation")
+	}
+	static := n.static.Load()
+	if static == nil {
+		return errors.New("static key is not bound")
+	}
+	p, err := n.peer(pubKey)
+	if err != nil {
+		return err
+	}
+	remoteIndex := binary.LittleEndian.Uint32(data[1:])
+	initiatorEphemeral, err := ecdh.X25519().NewPublicKey(data[5 : 5+keySize])
+	if err != nil {
+		return err
+	}
+	state := newSymmetricState(static.PublicKey().Bytes())
+	state.mixEphemeral(initiatorEphemeral.Bytes())
+	es, err := static.ECDH(initiatorEphemeral)
+	if err != nil {
+		return err
+	}
+	state.mixKey(es)
+	s := 5 + keySize
+	initiatorStatic, err := state.decryptAndHash(data[s : s+keySize+chacha20poly1305.Overhead])
+	if err != nil {
+		return err
+	}
+	// the peer id is the static key, the initiation can not be made with another key
+	if !bytes.Equal(initiatorStatic, p.static.Bytes()) {
+		return errors.New("static key mismatched")
+	}
+	ss, err := static.ECDH(p.static)
+	if err != nil {
+		return err
+	}
+	state.mixKey(ss)
+	psk, err := n.provideSecretKey(pubKey)
+	if err != nil {
+		return err
+	}
+	state.mixKeyAndHash(psk)
+	payload, err := state.decryptAndHash(data[s+keySize+chacha20poly1305.Overhead:])
+	if err != nil {
+		return err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	state.mixEphemeral(ephemeral.PublicKey().Bytes())
+	ee, err := ephemeral.ECDH(initiatorEphemeral)
+	if err != nil {
+		return err
+	}
+	state.mixKey(ee)
+	se, err := ephemeral.ECDH(p.static)
+	if err != nil {
+		return err
+	}
+	state.mixKey(se)
+
+	localIndex := n.newIndex()
+	resp := make([]byte, 1+4+4, responseSize)
+	resp[0] = msgResponse
+	binary.LittleEndian.PutUint32(resp[1:], localIndex)
+	binary.LittleEndian.PutUint32(resp[5:], remoteIndex)
+	resp = append(resp, ephemeral.PublicKey().Bytes()...)
+	resp = append(resp, state.encryptAndHash(nil)...)
+	recvKey, sendKey := state.split()
+
+	p.mut.Lock()
+	if timestamp := binary.BigEndian.Uint64(payload); timestamp > p.timestamp {
+		p.timestamp = timestamp
+	} else {
+		p.mut.Unlock()
+		return errors.New("replayed initiation")
+	}
+	sess, err := newSession(p, localIndex, remoteIndex, sendKey, recvKey, false)
+	if err != nil {
+		p.mut.Unlock()
+		return err
+	}
+	n.install(p, sess)
+	sendSess, pending := p.takePending()
+	p.mut.Unlock()
+
+	n.sendMessage(resp, pubKey)
+	for _, b := range pending {
+		n.sendMessage(sendSess.seal(b), pubKey)
+	}
+	return nil
+}
+
+func (n *Noise) handleResponse(data []byte, pubKey string) error {
+	if len(data) != responseSize {
+		return errors.New("invalid response")
+	}
+	p, err := n.peer(pubKey)
+	if err != nil {
+		return err
+	}
+	p.mut.Lock()
+	sess, err := n.completeHandshake(p, data)
+	if err != nil {
+		p.mut.Unlock()
+		return err
+	}
+	_, pending := p.takePending()
+	p.mut.Unlock()
+	if len(pending) == 0 {
+		// keepalive to confirm the session, the responder sends with it after receiving from it
+		pending = append(pending, nil)
+	}
+	for _, b := range pending {
+		n.sendMessage(sess.seal(b), pubKey)
+	}
+	return nil
+}
+
+// completeHandshake installs the session of the handshake initiated, p.mut must be held
+func (n *Noise) completeHandshake(p *peer, resp []byte) (*session, error) {
+	hs := p.handshake
+	if hs == nil || hs.localIndex != binary.LittleEndian.Uint32(resp[5:]) {
+		return nil, errors.New("unexpected response")
+	}
+	responderEphemeral, err := ecdh.X25519().NewPublicKey(resp[9 : 9+keySize])
+	if err != nil {
+		return nil, err
+	}
+	state := hs.state
+	state.mixEphemeral(responderEphemeral.Bytes())
+	ee, err := hs.ephemeral.ECDH(responderEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	state.mixKey(ee)
+	se, err := n.static.Load().ECDH(responderEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	state.mixKey(se)
+	if _, err := state.decryptAndHash(resp[9+keySize:]); err != nil {
+		return nil, err
+	}
+	sendKey, recvKey := state.split()
+	sess, err := newSession(p, hs.localIndex, binary.LittleEndian.Uint32(resp[1:]), sendKey, recvKey, true)
+	if err != nil {
+		return nil, err
+	}
+	p.handshake = nil
+	n.install(p, sess)
+	return sess, nil
+}
+
+// requireHandshake starts a handshake with the peer if there is no one in progress
+func (n *Noise) requireHandshake(pubKey string) {
+	p, err := n.peer(pubKey)
+	if err != nil {
+		return
+	}
+	p.mut.Lock()
+	if p.handshake != nil && time.Since(p.handshakeTime) < RekeyTimeout {
+		p.mut.Unlock()
+		return
+	}
+	initiation, err := n.initiate(p)
+	p.mut.Unlock()
+	if err != nil {
+		slog.Debug("[Noise] Initiate handshake", "peer", pubKey, "err", err)
+		return
+	}
+	n.sendMessage(initiation, pubKey)
+}
+
+// flushPending sends the queued packets if there is a session to send them
+func (n *Noise) flushPending(p *peer) {
+	p.mut.Lock()
+	sess, pending := p.takePending()
+	p.mut.Unlock()
+	for _, b := range pending {
+		n.sendMessage(sess.seal(b), p.id)
+	}
+}
+
+// install makes the session current and drops the expired ones, p.mut must be held
+func (n *Noise) install(p *peer, sess *session) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if p.previous != nil {
+		delete(n.sessions, p.previous.localIndex)
+	}
+	p.active.Store(time.Now().UnixNano())
+	n.expire()
+	n.sessions[sess.localIndex] = sess
+	p.previous, p.current = p.current, sess
+}
+
+// expire drops the expired sessions and the peers without a handshake in RejectAfterTime, n.mut must be held.
+// The replayed initiation of a dropped peer installs a session that is never confirmed, so it is not used
+func (n *Noise) expire() {
+	for index, s := range n.sessions {
+		if s.expired() {
+			delete(n.sessions, index)
+		}
+	}
+	for id, p := range n.peers {
+		if time.Since(time.Unix(0, p.active.Load())) > RejectAfterTime {
+			delete(n.peers, id)
+		}
+	}
+}
+
+func (n *Noise) newIndex() uint32 {
+	n.mut.RLock()
+	defer n.mut.RUnlock()
+	for {
+		var b [4]byte
+		rand.Read(b[:])
+		if index := binary.LittleEndian.Uint32(b[:]); index != 0 && n.sessions[index] == nil {
+			return index
+		}
+	}
+}
+
+// nextTimestamp returns the unix nanoseconds which always increase in the process
+func (n *Noise) nextTimestamp() uint64 {
+	for {
+		last := n.timestamp.Load()
+		timestamp := max(uint64(time.Now().UnixNano()), last+1)
+		if n.timestamp.CompareAndSwap(last, timestamp) {
+			return timestamp
+		}
+	}
+}
+
+func (n *Noise) sendMessage(b []byte, pubKey string) {
+	if b == nil {
+		return
+	}
+	send := n.send.Load()
+	if send == nil {
+		slog.Debug("[Noise] Sender is not bound", "peer", pubKey)
+		return
+	}
+	if err := (*send)(b, pubKey); err != nil {
+		slog.Debug("[Noise] Send", "peer", pubKey, "err", err)
+	}
+}
+
+func (n *Noise) peer(pubKey string) (*peer, error) {
+	n.mut.RLock()
+	p, ok := n.peers[pubKey]
+	n.mut.RUnlock()
+	if ok {
+		return p, nil
+	}
+	static, err := ecdh.X25519().NewPublicKey(base58.Decode(pubKey))
+	if err != nil {
+		return nil, err
+	}
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if p, ok := n.peers[pubKey]; ok {
+		return p, nil
+	}
+	n.expire()
+	p = &peer{id: pubKey, static: static}
+	p.active.Store(time.Now().UnixNano())
+	n.peers[pubKey] = p
+	return p, nil
+}
+
+// sendSession returns the session used to send packets, p.mut must be held. The responder session
+// is used after it is confirmed by a packet from the initiator, the previous one is used until then
+func (p *peer) sendSession() *session {
+	for _, sess := range []*session{p.current, p.previous} {
+		if sess != nil && !sess.expired() && sess.confirmed.Load() {
+			return sess
+		}
+	}
+	return nil
+}
+
+// rekeyRequired reports whether a new handshake should be started, p.mut must be held
+func (p *peer) rekeyRequired(sess *session) bool {
+	if p.handshake != nil && time.Since(p.handshakeTime) < RekeyTimeout {
+		return false
+	}
+	if sess == nil {
+		// the responder session is waiting for the confirmation, a handshake of the other direction would replace it
+		return p.current == nil || p.current.confirmed.Load() || time.Since(p.current.created) > RekeyTimeout
+	}
+	rekeyAge := RekeyAfterTime
+	if !sess.initiator {
+		// leave the rekey to the initiator to avoid handshakes in both directions
+		rekeyAge += 3 * RekeyTimeout
+	}
+	return time.Since(sess.created) > rekeyAge || sess.sent.Load() > RekeyAfterBytes
+}
+
+// takePending returns the queued packets and the session to send them, nothing is returned if there
+// is no session to send with. p.mut must be held
+func (p *peer) takePending() (*session, [][]byte) {
+	sess := p.sendSession()
+	if sess == nil {
+		return nil, nil
+	}
+	pending := p.pending
+	p.pending = nil
+	return sess, pending
+}
+
+func newSession(p *peer, localIndex, remoteIndex uint32, sendKey, recvKey [keySize]byte, initiator bool) (*session, error) {
+	send, err := chacha20poly1305.New(sendKey[:])
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey[:])
+	if err != nil {
+		return nil, err
+	}
+	sess := &session{
+		peer:        p,
+		localIndex:  localIndex,
+		remoteIndex: remoteIndex,
+		send:        send,
+		recv:        recv,
+		initiator:   initiator,
+		created:     time.Now(),
+	}
+	sess.confirmed.Store(initiator)
+	return sess, nil
+}
+
+func (s *session) expired() bool {
+	return time.Since(s.created) > RejectAfterTime
+}
+
+// seal encrypts the packet in the form of [type 1 byte][receiver index 4 bytes][counter 8 bytes][ciphertext]
+func (s *session) seal(data []byte) []byte {
+	counter := s.counter.Add(1) - 1
+	s.sent.Add(uint64(len(data)))
+	b := make([]byte, dataHeaderSize, dataHeaderSize+len(data)+s.send.Overhead())
+	b[0] = msgData
+	binary.LittleEndian.PutUint32(b[1:], s.remoteIndex)
+	binary.LittleEndian.PutUint64(b[5:], counter)
+	return s.send.Seal(b, nonce(counter), data, b[:dataHeaderSize])
+}
+
+func nonce(counter uint64) []byte {
+	b := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(b[4:], counter)
+	return b
+}
+
+// New creates the Noise SymmAlgo, the provideSecretKey must be the X25519 key exchange with the
+// static private key bound by BindStaticKey. It is not compatible with the other algorithms
+func New(provideSecretKey secure.ProvideSecretKey) secure.SymmAlgo {
+	return &Noise{
+		provideSecretKey: provideSecretKey,
+		peers:            make(map[string]*peer),
+		sessions:         make(map[uint32]*session),
+	}
+}
@@ -0,0 +1,342 @@
+package noise
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"storj.io/common/base58"
+
+	"github.com/sigcn/pg/secure"
+)
+
+type message struct {
+	to   *node
+	from string
+	b    []byte
+}
+
+type node struct {
+	id       string
+	priv     *ecdh.PrivateKey
+	noise    *Noise
+	received []string
+}
+
+// link delivers the messages between nodes in order, messages sent to the dropped nodes are lost
+type link struct {
+	t     *testing.T
+	nodes map[string]*node
+	queue []message
+}
+
+func newLink(t *testing.T) *link {
+	return &link{t: t, nodes: make(map[string]*node)}
+}
+
+func (l *link) newNode(priv *ecdh.PrivateKey) *node {
+	if priv == nil {
+		var err error
+		if priv, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			l.t.Fatal(err)
+		}
+	}
+	n := &node{id: base58.Encode(priv.PublicKey().Bytes()), priv: priv}
+	n.noise = New(func(pubKey string) ([]byte, error) {
+		pub, err := ecdh.X25519().NewPublicKey(base58.Decode(pubKey))
+		if err != nil {
+			return nil, err
+		}
+		return priv.ECDH(pub)
+	}).(*Noise)
+	n.noise.BindStaticKey(priv)
+	n.noise.BindSender(func(b []byte, pubKey string) error {
+		if to, ok := l.nodes[pubKey]; ok {
+			l.queue = append(l.queue, message{to: to, from: n.id, b: b})
+		}
+		return nil
+	})
+	l.nodes[n.id] = n
+	return n
+}
+
+// send encrypts the packet, it is delivered by pump
+func (l *link) send(from, to *node, data string) {
+	b, err := from.noise.Encrypt([]byte(data), to.id)
+	if errors.Is(err, secure.ErrHandshake) {
+		return
+	}
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	l.queue = append(l.queue, message{to: to, from: from.id, b: b})
+}
+
+func (l *link) pump() {
+	for len(l.queue) > 0 {
+		l.step()
+	}
+}
+
+// step delivers the first message in the queue
+func (l *link) step() {
+	m := l.queue[0]
+	l.queue = l.queue[1:]
+	if l.nodes[m.to.id] != m.to {
+		return
+	}
+	plain, err := m.to.noise.Decrypt(m.b, m.from)
+	if err == nil {
+		m.to.received = append(m.to.received, string(plain))
+	} else if !errors.Is(err, secure.ErrHandshake) {
+		l.t.Logf("decrypt: %v", err)
+	}
+}
+
+func expectReceived(t *testing.T, n *node, want ...string) {
+	t.Helper()
+	if len(n.received) != len(want) {
+		t.Fatalf("received %q, want %q", n.received, want)
+	}
+	for i := range want {
+		if n.received[i] != want[i] {
+			t.Fatalf("received %q, want %q", n.received, want)
+		}
+	}
+	n.received = nil
+}
+
+func TestHandshake(t *testing.T) {
+	l := newLink(t)
+	a, b := l.newNode(nil), l.newNode(nil)
+
+	// the packets are queued until the handshake completes
+	l.send(a, b, "hello")
+	l.send(a, b, "world")
+	l.pump()
+	expectReceived(t, b, "hello", "world")
+
+	l.send(b, a, "hi")
+	l.pump()
+	expectReceived(t, a, "hi")
+
+	packet, err := a.noise.Encrypt([]byte("once"), b.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := b.noise.Decrypt(packet, a.id); err != nil || string(plain) != "once" {
+		t.Fatalf("Decrypt = %q, %v", plain, err)
+	}
+	if _, err := b.noise.Decrypt(packet, a.id); !errors.Is(err, secure.ErrReplayed) {
+		t.Errorf("replayed packet: %v", err)
+	}
+	packet[len(packet)-1] ^= 1
+	if _, err := b.noise.Decrypt(packet, a.id); err == nil {
+		t.Error("tampered packet is accepted")
+	}
+	// the packet of a session is bound to the peer
+	c := l.newNode(nil)
+	packet, _ = a.noise.Encrypt([]byte("hello"), b.id)
+	if _, err := b.noise.Decrypt(packet, c.id); err == nil {
+		t.Error("packet of another peer is accepted")
+	}
+}
+
+func TestHandshakeMismatchedKey(t *testing.T) {
+	l := newLink(t)
+	a, b := l.newNode(nil), l.newNode(nil)
+	// the psk of b is made with another key, so the handshake can not be authenticated
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	b.noise.provideSecretKey = func(pubKey string) ([]byte, error) {
+		return other.ECDH(a.priv.PublicKey())
+	}
+	l.send(a, b, "hello")
+	l.pump()
+	expectReceived(t, b)
+	if sess := b.noise.peers[a.id].current; sess != nil {
+		t.Error("session is installed by the unauthenticated handshake")
+	}
+}
+
+func TestHandshakeImpersonation(t *testing.T) {
+	l := newLink(t)
+	a, b, c := l.newNode(nil), l.newNode(nil), l.newNode(nil)
+	// c claims to be a, but the static key encrypted in the initiation is its own
+	var initiation []byte
+	c.noise.BindSender(func(msg []byte, pubKey string) error {
+		initiation = msg
+		return nil
+	})
+	c.noise.Encrypt([]byte("hello"), b.id)
+	if _, err := b.noise.Decrypt(initiation, a.id); !errors.Is(err, secure.ErrHandshake) {
+		t.Fatal(err)
+	}
+	if p := b.noise.peers[a.id]; p != nil && p.current != nil {
+		t.Error("session is installed by the initiation of another static key")
+	}
+
+	// c responds as b without the static private key of b
+	c.noise.BindSender(func(msg []byte, pubKey string) error {
+		l.queue = append(l.queue, message{to: a, from: b.id, b: msg})
+		return nil
+	})
+	a.noise.BindSender(func(msg []byte, pubKey string) error {
+		l.queue = append(l.queue, message{to: c, from: a.id, b: msg})
+		return nil
+	})
+	l.send(a, b, "hello")
+	l.pump()
+	expectReceived(t, c)
+	if sess := a.noise.peers[b.id].current; sess != nil {
+		t.Error("session is installed by the response of another static key")
+	}
+}
+
+func TestResponderConfirmation(t *testing.T) {
+	l := newLink(t)
+	a, b := l.newNode(nil), l.newNode(nil)
+	l.send(a, b, "hello")
+	l.step() // initiation
+	if len(l.queue) != 1 || l.queue[0].b[0] != msgResponse {
+		t.Fatalf("queue = %v, want the response only", l.queue)
+	}
+	// the session of b is not confirmed, the packet is queued until a packet of a is received
+	l.send(b, a, "early")
+	if len(l.queue) != 1 {
+		t.Fatal("packet is sent with the unconfirmed session")
+	}
+	if rekey := b.noise.peers[a.id].handshake; rekey != nil {
+		t.Error("handshake is initiated while the session is waiting for the confirmation")
+	}
+	l.pump()
+	expectReceived(t, b, "hello")
+	expectReceived(t, a, "early")
+}
+
+func TestExpire(t *testing.T) {
+	l := newLink(t)
+	a, b := l.newNode(nil), l.newNode(nil)
+	l.send(a, b, "hello")
+	l.pump()
+	expectReceived(t, b, "hello")
+	if len(a.noise.peers) != 1 || len(a.noise.sessions) != 1 {
+		t.Fatalf("peers %d, sessions %d", len(a.noise.peers), len(a.noise.sessions))
+	}
+
+	// the peer and its session are dropped after RejectAfterTime without a handshake
+	p := a.noise.peers[b.id]
+	p.current.created = time.Now().Add(-RejectAfterTime - time.Second)
+	p.active.Store(time.Now().Add(-RejectAfterTime - time.Second).UnixNano())
+	c := l.newNode(nil)
+	l.send(a, c, "hi")
+	l.pump()
+	expectReceived(t, c, "hi")
+	if _, ok := a.noise.peers[b.id]; ok || len(a.noise.peers) != 1 {
+		t.Error("expired peer is not dropped")
+	}
+	if len(a.noise.sessions) != 1 {
+		t.Errorf("sessions %d, want 1", len(a.noise.sessions))
+	}
+
+	// the dropped peer handshakes again
+	l.send(a, b, "again")
+	l.pump()
+	expectReceived(t, b, "again")
+}
+
+func TestReplayedInitiation(t *testing.T) {
+	l := newLink(t)
+	a, b := l.newNode(nil), l.newNode(nil)
+	var initiation []byte
+	a.noise.BindSender(func(msg []byte, pubKey string) error {
+		if msg[0] == msgInitiation {
+			initiation = msg
+		}
+		l.queue = append(l.queue, message{to: l.nodes[pubKey], from: a.id, b: msg})
+		return nil
+	})
+	l.send(a, b, "hello")
+	l.pump()
+	expectReceived(t, b, "hello")
+
+	sess := b.noise.peers[a.id].current
+	if _, err := b.noise.Decrypt(initiation, a.id); !errors.Is(err, secure.ErrHandshake) {
+		t.Fatal(err)
+	}
+	l.pump()
+	if b.noise.peers[a.id].current != sess {
+		t.Error("session is replaced by the replayed initiation")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	l := newLink(t)
+	a, b := l.newNode(nil), l.newNode(nil)
+	l.send(a, b, "hello")
+	l.pump()
+	expectReceived(t, b, "hello")
+
+	old := a.noise.peers[b.id].current
+	old.created = time.Now().Add(-RekeyAfterTime - time.Second)
+	// the packet is sent with the old session while the handshake is in progress
+	l.send(a, b, "rekey")
+	l.pump()
+	expectReceived(t, b, "rekey")
+	current := a.noise.peers[b.id].current
+	if current == old || a.noise.peers[b.id].previous != old {
+		t.Fatal("session is not rekeyed")
+	}
+
+	l.send(a, b, "new")
+	l.send(b, a, "reply")
+	l.pump()
+	expectReceived(t, b, "new")
+	expectReceived(t, a, "reply")
+
+	// the sessions are rekeyed after RekeyAfterBytes as well
+	current.sent.Store(RekeyAfterBytes + 1)
+	l.send(a, b, "bytes")
+	l.pump()
+	expectReceived(t, b, "bytes")
+	if a.noise.peers[b.id].current == current {
+		t.Error("session is not rekeyed after RekeyAfterBytes")
+	}
+
+	// the expired sessions are not used anymore
+	current = a.noise.peers[b.id].current
+	current.created = time.Now().Add(-RejectAfterTime - time.Second)
+	a.noise.peers[b.id].previous = nil
+	if _, err := a.noise.Encrypt([]byte("expired"), b.id); !errors.Is(err, secure.ErrHandshake) {
+		t.Errorf("Encrypt with the expired session: %v", err)
+	}
+	l.pump()
+	expectReceived(t, b, "expired")
+}
+
+func TestRestart(t *testing.T) {
+	l := newLink(t)
+	a, b := l.newNode(nil), l.newNode(nil)
+	l.send(a, b, "hello")
+	l.pump()
+	expectReceived(t, b, "hello")
+
+	// b restarts with the same key, the packet of the unknown session starts a new handshake
+	b = l.newNode(b.priv)
+	l.send(a, b, "lost")
+	l.pump()
+	expectReceived(t, b)
+
+	l.send(a, b, "after restart")
+	l.send(b, a, "reply")
+	l.pump()
+	expectReceived(t, b, "after restart")
+	expectReceived(t, a, "reply")
+
+	// a restarts, its initiations have newer timestamps than the ones b has seen
+	a = l.newNode(a.priv)
+	l.send(a, b, "hello again")
+	l.pump()
+	expectReceived(t, b, "hello again")
+}
@@ -0,0 +1,88 @@
+package noise
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// symmetricState is the SymmetricState of the Noise protocol framework with SHA256 and ChaChaPoly
+type symmetricState struct {
+	ck [sha256.Size]byte
+	h  [sha256.Size]byte
+	k  [keySize]byte
+}
+
+// newSymmetricState initializes the state and mixes the static public key of the responder,
+// which is the pre-message of the IK pattern
+func newSymmetricState(responderStatic []byte) symmetricState {
+	var s symmetricState
+	s.h = sha256.Sum256(protocolName)
+	s.ck = s.h
+	s.mixHash(prologue)
+	s.mixHash(responderStatic)
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	s.ck, s.k, _ = hkdf(s.ck[:], ikm)
+}
+
+func (s *symmetricState) mixKeyAndHash(ikm []byte) {
+	var h [sha256.Size]byte
+	s.ck, h, s.k = hkdf(s.ck[:], ikm)
+	s.mixHash(h[:])
+}
+
+// mixEphemeral processes the e token in the psk handshake
+func (s *symmetricState) mixEphemeral(pub []byte) {
+	s.mixHash(pub)
+	s.mixKey(pub)
+}
+
+// encryptAndHash encrypts the payload with the key mixed, each key encrypts only one payload in the IKpsk1 pattern
+func (s *symmetricState) encryptAndHash(plain []byte) []byte {
+	aead, _ := chacha20poly1305.New(s.k[:])
+	ciphertext := aead.Seal(nil, make([]byte, aead.NonceSize()), plain, s.h[:])
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(s.k[:])
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, s.h[:])
+	if err != nil {
+		return nil, errors.New("handshake authentication failed")
+	}
+	s.mixHash(ciphertext)
+	return plain, nil
+}
+
+// split returns the keys to encrypt the transport messages from the initiator and the responder
+func (s *symmetricState) split() (k1, k2 [keySize]byte) {
+	k1, k2, _ = hkdf(s.ck[:], nil)
+	return
+}
+
+func hkdf(ck, ikm []byte) (out1, out2, out3 [sha256.Size]byte) {
+	temp := hmacSum(ck, ikm)
+	copy(out1[:], hmacSum(temp, []byte{1}))
+	copy(out2[:], hmacSum(temp, append(out1[:], 2)))
+	copy(out3[:], hmacSum(temp, append(out2[:], 3)))
+	return
+}
+
+func hmacSum(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
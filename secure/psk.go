@@ -0,0 +1,12 @@
+package secure
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+)
+
+// MixPSK derives the secret key from the key exchange result and the pre-shared key,
+// so peers without the pre-shared key can not get the same secret key
+func MixPSK(secret, psk []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, secret, psk, "peerguard psk", len(secret))
+}
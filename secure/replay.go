@@ -0,0 +1,38 @@
+package secure
+
+import "sync"
+
+// ReplayWindow is the count of the latest counters the ReplayFilter tracks
+const ReplayWindow = 2048
+
+// ReplayFilter is the sliding window replay filter described in RFC 6479
+type ReplayFilter struct {
+	mut    sync.Mutex
+	max    uint64
+	bitmap [ReplayWindow / 64]uint64
+}
+
+// Accept reports whether the counter is not seen and not too old, the counter is marked as seen.
+// It must be called after the packet is authenticated
+func (f *ReplayFilter) Accept(counter uint64) bool {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	const blocks = uint64(len(f.bitmap))
+	block := counter / 64
+	if counter > f.max {
+		current := f.max / 64
+		diff := min(block-current, blocks)
+		for i := uint64(1); i <= diff; i++ {
+			f.bitmap[(current+i)%blocks] = 0
+		}
+		f.max = counter
+	} else if f.max-counter >= ReplayWindow-64 {
+		return false
+	}
+	bit := uint64(1) << (counter % 64)
+	if f.bitmap[block%blocks]&bit != 0 {
+		return false
+	}
+	f.bitmap[block%blocks] |= bit
+	return true
+}
@@ -0,0 +1,54 @@
+package secure
+
+import "testing"
+
+func TestReplayFilter(t *testing.T) {
+	var f ReplayFilter
+	steps := []struct {
+		counter uint64
+		accept  bool
+	}{
+		{0, true},
+		{0, false},
+		{1, true},
+		{63, true},
+		{64, true},
+		{2, true},
+		{2, false},
+		{ReplayWindow, true},
+		{ReplayWindow, false},
+		{65, true}, // the oldest counter in the window
+		{64, false},
+		{ReplayWindow + 64, true}, // slide one block
+		{129, true},
+		{128, false},
+		{ReplayWindow + 63, true},
+		{10 * ReplayWindow, true}, // jump over the whole window
+		{ReplayWindow + 63, false},
+		{10*ReplayWindow - (ReplayWindow - 64) + 1, true},
+		{10*ReplayWindow - (ReplayWindow - 64), false},
+		{10*ReplayWindow - ReplayWindow/2, true},
+		{10*ReplayWindow - 1, true},
+		{10*ReplayWindow - 1, false},
+	}
+	for i, s := range steps {
+		if accept := f.Accept(s.counter); accept != s.accept {
+			t.Fatalf("step %d: Accept(%d) = %v, want %v", i, s.counter, accept, s.accept)
+		}
+	}
+}
+
+func TestReplayFilterReorder(t *testing.T) {
+	var f ReplayFilter
+	for i := uint64(0); i < 4*ReplayWindow; i += 2 {
+		if !f.Accept(i + 1) {
+			t.Fatalf("counter %d is rejected", i+1)
+		}
+		if !f.Accept(i) {
+			t.Fatalf("reordered counter %d is rejected", i)
+		}
+		if f.Accept(i) || f.Accept(i+1) {
+			t.Fatalf("counter %d is replayed", i)
+		}
+	}
+}
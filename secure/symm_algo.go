@@ -1,5 +1,18 @@
 package secure
 
+import (
+	"crypto/ecdh"
+	"errors"
+)
+
+var (
+	// ErrReplayed is returned by Decrypt when the packet has been received, the packet must be dropped
+	ErrReplayed = errors.New("replayed packet")
+	// ErrHandshake is returned by Decrypt when the packet is a handshake message, and by Encrypt when
+	// the packet is queued until the handshake completes. The packet must not be delivered or sent
+	ErrHandshake = errors.New("handshake in progress")
+)
+
 type ProvideSecretKey func(pubKey string) ([]byte, error)
 
 type SymmAlgo interface {
@@ -7,3 +20,24 @@ type SymmAlgo interface {
 	Decrypt(data []byte, pubKey string) ([]byte, error)
 	SecretKey() ProvideSecretKey
 }
+
+// Handshaker is a SymmAlgo which exchanges handshake messages with peers,
+// the messages are sent as is over the datagram path by the bound sender
+type Handshaker interface {
+	SymmAlgo
+	BindSender(send func(b []byte, pubKey string) error)
+}
+
+// LocalBinder is a SymmAlgo which derives the keys from the id of this peer as well,
+// e.g. to use different keys for the two directions
+type LocalBinder interface {
+	SymmAlgo
+	BindLocal(pubKey string)
+}
+
+// StaticKeyBinder is a SymmAlgo which authenticates the handshakes with the static private key
+// of this peer, the peer ids are the static public keys
+type StaticKeyBinder interface {
+	SymmAlgo
+	BindStaticKey(privateKey *ecdh.PrivateKey)
+}
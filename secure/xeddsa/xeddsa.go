@@ -0,0 +1,93 @@
+// Package xeddsa implements the XEdDSA signature scheme, which signs with the
+// curve25519 (X25519) keys, see https://signal.org/docs/specifications/xeddsa/
+package xeddsa
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+// SignatureSize is the size of the signature in bytes
+const SignatureSize = ed25519.SignatureSize
+
+// Sign signs the message with the X25519 private key
+func Sign(privateKey *ecdh.PrivateKey, message []byte) ([]byte, error) {
+	if privateKey.Curve() != ecdh.X25519() {
+		return nil, errors.New("xeddsa: x25519 private key is required")
+	}
+	k, err := edwards25519.NewScalar().SetBytesWithClamping(privateKey.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// the edwards public key is forced to have the sign bit cleared,
+	// so that it can be recovered from the montgomery u coordinate alone
+	publicKey := new(edwards25519.Point).ScalarBaseMult(k).Bytes()
+	if publicKey[31]&0x80 != 0 {
+		k.Negate(k)
+		publicKey[31] &= 0x7f
+	}
+
+	var z [64]byte
+	if _, err := rand.Read(z[:]); err != nil {
+		return nil, err
+	}
+	h := sha512.New()
+	h.Write([]byte{0xfe})
+	for range 31 {
+		h.Write([]byte{0xff})
+	}
+	h.Write(k.Bytes())
+	h.Write(message)
+	h.Write(z[:])
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(publicKey)
+	h.Write(message)
+	hram, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	s := edwards25519.NewScalar().MultiplyAdd(hram, k, r)
+	return append(R, s.Bytes()...), nil
+}
+
+// Verify reports whether sig is a valid signature of the message by the X25519 public key
+func Verify(publicKey, message, sig []byte) bool {
+	if len(publicKey) != 32 || len(sig) != SignatureSize {
+		return false
+	}
+	edPublicKey, ok := edwardsPublicKey(publicKey)
+	if !ok {
+		return false
+	}
+	return ed25519.Verify(edPublicKey, message, sig)
+}
+
+// edwardsPublicKey converts the montgomery u coordinate to the edwards point with the sign bit cleared
+func edwardsPublicKey(publicKey []byte) (ed25519.PublicKey, bool) {
+	u, err := new(field.Element).SetBytes(publicKey)
+	if err != nil {
+		return nil, false
+	}
+	one := new(field.Element).One()
+	// y = (u - 1) / (u + 1)
+	den := new(field.Element).Add(u, one)
+	if den.Equal(new(field.Element).Zero()) == 1 {
+		return nil, false
+	}
+	y := new(field.Element).Subtract(u, one)
+	y.Multiply(y, den.Invert(den))
+	return y.Bytes(), true
+}
@@ -0,0 +1,69 @@
+package xeddsa
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	for range 32 { // both signs of the edwards public key
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := priv.PublicKey().Bytes()
+		msg := []byte("hello")
+		sig, err := Sign(priv, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sig) != SignatureSize {
+			t.Fatalf("signature size %d", len(sig))
+		}
+		if !Verify(pub, msg, sig) {
+			t.Fatal("valid signature is rejected")
+		}
+		if Verify(pub, []byte("hellO"), sig) {
+			t.Fatal("signature of another message is accepted")
+		}
+		other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		if Verify(other.PublicKey().Bytes(), msg, sig) {
+			t.Fatal("signature of another key is accepted")
+		}
+		tampered := append([]byte(nil), sig...)
+		tampered[0] ^= 1
+		if Verify(pub, msg, tampered) {
+			t.Fatal("tampered signature is accepted")
+		}
+		if Verify(pub, msg, sig[:SignatureSize-1]) || Verify(pub[:31], msg, sig) {
+			t.Fatal("truncated signature or key is accepted")
+		}
+		// signatures are randomized
+		if sig1, _ := Sign(priv, msg); string(sig1) == string(sig) || !Verify(pub, msg, sig1) {
+			t.Fatal("signatures are not randomized")
+		}
+	}
+}
+
+func TestSignRejectsOtherCurves(t *testing.T) {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Sign(priv, []byte("hello")); err == nil {
+		t.Error("signed with the p256 key")
+	}
+}
+
+func TestVerifyInvalidPublicKey(t *testing.T) {
+	pub := make([]byte, 32)
+	for i := range pub {
+		pub[i] = 0xff // u = -1 has no edwards point
+	}
+	pub[31] = 0x7f
+	pub[0] = 0xec
+	if Verify(pub, []byte("hello"), make([]byte, SignatureSize)) {
+		t.Error("signature of the invalid public key is accepted")
+	}
+}
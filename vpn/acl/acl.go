@@ -0,0 +1,205 @@
+package acl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sigcn/pg/cache/lru"
+	"github.com/sigcn/pg/disco"
+	"github.com/sigcn/pg/vpn"
+	"github.com/sigcn/pg/vpn/nic"
+)
+
+var (
+	_ vpn.InboundHandler  = (*ACL)(nil)
+	_ vpn.OutboundHandler = (*ACL)(nil)
+)
+
+const (
+	protoICMP   uint8 = 1
+	protoTCP    uint8 = 6
+	protoUDP    uint8 = 17
+	protoICMPv6 uint8 = 58
+
+	// flowTimeout is how long the replies of an allowed flow are accepted
+	flowTimeout = 3 * time.Minute
+)
+
+// flow is the 5-tuple of an ip packet
+type flow struct {
+	src, dst         net.IP
+	proto            uint8
+	srcPort, dstPort uint16
+}
+
+func (f flow) key() string {
+	return fmt.Sprintf("%d/%s:%d/%s:%d", f.proto, f.src, f.srcPort, f.dst, f.dstPort)
+}
+
+func (f flow) reverse() flow {
+	return flow{src: f.dst, dst: f.src, proto: f.proto, srcPort: f.dstPort, dstPort: f.srcPort}
+}
+
+func parseFlow(pkt []byte) (f flow, ok bool) {
+	if len(pkt) == 0 {
+		return
+	}
+	var l4 []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return
+		}
+		f.proto, f.src, f.dst = pkt[9], net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff == 0 { // ports only in the first fragment
+			l4 = pkt[ihl:]
+		}
+	case 6:
+		if len(pkt) < 40 {
+			return
+		}
+		f.proto, f.src, f.dst = pkt[6], net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		l4 = pkt[40:]
+	default:
+		return
+	}
+	if (f.proto == protoTCP || f.proto == protoUDP) && len(l4) >= 4 {
+		f.srcPort = binary.BigEndian.Uint16(l4[0:2])
+		f.dstPort = binary.BigEndian.Uint16(l4[2:4])
+	}
+	return f, true
+}
+
+// ACL filters the vpn packets by the rules pushed from the peermap server.
+//
+// Rules are evaluated in order and the first matched rule wins, packets not
+// matched by any rule are dropped. All packets are allowed when there is no rule.
+// Replies of the allowed flows are always accepted
+type ACL struct {
+	Labels     disco.Labels    // labels of this node
+	VNIC       *nic.VirtualNIC // used to find peer labels and reject outbound packets
+	PacketConn net.PacketConn  // used to reject inbound packets
+
+	rules atomic.Pointer[[]Rule]
+
+	flowsInit  sync.Once
+	flowsMutex sync.Mutex
+	flows      *lru.Cache[string, time.Time]
+}
+
+func (a *ACL) Name() string {
+	return "acl"
+}
+
+// Update replaces the rules, the current rules are kept if any rule is invalid
+func (a *ACL) Update(texts []string) error {
+	rules, err := ParseRules(texts)
+	if err != nil {
+		return err
+	}
+	a.rules.Store(&rules)
+	a.initFlows()
+	a.flowsMutex.Lock()
+	a.flows.Clear()
+	a.flowsMutex.Unlock()
+	slog.Info("[ACL] Updated", "rules", len(rules))
+	return nil
+}
+
+// Rules returns the rules in effect
+func (a *ACL) Rules() []Rule {
+	if rules := a.rules.Load(); rules != nil {
+		return *rules
+	}
+	return nil
+}
+
+func (a *ACL) In(pkt *nic.Packet) *nic.Packet {
+	f, ok := parseFlow(pkt.AsBytes())
+	if !ok {
+		return pkt
+	}
+	if a.allow(f, a.peerLabels(f.src), a.Labels) {
+		return pkt
+	}
+	slog.Debug("[ACL] DenyInbound", "src", f.src, "dst", f.dst, "proto", f.proto, "port", f.dstPort)
+	if a.PacketConn != nil && a.VNIC != nil && !isICMP(f.proto) {
+		if peer, ok := a.VNIC.GetPeer(f.src.String()); ok {
+			a.PacketConn.WriteTo(vpn.ICMPHostUnreachable(f.dst, f.src, pkt.AsBytes()), peer)
+		}
+	}
+	return nil
+}
+
+func (a *ACL) Out(pkt *nic.Packet) *nic.Packet {
+	f, ok := parseFlow(pkt.AsBytes())
+	if !ok {
+		return pkt
+	}
+	if a.allow(f, a.Labels, a.peerLabels(f.dst)) {
+		return pkt
+	}
+	slog.Debug("[ACL] DenyOutbound", "src", f.src, "dst", f.dst, "proto", f.proto, "port", f.dstPort)
+	if a.VNIC != nil && !isICMP(f.proto) {
+		reject := nic.GetPacket(vpn.ICMPHostUnreachable(f.dst, f.src, pkt.AsBytes()))
+		if err := a.VNIC.Write(reject); err != nil {
+			slog.Debug("[ACL] Reject", "err", err)
+		}
+		nic.RecyclePacket(reject)
+	}
+	return nil
+}
+
+func (a *ACL) allow(f flow, srcLabels, dstLabels disco.Labels) bool {
+	rules := a.Rules()
+	if len(rules) == 0 {
+		return true
+	}
+	a.initFlows()
+	a.flowsMutex.Lock()
+	defer a.flowsMutex.Unlock()
+	if t, ok := a.flows.Get(f.reverse().key()); ok && time.Since(t) < flowTimeout {
+		return true
+	}
+	for _, r := range rules {
+		if !r.match(f, srcLabels, dstLabels) {
+			continue
+		}
+		if r.Action == ActionAllow {
+			a.flows.Put(f.key(), time.Now())
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+func (a *ACL) peerLabels(ip net.IP) disco.Labels {
+	if a.VNIC == nil {
+		return nil
+	}
+	meta, ok := a.VNIC.GetPeerMeta(ip.String())
+	if !ok {
+		return nil
+	}
+	return disco.Labels(meta["label"])
+}
+
+func (a *ACL) initFlows() {
+	a.flowsInit.Do(func() {
+		a.flows = lru.New[string, time.Time](4096)
+	})
+}
+
+func isICMP(proto uint8) bool {
+	return proto == protoICMP || proto == protoICMPv6
+}
@@ -0,0 +1,276 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sigcn/pg/disco"
+)
+
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionDeny  Action = "deny"
+)
+
+type Proto string
+
+const (
+	ProtoAny  Proto = "any"
+	ProtoTCP  Proto = "tcp"
+	ProtoUDP  Proto = "udp"
+	ProtoICMP Proto = "icmp"
+)
+
+func (p Proto) match(proto uint8) bool {
+	switch p {
+	case ProtoTCP:
+		return proto == protoTCP
+	case ProtoUDP:
+		return proto == protoUDP
+	case ProtoICMP:
+		return proto == protoICMP || proto == protoICMPv6
+	default:
+		return true
+	}
+}
+
+// Selector matches a peer by labels or ip address
+type Selector struct {
+	Any        bool
+	LabelKey   string
+	LabelValue string
+	CIDR       *net.IPNet
+}
+
+func (s Selector) match(ip net.IP, labels disco.Labels) bool {
+	if s.Any {
+		return true
+	}
+	if s.CIDR != nil {
+		return s.CIDR.Contains(ip)
+	}
+	value, ok := labels.Get(s.LabelKey)
+	if !ok {
+		return false
+	}
+	return s.LabelValue == "" || s.LabelValue == value
+}
+
+func (s Selector) String() string {
+	if s.Any {
+		return "*"
+	}
+	if s.CIDR != nil {
+		return s.CIDR.String()
+	}
+	if s.LabelValue == "" {
+		return "label:" + s.LabelKey
+	}
+	return fmt.Sprintf("label:%s=%s", s.LabelKey, s.LabelValue)
+}
+
+type PortRange struct {
+	From, To uint16
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(int(r.From))
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// Rule is an acl rule in the form of
+//
+//	allow|deny [from <selectors>] [to <selectors>] [proto tcp|udp|icmp|any] [port <ports>]
+//
+// selectors is a comma separated list of `*`, `label:key[=value]`, ip or cidr.
+// ports is a comma separated list of port or port range (e.g. 22,8000-8100),
+// it matches the destination port of tcp/udp packets
+type Rule struct {
+	Action Action
+	From   []Selector
+	To     []Selector
+	Proto  Proto
+	Ports  []PortRange
+}
+
+func (r Rule) match(f flow, srcLabels, dstLabels disco.Labels) bool {
+	if !r.Proto.match(f.proto) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		if f.proto != protoTCP && f.proto != protoUDP {
+			return false
+		}
+		if !matchPorts(r.Ports, f.dstPort) {
+			return false
+		}
+	}
+	return matchSelectors(r.From, f.src, srcLabels) && matchSelectors(r.To, f.dst, dstLabels)
+}
+
+func (r Rule) String() string {
+	var sb strings.Builder
+	sb.WriteString(string(r.Action))
+	writeSelectors := func(keyword string, selectors []Selector) {
+		if len(selectors) == 0 {
+			return
+		}
+		var s []string
+		for _, selector := range selectors {
+			s = append(s, selector.String())
+		}
+		fmt.Fprintf(&sb, " %s %s", keyword, strings.Join(s, ","))
+	}
+	writeSelectors("from", r.From)
+	writeSelectors("to", r.To)
+	if r.Proto != ProtoAny {
+		fmt.Fprintf(&sb, " proto %s", r.Proto)
+	}
+	if len(r.Ports) > 0 {
+		var s []string
+		for _, port := range r.Ports {
+			s = append(s, port.String())
+		}
+		fmt.Fprintf(&sb, " port %s", strings.Join(s, ","))
+	}
+	return sb.String()
+}
+
+func matchSelectors(selectors []Selector, ip net.IP, labels disco.Labels) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, s := range selectors {
+		if s.match(ip, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPorts(ports []PortRange, port uint16) bool {
+	for _, r := range ports {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRule parses the rule text. see Rule
+func ParseRule(text string) (Rule, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return Rule{}, errors.New("empty rule")
+	}
+	rule := Rule{Action: Action(fields[0]), Proto: ProtoAny}
+	if rule.Action != ActionAllow && rule.Action != ActionDeny {
+		return Rule{}, fmt.Errorf("invalid action %q", fields[0])
+	}
+	if len(fields[1:])%2 != 0 {
+		return Rule{}, fmt.Errorf("rule %q: missing value for %q", text, fields[len(fields)-1])
+	}
+	for i := 1; i < len(fields); i += 2 {
+		var err error
+		switch value := fields[i+1]; fields[i] {
+		case "from":
+			rule.From, err = parseSelectors(value)
+		case "to":
+			rule.To, err = parseSelectors(value)
+		case "proto":
+			rule.Proto = Proto(value)
+			switch rule.Proto {
+			case ProtoAny, ProtoTCP, ProtoUDP, ProtoICMP:
+			default:
+				err = fmt.Errorf("invalid proto %q", value)
+			}
+		case "port":
+			rule.Ports, err = parsePorts(value)
+		default:
+			err = fmt.Errorf("unknown keyword %q", fields[i])
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %w", text, err)
+		}
+	}
+	return rule, nil
+}
+
+// ParseRules parses all rules, an error is returned if any rule is invalid
+func ParseRules(texts []string) ([]Rule, error) {
+	var rules []Rule
+	for _, text := range texts {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		rule, err := ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseSelectors(value string) ([]Selector, error) {
+	var selectors []Selector
+	for _, s := range strings.Split(value, ",") {
+		if s == "*" {
+			selectors = append(selectors, Selector{Any: true})
+			continue
+		}
+		if label, ok := strings.CutPrefix(s, "label:"); ok {
+			key, value, _ := strings.Cut(label, "=")
+			if key == "" {
+				return nil, fmt.Errorf("invalid label selector %q", s)
+			}
+			selectors = append(selectors, Selector{LabelKey: key, LabelValue: value})
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid selector %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			selectors = append(selectors, Selector{CIDR: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q", s)
+		}
+		selectors = append(selectors, Selector{CIDR: cidr})
+	}
+	return selectors, nil
+}
+
+func parsePorts(value string) ([]PortRange, error) {
+	var ports []PortRange
+	for _, s := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(s, "-")
+		if !isRange {
+			to = from
+		}
+		start, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		end, err := strconv.ParseUint(to, 10, 16)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		ports = append(ports, PortRange{From: uint16(start), To: uint16(end)})
+	}
+	return ports, nil
+}
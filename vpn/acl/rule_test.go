@@ -0,0 +1,133 @@
+package acl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sigcn/pg/disco"
+)
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		text string
+		want string // empty if invalid
+	}{
+		{"allow", "allow"},
+		{"deny from * to label:role=db proto tcp port 5432", "deny from * to label:role=db proto tcp port 5432"},
+		{"allow from 100.64.0.1,100.64.1.0/24 to label:ssh port 22,8000-8100", "allow from 100.64.0.1/32,100.64.1.0/24 to label:ssh port 22,8000-8100"},
+		{"allow  to fd00::1   proto any", "allow to fd00::1/128"},
+		{"allow proto icmp", "allow proto icmp"},
+		{"", ""},
+		{"permit from *", ""},
+		{"allow from", ""},
+		{"allow via *", ""},
+		{"allow proto sctp", ""},
+		{"allow port 100-22", ""},
+		{"allow port 65536", ""},
+		{"allow port ssh", ""},
+		{"allow from label:", ""},
+		{"allow from label:=x", ""},
+		{"allow to 100.64.0.256", ""},
+		{"allow to 100.64.0.0/33", ""},
+	}
+	for _, c := range cases {
+		rule, err := ParseRule(c.text)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("ParseRule(%q) = %q, want error", c.text, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", c.text, err)
+			continue
+		}
+		if rule.String() != c.want {
+			t.Errorf("ParseRule(%q) = %q, want %q", c.text, rule, c.want)
+		}
+	}
+}
+
+func TestParseRulesRejectsAll(t *testing.T) {
+	if _, err := ParseRules([]string{"allow", "deny to nowhere"}); err == nil {
+		t.Fatal("rules with an invalid rule are accepted")
+	}
+	rules, err := ParseRules([]string{"allow", " ", "deny"})
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("ParseRules = %v, %v", rules, err)
+	}
+}
+
+func TestACLAllow(t *testing.T) {
+	var a ACL
+	if err := a.Update([]string{
+		"deny to label:role=db port 22",
+		"allow from label:role=app to label:role=db proto tcp port 5432",
+		"allow proto icmp",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	app := disco.Labels{"role=app"}
+	db := disco.Labels{"role=db"}
+	tcp := func(src, dst string, dstPort uint16) flow {
+		return flow{src: net.ParseIP(src), dst: net.ParseIP(dst), proto: protoTCP, srcPort: 40000, dstPort: dstPort}
+	}
+
+	cases := []struct {
+		name     string
+		flow     flow
+		src, dst disco.Labels
+		allowed  bool
+	}{
+		{"app to db", tcp("100.64.0.1", "100.64.0.2", 5432), app, db, true},
+		{"app to db ssh", tcp("100.64.0.1", "100.64.0.2", 22), app, db, false},
+		{"db to app", tcp("100.64.0.2", "100.64.0.1", 5432), db, app, false},
+		{"unlabeled", tcp("100.64.0.3", "100.64.0.2", 5432), nil, db, false},
+		{"udp", flow{src: net.ParseIP("100.64.0.1"), dst: net.ParseIP("100.64.0.2"), proto: protoUDP, dstPort: 5432}, app, db, false},
+		{"icmp", flow{src: net.ParseIP("100.64.0.3"), dst: net.ParseIP("100.64.0.2"), proto: protoICMP}, nil, db, true},
+	}
+	for _, c := range cases {
+		if allowed := a.allow(c.flow, c.src, c.dst); allowed != c.allowed {
+			t.Errorf("%s: allowed = %v, want %v", c.name, allowed, c.allowed)
+		}
+	}
+
+	// the replies of the allowed flow are accepted
+	if !a.allow(cases[0].flow.reverse(), db, app) {
+		t.Error("reply of the allowed flow is denied")
+	}
+	// rules update drops the flows
+	if err := a.Update([]string{"deny"}); err != nil {
+		t.Fatal(err)
+	}
+	if a.allow(cases[0].flow.reverse(), db, app) {
+		t.Error("reply is allowed after the rules updated")
+	}
+	// invalid rules keep the current ones
+	if err := a.Update([]string{"allow", "drop"}); err == nil || len(a.Rules()) != 1 {
+		t.Errorf("Update with invalid rules = %v, rules %v", err, a.Rules())
+	}
+	if err := a.Update(nil); err != nil || !a.allow(cases[2].flow, db, app) {
+		t.Error("packets are denied without rules")
+	}
+}
+
+func TestParseFlow(t *testing.T) {
+	pkt := make([]byte, 24)
+	pkt[0] = 0x45
+	pkt[9] = protoUDP
+	copy(pkt[12:], net.ParseIP("100.64.0.1").To4())
+	copy(pkt[16:], net.ParseIP("100.64.0.2").To4())
+	pkt[20], pkt[21], pkt[22], pkt[23] = 0x9c, 0x40, 0, 53
+	f, ok := parseFlow(pkt)
+	if !ok || f.proto != protoUDP || f.srcPort != 40000 || f.dstPort != 53 || !f.dst.Equal(net.ParseIP("100.64.0.2")) {
+		t.Fatalf("parseFlow = %+v, %v", f, ok)
+	}
+	pkt[6] = 0x01 // not the first fragment
+	if f, _ := parseFlow(pkt); f.dstPort != 0 {
+		t.Errorf("ports parsed from the fragment: %d", f.dstPort)
+	}
+	if _, ok := parseFlow(pkt[:19]); ok {
+		t.Error("truncated packet is parsed")
+	}
+}
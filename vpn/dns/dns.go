@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server is a dns responder which resolves `<hostname>.<Domain>` to the peer ips,
+// other names are forwarded to the upstream servers
+type Server struct {
+	Domain   string
+	Upstream []string
+	Lookup   func(hostname string) []net.IP
+}
+
+// LookupNetIP resolves the peer names locally, other names are resolved by net.DefaultResolver
+func (s *Server) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	hostname, ok := strings.CutSuffix(name, "."+strings.ToLower(s.Domain))
+	if !ok {
+		return net.DefaultResolver.LookupNetIP(ctx, network, host)
+	}
+	var addrs []netip.Addr
+	for _, ip := range s.lookup(hostname) {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if (network == "ip4" && !addr.Is4()) || (network == "ip6" && !addr.Is6()) {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (s *Server) lookup(hostname string) []net.IP {
+	if strings.Contains(hostname, ".") || s.Lookup == nil {
+		return nil
+	}
+	return s.Lookup(hostname)
+}
+
+// Serve serves the dns queries on the packet conn until ctx is done
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := s.handle(query)
+			if err != nil {
+				slog.Debug("[DNS] Handle", "from", addr, "err", err)
+				return
+			}
+			pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *Server) handle(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	hostname, ok := strings.CutSuffix(name, "."+strings.ToLower(s.Domain))
+	if !ok {
+		return s.forward(query)
+	}
+	slog.Debug("[DNS] Query", "name", name, "type", q.Type)
+
+	respHeader := dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	}
+	ips := s.lookup(hostname)
+	if len(ips) == 0 {
+		respHeader.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, respHeader)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			if err := b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			if err := b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.Finish()
+}
+
+func (s *Server) forward(query []byte) ([]byte, error) {
+	var errs []error
+	for _, upstream := range s.Upstream {
+		resp, err := exchange(upstream, query)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return resp, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no upstream server")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func exchange(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Label converts the name to a valid dns label, e.g. `My_Host` => `my-host`
+func Label(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			sb.WriteRune(r)
+			continue
+		}
+		sb.WriteByte('-')
+	}
+	return strings.Trim(sb.String(), "-")
+}
+
+// SystemUpstream returns the nameservers in /etc/resolv.conf, the excluded ips are skipped
+func SystemUpstream(exclude ...string) (servers []string) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if !slices.Contains(exclude, fields[1]) {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strings"
 	"sync"
 
@@ -26,9 +27,14 @@ var (
 	_ nic.NIC = (*GvisorCard)(nil)
 )
 
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
 type GvisorCard struct {
-	Stack  *stack.Stack
-	Config nic.Config
+	Stack    *stack.Stack
+	Config   nic.Config
+	Resolver Resolver // resolves the host names when dialing, default net.DefaultResolver
 
 	initOnce  sync.Once
 	closeOnce sync.Once
@@ -81,6 +87,29 @@ func (g *GvisorCard) init() {
 	})
 }
 
+// AddRoute routes the dst to this card in the gvisor stack
+func (g *GvisorCard) AddRoute(dst *net.IPNet) {
+	g.init()
+	g.Stack.AddRoute(tcpip.Route{Destination: toSubnet(dst), NIC: g.nicID})
+}
+
+func (g *GvisorCard) DelRoute(dst *net.IPNet) {
+	g.init()
+	subnet := toSubnet(dst)
+	g.Stack.RemoveRoutes(func(r tcpip.Route) bool {
+		return r.NIC == g.nicID && r.Destination == subnet
+	})
+}
+
+func toSubnet(ipnet *net.IPNet) tcpip.Subnet {
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom4([4]byte(ip4)), tcpip.MaskFromBytes(ipnet.Mask[len(ipnet.Mask)-4:]))
+		return subnet
+	}
+	subnet, _ := tcpip.NewSubnet(tcpip.AddrFrom16([16]byte(ipnet.IP.To16())), tcpip.MaskFromBytes(ipnet.Mask))
+	return subnet
+}
+
 func (g *GvisorCard) Write(p *nic.Packet) error {
 	g.init()
 	var ipVer tcpip.NetworkProtocolNumber
@@ -130,10 +159,11 @@ func (g *GvisorCard) DialContext(ctx context.Context, network, address string) (
 	}
 
 	if strings.HasPrefix(network, "tcp") {
-		tcpAddr, err := net.ResolveTCPAddr(network, address)
+		addrPort, err := g.resolve(ctx, network, address)
 		if err != nil {
 			return nil, err
 		}
+		tcpAddr := net.TCPAddrFromAddrPort(addrPort)
 		var add tcpip.Address
 		var protocol tcpip.NetworkProtocolNumber
 		if tcpAddr.IP.To4() != nil {
@@ -151,10 +181,11 @@ func (g *GvisorCard) DialContext(ctx context.Context, network, address string) (
 	}
 
 	if strings.HasPrefix(network, "udp") {
-		udpAddr, err := net.ResolveUDPAddr(network, address)
+		addrPort, err := g.resolve(ctx, network, address)
 		if err != nil {
 			return nil, err
 		}
+		udpAddr := net.UDPAddrFromAddrPort(addrPort)
 		var add tcpip.Address
 		var protocol tcpip.NetworkProtocolNumber
 		if udpAddr.IP.To4() != nil {
@@ -173,6 +204,56 @@ func (g *GvisorCard) DialContext(ctx context.Context, network, address string) (
 	return nil, nil
 }
 
+// resolve resolves the address by the Resolver, ipv4 is preferred
+func (g *GvisorCard) resolve(ctx context.Context, network, address string) (netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	portNum, err := net.LookupPort(network, port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), uint16(portNum)), nil
+	}
+	ipNetwork := "ip"
+	if strings.HasSuffix(network, "4") {
+		ipNetwork = "ip4"
+	} else if strings.HasSuffix(network, "6") {
+		ipNetwork = "ip6"
+	}
+	var resolver Resolver = net.DefaultResolver
+	if g.Resolver != nil {
+		resolver = g.Resolver
+	}
+	addrs, err := resolver.LookupNetIP(ctx, ipNetwork, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("no such host %s", host)
+	}
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			return netip.AddrPortFrom(addr.Unmap(), uint16(portNum)), nil
+		}
+	}
+	return netip.AddrPortFrom(addrs[0], uint16(portNum)), nil
+}
+
+// ListenPacket listens the udp port on the card address, network must be udp4 or udp6
+func (g *GvisorCard) ListenPacket(network string, port uint16) (net.PacketConn, error) {
+	g.init()
+	switch network {
+	case "udp4":
+		return g.listenUDP(tcpip.FullAddress{NIC: g.nicID, Addr: g.addr4, Port: port})
+	case "udp6":
+		return g.listenUDP(tcpip.FullAddress{NIC: g.nicID, Addr: g.addr6, Port: port})
+	}
+	return nil, errors.New("only udp4/udp6 is supported")
+}
+
 func (g *GvisorCard) listenUDP(addr tcpip.FullAddress) (net.PacketConn, error) {
 	var wq waiter.Queue
 	var ep tcpip.Endpoint
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"net"
 	"net/url"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -40,6 +41,7 @@ type VirtualNIC struct {
 
 	routing    *lru.Cache[string, string] // cidr as key, via ip as value
 	peers      *lru.Cache[string, *Peer]  // ip as key
+	conflicts  map[string][]string        // ip as key, ids of the peers claim the ip as value
 	nicInit    sync.Once
 	peersMutex sync.RWMutex
 }
@@ -51,6 +53,7 @@ func (r *VirtualNIC) init() {
 	r.nicInit.Do(func() {
 		r.routing = lru.New[string, string](512)
 		r.peers = lru.New[string, *Peer](1024)
+		r.conflicts = make(map[string][]string)
 	})
 }
 
@@ -62,14 +65,18 @@ func (r *VirtualNIC) GetPeer(ip string) (net.Addr, bool) {
 	if ok {
 		return peerID.Addr, true
 	}
+	// longest prefix match
 	dstIP := net.ParseIP(ip)
-	_, v, _ := r.routing.Find(func(k string, v string) bool {
+	v, longest := "", -1
+	for k, via := range r.routing.Dump() {
 		_, cidr, err := net.ParseCIDR(k)
-		if err != nil {
-			return false
+		if via == "" || err != nil || !cidr.Contains(dstIP) {
+			continue
 		}
-		return cidr.Contains(dstIP)
-	})
+		if ones, _ := cidr.Mask.Size(); ones > longest {
+			v, longest = via, ones
+		}
+	}
 	peerID, ok = r.peers.Get(v)
 	if v == "" || !ok {
 		return nil, false
@@ -77,18 +84,70 @@ func (r *VirtualNIC) GetPeer(ip string) (net.Addr, bool) {
 	return peerID.Addr, true
 }
 
+// GetPeerMeta get the metadata of the peer which owns the ip, routes are not included
+func (r *VirtualNIC) GetPeerMeta(ip string) (url.Values, bool) {
+	r.init()
+	r.peersMutex.RLock()
+	defer r.peersMutex.RUnlock()
+	peer, ok := r.peers.Get(ip)
+	if !ok {
+		return nil, false
+	}
+	return peer.Meta, true
+}
+
 func (r *VirtualNIC) AddPeer(peer Peer) {
 	r.init()
 	r.peersMutex.Lock()
 	defer r.peersMutex.Unlock()
 	if peer.IPv4 != "" {
+		r.detectConflict(peer.IPv4, peer.Addr)
 		r.peers.Put(peer.IPv4, &peer)
 	}
 	if peer.IPv6 != "" {
+		r.detectConflict(peer.IPv6, peer.Addr)
 		r.peers.Put(peer.IPv6, &peer)
 	}
 }
 
+// Conflicts returns the ips claimed by more than one online peer, the last joined peer takes over the ip
+func (r *VirtualNIC) Conflicts() map[string][]string {
+	r.init()
+	r.peersMutex.RLock()
+	defer r.peersMutex.RUnlock()
+	conflicts := make(map[string][]string, len(r.conflicts))
+	for ip, peers := range r.conflicts {
+		conflicts[ip] = slices.Clone(peers)
+	}
+	return conflicts
+}
+
+// detectConflict records the ip conflict if the ip is owned by another online peer, peersMutex must be held
+func (r *VirtualNIC) detectConflict(ip string, addr net.Addr) {
+	p, ok := r.peers.Get(ip)
+	if !ok || p.Addr.String() == addr.String() || slices.Contains(p.Meta["label"], "node.off") {
+		return
+	}
+	slog.Warn("[NIC] IP conflict, the latter peer takes over", "ip", ip, "peer", addr, "previous", p.Addr)
+	for _, id := range []string{p.Addr.String(), addr.String()} {
+		if !slices.Contains(r.conflicts[ip], id) {
+			r.conflicts[ip] = append(r.conflicts[ip], id)
+		}
+	}
+}
+
+// resolveConflicts removes the peer from the ip conflicts, peersMutex must be held
+func (r *VirtualNIC) resolveConflicts(addr net.Addr) {
+	for ip, peers := range r.conflicts {
+		peers = slices.DeleteFunc(peers, func(id string) bool { return id == addr.String() })
+		if len(peers) < 2 {
+			delete(r.conflicts, ip)
+			continue
+		}
+		r.conflicts[ip] = peers
+	}
+}
+
 func (r *VirtualNIC) RemovePeer(addr net.Addr) {
 	r.init()
 	r.peersMutex.Lock()
@@ -97,9 +156,14 @@ func (r *VirtualNIC) RemovePeer(addr net.Addr) {
 		return p.Addr == addr
 	})
 	if ok {
-		r.peers.Del(v.IPv4)
-		r.peers.Del(v.IPv6)
+		// the ips may be taken over by another peer
+		for _, ip := range []string{v.IPv4, v.IPv6} {
+			if p, ok := r.peers.Get(ip); ok && p.Addr.String() == addr.String() {
+				r.peers.Del(ip)
+			}
+		}
 	}
+	r.resolveConflicts(addr)
 }
 
 func (r *VirtualNIC) LabelPeer(addr net.Addr, kv string) {
@@ -113,6 +177,9 @@ func (r *VirtualNIC) LabelPeer(addr net.Addr, kv string) {
 		return
 	}
 	v.Meta.Add("label", kv)
+	if kv == "node.off" {
+		r.resolveConflicts(addr)
+	}
 	if v.IPv4 != "" {
 		r.peers.Put(v.IPv4, v)
 	}
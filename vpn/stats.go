@@ -0,0 +1,53 @@
+package vpn
+
+import "sync/atomic"
+
+// Stats is the counters of the packets dropped by the vpn
+type Stats struct {
+	InboundDrops        uint64 `json:"inbound_drops"`
+	OutboundDrops       uint64 `json:"outbound_drops"`
+	MulticastDrops      uint64 `json:"multicast_drops"`
+	UnreachableDrops    uint64 `json:"unreachable_drops"`
+	InvalidPackets      uint64 `json:"invalid_packets"`
+	InboundQueueFull    uint64 `json:"inbound_queue_full"`
+	OutboundQueueFull   uint64 `json:"outbound_queue_full"`
+	NICWriteErrors      uint64 `json:"nic_write_errors"`
+	PeerWriteErrors     uint64 `json:"peer_write_errors"`
+	InboundPackets      uint64 `json:"inbound_packets"`
+	OutboundPackets     uint64 `json:"outbound_packets"`
+	InboundQueueLength  int    `json:"inbound_queue_length"`
+	OutboundQueueLength int    `json:"outbound_queue_length"`
+}
+
+type stats struct {
+	inboundDrops      atomic.Uint64
+	outboundDrops     atomic.Uint64
+	multicastDrops    atomic.Uint64
+	unreachableDrops  atomic.Uint64
+	invalidPackets    atomic.Uint64
+	inboundQueueFull  atomic.Uint64
+	outboundQueueFull atomic.Uint64
+	nicWriteErrors    atomic.Uint64
+	peerWriteErrors   atomic.Uint64
+	inboundPackets    atomic.Uint64
+	outboundPackets   atomic.Uint64
+}
+
+// Stats get the counters of the packets dropped by the vpn
+func (vpn *VPN) Stats() Stats {
+	return Stats{
+		InboundDrops:        vpn.stats.inboundDrops.Load(),
+		OutboundDrops:       vpn.stats.outboundDrops.Load(),
+		MulticastDrops:      vpn.stats.multicastDrops.Load(),
+		UnreachableDrops:    vpn.stats.unreachableDrops.Load(),
+		InvalidPackets:      vpn.stats.invalidPackets.Load(),
+		InboundQueueFull:    vpn.stats.inboundQueueFull.Load(),
+		OutboundQueueFull:   vpn.stats.outboundQueueFull.Load(),
+		NICWriteErrors:      vpn.stats.nicWriteErrors.Load(),
+		PeerWriteErrors:     vpn.stats.peerWriteErrors.Load(),
+		InboundPackets:      vpn.stats.inboundPackets.Load(),
+		OutboundPackets:     vpn.stats.outboundPackets.Load(),
+		InboundQueueLength:  len(vpn.inbound),
+		OutboundQueueLength: len(vpn.outbound),
+	}
+}
@@ -29,6 +29,7 @@ type VPN struct {
 	cfg      Config
 	outbound chan *nic.Packet
 	inbound  chan *nic.Packet
+	stats    stats
 }
 
 func New(cfg Config) *VPN {
@@ -93,6 +94,9 @@ func (vpn *VPN) nicRead(wg *sync.WaitGroup, nic *nic.VirtualNIC) {
 			}
 			panic(err)
 		}
+		if len(vpn.outbound) == cap(vpn.outbound) {
+			vpn.stats.outboundQueueFull.Add(1)
+		}
 		vpn.outbound <- packet
 	}
 }
@@ -104,19 +108,25 @@ func (vpn *VPN) nicWrite(wg *sync.WaitGroup, vnic *nic.VirtualNIC) {
 		for _, in := range vpn.cfg.InboundHandlers {
 			if pkt = in.In(pkt); pkt == nil {
 				slog.Debug("DropInbound", "handler", in.Name())
+				vpn.stats.inboundDrops.Add(1)
 				return nil
 			}
 		}
 		return pkt
 	}
 	for packet := range vpn.inbound {
-		if packet = handle(packet); packet == nil {
+		handled := handle(packet)
+		if handled == nil {
 			nic.RecyclePacket(packet)
 			continue
 		}
+		packet = handled
 		err := vnic.Write(packet)
 		if err != nil {
 			slog.Debug("WriteTo nic device", "err", err.Error())
+			vpn.stats.nicWriteErrors.Add(1)
+		} else {
+			vpn.stats.inboundPackets.Add(1)
 		}
 		nic.RecyclePacket(packet)
 	}
@@ -134,6 +144,9 @@ func (vpn *VPN) packetConnRead(wg *sync.WaitGroup, packetConn net.PacketConn) {
 			}
 			panic(err)
 		}
+		if len(vpn.inbound) == cap(vpn.inbound) {
+			vpn.stats.inboundQueueFull.Add(1)
+		}
 		vpn.inbound <- nic.GetPacket(buf[:n])
 	}
 }
@@ -145,15 +158,20 @@ func (vpn *VPN) packetConnWrite(wg *sync.WaitGroup, packetConn net.PacketConn) {
 		defer nic.RecyclePacket(packet)
 		if dstIP.IsMulticast() {
 			slog.Log(context.Background(), -10, "DropMulticastIP", "dst", dstIP)
+			vpn.stats.multicastDrops.Add(1)
 			return
 		}
 		if peer, ok := vpn.nic.GetPeer(dstIP.String()); ok {
 			_, err := packetConn.WriteTo(packet.AsBytes(), peer)
 			if err != nil && !errors.Is(err, net.ErrClosed) {
 				slog.Error("WriteTo packet conn", "peer", peer, "err", err)
+				vpn.stats.peerWriteErrors.Add(1)
+				return
 			}
+			vpn.stats.outboundPackets.Add(1)
 			return
 		}
+		vpn.stats.unreachableDrops.Add(1)
 		// reject with icmp-host-unreachable
 		vpn.inbound <- nic.GetPacket(ICMPHostUnreachable(dstIP, srcIP, packet.AsBytes()))
 	}
@@ -161,16 +179,19 @@ func (vpn *VPN) packetConnWrite(wg *sync.WaitGroup, packetConn net.PacketConn) {
 		for _, out := range vpn.cfg.OutboundHandlers {
 			if pkt = out.Out(pkt); pkt == nil {
 				slog.Debug("DropOutbound", "handler", out.Name())
+				vpn.stats.outboundDrops.Add(1)
 				return nil
 			}
 		}
 		return pkt
 	}
 	for packet := range vpn.outbound {
-		if packet = handle(packet); packet == nil {
+		handled := handle(packet)
+		if handled == nil {
 			nic.RecyclePacket(packet)
 			continue
 		}
+		packet = handled
 		pkt := packet.AsBytes()
 		if packet.Ver() == 4 {
 			header, err := ipv4.ParseHeader(pkt)
@@ -197,6 +218,7 @@ func (vpn *VPN) packetConnWrite(wg *sync.WaitGroup, packetConn net.PacketConn) {
 			continue
 		}
 		slog.Warn("Received invalid packet", "packet", hex.EncodeToString(pkt))
+		vpn.stats.invalidPackets.Add(1)
 		nic.RecyclePacket(packet)
 	}
 }